@@ -0,0 +1,227 @@
+// Package artifact stores VNFS and bootstrap files as content addressed blobs under a managed
+// root. A blob is named by its checksum, so identical images are stored once, and blobs are read
+// only and never overwritten; they are removed only by GC once nothing references them.
+package artifact
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bensallen/warewulf4/checksum"
+)
+
+// Store holds blobs under root as root/<algo>/<first two hex digits>/<hex>
+type Store struct {
+	root string
+}
+
+// New returns a Store rooted at root, creating the directory if needed
+func New(root string) (*Store, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 0755); err != nil {
+		return nil, err
+	}
+	return &Store{root: root}, nil
+}
+
+// Root returns the directory the Store is rooted at
+func (s *Store) Root() string {
+	return s.root
+}
+
+// Path returns the path of the blob with the given checksum, whether or not it exists
+func (s *Store) Path(sum string) (string, error) {
+	algo, digest, err := checksum.Parse(sum)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, algo, digest[:2], digest), nil
+}
+
+// Has reports whether the blob with the given checksum exists
+func (s *Store) Has(sum string) bool {
+	path, err := s.Path(sum)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Open opens the blob with the given checksum for reading
+func (s *Store) Open(sum string) (*os.File, error) {
+	path, err := s.Path(sum)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// TempFile creates a file in the Store's temporary directory, on the same filesystem as the blobs,
+// for writing data to be added with Adopt
+func (s *Store) TempFile() (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(s.root, "tmp"), "blob-")
+}
+
+// Put copies r into the Store, returning the checksum and path of the blob
+func (s *Store) Put(r io.Reader) (string, string, error) {
+	tmp, err := s.TempFile()
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash, err := checksum.New(checksum.Default)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		return "", "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", err
+	}
+
+	sum := checksum.Format(checksum.Default, hash.Sum(nil))
+	path, err := s.Adopt(tmp.Name(), sum)
+	return sum, path, err
+}
+
+// Adopt moves the file at tmp, whose content has the given checksum, into the Store and returns
+// the path of the blob. If the blob already exists tmp is removed instead and the modification
+// time of the existing blob is refreshed, so GC treats it as newly added.
+func (s *Store) Adopt(tmp, sum string) (string, error) {
+	path, err := s.Path(sum)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			return "", err
+		}
+		return path, os.Remove(tmp)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// GC removes the blobs whose checksums are not in live, returning their paths. Blobs modified
+// within minAge are kept, as they may have been added for an aggregate whose command has not been
+// recorded yet.
+func (s *Store) GC(live []string, minAge time.Duration) ([]string, error) {
+	keep := map[string]bool{}
+	for _, sum := range live {
+		path, err := s.Path(sum)
+		if err != nil {
+			continue
+		}
+		keep[path] = true
+	}
+
+	cutoff := time.Now().Add(-minAge)
+	var removed []string
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(s.root, "tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if keep[path] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if _, err := s.checksumOf(path); err != nil {
+			// Not a blob, leave it alone
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed = append(removed, path)
+		return nil
+	})
+	return removed, err
+}
+
+// checksumOf returns the checksum a blob path names
+func (s *Store) checksumOf(path string) (string, error) {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], parts[1]) {
+		return "", fmt.Errorf("%v is not a blob path", path)
+	}
+	sum := parts[0] + ":" + parts[2]
+	return sum, checksum.Validate(sum)
+}
+
+// Check returns an error unless path is the path of the existing blob with the given checksum
+func (s *Store) Check(path, sum string) error {
+	if sum == "" {
+		return fmt.Errorf("path, %v, must have a checksum to be stored as an artifact", path)
+	}
+	want, err := s.Path(sum)
+	if err != nil {
+		return err
+	}
+	if filepath.Clean(path) != want {
+		return fmt.Errorf("path, %v, is not the artifact path of checksum %v, %v", path, sum, want)
+	}
+	if _, err := os.Stat(want); err != nil {
+		return fmt.Errorf("artifact %v is not in the store: %v", sum, err)
+	}
+	return nil
+}
+
+type storeKey struct{}
+
+// WithStore returns a copy of ctx carrying s. When a Store is found in the context, the VNFS and
+// Bootstrap command handlers require Path to be the blob of Checksum, and VNFS images are built
+// into the Store.
+func WithStore(ctx context.Context, s *Store) context.Context {
+	return context.WithValue(ctx, storeKey{}, s)
+}
+
+// StoreFrom returns the Store carried by ctx, if any
+func StoreFrom(ctx context.Context) (*Store, bool) {
+	s, ok := ctx.Value(storeKey{}).(*Store)
+	return s, ok && s != nil
+}
+
+// CheckPath checks path and sum against the Store carried by ctx; with no Store it does nothing
+func CheckPath(ctx context.Context, path, sum string) error {
+	s, ok := StoreFrom(ctx)
+	if !ok {
+		return nil
+	}
+	return s.Check(path, sum)
+}
@@ -0,0 +1,77 @@
+package artifact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s, err := New(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	sum, path, err := s.Put(strings.NewReader("centos7"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if want, _ := s.Path(sum); path != want || !s.Has(sum) {
+		t.Fatalf("Blob not stored at its content address: %v", path)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0444 {
+		t.Fatalf("Blob should be read only: %v %v", info.Mode(), err)
+	}
+
+	t.Run("Dedup", func(t *testing.T) {
+		sum2, path2, err := s.Put(strings.NewReader("centos7"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if sum2 != sum || path2 != path {
+			t.Fatalf("Identical data stored twice: %v %v", path, path2)
+		}
+		tmp, _ := ioutil.ReadDir(filepath.Join(s.Root(), "tmp"))
+		if len(tmp) != 0 {
+			t.Fatalf("Temporary files left behind: %d", len(tmp))
+		}
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		ctx := WithStore(context.Background(), s)
+		if err := CheckPath(ctx, path, sum); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := CheckPath(ctx, "/srv/centos7.img", sum); err == nil {
+			t.Fatal("Path outside the store should have been rejected")
+		}
+		if err := CheckPath(ctx, path, ""); err == nil {
+			t.Fatal("Path without a checksum should have been rejected")
+		}
+		if err := CheckPath(context.Background(), "/srv/centos7.img", ""); err != nil {
+			t.Fatalf("No store in context should not check paths: %v", err)
+		}
+	})
+
+	t.Run("GC", func(t *testing.T) {
+		sles, _, err := s.Put(strings.NewReader("sles12"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if removed, err := s.GC([]string{sum}, time.Hour); err != nil || len(removed) != 0 {
+			t.Fatalf("Recent blob collected: %v %v", removed, err)
+		}
+
+		removed, err := s.GC([]string{sum}, 0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(removed) != 1 || s.Has(sles) || !s.Has(sum) {
+			t.Fatalf("Mismatch: %v", removed)
+		}
+	})
+}
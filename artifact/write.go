@@ -0,0 +1,84 @@
+package artifact
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/compress"
+)
+
+// Write writes the data written by fn, compressed with compressAlgo, through a temporary file to
+// path, or into the Store carried by ctx in which case path is ignored. It returns the path, size
+// and checksum of the written file.
+func Write(ctx context.Context, path, compressAlgo string, fn func(w io.Writer) error) (string, int64, string, error) {
+	algo, err := compress.Lookup(compressAlgo)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	store, stored := StoreFrom(ctx)
+	var tmp *os.File
+	if stored {
+		tmp, err = store.TempFile()
+	} else {
+		tmp, err = ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	}
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash, err := checksum.New(checksum.Default)
+	if err != nil {
+		return "", 0, "", err
+	}
+	counter := &countingWriter{w: io.MultiWriter(tmp, hash)}
+
+	compressor, err := algo.NewWriter(counter)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if err := fn(compressor); err != nil {
+		compressor.Close()
+		return "", 0, "", err
+	}
+	if err := compressor.Close(); err != nil {
+		return "", 0, "", err
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		return "", 0, "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", 0, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, "", err
+	}
+
+	sum := checksum.Format(checksum.Default, hash.Sum(nil))
+	if stored {
+		path, err = store.Adopt(tmp.Name(), sum)
+		return path, counter.n, sum, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, "", err
+	}
+	return path, counter.n, sum, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,338 @@
+// Package batch applies node commands to the many nodes named by a hostlist expression, such as
+// n[0001-0512], with bounded concurrency. Created nodes can be addressed with the free addresses
+// of a subnet in the order they are listed, and a dry run reports the changes a request would
+// make without recording them.
+package batch
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/ipam"
+	node "github.com/bensallen/warewulf4/node"
+)
+
+// DefaultConcurrency is the number of nodes a Runner works on at once when its Concurrency is
+// zero
+const DefaultConcurrency = 16
+
+// Op is the command a Request applies to each node
+type Op string
+
+// Ops of a Request
+const (
+	Create       Op = "create"
+	SetVNFS      Op = "set-vnfs"
+	SetBootstrap Op = "set-bootstrap"
+	Delete       Op = "delete"
+)
+
+// Request describes a command to apply to the nodes named by a hostlist expression
+type Request struct {
+	Hosts     string // Hostlist expression of node IDs, see Expand
+	Op        Op
+	Arch      string   // Of created nodes
+	Bootstrap node.Ref // Of created nodes, or set by SetBootstrap
+	VNFS      node.Ref // Of created nodes, or set by SetVNFS
+	Profiles  []string // Of created nodes
+	Network   *Network // Netdev of created nodes, when not nil
+	DryRun    bool     // Report the changes without recording them
+}
+
+// Network describes the netdev of created nodes. Nodes are addressed in the order Hosts lists
+// them, the first getting the lowest free address of Subnet from Offset, the next one the
+// following free address, and so on, see ipam.IPAM.Free.
+type Network struct {
+	Subnet  string // Subnet in CIDR notation the netdev is addressed in, its key in node.Node.Netdevs
+	Offset  int    // Offset in Subnet of the first address considered, 1 when zero
+	Name    string // Name of the netdev, may be empty
+	Gateway string
+	Domain  string
+}
+
+// netdevs returns the netdevs of a node addressed with ip
+func (n Network) netdevs(ip net.IP) map[string]*node.Netdev {
+	return map[string]*node.Netdev{
+		n.Subnet: {
+			Name:    n.Name,
+			IP:      ip.String(),
+			Gateway: n.Gateway,
+			Domain:  n.Domain,
+		},
+	}
+}
+
+// Change is a setting of a node changed by a command
+type Change struct {
+	Field string // State, Arch, Bootstrap, VNFS, Netdevs, Profiles or KernelArgs
+	From  string
+	To    string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %q -> %q", c.Field, c.From, c.To)
+}
+
+// Result is the outcome of a Request for one node
+type Result struct {
+	Node    string
+	Version int      // Of the node after the command, or that it would have after a dry run
+	Changes []Change // Made, or that would be made by a dry run; empty when the node is unchanged
+	Err     error
+}
+
+// Runner applies Requests to the nodes of a repository. Commands are checked by the Node command
+// handler, so ctx should carry the node.Resolver it uses; the netdevs of nodes are checked by
+// IPAM, which also addresses the nodes of a Request with a Network. Runs addressing nodes in the
+// same subnet are serialized from allocation to creation; allocations from the IPAM made outside
+// the Runner, e.g. by a registration.Registrar, must not overlap them.
+type Runner struct {
+	Nodes       *eventsource.Repository
+	IPAM        *ipam.IPAM
+	Concurrency int // Nodes worked on at once, DefaultConcurrency when zero
+
+	mux   sync.Mutex
+	locks map[string]*sync.Mutex // Held by the Run addressing nodes in a subnet, by subnet
+}
+
+// New returns a Runner applying commands to the nodes of repo, addressing and checking their
+// netdevs with m
+func New(repo *eventsource.Repository, m *ipam.IPAM) *Runner {
+	return &Runner{Nodes: repo, IPAM: m}
+}
+
+// Run applies req to each node of req.Hosts and returns the results in the order Hosts lists the
+// nodes. An error is returned without applying anything if req is invalid, e.g. when Hosts does
+// not parse or the Network runs out of free addresses; otherwise the nodes are independent, and
+// one failing leaves the others to their own Result. Dry runs are checked as the commands would
+// be, by the IPAM among others. Nodes not yet started when ctx is done fail with the error of ctx.
+func (r *Runner) Run(ctx context.Context, req Request) ([]Result, error) {
+	hosts, err := Expand(req.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	if r.IPAM != nil {
+		ctx = node.WithNetdevChecker(ctx, r.IPAM)
+	}
+	if req.Op == Create && req.Network != nil {
+		unlock := r.lock(req.Network.Subnet)
+		defer unlock()
+	}
+	addrs, err := r.addresses(ctx, req, len(hosts))
+	if err != nil {
+		return nil, err
+	}
+	commands := make([]eventsource.Command, len(hosts))
+	for i, id := range hosts {
+		if commands[i], err = req.command(id, addrs[i]); err != nil {
+			return nil, fmt.Errorf("node %v: %v", id, err)
+		}
+	}
+
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	results := make([]Result, len(hosts))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, id := range hosts {
+		if ctx.Err() == nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			results[i] = Result{Node: id, Err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = r.apply(ctx, id, commands[i], req.DryRun)
+		}(i, id)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// lock locks the addressing of nodes in subnet and returns the function unlocking it
+func (r *Runner) lock(subnet string) func() {
+	r.mux.Lock()
+	if r.locks == nil {
+		r.locks = map[string]*sync.Mutex{}
+	}
+	l, ok := r.locks[subnet]
+	if !ok {
+		l = &sync.Mutex{}
+		r.locks[subnet] = l
+	}
+	r.mux.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// addresses returns the addresses of the n nodes created by req, or nils when req addresses none
+func (r *Runner) addresses(ctx context.Context, req Request, n int) ([]net.IP, error) {
+	if req.Op != Create || req.Network == nil {
+		return make([]net.IP, n), nil
+	}
+	network := req.Network
+	if prefix, err := netip.ParsePrefix(network.Subnet); err != nil || prefix != prefix.Masked() {
+		return nil, fmt.Errorf("invalid subnet, %v", network.Subnet)
+	}
+	if network.Offset < 0 {
+		return nil, fmt.Errorf("invalid offset, %d, in %v", network.Offset, network.Subnet)
+	}
+	if r.IPAM == nil {
+		return nil, fmt.Errorf("no IPAM to address nodes in %v", network.Subnet)
+	}
+	var exclude []string
+	if network.Gateway != "" {
+		exclude = append(exclude, network.Gateway)
+	}
+	return r.IPAM.Free(ctx, ipam.Request{Subnet: network.Subnet, Offset: network.Offset, Exclude: exclude}, n)
+}
+
+// command returns the command of req for node id, addressed with addr when req has a Network
+func (req Request) command(id string, addr net.IP) (eventsource.Command, error) {
+	model := eventsource.CommandModel{ID: id}
+	switch req.Op {
+	case Create:
+		c := &node.CreateNode{CommandModel: model, Arch: req.Arch, Bootstrap: req.Bootstrap, VNFS: req.VNFS, Profiles: req.Profiles}
+		if req.Network != nil {
+			c.Netdevs = req.Network.netdevs(addr)
+		}
+		return c, nil
+	case SetVNFS:
+		if req.VNFS.ID == "" {
+			return nil, fmt.Errorf("no VNFS to set")
+		}
+		return &node.SetVNFS{CommandModel: model, VNFS: req.VNFS}, nil
+	case SetBootstrap:
+		if req.Bootstrap.ID == "" {
+			return nil, fmt.Errorf("no Bootstrap to set")
+		}
+		return &node.SetBootstrap{CommandModel: model, Bootstrap: req.Bootstrap}, nil
+	case Delete:
+		return &node.DeleteNode{CommandModel: model}, nil
+	default:
+		return nil, fmt.Errorf("unknown op, %q", req.Op)
+	}
+}
+
+// apply runs command against node id. The command handler is run on the current state of the
+// node to find the changes, then, unless dryRun, the command is applied against the repository
+// expecting that same state, so that the changes reported are the ones recorded.
+func (r *Runner) apply(ctx context.Context, id string, command eventsource.Command, dryRun bool) Result {
+	result := Result{Node: id}
+
+	aggregate, err := r.Nodes.Load(ctx, id)
+	if eventsource.IsNotFound(err) {
+		aggregate, err = r.Nodes.New(), nil
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	n, ok := aggregate.(*node.Node)
+	if !ok {
+		result.Err = fmt.Errorf("ID returned an aggregate that is not a Node")
+		return result
+	}
+	before := *n
+
+	events, err := n.Apply(ctx, command)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	after := before
+	for _, event := range events {
+		if err := after.On(event); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	result.Version, result.Changes = after.Version, changes(before, after)
+	if dryRun || len(events) == 0 {
+		return result
+	}
+
+	setExpectedVersion(command, before.Version)
+	if result.Version, err = r.Nodes.Apply(ctx, command); err != nil {
+		result.Version, result.Changes, result.Err = before.Version, nil, err
+	}
+	return result
+}
+
+// setExpectedVersion sets the version the node must be at for command to be applied. Creation
+// has no expected version, as it fails when the node already exists.
+func setExpectedVersion(command eventsource.Command, version int) {
+	switch c := command.(type) {
+	case *node.SetVNFS:
+		c.ExpectedVersion = version
+	case *node.SetBootstrap:
+		c.ExpectedVersion = version
+	case *node.DeleteNode:
+		c.ExpectedVersion = version
+	}
+}
+
+// changes returns the settings that differ between before and after
+func changes(before, after node.Node) []Change {
+	var changes []Change
+	for _, f := range []struct {
+		field    string
+		from, to interface{}
+	}{
+		{"State", before.State, after.State},
+		{"Arch", before.Arch, after.Arch},
+		{"Bootstrap", before.Bootstrap, after.Bootstrap},
+		{"VNFS", before.VNFS, after.VNFS},
+		{"Netdevs", before.Netdevs, after.Netdevs},
+		{"Profiles", before.Profiles, after.Profiles},
+		{"KernelArgs", before.KernelArgs, after.KernelArgs},
+	} {
+		if !reflect.DeepEqual(f.from, f.to) {
+			changes = append(changes, Change{Field: f.field, From: format(f.from), To: format(f.to)})
+		}
+	}
+	return changes
+}
+
+// format returns a setting as shown in a Change
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case node.Ref:
+		if v.Version != 0 {
+			return fmt.Sprintf("%v@%d", v.ID, v.Version)
+		}
+		return v.ID
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]*node.Netdev:
+		keys := make([]string, 0, len(v))
+		for key, netdev := range v {
+			if netdev != nil && netdev.IP != "" {
+				key += "=" + netdev.IP
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ",")
+	}
+	return fmt.Sprint(v)
+}
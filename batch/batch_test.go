@@ -0,0 +1,251 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/filestore"
+	"github.com/bensallen/warewulf4/ipam"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+func TestRunner(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+
+	resolver := &node.Resolver{
+		VNFSs: eventsource.New(&vnfs.VNFS{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(vnfs.Events()...)),
+			eventsource.WithStore(store),
+		),
+	}
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	p, err := projection.New(context.Background(), store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctx := node.WithResolver(context.Background(), resolver)
+
+	for _, id := range []string{"centos7", "sles12"} {
+		if err := (&vnfs.VNFS{ID: id}).Create(ctx, resolver.VNFSs); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	r := New(nodeRepo, ipam.New(p))
+	r.Concurrency = 2
+	create := Request{
+		Hosts:   "n[01-04]",
+		Op:      Create,
+		Arch:    "x86_64",
+		VNFS:    node.Ref{ID: "centos7"},
+		Network: &Network{Subnet: "10.0.0.0/24", Offset: 10, Name: "eth0"},
+	}
+
+	t.Run("DryRunCreate", func(t *testing.T) {
+		req := create
+		req.DryRun = true
+		results, err := r.Run(ctx, req)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(results) != 4 {
+			t.Fatalf("Expected 4 results, %d instead", len(results))
+		}
+		for i, result := range results {
+			if result.Err != nil {
+				t.Fatalf("Error: %v", result.Err)
+			}
+			want := []Change{
+				{Field: "State", To: "Created"},
+				{Field: "Arch", To: "x86_64"},
+				{Field: "VNFS", To: "centos7"},
+				{Field: "Netdevs", To: fmt.Sprintf("10.0.0.0/24=10.0.0.%d", 10+i)},
+			}
+			if result.Node != fmt.Sprintf("n%02d", i+1) || fmt.Sprint(result.Changes) != fmt.Sprint(want) {
+				t.Fatalf("Mismatch: %+v", result)
+			}
+		}
+
+		if _, err := nodeRepo.Load(ctx, "n01"); !eventsource.IsNotFound(err) {
+			t.Fatalf("Should not have created nodes in a dry run, %v", err)
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		results, err := r.Run(ctx, create)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for _, result := range results {
+			if result.Err != nil || len(result.Changes) != 4 {
+				t.Fatalf("Mismatch: %+v", result)
+			}
+		}
+
+		n := node.Node{ID: "n03"}
+		if err := n.Read(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if n.Version != results[2].Version || n.VNFS.ID != "centos7" || n.Netdevs["10.0.0.0/24"].IP != "10.0.0.12" {
+			t.Fatalf("Mismatch: %+v", n)
+		}
+
+		results, err = r.Run(ctx, create)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for _, result := range results {
+			if result.Err == nil {
+				t.Fatalf("Should have failed with already exists error, %+v", result)
+			}
+		}
+	})
+
+	t.Run("SkipAssigned", func(t *testing.T) {
+		req := create
+		req.Hosts = "m[1-3]"
+		req.Network = &Network{Subnet: "10.0.0.0/24", Offset: 12, Gateway: "10.0.0.15"}
+		for _, dryRun := range []bool{true, false} {
+			req.DryRun = dryRun
+			results, err := r.Run(ctx, req)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			for i, result := range results {
+				want := fmt.Sprintf("10.0.0.0/24=10.0.0.%d", []int{14, 16, 17}[i])
+				if result.Err != nil || fmt.Sprint(result.Changes[len(result.Changes)-1].To) != want {
+					t.Fatalf("Mismatch: %+v", result)
+				}
+			}
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		results := make([][]Result, 2)
+		errs := make([]error, 2)
+		for i, hosts := range []string{"c[1-4]", "d[1-4]"} {
+			wg.Add(1)
+			go func(i int, hosts string) {
+				defer wg.Done()
+				results[i], errs[i] = r.Run(ctx, Request{Hosts: hosts, Op: Create, Network: &Network{Subnet: "10.2.0.0/24"}})
+			}(i, hosts)
+		}
+		wg.Wait()
+		for i := range results {
+			if errs[i] != nil {
+				t.Fatalf("Error: %v", errs[i])
+			}
+			for _, result := range results[i] {
+				if result.Err != nil {
+					t.Fatalf("Error: %v", result.Err)
+				}
+			}
+		}
+	})
+
+	t.Run("SetVNFS", func(t *testing.T) {
+		n := node.Node{ID: "n01", VNFS: node.Ref{ID: "sles12"}}
+		if err := n.Update(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		req := Request{Hosts: "n[01-02]", Op: SetVNFS, VNFS: node.Ref{ID: "sles12"}, DryRun: true}
+		results, err := r.Run(ctx, req)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if results[0].Err != nil || len(results[0].Changes) != 0 || results[0].Version != n.Version {
+			t.Fatalf("Mismatch: %+v", results[0])
+		}
+		if results[1].Err != nil || fmt.Sprint(results[1].Changes) != fmt.Sprint([]Change{{Field: "VNFS", From: "centos7", To: "sles12"}}) {
+			t.Fatalf("Mismatch: %+v", results[1])
+		}
+		if n, _ := p.Node("n02"); n.VNFS.ID != "centos7" {
+			t.Fatalf("Should not have set the VNFS in a dry run, %v", n.VNFS)
+		}
+
+		req.DryRun = false
+		if _, err := r.Run(ctx, req); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if got := len(p.NodesBy(projection.ByVNFS, "sles12")); got != 2 {
+			t.Fatalf("Expected 2 nodes with VNFS sles12, %d instead", got)
+		}
+
+		req.VNFS = node.Ref{ID: "missing"}
+		results, err = r.Run(ctx, req)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if results[0].Err == nil || results[1].Err == nil {
+			t.Fatal("Should have failed with VNFS does not exist error")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		results, err := r.Run(ctx, Request{Hosts: "n[01-05]", Op: Delete})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for _, result := range results[:4] {
+			if result.Err != nil || fmt.Sprint(result.Changes) != fmt.Sprint([]Change{{Field: "State", From: "Created", To: "Deleted"}}) {
+				t.Fatalf("Mismatch: %+v", result)
+			}
+		}
+		if results[4].Err == nil {
+			t.Fatal("Should have failed with does not exist error")
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, req := range []Request{
+			{Hosts: "n[01-", Op: Delete},
+			{Hosts: "x[1-2]", Op: "reboot"},
+			{Hosts: "x[1-2]", Op: SetVNFS},
+			{Hosts: "x[1-2]", Op: Create, Network: &Network{Subnet: "10.1.0.0/24", Offset: 254}},
+			{Hosts: "x[1-2]", Op: Create, Network: &Network{Subnet: "10.1.0.1/24"}},
+		} {
+			if _, err := r.Run(ctx, req); err == nil {
+				t.Fatalf("Should have failed, %+v", req)
+			}
+		}
+		if _, err := New(nodeRepo, nil).Run(ctx, Request{Hosts: "x[1-2]", Op: Create, Network: &Network{Subnet: "10.1.0.0/24"}}); err == nil {
+			t.Fatal("Should have failed without an IPAM to address nodes")
+		}
+		if _, err := nodeRepo.Load(ctx, "x1"); !eventsource.IsNotFound(err) {
+			t.Fatalf("Should not have created nodes of an invalid request, %v", err)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		results, err := r.Run(cancelled, Request{Hosts: "x[1-3]", Op: Create})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for _, result := range results {
+			if result.Err != context.Canceled {
+				t.Fatalf("Mismatch: %+v", result)
+			}
+		}
+	})
+}
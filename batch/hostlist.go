@@ -0,0 +1,123 @@
+package batch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxHosts bounds the number of names a hostlist expression expands to
+const MaxHosts = 1 << 16
+
+// Expand returns the names of the hostlist expression expr, in order. The expression is a comma
+// separated list of names, each of which may hold bracketed lists of numbers and ranges, e.g.
+// n[0001-0512] or rack[1-2]n[01-04,08]. Numbers keep the width of the start of their range, so
+// that n[01-10] expands to n01 through n10, and names with several brackets expand to every
+// combination, the leftmost bracket varying slowest. Names listed more than once are rejected.
+func Expand(expr string) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	for _, item := range split(expr) {
+		if item == "" {
+			return nil, fmt.Errorf("hostlist, %q, has an empty name", expr)
+		}
+		expanded, err := expandItem(item, MaxHosts-len(names))
+		if err != nil {
+			return nil, fmt.Errorf("hostlist, %q: %v", expr, err)
+		}
+		for _, name := range expanded {
+			if seen[name] {
+				return nil, fmt.Errorf("hostlist, %q, lists %v more than once", expr, name)
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// split splits expr at the commas outside brackets
+func split(expr string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i, c := range expr {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(expr[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(items, strings.TrimSpace(expr[start:]))
+}
+
+// expandItem expands a name holding brackets into at most max names
+func expandItem(item string, max int) ([]string, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("expands to more than %d names", MaxHosts)
+	}
+	open := strings.IndexByte(item, '[')
+	if open < 0 {
+		if strings.ContainsAny(item, "] \t\n") {
+			return nil, fmt.Errorf("invalid name, %q", item)
+		}
+		return []string{item}, nil
+	}
+	end := strings.IndexByte(item[open:], ']')
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated bracket in %q", item)
+	}
+	end += open
+
+	prefix := item[:open]
+	if strings.ContainsAny(prefix, "] \t\n") {
+		return nil, fmt.Errorf("invalid name, %q", item)
+	}
+	numbers, err := expandRanges(item[open+1:end], max)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := expandItem(item[end+1:], max/len(numbers))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(numbers)*len(rest))
+	for _, number := range numbers {
+		for _, r := range rest {
+			names = append(names, prefix+number+r)
+		}
+	}
+	return names, nil
+}
+
+// expandRanges expands the comma separated numbers and ranges of a bracket into at most max
+// numbers
+func expandRanges(ranges string, max int) ([]string, error) {
+	var numbers []string
+	for _, r := range strings.Split(ranges, ",") {
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+		first, err := strconv.ParseUint(lo, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range, %q", r)
+		}
+		last, err := strconv.ParseUint(hi, 10, 32)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid range, %q", r)
+		}
+		if last-first >= uint64(max-len(numbers)) {
+			return nil, fmt.Errorf("expands to more than %d names", MaxHosts)
+		}
+		for n := first; n <= last; n++ {
+			numbers = append(numbers, fmt.Sprintf("%0*d", len(lo), n))
+		}
+	}
+	return numbers, nil
+}
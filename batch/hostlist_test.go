@@ -0,0 +1,64 @@
+package batch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		expr  string
+		names string
+	}{
+		{"n0001", "n0001"},
+		{"n[1-3]", "n1,n2,n3"},
+		{"n[08-11]", "n08,n09,n10,n11"},
+		{"n[1-2,5],login1", "n1,n2,n5,login1"},
+		{"rack[1-2]n[01-02]", "rack1n01,rack1n02,rack2n01,rack2n02"},
+		{"n[1-2]-ib", "n1-ib,n2-ib"},
+		{" n1 , n2 ", "n1,n2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			names, err := Expand(tt.expr)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if got := strings.Join(names, ","); got != tt.names {
+				t.Fatalf("Mismatch: %v", got)
+			}
+		})
+	}
+
+	t.Run("Large", func(t *testing.T) {
+		names, err := Expand("n[0001-0512]")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(names) != 512 || names[0] != "n0001" || names[511] != "n0512" {
+			t.Fatalf("Mismatch: %d names from %v to %v", len(names), names[0], names[len(names)-1])
+		}
+	})
+
+	for _, expr := range []string{
+		"",
+		"n1,,n2",
+		"n[1-3",
+		"n1-3]",
+		"n[]",
+		"n[3-1]",
+		"n[a-c]",
+		"n[1-2-3]",
+		"n[[1-2]]",
+		"n 1",
+		"n[1-2],n2",
+		"n[0-65536]",
+		"n[0-255]m[0-256]",
+	} {
+		t.Run("Invalid"+expr, func(t *testing.T) {
+			if names, err := Expand(expr); err == nil {
+				t.Fatalf("Should have failed, expanded to %d names", len(names))
+			}
+		})
+	}
+}
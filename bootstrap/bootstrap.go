@@ -1,39 +1,247 @@
 package warewulf
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/artifact"
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/compress"
+	"github.com/bensallen/warewulf4/concurrency"
 )
 
-// Bootstrap represents a kernel and initramfs
+// Bootstrap represents a kernel and initramfs, and optionally an archive of kernel modules
 type Bootstrap struct {
-	ID           string
-	Version      int
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
-	State        string
-	Arch         string
-	Path         string
-	Checksum     string
-	Size         int64
-	CompressAlgo string
-}
-
-//BootstrapCreated represents the event of the bootstrap being created
+	ID            string
+	Version       int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	State         string
+	Arch          string
+	Kernel        File
+	Initramfs     File
+	Modules       File   // Optional archive of the kernel modules, unpacked into the VNFS
+	KernelVersion string // Release of the kernel, as reported by uname -r
+	Cmdline       string // Default kernel command line
+	CompressAlgo  string // Compression of the initramfs and modules archive
+}
+
+// File is an artifact of a Bootstrap
+type File struct {
+	Path     string
+	Checksum string
+	Size     int64
+}
+
+// merge sets the fields of f that are not zero in o
+func (f *File) merge(o File) {
+	if o.Path != "" {
+		f.Path = o.Path
+	}
+	if o.Checksum != "" {
+		f.Checksum = o.Checksum
+	}
+	if o.Size != 0 {
+		f.Size = o.Size
+	}
+}
+
+// Files returns the kernel, initramfs and modules files of the Bootstrap
+func (b *Bootstrap) Files() []File {
+	return []File{b.Kernel, b.Initramfs, b.Modules}
+}
+
+// Create saves a new Bootstrap by building a CreateBootstrap command and applying it against the repository.
+func (b *Bootstrap) Create(ctx context.Context, repo *eventsource.Repository) error {
+	if b.ID == "" {
+		return fmt.Errorf("ID of Bootstrap must be specified")
+	}
+
+	createBootstrap := &CreateBootstrap{
+		CommandModel:  eventsource.CommandModel{ID: b.ID},
+		Arch:          b.Arch,
+		Kernel:        b.Kernel,
+		Initramfs:     b.Initramfs,
+		Modules:       b.Modules,
+		KernelVersion: b.KernelVersion,
+		Cmdline:       b.Cmdline,
+		CompressAlgo:  b.CompressAlgo,
+	}
+
+	version, err := repo.Apply(ctx, createBootstrap)
+	if err != nil {
+		return err
+	}
+	b.Version = version
+	return nil
+}
+
+// Read attempts to fetch the Bootstrap aggregate from the event repository. b.ID must be specified
+// as it is used the aggregate ID.
+func (b *Bootstrap) Read(ctx context.Context, repo *eventsource.Repository) error {
+	if b.ID == "" {
+		return fmt.Errorf("ID of Bootstrap must be specified")
+	}
+
+	aggregate, err := repo.Load(ctx, b.ID)
+	if err != nil {
+		return err
+	}
+
+	bootstrap, ok := aggregate.(*Bootstrap)
+	if !ok {
+		return fmt.Errorf("ID returned an aggregate that is not a Bootstrap")
+	}
+
+	// Copy values of casted aggregate to *b
+	*b = *bootstrap
+
+	return nil
+}
+
+// Update changes the bootstrap files by applying an UpdateBootstrap command against the repository.
+// Fields left at their zero value are not changed. b.Version is sent as the expected version, so an
+// Update of a Bootstrap obtained from Read fails with a concurrency.ErrVersionConflict error if the
+// Bootstrap has been changed since. On success b.Version is set to the new version.
+func (b *Bootstrap) Update(ctx context.Context, repo *eventsource.Repository) error {
+	if b.ID == "" {
+		return fmt.Errorf("ID of Bootstrap must be specified")
+	}
+	updateBootstrap := &UpdateBootstrap{
+		CommandModel:    eventsource.CommandModel{ID: b.ID},
+		ExpectedVersion: b.Version,
+		Arch:            b.Arch,
+		Kernel:          b.Kernel,
+		Initramfs:       b.Initramfs,
+		Modules:         b.Modules,
+		KernelVersion:   b.KernelVersion,
+		Cmdline:         b.Cmdline,
+		CompressAlgo:    b.CompressAlgo,
+	}
+
+	version, err := repo.Apply(ctx, updateBootstrap)
+	if err != nil {
+		return err
+	}
+	b.Version = version
+	return nil
+}
+
+// Delete marks the Bootstrap as deleted by applying a DeleteBootstrap command against the repository,
+// with b.Version as the expected version. On success b.Version is set to the new version.
+func (b *Bootstrap) Delete(ctx context.Context, repo *eventsource.Repository) error {
+	if b.ID == "" {
+		return fmt.Errorf("ID of Bootstrap must be specified")
+	}
+	deleteBootstrap := &DeleteBootstrap{
+		CommandModel:    eventsource.CommandModel{ID: b.ID},
+		ExpectedVersion: b.Version,
+	}
+	version, err := repo.Apply(ctx, deleteBootstrap)
+	if err != nil {
+		return err
+	}
+	b.Version = version
+	return nil
+}
+
+// Events returns an instance of every event type of the Bootstrap aggregate, for binding to a serializer
+func Events() []eventsource.Event {
+	return []eventsource.Event{
+		BootstrapCreated{},
+		BootstrapChanged{},
+		BootstrapDeleted{},
+		BootstrapSnapshotted{},
+	}
+}
+
+// BootstrapCreated represents the event of the bootstrap being created. Events recorded before
+// the kernel, initramfs and modules were tracked separately are upcast when decoded; see legacyFile.
 type BootstrapCreated struct {
 	eventsource.Model
+	Arch          string
+	Kernel        File
+	Initramfs     File
+	Modules       File
+	KernelVersion string
+	Cmdline       string
+	CompressAlgo  string
 }
 
-//BootstrapChanged represents the event of the bootstrap files being changed
+// BootstrapChanged represents the event of the bootstrap files being changed. Events recorded
+// before the kernel, initramfs and modules were tracked separately are upcast when decoded; see
+// legacyFile.
 type BootstrapChanged struct {
 	eventsource.Model
-	Arch         string
-	Path         string
-	Checksum     string
-	Size         int64
-	CompressAlgo string
+	Arch          string
+	Kernel        File
+	Initramfs     File
+	Modules       File
+	KernelVersion string
+	Cmdline       string
+	CompressAlgo  string
+}
+
+// legacyFile holds the single Path, Checksum and Size recorded for a Bootstrap before the kernel,
+// initramfs and modules were tracked separately. That file was the initramfs the bootstrap was
+// built from, so it is upcast to Initramfs.
+type legacyFile struct {
+	Path     string
+	Checksum string
+	Size     int64
+}
+
+func (l legacyFile) upcast(initramfs *File) {
+	if *initramfs == (File{}) {
+		*initramfs = File{Path: l.Path, Checksum: l.Checksum, Size: l.Size}
+	}
+}
+
+// UnmarshalJSON decodes the event, upcasting the legacy single file fields to Initramfs
+func (e *BootstrapCreated) UnmarshalJSON(data []byte) error {
+	type event BootstrapCreated
+	v := struct {
+		*event
+		legacyFile
+	}{event: (*event)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	v.legacyFile.upcast(&e.Initramfs)
+	return nil
+}
+
+// UnmarshalJSON decodes the event, upcasting the legacy single file fields to Initramfs
+func (e *BootstrapChanged) UnmarshalJSON(data []byte) error {
+	type event BootstrapChanged
+	v := struct {
+		*event
+		legacyFile
+	}{event: (*event)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	v.legacyFile.upcast(&e.Initramfs)
+	return nil
+}
+
+// UnmarshalJSON decodes a Bootstrap, upcasting the legacy single file fields of snapshots and
+// checkpoints taken before the kernel, initramfs and modules were tracked separately
+func (b *Bootstrap) UnmarshalJSON(data []byte) error {
+	type bootstrap Bootstrap
+	v := struct {
+		*bootstrap
+		legacyFile
+	}{bootstrap: (*bootstrap)(b)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	v.legacyFile.upcast(&b.Initramfs)
+	return nil
 }
 
 //BootstrapDeleted represents the event of the bootstrap files being deleted
@@ -42,30 +250,69 @@ type BootstrapDeleted struct {
 	State string
 }
 
+// BootstrapSnapshotted carries the full state of a Bootstrap at a version. It is produced by
+// Snapshot for snapshot stores and is not saved to the event log.
+type BootstrapSnapshotted struct {
+	eventsource.Model
+	Bootstrap Bootstrap
+}
+
+// Snapshot captures the current state of the Bootstrap as a BootstrapSnapshotted event
+func (b *Bootstrap) Snapshot() eventsource.Event {
+	return &BootstrapSnapshotted{
+		Model:     eventsource.Model{ID: b.ID, Version: b.Version, At: time.Now()},
+		Bootstrap: *b,
+	}
+}
+
 //On parses an event and applies the event's changes to the Bootstrap object
 func (b *Bootstrap) On(event eventsource.Event) error {
 	switch e := event.(type) {
 	case *BootstrapCreated:
 		b.Version = e.Model.Version
 		b.ID = e.Model.ID
+		b.State = "Created"
+		b.CreatedAt = e.At
+		b.UpdatedAt = e.At
+
+		if e.Arch != "" {
+			b.Arch = e.Arch
+		}
+
+		b.Kernel.merge(e.Kernel)
+		b.Initramfs.merge(e.Initramfs)
+		b.Modules.merge(e.Modules)
+
+		if e.KernelVersion != "" {
+			b.KernelVersion = e.KernelVersion
+		}
+
+		if e.Cmdline != "" {
+			b.Cmdline = e.Cmdline
+		}
+
+		if e.CompressAlgo != "" {
+			b.CompressAlgo = e.CompressAlgo
+		}
 
 	case *BootstrapChanged:
 		b.Version = e.Model.Version
+		b.UpdatedAt = e.At
 
 		if e.Arch != "" {
 			b.Arch = e.Arch
 		}
 
-		if e.Path != "" {
-			b.Path = e.Path
-		}
+		b.Kernel.merge(e.Kernel)
+		b.Initramfs.merge(e.Initramfs)
+		b.Modules.merge(e.Modules)
 
-		if e.Checksum != "" {
-			b.Checksum = e.Checksum
+		if e.KernelVersion != "" {
+			b.KernelVersion = e.KernelVersion
 		}
 
-		if e.Size != 0 {
-			b.Size = e.Size
+		if e.Cmdline != "" {
+			b.Cmdline = e.Cmdline
 		}
 
 		if e.CompressAlgo != "" {
@@ -76,9 +323,148 @@ func (b *Bootstrap) On(event eventsource.Event) error {
 		b.UpdatedAt = e.At
 		b.State = "Deleted"
 
+	case *BootstrapSnapshotted:
+		*b = e.Bootstrap
+		b.Version = e.Model.Version
+
+	default:
+		return fmt.Errorf("unhandled event, %v, type: %s", e, reflect.TypeOf(e))
+	}
+
+	return nil
+}
+
+// CreateBootstrap represents the command to create a Bootstrap
+type CreateBootstrap struct {
+	eventsource.CommandModel
+	Arch          string
+	Kernel        File
+	Initramfs     File
+	Modules       File
+	KernelVersion string
+	Cmdline       string
+	CompressAlgo  string
+}
+
+// UpdateBootstrap represents the command to change the bootstrap files
+type UpdateBootstrap struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the Bootstrap is at this version
+	Arch            string
+	Kernel          File
+	Initramfs       File
+	Modules         File
+	KernelVersion   string
+	Cmdline         string
+	CompressAlgo    string
+}
+
+// DeleteBootstrap represents the command to delete bootstrap files
+type DeleteBootstrap struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the Bootstrap is at this version
+}
+
+// Apply implements the CommandHandler interface for Bootstrap
+func (b *Bootstrap) Apply(ctx context.Context, command eventsource.Command) ([]eventsource.Event, error) {
+	switch c := command.(type) {
+	case *CreateBootstrap:
+		if b.State != "" {
+			return nil, fmt.Errorf("Bootstrap, %v, already exists, use an UpdateBootstrap type instead", command.AggregateID())
+		}
+		if err := compress.Validate(c.CompressAlgo); err != nil {
+			return nil, err
+		}
+		if err := checkFiles(ctx, &Bootstrap{}, c.Kernel, c.Initramfs, c.Modules); err != nil {
+			return nil, err
+		}
+		bootstrapCreated := &BootstrapCreated{
+			Model:         eventsource.Model{ID: command.AggregateID(), Version: b.Version + 1, At: time.Now()},
+			Arch:          c.Arch,
+			Kernel:        c.Kernel,
+			Initramfs:     c.Initramfs,
+			Modules:       c.Modules,
+			KernelVersion: c.KernelVersion,
+			Cmdline:       c.Cmdline,
+			CompressAlgo:  c.CompressAlgo,
+		}
+		return []eventsource.Event{bootstrapCreated}, nil
+
+	case *UpdateBootstrap:
+		if b.State == "" {
+			return nil, fmt.Errorf("Bootstrap, %v, does not exist, use a CreateBootstrap type instead", command.AggregateID())
+		}
+		if b.State == "Deleted" {
+			return nil, fmt.Errorf("Bootstrap, %v, is deleted", command.AggregateID())
+		}
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, b.Version); err != nil {
+			return nil, err
+		}
+		if err := compress.Validate(c.CompressAlgo); err != nil {
+			return nil, err
+		}
+		if err := checkFiles(ctx, b, c.Kernel, c.Initramfs, c.Modules); err != nil {
+			return nil, err
+		}
+		bootstrapChanged := &BootstrapChanged{
+			Model:         eventsource.Model{ID: command.AggregateID(), Version: b.Version + 1, At: time.Now()},
+			Arch:          c.Arch,
+			Kernel:        c.Kernel,
+			Initramfs:     c.Initramfs,
+			Modules:       c.Modules,
+			KernelVersion: c.KernelVersion,
+			Cmdline:       c.Cmdline,
+			CompressAlgo:  c.CompressAlgo,
+		}
+		return []eventsource.Event{bootstrapChanged}, nil
+
+	case *DeleteBootstrap:
+		if b.State == "" {
+			return nil, fmt.Errorf("Bootstrap, %v, does not exist", command.AggregateID())
+		}
+		if b.State == "Deleted" {
+			return nil, fmt.Errorf("Bootstrap, %v, is already deleted", command.AggregateID())
+		}
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, b.Version); err != nil {
+			return nil, err
+		}
+		bootstrapDeleted := &BootstrapDeleted{
+			Model: eventsource.Model{ID: command.AggregateID(), Version: b.Version + 1, At: time.Now()},
+		}
+		return []eventsource.Event{bootstrapDeleted}, nil
+
 	default:
-		return fmt.Errorf("unhandled event, %v", e)
+		return nil, fmt.Errorf("unhandled command, %v", c)
 	}
+}
 
+// checkFiles validates the update of the kernel, initramfs and modules of b, see checkFile
+func checkFiles(ctx context.Context, b *Bootstrap, kernel, initramfs, modules File) error {
+	if err := checkFile(ctx, "kernel", b.Kernel, kernel); err != nil {
+		return err
+	}
+	if err := checkFile(ctx, "initramfs", b.Initramfs, initramfs); err != nil {
+		return err
+	}
+	return checkFile(ctx, "modules", b.Modules, modules)
+}
+
+// checkFile validates the update of a file of a Bootstrap from current. The checksum must be valid
+// and, when an artifact.Store is carried by ctx, the resulting path must be the blob of the
+// resulting checksum.
+func checkFile(ctx context.Context, name string, current, update File) error {
+	if err := checksum.Validate(update.Checksum); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	if update.Path == "" && update.Checksum == "" {
+		return nil
+	}
+	current.merge(update)
+	if current.Path == "" {
+		return nil
+	}
+	if err := artifact.CheckPath(ctx, current.Path, current.Checksum); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
 	return nil
 }
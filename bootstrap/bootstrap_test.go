@@ -0,0 +1,324 @@
+package warewulf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+func TestBootstrapOn(t *testing.T) {
+
+	t.Run("BootstrapCreated", func(t *testing.T) {
+		b1 := Bootstrap{}
+		timeNow := time.Now()
+		b2 := Bootstrap{
+			ID:        "test",
+			Version:   1,
+			CreatedAt: timeNow,
+			UpdatedAt: timeNow,
+			State:     "Created",
+		}
+		bootstrapCreated := BootstrapCreated{
+			Model: eventsource.Model{ID: b2.ID, Version: b2.Version, At: b2.CreatedAt},
+		}
+		err := b1.On(&bootstrapCreated)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if b1.State != "Created" {
+			t.Fatalf("State not Created, %s instead", b1.State)
+		}
+		if !reflect.DeepEqual(b1, b2) {
+			t.Fatalf("Mismatch: %v", b1)
+		}
+
+	})
+
+	t.Run("BootstrapChanged", func(t *testing.T) {
+		b1 := Bootstrap{
+			ID:        "test",
+			Version:   1,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+			State:     "Created",
+		}
+		b2 := Bootstrap{
+			ID:        "test",
+			Version:   2,
+			CreatedAt: b1.CreatedAt,
+			UpdatedAt: time.Now(),
+			State:     "Created",
+			Arch:      "x86_64",
+			Initramfs: File{
+				Checksum: "0f82992b7693500212e8dd9d7542a5e960c8f787a25f7ce2497a51202c16e558cf4b61a48eade93135bf96c79aafb12dc6dbabdb10907f84571c886157714a74",
+				Size:     123456,
+				Path:     "/test/path/to/nothing",
+			},
+			KernelVersion: "3.10.0-693.el7.x86_64",
+			Cmdline:       "console=ttyS0",
+		}
+
+		bootstrapChanged := BootstrapChanged{
+			Model:         eventsource.Model{ID: b2.ID, Version: b2.Version, At: b2.UpdatedAt},
+			Arch:          b2.Arch,
+			Initramfs:     b2.Initramfs,
+			KernelVersion: b2.KernelVersion,
+			Cmdline:       b2.Cmdline,
+		}
+		err := b1.On(&bootstrapChanged)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if !reflect.DeepEqual(b1, b2) {
+			t.Fatalf("Mismatch: %v", b1)
+		}
+
+	})
+
+	t.Run("BootstrapDeleted", func(t *testing.T) {
+		b1 := Bootstrap{
+			ID: "test",
+		}
+		b2 := Bootstrap{
+			ID:        "test",
+			Version:   10,
+			UpdatedAt: time.Now(),
+			State:     "Deleted",
+		}
+		bootstrapDeleted := BootstrapDeleted{
+			Model: eventsource.Model{ID: b2.ID, Version: b2.Version, At: b2.UpdatedAt},
+			State: "Created",
+		}
+		err := b1.On(&bootstrapDeleted)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if !reflect.DeepEqual(b1, b2) {
+			t.Fatalf("Mismatch: %v", b1)
+		}
+
+	})
+
+}
+
+func TestBootstrapApply(t *testing.T) {
+	bootstrapID := "test"
+
+	serializer := eventsource.NewJSONSerializer(
+		BootstrapCreated{},
+		BootstrapChanged{},
+		BootstrapDeleted{},
+	)
+	repo := eventsource.New(&Bootstrap{},
+		eventsource.WithSerializer(serializer),
+	)
+	ctx := context.Background()
+
+	t.Run("UpdateBootstrapBeforeCreate", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &UpdateBootstrap{
+			CommandModel: eventsource.CommandModel{ID: bootstrapID},
+			Arch:         "x86_64",
+		})
+		if err == nil {
+			t.Fatal("Should have failed with does not exist error")
+		}
+	})
+
+	t.Run("CreateBootstrapCompressAlgo", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &CreateBootstrap{
+			CommandModel: eventsource.CommandModel{ID: bootstrapID},
+			CompressAlgo: "rar",
+		})
+		if err == nil {
+			t.Fatal("Should have failed with unsupported compression algorithm")
+		}
+	})
+
+	t.Run("CreateBootstrap", func(t *testing.T) {
+		b2 := Bootstrap{
+			ID:   bootstrapID,
+			Arch: "x86_64",
+			Kernel: File{
+				Checksum: "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+				Size:     4096,
+				Path:     "/test/path/to/vmlinuz",
+			},
+			Initramfs: File{
+				Checksum: "0f82992b7693500212e8dd9d7542a5e960c8f787a25f7ce2497a51202c16e558cf4b61a48eade93135bf96c79aafb12dc6dbabdb10907f84571c886157714a74",
+				Size:     123456,
+				Path:     "/test/path/to/nothing",
+			},
+			KernelVersion: "3.10.0-693.el7.x86_64",
+		}
+		err := b2.Create(ctx, repo)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		bootstrap := Bootstrap{ID: bootstrapID}
+		err = bootstrap.Read(ctx, repo)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if bootstrap.Version != 1 {
+			t.Fatalf("Version not 1, %d instead", bootstrap.Version)
+		}
+		if bootstrap.State != "Created" {
+			t.Fatalf("State not set to created, set to %s instead", bootstrap.State)
+		}
+		if bootstrap.Arch != b2.Arch {
+			t.Fatalf("Arch mismatch, set to %s instead", bootstrap.Arch)
+		}
+		if bootstrap.Kernel != b2.Kernel {
+			t.Fatalf("Kernel mismatch, set to %v instead", bootstrap.Kernel)
+		}
+		if bootstrap.Initramfs != b2.Initramfs {
+			t.Fatalf("Initramfs mismatch, set to %v instead", bootstrap.Initramfs)
+		}
+		if bootstrap.KernelVersion != b2.KernelVersion {
+			t.Fatalf("KernelVersion mismatch, set to %s instead", bootstrap.KernelVersion)
+		}
+
+		err = b2.Create(ctx, repo)
+		if err == nil {
+			t.Fatal("Shoud have failed with already exists error instead")
+		}
+	})
+
+	t.Run("UpdateBootstrap", func(t *testing.T) {
+		b2 := Bootstrap{
+			ID:   bootstrapID,
+			Arch: "aarch64",
+			Initramfs: File{
+				Checksum: "202c16e558cf4b61a48eade93135bf96c79aafb12dc6dbabdb10907f84571c886157714a740f82992b7693500212e8dd9d7542a5e960c8f787a25f7ce2497a51",
+				Size:     654321,
+				Path:     "/test/path/to/everything",
+			},
+			Cmdline: "console=ttyAMA0",
+		}
+		vers, err := repo.Apply(ctx, &UpdateBootstrap{
+			CommandModel: eventsource.CommandModel{ID: bootstrapID},
+			Arch:         b2.Arch,
+			Initramfs:    b2.Initramfs,
+			Cmdline:      b2.Cmdline,
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if vers != 2 {
+			t.Fatalf("Version not 2, %d instead", vers)
+		}
+
+		bootstrap := Bootstrap{ID: bootstrapID}
+		err = bootstrap.Read(ctx, repo)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if bootstrap.State != "Created" {
+			t.Fatalf("State not set to created, set to %s instead", bootstrap.State)
+		}
+		if bootstrap.Arch != b2.Arch {
+			t.Fatalf("Arch mismatch, set to %s instead", bootstrap.Arch)
+		}
+		if bootstrap.Initramfs != b2.Initramfs {
+			t.Fatalf("Initramfs mismatch, set to %v instead", bootstrap.Initramfs)
+		}
+		if bootstrap.Kernel.Path != "/test/path/to/vmlinuz" {
+			t.Fatalf("Kernel changed by update, set to %v instead", bootstrap.Kernel)
+		}
+		if bootstrap.Cmdline != b2.Cmdline {
+			t.Fatalf("Cmdline mismatch, set to %s instead", bootstrap.Cmdline)
+		}
+	})
+
+	t.Run("UpdateBootstrapChecksum", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &UpdateBootstrap{
+			CommandModel: eventsource.CommandModel{ID: bootstrapID},
+			Modules:      File{Checksum: "sha256:abc"},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with invalid checksum")
+		}
+	})
+
+	t.Run("DeleteBootstrap", func(t *testing.T) {
+		bootstrap := Bootstrap{ID: bootstrapID, Version: 1}
+		err := bootstrap.Delete(ctx, repo)
+		if !concurrency.IsVersionConflict(err) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+
+		bootstrap = Bootstrap{ID: bootstrapID}
+		err = bootstrap.Delete(ctx, repo)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		err = bootstrap.Read(ctx, repo)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if bootstrap.Version != 3 {
+			t.Fatalf("Version, %d, not incremented on apply", bootstrap.Version)
+		}
+		if bootstrap.State != "Deleted" {
+			t.Fatalf("State not updated to deleted, set to %s instead", bootstrap.State)
+		}
+
+		_, err = repo.Apply(ctx, &UpdateBootstrap{
+			CommandModel: eventsource.CommandModel{ID: bootstrapID},
+			Arch:         "x86_64",
+		})
+		if err == nil {
+			t.Fatal("Should have failed with deleted error")
+		}
+		_, err = repo.Apply(ctx, &DeleteBootstrap{
+			CommandModel: eventsource.CommandModel{ID: bootstrapID},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with already deleted error")
+		}
+	})
+}
+
+func TestBootstrapUpcast(t *testing.T) {
+	serializer := eventsource.NewJSONSerializer(Events()...)
+
+	// A BootstrapChanged event as recorded with a single Path, Checksum and Size
+	legacy := eventsource.Record{
+		Version: 2,
+		Data:    []byte(`{"t":"BootstrapChanged","d":{"ID":"test","Version":2,"Arch":"x86_64","Path":"/srv/initramfs","Checksum":"sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad","Size":42}}`),
+	}
+	event, err := serializer.UnmarshalEvent(legacy)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	b := Bootstrap{ID: "test", Version: 1, State: "Created"}
+	if err := b.On(event); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	want := File{Path: "/srv/initramfs", Checksum: "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", Size: 42}
+	if b.Initramfs != want || b.Kernel != (File{}) || b.Arch != "x86_64" {
+		t.Fatalf("Legacy event not upcast: %+v", b)
+	}
+
+	// Events in the current form are decoded unchanged
+	record, err := serializer.MarshalEvent(&BootstrapChanged{
+		Model:  eventsource.Model{ID: "test", Version: 3},
+		Kernel: File{Path: "/srv/vmlinuz"},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	event, err = serializer.UnmarshalEvent(record)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if e := event.(*BootstrapChanged); e.Kernel.Path != "/srv/vmlinuz" || e.Initramfs != (File{}) {
+		t.Fatalf("Mismatch: %+v", e)
+	}
+}
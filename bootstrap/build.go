@@ -0,0 +1,265 @@
+package warewulf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/artifact"
+	"github.com/bensallen/warewulf4/cpio"
+)
+
+// Paths of the initramfs read by the provisioning init
+const (
+	// InitramfsModules lists the modules of the initramfs, relative to lib/modules/<KernelVersion>,
+	// one per line in the order they are to be loaded
+	InitramfsModules = "etc/warewulf/modules"
+)
+
+// BuildConfig describes the inputs of a Bootstrap build. Only read access to the files is
+// needed; everything in the built archives is owned by root.
+type BuildConfig struct {
+	KernelVersion  string
+	ModuleDir      string   // Directory holding modules.dep, defaults to /lib/modules/<KernelVersion>
+	Kernel         string   // Kernel image, defaults to vmlinuz in ModuleDir, then /boot/vmlinuz-<KernelVersion>
+	Init           string   // Provisioning init program, installed as /init in the initramfs
+	Modules        []string // Modules for the init to load, by name or path relative to ModuleDir
+	ModulesArchive bool     // Also pack the whole of ModuleDir as the Modules archive, to be unpacked into the VNFS
+}
+
+// Build assembles a Bootstrap from the kernel and modules described by config, then records it
+// with a CreateBootstrap command, or an UpdateBootstrap command when the Bootstrap already exists.
+//
+// The kernel image is copied as is. The initramfs is a newc cpio archive holding the init program,
+// the requested modules and their dependencies resolved from modules.dep, and InitramfsModules; it
+// and the optional Modules archive are compressed with b.CompressAlgo. Files are written to the
+// Path of b.Kernel, b.Initramfs and b.Modules, or into the artifact.Store carried by ctx.
+func (b *Bootstrap) Build(ctx context.Context, repo *eventsource.Repository, config BuildConfig) error {
+	if b.ID == "" {
+		return fmt.Errorf("ID of Bootstrap must be specified")
+	}
+	if config.KernelVersion == "" {
+		return fmt.Errorf("KernelVersion must be specified")
+	}
+	if config.Init == "" {
+		return fmt.Errorf("Init must be specified")
+	}
+	if config.ModuleDir == "" {
+		config.ModuleDir = filepath.Join("/lib/modules", config.KernelVersion)
+	}
+	if config.Kernel == "" {
+		config.Kernel = filepath.Join(config.ModuleDir, "vmlinuz")
+		if _, err := os.Stat(config.Kernel); err != nil {
+			config.Kernel = filepath.Join("/boot", "vmlinuz-"+config.KernelVersion)
+		}
+	}
+	if _, ok := artifact.StoreFrom(ctx); !ok {
+		if b.Kernel.Path == "" || b.Initramfs.Path == "" || (config.ModulesArchive && b.Modules.Path == "") {
+			return fmt.Errorf("Path of the Bootstrap files must be specified")
+		}
+	}
+
+	f, err := os.Open(filepath.Join(config.ModuleDir, "modules.dep"))
+	if err != nil {
+		return err
+	}
+	deps, err := readModulesDep(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	modules, err := deps.resolve(config.Modules)
+	if err != nil {
+		return err
+	}
+
+	kernel, err := os.Open(config.Kernel)
+	if err != nil {
+		return err
+	}
+	defer kernel.Close()
+	if b.Kernel, err = writeFile(ctx, b.Kernel.Path, "", func(w io.Writer) error {
+		_, err := io.Copy(w, kernel)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if b.Initramfs, err = writeFile(ctx, b.Initramfs.Path, b.CompressAlgo, func(w io.Writer) error {
+		return writeInitramfs(w, config, deps, modules)
+	}); err != nil {
+		return err
+	}
+
+	if config.ModulesArchive {
+		if b.Modules, err = writeFile(ctx, b.Modules.Path, b.CompressAlgo, func(w io.Writer) error {
+			return writeModules(w, config)
+		}); err != nil {
+			return err
+		}
+	}
+	b.KernelVersion = config.KernelVersion
+
+	existing := Bootstrap{ID: b.ID}
+	err = existing.Read(ctx, repo)
+	switch {
+	case eventsource.IsNotFound(err):
+		return b.Create(ctx, repo)
+	case err != nil:
+		return err
+	}
+
+	return b.Update(ctx, repo)
+}
+
+// writeFile writes a file of the Bootstrap with artifact.Write
+func writeFile(ctx context.Context, path, compressAlgo string, fn func(w io.Writer) error) (File, error) {
+	path, size, sum, err := artifact.Write(ctx, path, compressAlgo, fn)
+	if err != nil {
+		return File{}, err
+	}
+	return File{Path: path, Checksum: sum, Size: size}, nil
+}
+
+// writeInitramfs writes the initramfs archive holding the init program and the modules, which
+// are in load order
+func writeInitramfs(w io.Writer, config BuildConfig, deps moduleDeps, modules []string) error {
+	moduleDir := path.Join("lib/modules", config.KernelVersion)
+
+	dirs := map[string]bool{}
+	for _, d := range []string{"dev", "proc", "sys", "run", "tmp", "newroot", path.Dir(InitramfsModules), moduleDir} {
+		addParents(dirs, d)
+	}
+	for _, m := range modules {
+		addParents(dirs, path.Dir(path.Join(moduleDir, m)))
+	}
+	sorted := make([]string, 0, len(dirs))
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+
+	archiver := cpio.NewArchiver(cpio.NewWriter(w))
+	for _, d := range sorted {
+		perm := uint32(0755)
+		if d == "tmp" {
+			perm = 01777
+		}
+		if err := archiver.AddDir(d, perm); err != nil {
+			return err
+		}
+	}
+
+	// The kernel opens the console before running init, ahead of any devtmpfs being mounted
+	if err := archiver.AddNode("dev/console", cpio.TypeChar, 0600, 5, 1); err != nil {
+		return err
+	}
+	if err := archiver.AddNode("dev/null", cpio.TypeChar, 0666, 1, 3); err != nil {
+		return err
+	}
+
+	init, err := ioutil.ReadFile(config.Init)
+	if err != nil {
+		return err
+	}
+	if err := archiver.AddData("init", 0755, init); err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, m := range modules {
+		data, err := ioutil.ReadFile(filepath.Join(config.ModuleDir, filepath.FromSlash(m)))
+		if err != nil {
+			return err
+		}
+		if err := archiver.AddData(path.Join(moduleDir, m), 0644, data); err != nil {
+			return err
+		}
+		lines = append(lines, deps.line(m))
+	}
+	if err := archiver.AddData(path.Join(moduleDir, "modules.dep"), 0644, []byte(joinLines(lines))); err != nil {
+		return err
+	}
+	if err := archiver.AddData(InitramfsModules, 0644, []byte(joinLines(modules))); err != nil {
+		return err
+	}
+
+	return archiver.Close()
+}
+
+// writeModules writes an archive of the whole module directory, named as it is to be unpacked
+// at the root of a VNFS
+func writeModules(w io.Writer, config BuildConfig) error {
+	moduleDir := path.Join("lib/modules", config.KernelVersion)
+
+	archiver := cpio.NewArchiver(cpio.NewWriter(w))
+	for _, d := range []string{"lib", "lib/modules", moduleDir} {
+		if err := archiver.AddDir(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	err := filepath.Walk(config.ModuleDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(config.ModuleDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		// build and source point into the kernel's build tree on the host
+		if rel == "build" || rel == "source" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := path.Join(moduleDir, filepath.ToSlash(rel))
+
+		switch {
+		case info.IsDir():
+			return archiver.AddDir(name, uint32(info.Mode().Perm()))
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return archiver.AddSymlink(name, target)
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return archiver.AddData(name, uint32(info.Mode().Perm()), data)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return archiver.Close()
+}
+
+// addParents adds dir and all of its parents to dirs
+func addParents(dirs map[string]bool, dir string) {
+	for dir != "." && dir != "/" && dir != "" {
+		dirs[dir] = true
+		dir = path.Dir(dir)
+	}
+}
+
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
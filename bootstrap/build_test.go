@@ -0,0 +1,172 @@
+package warewulf
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/artifact"
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/compress"
+	"github.com/bensallen/warewulf4/cpio"
+)
+
+func TestBootstrapBuild(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	version := "4.18.0-80.el8.x86_64"
+	moduleDir := filepath.Join(dir, "lib", "modules", version)
+
+	files := map[string]string{
+		"vmlinuz": "kernel",
+		"modules.dep": "kernel/drivers/net/ethernet/intel/e1000e/e1000e.ko.xz: kernel/drivers/ptp/ptp.ko.xz kernel/drivers/pps/pps_core.ko.xz\n" +
+			"kernel/drivers/ptp/ptp.ko.xz: kernel/drivers/pps/pps_core.ko.xz\n" +
+			"kernel/drivers/pps/pps_core.ko.xz:\n" +
+			"kernel/fs/xfs/xfs.ko.xz:\n",
+		"kernel/drivers/net/ethernet/intel/e1000e/e1000e.ko.xz": "e1000e",
+		"kernel/drivers/ptp/ptp.ko.xz":                          "ptp",
+		"kernel/drivers/pps/pps_core.ko.xz":                     "pps_core",
+		"kernel/fs/xfs/xfs.ko.xz":                               "xfs",
+	}
+	for name, data := range files {
+		p := filepath.Join(moduleDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := os.Symlink("/usr/src/kernels/"+version, filepath.Join(moduleDir, "build")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	initPath := filepath.Join(dir, "init")
+	if err := ioutil.WriteFile(initPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	store, err := artifact.New(filepath.Join(dir, "artifacts"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctx = artifact.WithStore(ctx, store)
+	repo := eventsource.New(&Bootstrap{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(Events()...)),
+	)
+
+	b := Bootstrap{ID: "el8", Arch: "x86_64", CompressAlgo: "gzip", Cmdline: "console=ttyS0"}
+	err = b.Build(ctx, repo, BuildConfig{
+		KernelVersion:  version,
+		ModuleDir:      moduleDir,
+		Init:           initPath,
+		Modules:        []string{"e1000e"},
+		ModulesArchive: true,
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	loaded := Bootstrap{ID: "el8"}
+	if err := loaded.Read(ctx, repo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if loaded.Version != 1 || loaded.KernelVersion != version || loaded.Cmdline != "console=ttyS0" {
+		t.Fatalf("Mismatch: %+v", loaded)
+	}
+	for _, f := range loaded.Files() {
+		if err := store.Check(f.Path, f.Checksum); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if sum, _ := checksum.Sum(strings.NewReader("kernel"), checksum.Default); loaded.Kernel.Checksum != sum {
+		t.Fatalf("Kernel not copied as is: %v", loaded.Kernel)
+	}
+
+	headers, contents := readArchive(t, loaded.Initramfs.Path, "gzip")
+	if h := headers["init"]; h == nil || h.Mode&0777 != 0755 || contents["init"] != "#!/bin/sh\n" {
+		t.Fatalf("init not packed: %+v", h)
+	}
+	if h := headers["dev/console"]; h == nil || h.Type() != cpio.TypeChar || h.RdevMajor != 5 || h.RdevMinor != 1 {
+		t.Fatalf("Console not packed: %+v", h)
+	}
+	if _, ok := headers["lib/modules/"+version+"/kernel/fs/xfs/xfs.ko.xz"]; ok {
+		t.Fatal("Module not requested should not be packed")
+	}
+	order := "kernel/drivers/pps/pps_core.ko.xz\nkernel/drivers/ptp/ptp.ko.xz\nkernel/drivers/net/ethernet/intel/e1000e/e1000e.ko.xz\n"
+	if contents[InitramfsModules] != order {
+		t.Fatalf("Module load order mismatch: %q", contents[InitramfsModules])
+	}
+	if contents["lib/modules/"+version+"/kernel/drivers/ptp/ptp.ko.xz"] != "ptp" {
+		t.Fatal("Dependency not packed")
+	}
+	for name, h := range headers {
+		if h.UID != 0 || h.GID != 0 {
+			t.Fatalf("%v not owned by root", name)
+		}
+	}
+
+	headers, _ = readArchive(t, loaded.Modules.Path, "gzip")
+	if _, ok := headers["lib/modules/"+version+"/kernel/fs/xfs/xfs.ko.xz"]; !ok {
+		t.Fatal("Modules archive should hold every module")
+	}
+	if _, ok := headers["lib/modules/"+version+"/build"]; ok {
+		t.Fatal("Modules archive should not hold the build link")
+	}
+
+	if err := b.Build(ctx, repo, BuildConfig{KernelVersion: version, ModuleDir: moduleDir, Init: initPath, Modules: []string{"nvme"}}); err == nil {
+		t.Fatal("Should have failed with unknown module")
+	}
+}
+
+func TestModulesDep(t *testing.T) {
+	deps, err := readModulesDep(strings.NewReader("a.ko: b.ko\nb.ko: a.ko\nc-d.ko:\n"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := deps.resolve([]string{"a"}); err == nil {
+		t.Fatal("Should have failed with dependency cycle")
+	}
+	if got, err := deps.resolve([]string{"c_d"}); err != nil || !reflect.DeepEqual(got, []string{"c-d.ko"}) {
+		t.Fatalf("Mismatch: %v %v", got, err)
+	}
+}
+
+func readArchive(t *testing.T, path, compressAlgo string) (map[string]*cpio.Header, map[string]string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer f.Close()
+	algo, err := compress.Lookup(compressAlgo)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	zr, err := algo.NewReader(f)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer zr.Close()
+
+	headers := map[string]*cpio.Header{}
+	contents := map[string]string{}
+	r := cpio.NewReader(zr)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		headers[h.Name] = h
+		contents[h.Name] = string(data)
+	}
+	return headers, contents
+}
@@ -0,0 +1,100 @@
+package warewulf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// moduleDeps maps the path of each module, relative to the module directory, to the paths of
+// the modules it depends on, as listed in modules.dep
+type moduleDeps map[string][]string
+
+// readModulesDep parses a modules.dep file, whose lines have the form
+// "kernel/a.ko.xz: kernel/b.ko.xz kernel/c.ko.xz"
+func readModulesDep(r io.Reader) (moduleDeps, error) {
+	deps := moduleDeps{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("modules.dep line %d: missing colon", n)
+		}
+		deps[line[:i]] = strings.Fields(line[i+1:])
+	}
+	return deps, scanner.Err()
+}
+
+// moduleName returns the name of the module at path, e.g. "e1000e" for
+// "kernel/drivers/net/ethernet/intel/e1000e/e1000e.ko.xz". Dashes are replaced by underscores,
+// as the kernel treats them the same in module names.
+func moduleName(p string) string {
+	name := path.Base(p)
+	if i := strings.Index(name, ".ko"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// resolve returns the paths of the named modules and of all the modules they depend on, ordered
+// so that every module follows its dependencies. Modules may be given by name or by path.
+func (d moduleDeps) resolve(modules []string) ([]string, error) {
+	byName := map[string]string{}
+	for p := range d {
+		byName[moduleName(p)] = p
+	}
+
+	var ordered []string
+	visited := map[string]bool{}
+	var visit func(p string, stack []string) error
+	visit = func(p string, stack []string) error {
+		if visited[p] {
+			return nil
+		}
+		for _, s := range stack {
+			if s == p {
+				return fmt.Errorf("module dependency cycle: %v", strings.Join(append(stack, p), " -> "))
+			}
+		}
+		deps, ok := d[p]
+		if !ok {
+			return fmt.Errorf("module, %v, is not in modules.dep", p)
+		}
+		for _, dep := range deps {
+			if err := visit(dep, append(stack, p)); err != nil {
+				return err
+			}
+		}
+		visited[p] = true
+		ordered = append(ordered, p)
+		return nil
+	}
+
+	for _, m := range modules {
+		p, ok := byName[moduleName(m)]
+		if _, isPath := d[m]; isPath {
+			p, ok = m, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("module, %v, is not in modules.dep", m)
+		}
+		if err := visit(p, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// line returns the modules.dep line of the module at p
+func (d moduleDeps) line(p string) string {
+	if len(d[p]) == 0 {
+		return p + ":"
+	}
+	return p + ": " + strings.Join(d[p], " ")
+}
@@ -0,0 +1,152 @@
+// Package checksum computes and verifies the checksums recorded for VNFS and bootstrap artifacts.
+// Checksums are stored as "algo:hex", e.g. "sha512:0f82...", so the algorithm that produced them
+// is known when they are verified.
+package checksum
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Supported algorithms
+const (
+	SHA256  = "sha256"
+	SHA512  = "sha512"
+	BLAKE2b = "blake2b"
+
+	// Default is the algorithm used for newly written artifacts
+	Default = SHA512
+)
+
+var algorithms = map[string]func() hash.Hash{
+	SHA256:  sha256.New,
+	SHA512:  sha512.New,
+	BLAKE2b: newBlake2b,
+}
+
+// newBlake2b returns an unkeyed BLAKE2b-512 hash, which cannot fail to be created
+func newBlake2b() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// New returns a hash computing checksums with the named algorithm
+func New(algo string) (hash.Hash, error) {
+	fn, ok := algorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm, %v, must be one of %v, %v or %v", algo, SHA256, SHA512, BLAKE2b)
+	}
+	return fn(), nil
+}
+
+// Format returns the checksum of sum computed with algo
+func Format(algo string, sum []byte) string {
+	return algo + ":" + hex.EncodeToString(sum)
+}
+
+// Parse splits a checksum into its algorithm and lowercase hex digest. An untagged 128 character
+// hex digest, as recorded before checksums were tagged, is taken to be SHA-512.
+func Parse(checksum string) (string, string, error) {
+	algo, digest := SHA512, checksum
+	if i := strings.IndexByte(checksum, ':'); i >= 0 {
+		algo, digest = checksum[:i], checksum[i+1:]
+	} else if len(checksum) != sha512.Size*2 {
+		return "", "", fmt.Errorf("checksum, %v, must be of the form algo:hex", checksum)
+	}
+
+	h, err := New(algo)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != h.Size()*2 {
+		return "", "", fmt.Errorf("checksum, %v, is not a valid %v hex digest", checksum, algo)
+	}
+	return algo, strings.ToLower(digest), nil
+}
+
+// Validate returns an error if checksum is neither empty nor a valid checksum
+func Validate(checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	_, _, err := Parse(checksum)
+	return err
+}
+
+// Equal reports whether a and b are valid checksums with the same algorithm and digest
+func Equal(a, b string) bool {
+	algoA, digestA, err := Parse(a)
+	if err != nil {
+		return false
+	}
+	algoB, digestB, err := Parse(b)
+	if err != nil {
+		return false
+	}
+	return algoA == algoB && digestA == digestB
+}
+
+// Sum returns the checksum of the data read from r computed with algo
+func Sum(r io.Reader, algo string) (string, error) {
+	h, err := New(algo)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return Format(algo, h.Sum(nil)), nil
+}
+
+// MismatchError is returned when an artifact does not match its recorded checksum
+type MismatchError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("checksum of %v is %v, expected %v", e.Path, e.Actual, e.Expected)
+}
+
+// IsMismatch reports whether err is a *MismatchError
+func IsMismatch(err error) bool {
+	_, ok := err.(*MismatchError)
+	return ok
+}
+
+// Verify streams the data read from r through the algorithm of expected, returning the actual
+// checksum and a *MismatchError if it differs. name identifies the data in the error.
+func Verify(r io.Reader, name, expected string) (string, error) {
+	algo, _, err := Parse(expected)
+	if err != nil {
+		return "", err
+	}
+	actual, err := Sum(r, algo)
+	if err != nil {
+		return "", err
+	}
+	if !Equal(actual, expected) {
+		return actual, &MismatchError{Path: name, Expected: expected, Actual: actual}
+	}
+	return actual, nil
+}
+
+// VerifyFile verifies the file at path against expected, see Verify
+func VerifyFile(path, expected string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return Verify(f, path, expected)
+}
@@ -0,0 +1,77 @@
+package checksum
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSum(t *testing.T) {
+	// Test vectors from FIPS 180-2 and RFC 7693
+	tests := []struct {
+		algo string
+		data string
+		want string
+	}{
+		{SHA256, "abc", "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{SHA512, "abc", "sha512:ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{BLAKE2b, "abc", "blake2b:ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{BLAKE2b, "", "blake2b:786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+	}
+	for _, test := range tests {
+		got, err := Sum(strings.NewReader(test.data), test.algo)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if got != test.want {
+			t.Fatalf("%v(%q) = %v, expected %v", test.algo, test.data, got, test.want)
+		}
+	}
+
+	// Exercise writes spanning several blocks
+	long := strings.Repeat("a", 1000)
+	whole, _ := Sum(strings.NewReader(long), BLAKE2b)
+	h, _ := New(BLAKE2b)
+	for i := 0; i < len(long); i += 7 {
+		end := i + 7
+		if end > len(long) {
+			end = len(long)
+		}
+		h.Write([]byte(long[i:end]))
+	}
+	if got := Format(BLAKE2b, h.Sum(nil)); got != whole {
+		t.Fatalf("Chunked writes mismatch: %v != %v", got, whole)
+	}
+}
+
+func TestParse(t *testing.T) {
+	legacy := "0f82992b7693500212e8dd9d7542a5e960c8f787a25f7ce2497a51202c16e558cf4b61a48eade93135bf96c79aafb12dc6dbabdb10907f84571c886157714a74"
+	if algo, digest, err := Parse(legacy); err != nil || algo != SHA512 || digest != legacy {
+		t.Fatalf("Untagged SHA-512 not accepted: %v", err)
+	}
+	if !Equal(legacy, "sha512:"+strings.ToUpper(legacy)) {
+		t.Fatal("Untagged and tagged checksums should be equal")
+	}
+	for _, bad := range []string{"abc", "md5:900150983cd24fb0d6963f7d28e17f72", "sha256:abc", "sha256:" + legacy} {
+		if err := Validate(bad); err == nil {
+			t.Fatalf("Validate(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+	if err := ioutil.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := VerifyFile(path, "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("abd"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := VerifyFile(path, "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"); !IsMismatch(err) {
+		t.Fatalf("Should have failed with a mismatch, %v instead", err)
+	}
+}
@@ -0,0 +1,30 @@
+// Command wwinit is the provisioning init installed as /init in initramfs images built by
+// bootstrap.Build. It must be built statically, e.g.
+//
+//	CGO_ENABLED=0 go build -o wwinit ./cmd/wwinit
+//
+// VNFS images are decompressed natively, the initramfs holding no other programs; VNFS commands
+// reject algorithms that would need one, see compress.ValidateNative.
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/bensallen/warewulf4/wwinit"
+)
+
+func main() {
+	log.SetFlags(0)
+	if os.Getpid() != 1 {
+		log.Fatal("wwinit: must run as PID 1 of an initramfs")
+	}
+
+	err := wwinit.Run()
+	log.Printf("wwinit: provisioning failed: %v", err)
+	// The kernel panics if init exits, hiding the error from the console
+	for {
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,87 @@
+// Command wwsnapshot verifies the snapshots of one aggregate type against the full replay of their
+// history, and optionally rebuilds those that do not match, e.g.
+//
+//	wwsnapshot -events /var/lib/warewulf/events -snapshots /var/lib/warewulf/snapshots/node -type node -rebuild
+//
+// The event log must not be in use by another process. The IDs of the aggregates whose snapshots
+// did not match are printed, one per line, and the exit status is 1 if there were any, rebuilt or
+// not, and 2 on other errors.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/altairsix/eventsource"
+	bootstrap "github.com/bensallen/warewulf4/bootstrap"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/snapshot"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+// aggregates returns a new aggregate and the events of each aggregate type with snapshots
+var aggregates = map[string]func() (eventsource.Aggregate, []eventsource.Event){
+	"node":      func() (eventsource.Aggregate, []eventsource.Event) { return &node.Node{}, node.Events() },
+	"vnfs":      func() (eventsource.Aggregate, []eventsource.Event) { return &vnfs.VNFS{}, vnfs.Events() },
+	"bootstrap": func() (eventsource.Aggregate, []eventsource.Event) { return &bootstrap.Bootstrap{}, bootstrap.Events() },
+}
+
+func main() {
+	log.SetFlags(0)
+	events := flag.String("events", "", "path of the event log")
+	snapshots := flag.String("snapshots", "", "directory of the snapshots of the aggregates of -type")
+	kind := flag.String("type", "", "type of the aggregates, one of node, vnfs and bootstrap")
+	rebuild := flag.Bool("rebuild", false, "rebuild the snapshots that do not match")
+	flag.Parse()
+
+	aggregate, ok := aggregates[*kind]
+	if *events == "" || *snapshots == "" || !ok || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	mismatched, err := run(context.Background(), *events, *snapshots, aggregate, *rebuild)
+	for _, id := range mismatched {
+		fmt.Println(id)
+	}
+	if err != nil {
+		log.Printf("wwsnapshot: %v", err)
+		os.Exit(2)
+	}
+	if len(mismatched) != 0 {
+		os.Exit(1)
+	}
+}
+
+// run verifies the snapshots in dir of the aggregates created by aggregate, whose events are
+// recorded in the log at path, and returns the IDs of those that did not match
+func run(ctx context.Context, path, dir string, aggregate func() (eventsource.Aggregate, []eventsource.Event), rebuild bool) ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	records, err := filestore.New(path)
+	if err != nil {
+		return nil, err
+	}
+	defer records.Close()
+
+	storage, err := snapshot.NewDirStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are only taken by Rebuild
+	store := snapshot.New(records, storage, snapshot.WithEvery(0))
+	prototype, events := aggregate()
+	repo := eventsource.New(prototype,
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(events...)),
+		eventsource.WithStore(store),
+	)
+	store.Bind(repo)
+
+	return store.VerifyAll(ctx, records, rebuild)
+}
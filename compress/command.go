@@ -0,0 +1,115 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// command provides an Algorithm by streaming through an external program, for algorithms the
+// standard library has no implementation of. The program must be in the PATH when used. Streams
+// are decompressed by reader instead, when it is set.
+type command struct {
+	name       string
+	compress   []string
+	decompress []string
+	reader     func(r io.Reader) (io.ReadCloser, error)
+}
+
+func (c *command) Name() string { return c.name }
+
+func (c *command) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	cmd := exec.Command(c.compress[0], c.compress[1:]...)
+	cmd.Stdout = w
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to run %v for %v compression: %v", c.compress[0], c.name, err)
+	}
+	return &commandWriter{WriteCloser: stdin, cmd: cmd, stderr: stderr}, nil
+}
+
+func (c *command) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if c.reader != nil {
+		return c.reader(r)
+	}
+	cmd := exec.Command(c.decompress[0], c.decompress[1:]...)
+	cmd.Stdin = r
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to run %v for %v decompression: %v", c.decompress[0], c.name, err)
+	}
+	return &commandReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+type commandWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	closed bool
+}
+
+// Close closes the program's input and waits for it to finish writing
+func (c *commandWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return wait(c.cmd, c.stderr)
+}
+
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	closed bool
+	eof    bool
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF {
+		c.eof = true
+		if werr := c.Close(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close waits for the program to exit; if the output was not read to the end the program is killed
+func (c *commandReader) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if !c.eof {
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+		return nil
+	}
+	return wait(c.cmd, c.stderr)
+}
+
+func wait(cmd *exec.Cmd, stderr *bytes.Buffer) error {
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v failed: %v: %v", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
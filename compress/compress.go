@@ -0,0 +1,200 @@
+// Package compress provides a registry of the compression algorithms VNFS and bootstrap artifacts
+// can be stored with, keyed by the name recorded in their CompressAlgo field.
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Algorithm compresses and decompresses streams
+type Algorithm interface {
+	// Name returns the name the algorithm is registered and recorded as
+	Name() string
+
+	// NewWriter returns a writer compressing to w. Close must be called to flush it; it does
+	// not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader decompressing r. Close releases its resources; it does not
+	// close r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	mux        sync.RWMutex
+	algorithms = map[string]Algorithm{}
+)
+
+// None is the name of the algorithm storing data uncompressed. An empty CompressAlgo is treated
+// the same way.
+const None = "none"
+
+func init() {
+	Register(none{})
+	Register(gzipAlgorithm{})
+	Register(zstdAlgorithm{})
+	// xz streams are decompressed in Go, but compressed by the xz program, which is several times
+	// faster with its threads
+	Register(&command{name: "xz", compress: []string{"xz", "-c", "-T0"}, reader: newXZReader})
+	Register(&command{name: "lz4", compress: []string{"lz4", "-c", "-q", "-l"}, decompress: []string{"lz4", "-dc", "-q"}})
+}
+
+// Register adds an algorithm to the registry, replacing any registered under the same name
+func Register(a Algorithm) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	algorithms[a.Name()] = a
+}
+
+// Lookup returns the algorithm registered under name; "" returns the None algorithm
+func Lookup(name string) (Algorithm, error) {
+	if name == "" {
+		name = None
+	}
+
+	mux.RLock()
+	defer mux.RUnlock()
+
+	a, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression algorithm, %v, must be one of %v", name, namesLocked())
+	}
+	return a, nil
+}
+
+// Validate returns an error if name is neither empty nor a registered algorithm
+func Validate(name string) error {
+	_, err := Lookup(name)
+	return err
+}
+
+// ValidateNative returns an error if name is not a registered algorithm that decompresses without
+// an external program. Only such algorithms are usable for VNFS images, which wwinit unpacks in an
+// initramfs holding no other programs.
+func ValidateNative(name string) error {
+	a, err := Lookup(name)
+	if err != nil {
+		return err
+	}
+	if c, ok := a.(*command); ok && c.reader == nil {
+		return fmt.Errorf("compression algorithm, %v, needs the %v program to decompress", name, c.decompress[0])
+	}
+	return nil
+}
+
+// Names returns the names of the registered algorithms, sorted
+func Names() []string {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	return namesLocked()
+}
+
+func namesLocked() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Recompress copies src, compressed with the algorithm named from, to dst compressed with the
+// algorithm named to
+func Recompress(dst io.Writer, src io.Reader, from, to string) error {
+	decompressor, err := Lookup(from)
+	if err != nil {
+		return err
+	}
+	compressor, err := Lookup(to)
+	if err != nil {
+		return err
+	}
+
+	r, err := decompressor.NewReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := compressor.NewWriter(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+type none struct{}
+
+func (none) Name() string { return None }
+
+func (none) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (none) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return nopReadCloser{r}, nil
+}
+
+type gzipAlgorithm struct{}
+
+func (gzipAlgorithm) Name() string { return "gzip" }
+
+func (gzipAlgorithm) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipAlgorithm) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdAlgorithm struct{}
+
+func (zstdAlgorithm) Name() string { return "zstd" }
+
+func (zstdAlgorithm) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdAlgorithm) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func newXZReader(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return nopReadCloser{xr}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
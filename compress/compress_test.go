@@ -0,0 +1,93 @@
+package compress
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestAlgorithms(t *testing.T) {
+	data := []byte(strings.Repeat("warewulf ", 4096))
+
+	for _, name := range Names() {
+		t.Run(name, func(t *testing.T) {
+			if c, ok := algorithms[name].(*command); ok {
+				if _, err := exec.LookPath(c.compress[0]); err != nil {
+					t.Skipf("%v not installed", c.compress[0])
+				}
+			}
+			a, err := Lookup(name)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			buf := &bytes.Buffer{}
+			w, err := a.NewWriter(buf)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if name != None && buf.Len() >= len(data) {
+				t.Fatalf("Data not compressed, %d bytes", buf.Len())
+			}
+
+			r, err := a.NewReader(buf)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("Round trip mismatch")
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if a, err := Lookup(""); err != nil || a.Name() != None {
+		t.Fatalf("Empty name should be None, %v", err)
+	}
+	if err := Validate("rar"); err == nil {
+		t.Fatal("Should have failed with unsupported compression algorithm")
+	}
+}
+
+func TestValidateNative(t *testing.T) {
+	for _, name := range []string{"", None, "gzip", "xz", "zstd"} {
+		if err := ValidateNative(name); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for _, name := range []string{"lz4", "rar"} {
+		if err := ValidateNative(name); err == nil {
+			t.Fatalf("Should have failed, %v does not decompress natively", name)
+		}
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	gz := &bytes.Buffer{}
+	if err := Recompress(gz, strings.NewReader("warewulf"), None, "gzip"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	out := &bytes.Buffer{}
+	if err := Recompress(out, gz, "gzip", ""); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if out.String() != "warewulf" {
+		t.Fatalf("Mismatch: %q", out.String())
+	}
+}
@@ -0,0 +1,25 @@
+// Package concurrency defines the error reported when a change is based on a stale version of an
+// aggregate, so that callers can reload and retry or prompt the user.
+package concurrency
+
+import (
+	"github.com/altairsix/eventsource"
+)
+
+// ErrVersionConflict is the eventsource.Error code of errors returned when a command was issued
+// against, or records were saved on top of, a version of an aggregate that is no longer current
+const ErrVersionConflict = "VersionConflict"
+
+// CheckVersion returns an error with the ErrVersionConflict code if expected is set and differs
+// from actual. An expected version of 0 disables the check.
+func CheckVersion(aggregateID string, expected, actual int) error {
+	if expected == 0 || expected == actual {
+		return nil
+	}
+	return eventsource.NewError(nil, ErrVersionConflict, "aggregate, %v, is at version %d, expected version %d", aggregateID, actual, expected)
+}
+
+// IsVersionConflict returns true if any error in the cause chain has the ErrVersionConflict code
+func IsVersionConflict(err error) bool {
+	return eventsource.ErrHasCode(err, ErrVersionConflict)
+}
@@ -0,0 +1,106 @@
+package cpio
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Xattrs maps the name of an archived file to its extended attributes
+type Xattrs map[string]map[string][]byte
+
+// Archiver adds files to a Writer, assigning inode numbers, preserving hard links between the
+// files it adds and collecting their extended attributes into the XattrsName entry.
+type Archiver struct {
+	w       *Writer
+	nextIno uint32
+	links   map[[2]uint64]uint32
+	xattrs  Xattrs
+}
+
+// NewArchiver returns an Archiver writing to w
+func NewArchiver(w *Writer) *Archiver {
+	return &Archiver{
+		w:       w,
+		nextIno: 1,
+		links:   map[[2]uint64]uint32{},
+		xattrs:  Xattrs{},
+	}
+}
+
+func (a *Archiver) ino() uint32 {
+	ino := a.nextIno
+	a.nextIno++
+	return ino
+}
+
+// AddDir adds a directory owned by root
+func (a *Archiver) AddDir(name string, perm uint32) error {
+	return a.w.WriteHeader(&Header{
+		Name:  name,
+		Ino:   a.ino(),
+		Mode:  TypeDir | perm&07777,
+		Nlink: 2,
+		Mtime: time.Now().Unix(),
+	})
+}
+
+// AddData adds a regular file owned by root holding data
+func (a *Archiver) AddData(name string, perm uint32, data []byte) error {
+	return a.add(&Header{
+		Name:  name,
+		Ino:   a.ino(),
+		Mode:  TypeReg | perm&07777,
+		Nlink: 1,
+		Mtime: time.Now().Unix(),
+	}, data)
+}
+
+// AddSymlink adds a symbolic link owned by root
+func (a *Archiver) AddSymlink(name, target string) error {
+	return a.add(&Header{
+		Name:  name,
+		Ino:   a.ino(),
+		Mode:  TypeSymlink | 0777,
+		Nlink: 1,
+		Mtime: time.Now().Unix(),
+	}, []byte(target))
+}
+
+// add writes an entry described by h holding data, setting h.Size from data
+func (a *Archiver) add(h *Header, data []byte) error {
+	h.Size = int64(len(data))
+	if err := a.w.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := a.w.Write(data)
+	return err
+}
+
+// Close writes the XattrsName entry when any extended attributes were collected, then closes the
+// Writer
+func (a *Archiver) Close() error {
+	if len(a.xattrs) > 0 {
+		data, err := json.Marshal(a.xattrs)
+		if err != nil {
+			return err
+		}
+		if err := a.AddData(XattrsName, 0600, data); err != nil {
+			return err
+		}
+	}
+	return a.w.Close()
+}
+
+// AddNode adds a device node owned by root; typ is TypeChar or TypeBlock. The node is only
+// described in the archive, so no privileges are needed to add it.
+func (a *Archiver) AddNode(name string, typ, perm, major, minor uint32) error {
+	return a.w.WriteHeader(&Header{
+		Name:      name,
+		Ino:       a.ino(),
+		Mode:      typ | perm&07777,
+		Nlink:     1,
+		Mtime:     time.Now().Unix(),
+		RdevMajor: major,
+		RdevMinor: minor,
+	})
+}
@@ -0,0 +1,137 @@
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// AddTree adds root and everything below it, naming entries relative to root under prefix. The
+// root itself is only added when prefix is not empty.
+func (a *Archiver) AddTree(root, prefix string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(prefix, rel))
+		if name == "." {
+			return nil
+		}
+		return a.AddFile(path, name)
+	})
+}
+
+// AddFile adds the file at path, which is not followed if it is a symlink, as name. Ownership,
+// mode, modification time, device numbers and extended attributes are preserved. Files with more
+// than one link that were added before share their inode number and only the first carries data.
+func (a *Archiver) AddFile(path, name string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return &os.PathError{Op: "stat", Path: path, Err: syscall.EINVAL}
+	}
+
+	h := &Header{
+		Name:      name,
+		Mode:      uint32(st.Mode),
+		UID:       st.Uid,
+		GID:       st.Gid,
+		Nlink:     uint32(st.Nlink),
+		Mtime:     info.ModTime().Unix(),
+		DevMajor:  major(uint64(st.Dev)),
+		DevMinor:  minor(uint64(st.Dev)),
+		RdevMajor: major(uint64(st.Rdev)),
+		RdevMinor: minor(uint64(st.Rdev)),
+	}
+
+	key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+	linked := false
+	if h.Type() == TypeReg && st.Nlink > 1 {
+		h.Ino, linked = a.links[key]
+	}
+	if !linked {
+		h.Ino = a.ino()
+		if h.Type() == TypeReg && st.Nlink > 1 {
+			a.links[key] = h.Ino
+		}
+	}
+
+	if h.Type() != TypeSymlink {
+		if xattrs := listXattrs(path); len(xattrs) > 0 {
+			a.xattrs[name] = xattrs
+		}
+	}
+
+	switch {
+	case h.Type() == TypeSymlink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return a.add(h, []byte(target))
+
+	case h.Type() == TypeReg && !linked:
+		h.Size = info.Size()
+		if err := a.w.WriteHeader(h); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(a.w, f, h.Size)
+		return err
+
+	default:
+		return a.w.WriteHeader(h)
+	}
+}
+
+// listXattrs returns the extended attributes of path that can be read; attributes of namespaces
+// the caller has no access to are skipped
+func listXattrs(path string) map[string][]byte {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+
+	xattrs := map[string][]byte{}
+	for _, attr := range bytes.Split(buf[:size], []byte{0}) {
+		if len(attr) == 0 {
+			continue
+		}
+		n, err := syscall.Getxattr(path, string(attr), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(path, string(attr), value); err != nil {
+			continue
+		}
+		xattrs[string(attr)] = value[:n]
+	}
+	return xattrs
+}
+
+func major(dev uint64) uint32 {
+	return uint32(((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff))
+}
+
+func minor(dev uint64) uint32 {
+	return uint32((dev & 0xff) | ((dev >> 12) &^ 0xff))
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// AddTree is only supported on Linux
+func (a *Archiver) AddTree(root, prefix string) error {
+	return fmt.Errorf("cpio: archiving directories is not supported on %s", runtime.GOOS)
+}
+
+// AddFile is only supported on Linux
+func (a *Archiver) AddFile(path, name string) error {
+	return fmt.Errorf("cpio: archiving files is not supported on %s", runtime.GOOS)
+}
+
+// Extract is only supported on Linux
+func Extract(r io.Reader, dir string) error {
+	return fmt.Errorf("cpio: extracting archives is not supported on %s", runtime.GOOS)
+}
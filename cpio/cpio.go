@@ -0,0 +1,234 @@
+// Package cpio reads and writes archives in the "newc" (SVR4 without CRC) cpio format used for
+// VNFS images and initramfs.
+package cpio
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+const (
+	magic      = "070701"
+	headerSize = 110
+
+	// Trailer is the name of the entry marking the end of an archive
+	Trailer = "TRAILER!!!"
+
+	// XattrsName is the name of the entry holding the extended attributes of the archived files.
+	// newc has no field for extended attributes, so they are recorded as a JSON object mapping
+	// each file name to its attributes; see Xattrs.
+	XattrsName = ".warewulf-xattrs.json"
+)
+
+// File type bits of Header.Mode
+const (
+	TypeMask    = 0170000
+	TypeSocket  = 0140000
+	TypeSymlink = 0120000
+	TypeReg     = 0100000
+	TypeBlock   = 0060000
+	TypeDir     = 0040000
+	TypeChar    = 0020000
+	TypeFifo    = 0010000
+)
+
+// Header describes a single entry of an archive
+type Header struct {
+	Name      string
+	Ino       uint32
+	Mode      uint32 // File type and permission bits
+	UID       uint32
+	GID       uint32
+	Nlink     uint32
+	Mtime     int64
+	Size      int64 // Length of the file data, or of the target of a symlink
+	DevMajor  uint32
+	DevMinor  uint32
+	RdevMajor uint32
+	RdevMinor uint32
+}
+
+// Type returns the file type bits of h.Mode
+func (h *Header) Type() uint32 {
+	return h.Mode & TypeMask
+}
+
+// Writer writes a newc archive
+type Writer struct {
+	w       io.Writer
+	written int64
+	remain  int64
+	pad     int64
+	closed  bool
+}
+
+// NewWriter returns a Writer writing an archive to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader starts a new entry; h.Size bytes of data must then be written with Write
+func (cw *Writer) WriteHeader(h *Header) error {
+	if cw.closed {
+		return fmt.Errorf("cpio: write to closed archive")
+	}
+	if err := cw.finishEntry(); err != nil {
+		return err
+	}
+	if h.Size < 0 || h.Size > 0xffffffff {
+		return fmt.Errorf("cpio: %v is too large for a newc archive", h.Name)
+	}
+
+	fields := []uint32{
+		h.Ino, h.Mode, h.UID, h.GID, h.Nlink, uint32(h.Mtime), uint32(h.Size),
+		h.DevMajor, h.DevMinor, h.RdevMajor, h.RdevMinor, uint32(len(h.Name) + 1), 0,
+	}
+
+	buf := bytes.NewBufferString(magic)
+	for _, field := range fields {
+		fmt.Fprintf(buf, "%08X", field)
+	}
+	buf.WriteString(h.Name)
+	buf.WriteByte(0)
+	buf.Write(make([]byte, padding(int64(buf.Len()))))
+
+	if err := cw.write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	cw.remain = h.Size
+	cw.pad = padding(h.Size)
+	return nil
+}
+
+// Write writes data of the current entry
+func (cw *Writer) Write(p []byte) (int, error) {
+	if int64(len(p)) > cw.remain {
+		return 0, fmt.Errorf("cpio: write exceeds size in header")
+	}
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	cw.remain -= int64(n)
+	return n, err
+}
+
+// Close writes the trailer entry. It does not close the underlying writer.
+func (cw *Writer) Close() error {
+	if cw.closed {
+		return nil
+	}
+	if err := cw.WriteHeader(&Header{Name: Trailer, Nlink: 1}); err != nil {
+		return err
+	}
+	cw.closed = true
+	// Pad the archive to a multiple of 512 bytes like cpio(1)
+	return cw.write(make([]byte, (512-cw.written%512)%512))
+}
+
+func (cw *Writer) finishEntry() error {
+	if cw.remain > 0 {
+		return fmt.Errorf("cpio: %d bytes missing from previous entry", cw.remain)
+	}
+	err := cw.write(make([]byte, cw.pad))
+	cw.pad = 0
+	return err
+}
+
+func (cw *Writer) write(p []byte) error {
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	return err
+}
+
+// Reader reads a newc archive
+type Reader struct {
+	r      *bufio.Reader
+	remain int64
+	pad    int64
+}
+
+// NewReader returns a Reader reading an archive from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next advances to the next entry, skipping any unread data of the current one. io.EOF is
+// returned at the trailer.
+func (cr *Reader) Next() (*Header, error) {
+	if _, err := io.CopyN(ioutil.Discard, cr.r, cr.remain+cr.pad); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, headerSize)
+	if _, err := io.ReadFull(cr.r, raw); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if string(raw[:6]) != magic {
+		return nil, fmt.Errorf("cpio: invalid header magic, %q", raw[:6])
+	}
+
+	fields := make([]uint32, 13)
+	for i := range fields {
+		v, err := strconv.ParseUint(string(raw[6+i*8:14+i*8]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("cpio: invalid header field: %v", err)
+		}
+		fields[i] = uint32(v)
+	}
+
+	nameSize := int64(fields[11])
+	name := make([]byte, nameSize+padding(headerSize+nameSize))
+	if _, err := io.ReadFull(cr.r, name); err != nil {
+		return nil, err
+	}
+
+	h := &Header{
+		Name:      string(bytes.TrimRight(name[:nameSize], "\x00")),
+		Ino:       fields[0],
+		Mode:      fields[1],
+		UID:       fields[2],
+		GID:       fields[3],
+		Nlink:     fields[4],
+		Mtime:     int64(fields[5]),
+		Size:      int64(fields[6]),
+		DevMajor:  fields[7],
+		DevMinor:  fields[8],
+		RdevMajor: fields[9],
+		RdevMinor: fields[10],
+	}
+	cr.remain = h.Size
+	cr.pad = padding(h.Size)
+
+	if h.Name == Trailer {
+		return nil, io.EOF
+	}
+	return h, nil
+}
+
+// Read reads data of the current entry
+func (cr *Reader) Read(p []byte) (int, error) {
+	if cr.remain == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > cr.remain {
+		p = p[:cr.remain]
+	}
+	n, err := cr.r.Read(p)
+	cr.remain -= int64(n)
+	if err == io.EOF && cr.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// padding returns the number of bytes needed to align n to 4 bytes
+func padding(n int64) int64 {
+	return (4 - n%4) % 4
+}
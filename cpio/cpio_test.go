@@ -0,0 +1,63 @@
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	entries := []struct {
+		header Header
+		data   string
+	}{
+		{Header{Name: "etc", Ino: 1, Mode: TypeDir | 0755, Nlink: 2}, ""},
+		{Header{Name: "etc/hostname", Ino: 2, Mode: TypeReg | 0644, UID: 1, GID: 2, Nlink: 1, Mtime: 1500000000}, "n0001\n"},
+		{Header{Name: "etc/localtime", Ino: 3, Mode: TypeSymlink | 0777, Nlink: 1}, "/usr/share/zoneinfo/UTC"},
+		{Header{Name: "dev/null", Ino: 4, Mode: TypeChar | 0666, Nlink: 1, RdevMajor: 1, RdevMinor: 3}, ""},
+	}
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	for _, e := range entries {
+		h := e.header
+		h.Size = int64(len(e.data))
+		if err := w.WriteHeader(&h); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if buf.Len()%512 != 0 {
+		t.Fatalf("Archive not padded to 512 bytes, %d bytes instead", buf.Len())
+	}
+
+	r := NewReader(buf)
+	for _, e := range entries {
+		h, err := r.Next()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		expected := e.header
+		expected.Size = int64(len(e.data))
+		if !reflect.DeepEqual(*h, expected) {
+			t.Fatalf("Mismatch: %+v", *h)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if string(data) != e.data {
+			t.Fatalf("Data mismatch for %s: %q", h.Name, data)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF at trailer, %v instead", err)
+	}
+}
@@ -0,0 +1,233 @@
+package cpio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Extract unpacks the archive read from r below dir, restoring what AddFile preserves: ownership,
+// modes, modification times, symlinks, hard links, device nodes and the extended attributes of the
+// XattrsName entry. Ownership is only restored when running as root. Entries whose names would
+// escape dir are rejected, as are entries below a symlink, which could otherwise be written through
+// to outside dir by an archive holding a symlink and then an entry below it.
+func Extract(r io.Reader, dir string) error {
+	cr := NewReader(r)
+	links := map[uint32]string{}
+	var dirs []*Header
+	var xattrs Xattrs
+
+	for {
+		h, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if h.Name == XattrsName {
+			data, err := ioutil.ReadAll(cr)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, &xattrs); err != nil {
+				return fmt.Errorf("cpio: invalid %v: %v", XattrsName, err)
+			}
+			continue
+		}
+
+		path, err := extractPath(dir, h.Name)
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			dirs = append(dirs, h)
+			continue
+		}
+		if h.Type() != TypeDir {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		switch h.Type() {
+		case TypeDir:
+			if err := notSymlink(path, h.Name); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+			// Modes are applied once the directory's contents are extracted, as they may forbid writing
+			dirs = append(dirs, h)
+			continue
+
+		case TypeReg:
+			if name, ok := links[h.Ino]; ok && h.Nlink > 1 {
+				// A later entry may have replaced a directory leading to the first link
+				first, err := extractPath(dir, name)
+				if err != nil {
+					return err
+				}
+				if err := os.Link(first, path); err != nil {
+					return err
+				}
+				continue
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, cr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			if h.Nlink > 1 {
+				links[h.Ino] = h.Name
+			}
+
+		case TypeSymlink:
+			target, err := ioutil.ReadAll(cr)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(string(target), path); err != nil {
+				return err
+			}
+			if err := chown(path, h); err != nil {
+				return err
+			}
+			continue
+
+		case TypeChar, TypeBlock, TypeFifo:
+			if err := syscall.Mknod(path, h.Mode, int(mkdev(h.RdevMajor, h.RdevMinor))); err != nil {
+				return &os.PathError{Op: "mknod", Path: path, Err: err}
+			}
+
+		default:
+			// Sockets are created by their servers
+			continue
+		}
+
+		if err := setAttrs(path, h); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// A later entry may have replaced the directory with a symlink
+		path, err := extractPath(dir, dirs[i].Name)
+		if err != nil {
+			return err
+		}
+		if err := notSymlink(path, dirs[i].Name); err != nil {
+			return err
+		}
+		if err := setAttrs(path, dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	for name, attrs := range xattrs {
+		path, err := extractPath(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := notSymlink(path, name); err != nil {
+			return err
+		}
+		for attr, value := range attrs {
+			if err := syscall.Setxattr(path, attr, value, 0); err != nil {
+				return &os.PathError{Op: "setxattr", Path: path, Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// extractPath returns the path below dir of the entry called name. The directories between dir
+// and the path must not be symlinks.
+func extractPath(dir, name string) (string, error) {
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("cpio: entry %v escapes the extraction directory", name)
+		}
+	}
+	rel := filepath.Clean("/" + name)
+	path := filepath.Join(dir, rel)
+	parts := strings.Split(rel[1:], "/")
+	parent := dir
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		if err := notSymlink(parent, name); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// notSymlink returns an error if path, extracted for the entry called name, is a symlink
+func notSymlink(path, name string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("cpio: entry %v would be extracted through symlink %v", name, path)
+	}
+	return nil
+}
+
+func setAttrs(path string, h *Header) error {
+	if err := chown(path, h); err != nil {
+		return err
+	}
+	// chmod after chown, which clears the setuid and setgid bits
+	if err := os.Chmod(path, fileMode(h.Mode)); err != nil {
+		return err
+	}
+	mtime := time.Unix(h.Mtime, 0)
+	return os.Chtimes(path, mtime, mtime)
+}
+
+func chown(path string, h *Header) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, int(h.UID), int(h.GID))
+}
+
+// fileMode converts the permission bits of a cpio mode to an os.FileMode
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
@@ -0,0 +1,156 @@
+package cpio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	for _, d := range []string{"bin", "etc/ssh"} {
+		if err := os.MkdirAll(filepath.Join(src, d), 0755); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "bin", "busybox"), []byte("busybox"), 0755); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(src, "bin", "busybox"), 0755|os.ModeSetuid); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := os.Link(filepath.Join(src, "bin", "busybox"), filepath.Join(src, "bin", "sh")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := os.Symlink("/proc/mounts", filepath.Join(src, "etc", "mtab")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(src, "etc", "ssh"), 0500); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	a := NewArchiver(NewWriter(buf))
+	if err := a.AddTree(src, ""); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Only root can create device nodes
+	if os.Geteuid() == 0 {
+		if err := a.AddNode("dev/null", TypeChar, 0666, 1, 3); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := Extract(buf, dst); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	busybox, err := os.Stat(filepath.Join(dst, "bin", "busybox"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if busybox.Mode() != 0755|os.ModeSetuid {
+		t.Fatalf("Mode not restored: %v", busybox.Mode())
+	}
+	sh, err := os.Stat(filepath.Join(dst, "bin", "sh"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !os.SameFile(busybox, sh) {
+		t.Fatal("Hard link not restored")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "bin", "sh")); string(data) != "busybox" {
+		t.Fatalf("Hard linked data not restored: %q", data)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "etc", "mtab")); err != nil || target != "/proc/mounts" {
+		t.Fatalf("Symlink not restored: %v %v", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "etc", "ssh")); err != nil || info.Mode().Perm() != 0500 {
+		t.Fatalf("Directory mode not restored: %v %v", info.Mode(), err)
+	}
+	if os.Geteuid() == 0 {
+		info, err := os.Stat(filepath.Join(dst, "dev", "null"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if st := info.Sys().(*syscall.Stat_t); info.Mode()&os.ModeCharDevice == 0 || major(uint64(st.Rdev)) != 1 || minor(uint64(st.Rdev)) != 3 {
+			t.Fatalf("Device node not restored: %v", info.Mode())
+		}
+	}
+}
+
+func TestExtractEscape(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewArchiver(NewWriter(buf))
+	if err := a.AddData("../../etc/passwd", 0644, []byte("root::0:0::/:/bin/sh\n")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := Extract(buf, t.TempDir()); err == nil {
+		t.Fatal("Should have failed with entry escaping the extraction directory")
+	}
+}
+
+func TestExtractSymlinkEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(a *Archiver) error
+	}{
+		{"File", func(a *Archiver) error {
+			return a.AddData("etc/passwd", 0644, []byte("root::0:0::/:/bin/sh\n"))
+		}},
+		{"Dir", func(a *Archiver) error {
+			return a.AddDir("etc", 0777)
+		}},
+		{"Nested", func(a *Archiver) error {
+			return a.AddData("etc/ssh/sshd_config", 0644, []byte("PermitRootLogin yes\n"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outside := t.TempDir()
+			if err := os.Mkdir(filepath.Join(outside, "ssh"), 0755); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			buf := &bytes.Buffer{}
+			a := NewArchiver(NewWriter(buf))
+			if err := a.AddSymlink("etc", outside); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if err := tt.add(a); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if err := a.Close(); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if err := Extract(buf, t.TempDir()); err == nil {
+				t.Fatal("Should have failed with entry below a symlink")
+			}
+
+			entries, _ := ioutil.ReadDir(outside)
+			info, err := os.Stat(outside)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if len(entries) != 1 || info.Mode().Perm() == 0777 {
+				t.Fatalf("Should not have written through the symlink, mode %v, %d entries", info.Mode(), len(entries))
+			}
+			if entries, _ := ioutil.ReadDir(filepath.Join(outside, "ssh")); len(entries) != 0 {
+				t.Fatal("Should not have written through the symlink")
+			}
+		})
+	}
+}
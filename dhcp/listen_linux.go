@@ -0,0 +1,35 @@
+package dhcp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// ListenAndServe answers requests received on port 67 of the interface named iface, or of all
+// interfaces when iface is empty, until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, iface string) error {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+					return
+				}
+				if iface != "" {
+					err = syscall.BindToDevice(int(fd), iface)
+				}
+			})
+			return err
+		},
+	}
+	conn, err := lc.ListenPacket(ctx, "udp4", ":"+strconv.Itoa(ServerPort))
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
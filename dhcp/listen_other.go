@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package dhcp
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// ListenAndServe is only supported on Linux
+func (s *Server) ListenAndServe(ctx context.Context, iface string) error {
+	return fmt.Errorf("dhcp: serving is not supported on %s", runtime.GOOS)
+}
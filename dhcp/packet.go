@@ -0,0 +1,212 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Message types of option 53
+const (
+	Discover = 1
+	Offer    = 2
+	Request  = 3
+	Decline  = 4
+	Ack      = 5
+	Nak      = 6
+	Release  = 7
+	Inform   = 8
+)
+
+// Options used by the server
+const (
+	OptSubnetMask     = 1
+	OptRouter         = 3
+	OptHostname       = 12
+	OptDomainName     = 15
+	OptRequestedIP    = 50
+	OptLeaseTime      = 51
+	OptMessageType    = 53
+	OptServerID       = 54
+	OptParameterList  = 55
+	OptVendorClass    = 60
+	OptTFTPServerName = 66
+	OptBootFile       = 67
+	OptUserClass      = 77
+	OptClientArch     = 93
+	OptEnd            = 255
+	optPad            = 0
+)
+
+const (
+	bootRequest = 1
+	bootReply   = 2
+
+	headerLen = 236
+	minLen    = 300 // BOOTP clients discard shorter messages
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Packet is a DHCPv4 message of RFC 2131
+type Packet struct {
+	Op      byte
+	HType   byte
+	HLen    byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP // Next server, where the client fetches its boot file
+	GIAddr  net.IP // Relay agent
+	CHAddr  net.HardwareAddr
+	SName   string
+	File    string
+	Options Options
+}
+
+// Options holds the options of a Packet by code
+type Options map[byte][]byte
+
+// Parse decodes a DHCPv4 message
+func Parse(b []byte) (*Packet, error) {
+	if len(b) < headerLen+len(magicCookie) {
+		return nil, fmt.Errorf("short message, %d bytes", len(b))
+	}
+	if !bytes.Equal(b[headerLen:headerLen+4], magicCookie) {
+		return nil, fmt.Errorf("not a DHCP message")
+	}
+	p := &Packet{
+		Op:      b[0],
+		HType:   b[1],
+		HLen:    b[2],
+		Hops:    b[3],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(append([]byte(nil), b[12:16]...)),
+		YIAddr:  net.IP(append([]byte(nil), b[16:20]...)),
+		SIAddr:  net.IP(append([]byte(nil), b[20:24]...)),
+		GIAddr:  net.IP(append([]byte(nil), b[24:28]...)),
+		SName:   cstring(b[44:108]),
+		File:    cstring(b[108:236]),
+		Options: Options{},
+	}
+	if p.HLen > 16 {
+		return nil, fmt.Errorf("invalid hardware address length %d", p.HLen)
+	}
+	p.CHAddr = net.HardwareAddr(append([]byte(nil), b[28:28+int(p.HLen)]...))
+
+	opts := b[headerLen+4:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == OptEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		// Options longer than 255 bytes are split over several instances, RFC 3396
+		p.Options[code] = append(p.Options[code], opts[2:2+int(opts[1])]...)
+		opts = opts[2+int(opts[1]):]
+	}
+	return p, nil
+}
+
+// Marshal encodes p, padded to the minimum BOOTP message length
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, headerLen, minLen)
+	b[0], b[1], b[2], b[3] = p.Op, p.HType, p.HLen, p.Hops
+	binary.BigEndian.PutUint32(b[4:], p.XID)
+	binary.BigEndian.PutUint16(b[8:], p.Secs)
+	binary.BigEndian.PutUint16(b[10:], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	copy(b[44:107], p.SName)
+	copy(b[108:235], p.File)
+	b = append(b, magicCookie...)
+
+	// Message type first, as some PXE ROMs expect, then the rest in order of code
+	if t, ok := p.Options[OptMessageType]; ok {
+		b = appendOption(b, OptMessageType, t)
+	}
+	for code := 1; code < OptEnd; code++ {
+		if v, ok := p.Options[byte(code)]; ok && code != OptMessageType {
+			b = appendOption(b, byte(code), v)
+		}
+	}
+	b = append(b, OptEnd)
+	for len(b) < minLen {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+func appendOption(b []byte, code byte, v []byte) []byte {
+	for {
+		n := len(v)
+		if n > 255 {
+			n = 255
+		}
+		b = append(b, code, byte(n))
+		b = append(b, v[:n]...)
+		if v = v[n:]; len(v) == 0 {
+			return b
+		}
+	}
+}
+
+// Type returns the message type of p, or 0 for a BOOTP message
+func (p *Packet) Type() byte {
+	if t := p.Options[OptMessageType]; len(t) == 1 {
+		return t[0]
+	}
+	return 0
+}
+
+// IP returns the address carried by option code, or nil
+func (o Options) IP(code byte) net.IP {
+	if v := o[code]; len(v) == 4 {
+		return net.IP(v)
+	}
+	return nil
+}
+
+// Uint16 returns the first 16-bit value carried by option code
+func (o Options) Uint16(code byte) (uint16, bool) {
+	if v := o[code]; len(v) >= 2 {
+		return binary.BigEndian.Uint16(v), true
+	}
+	return 0, false
+}
+
+// SetUint32 sets option code to the 32-bit value v
+func (o Options) SetUint32(code byte, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	o[code] = b
+}
+
+// SetIP sets option code to the address ip, doing nothing if ip is not an IPv4 address
+func (o Options) SetIP(code byte, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		o[code] = append([]byte(nil), ip4...)
+	}
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
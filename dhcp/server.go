@@ -0,0 +1,371 @@
+// Package dhcp is a DHCPv4 server that answers only the hardware addresses of nodes' Netdevs, with
+// the address, netmask, gateway and domain recorded on the Netdev, and directs PXE firmware to the
+// bootloader for its architecture and iPXE to the script of its node.
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	"github.com/bensallen/warewulf4/provision"
+	"github.com/bensallen/warewulf4/tftp"
+)
+
+// Ports of RFC 2131
+const (
+	ServerPort = 67
+	ClientPort = 68
+)
+
+// DefaultLeaseTime is the lease time handed out when Server.LeaseTime is zero. Addresses are fixed
+// per node, so leases are long.
+const DefaultLeaseTime = 24 * time.Hour
+
+// Lease is the configuration handed to a hardware address
+type Lease struct {
+	Node    string // ID of the node
+	Arch    string // Arch of the node
+	HWAddr  net.HardwareAddr
+	IP      net.IP
+	Mask    net.IPMask
+	Gateway net.IP
+	Domain  string
+}
+
+// Client describes the client of a request
+type Client struct {
+	HWAddr        net.HardwareAddr
+	ClientArch    tftp.ClientArch // Client architecture of option 93, when ClientArchSet
+	ClientArchSet bool
+	VendorClass   string
+}
+
+// Server answers DHCP requests from the hardware addresses of the Netdevs of the nodes in a
+// Projection. Its leases are rebuilt whenever the Projection applies NodeNetdevsSet, NodeArchSet or
+// NodeDeleted events, or events changing the profiles nodes inherit their Netdevs and Arch from.
+type Server struct {
+	IP          net.IP           // Address of the server on the provisioning network, sent as server identifier and next server
+	HTTPURL     string           // Base URL of the provisioning server, e.g. http://10.0.0.1:9873; iPXE clients are sent their node's script
+	Bootloaders tftp.Bootloaders // Boot file by client architecture for PXE firmware
+	LeaseTime   time.Duration
+
+	// Unknown, when set, is called with the client of each DHCPDISCOVER from a hardware address
+	// that has no lease. It is called on the serving goroutine and must not block.
+	Unknown func(Client)
+
+	nodes  *projection.Projection
+	mux    sync.RWMutex
+	leases map[string]*Lease          // By hardware address
+	arches map[string]tftp.ClientArch // Announced in option 93, by leased address
+}
+
+// NewServer returns a Server handing out the addresses of the nodes in p, serving the default
+// bootloaders from ip
+func NewServer(p *projection.Projection, ip net.IP) *Server {
+	s := &Server{
+		IP:          ip,
+		Bootloaders: tftp.DefaultBootloaders(),
+		nodes:       p,
+		arches:      map[string]tftp.ClientArch{},
+	}
+	s.Reload()
+	p.Subscribe(s.onEvents)
+	return s
+}
+
+// onEvents reloads the leases when events changing the Netdevs or Arch of nodes were applied
+func (s *Server) onEvents(events []eventsource.Event) {
+	for _, event := range events {
+		switch event.(type) {
+		case *node.NodeNetdevsSet, *node.NodeArchSet, *node.NodeDeleted,
+			*node.NodeProfilesSet, *node.ProfileUpdated, *node.ProfileDeleted:
+			s.Reload()
+			return
+		}
+	}
+}
+
+// Reload rebuilds the leases from the nodes of the Projection. Netdevs are skipped when they have
+// no hardware address, or no IPv4 address of their own or of a bond or bridge they are a member
+// of; invalid netdevs and hardware addresses used by several nodes are logged and skipped. Client
+// architectures announced from addresses no longer leased are forgotten.
+func (s *Server) Reload() {
+	leases := map[string]*Lease{}
+	conflicts := map[string]bool{}
+	for _, n := range s.nodes.Nodes() {
+		for key, netdev := range n.Netdevs {
+			if netdev == nil || netdev.HWAddr == "" {
+				continue
+			}
+			// Members of a bond or bridge boot with the address of their master
+			subnet, addressed, ok := node.Addressed(n.Netdevs, key)
+			if !ok || net.ParseIP(addressed.IP).To4() == nil {
+				// IPv6 netdevs are answered by package dhcpv6
+				continue
+			}
+			lease, err := newLease(n, subnet, addressed, netdev.HWAddr)
+			if err != nil {
+				log.Printf("dhcp: node %v: %v", n.ID, err)
+				continue
+			}
+			key := lease.HWAddr.String()
+			if other, ok := leases[key]; ok && other.Node == n.ID && other.IP.Equal(lease.IP) {
+				// A bond sharing the hardware address of its member
+				continue
+			}
+			if other, ok := leases[key]; ok || conflicts[key] {
+				if ok {
+					log.Printf("dhcp: hardware address %v is used by nodes %v and %v, not answering it", key, other.Node, n.ID)
+				}
+				delete(leases, key)
+				conflicts[key] = true
+				continue
+			}
+			leases[key] = lease
+		}
+	}
+
+	leased := map[string]bool{}
+	for _, lease := range leases {
+		leased[lease.IP.String()] = true
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.leases = leases
+	for ip := range s.arches {
+		if !leased[ip] {
+			delete(s.arches, ip)
+		}
+	}
+}
+
+// newLease returns the lease of hardware address mac, given the address of netdev on subnet of
+// node n
+func newLease(n node.Node, subnet string, netdev *node.Netdev, mac string) (*Lease, error) {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil || len(hwaddr) != 6 {
+		return nil, fmt.Errorf("netdev on %v has invalid hardware address, %v", subnet, mac)
+	}
+	ip := net.ParseIP(netdev.IP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("netdev on %v has invalid IPv4 address, %v", subnet, netdev.IP)
+	}
+	lease := &Lease{Node: n.ID, Arch: n.Arch, HWAddr: hwaddr, IP: ip, Domain: netdev.Domain}
+	if netdev.Netmask != "" {
+		mask := net.ParseIP(netdev.Netmask).To4()
+		if mask == nil {
+			return nil, fmt.Errorf("netdev on %v has invalid netmask, %v", subnet, netdev.Netmask)
+		}
+		lease.Mask = net.IPMask(mask)
+	} else if _, network, err := net.ParseCIDR(subnet); err == nil && len(network.Mask) == net.IPv4len {
+		lease.Mask = network.Mask
+	} else {
+		return nil, fmt.Errorf("netdev subnet, %v, is not an IPv4 subnet", subnet)
+	}
+	if netdev.Gateway != "" {
+		if lease.Gateway = net.ParseIP(netdev.Gateway).To4(); lease.Gateway == nil {
+			return nil, fmt.Errorf("netdev on %v has invalid gateway, %v", subnet, netdev.Gateway)
+		}
+	}
+	return lease, nil
+}
+
+// Lease returns the lease of hwaddr
+func (s *Server) Lease(hwaddr string) (*Lease, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	lease, ok := s.leases[strings.ToLower(hwaddr)]
+	return lease, ok
+}
+
+// ClientArch returns the client architecture last announced by the client leased ip. It suits
+// tftp.Server.ClientArch.
+func (s *Server) ClientArch(ip net.IP) (tftp.ClientArch, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	arch, ok := s.arches[ip.String()]
+	return arch, ok
+}
+
+// Handle returns the reply to req, or nil if req is not answered
+func (s *Server) Handle(req *Packet) *Packet {
+	if req.Op != bootRequest || req.HType != 1 || req.HLen != 6 {
+		return nil
+	}
+	lease, ok := s.Lease(req.CHAddr.String())
+	if !ok {
+		if s.Unknown != nil && req.Type() == Discover {
+			client := Client{HWAddr: req.CHAddr, VendorClass: string(req.Options[OptVendorClass])}
+			if arch, ok := req.Options.Uint16(OptClientArch); ok {
+				client.ClientArch, client.ClientArchSet = tftp.ClientArch(arch), true
+			}
+			s.Unknown(client)
+		}
+		return nil
+	}
+	if arch, ok := req.Options.Uint16(OptClientArch); ok {
+		s.mux.Lock()
+		s.arches[lease.IP.String()] = tftp.ClientArch(arch)
+		s.mux.Unlock()
+	}
+
+	switch req.Type() {
+	case Discover:
+		return s.reply(req, Offer, lease)
+
+	case Request:
+		if id := req.Options.IP(OptServerID); id != nil && !id.Equal(s.IP) {
+			// The client chose another server's offer
+			return nil
+		}
+		requested := req.Options.IP(OptRequestedIP)
+		if requested == nil {
+			requested = req.CIAddr
+		}
+		if !requested.Equal(lease.IP) {
+			log.Printf("dhcp: %v (node %v) requested %v, leased %v", lease.HWAddr, lease.Node, requested, lease.IP)
+			return s.reply(req, Nak, lease)
+		}
+		log.Printf("dhcp: %v (node %v) leased %v", lease.HWAddr, lease.Node, lease.IP)
+		return s.reply(req, Ack, lease)
+
+	case Inform:
+		resp := s.reply(req, Ack, lease)
+		resp.YIAddr = nil
+		delete(resp.Options, OptLeaseTime)
+		return resp
+
+	case Decline:
+		log.Printf("dhcp: %v (node %v) declined %v, it may be in use by another host", lease.HWAddr, lease.Node, lease.IP)
+	}
+	return nil
+}
+
+// reply builds a reply of type t to req
+func (s *Server) reply(req *Packet, t byte, lease *Lease) *Packet {
+	resp := &Packet{
+		Op:      bootReply,
+		HType:   req.HType,
+		HLen:    req.HLen,
+		XID:     req.XID,
+		Flags:   req.Flags,
+		GIAddr:  req.GIAddr,
+		CHAddr:  req.CHAddr,
+		Options: Options{OptMessageType: {t}},
+	}
+	resp.Options.SetIP(OptServerID, s.IP)
+	if t == Nak {
+		return resp
+	}
+
+	resp.CIAddr = req.CIAddr
+	resp.YIAddr = lease.IP
+	resp.SIAddr = s.IP
+	leaseTime := s.LeaseTime
+	if leaseTime == 0 {
+		leaseTime = DefaultLeaseTime
+	}
+	resp.Options.SetUint32(OptLeaseTime, uint32(leaseTime/time.Second))
+	resp.Options[OptSubnetMask] = []byte(lease.Mask)
+	resp.Options.SetIP(OptRouter, lease.Gateway)
+	resp.Options[OptHostname] = []byte(lease.Node)
+	if lease.Domain != "" {
+		resp.Options[OptDomainName] = []byte(lease.Domain)
+	}
+
+	if bytes.HasPrefix(req.Options[OptVendorClass], []byte("PXEClient")) {
+		resp.Options[OptVendorClass] = []byte("PXEClient")
+	}
+	if file := s.bootFile(req, lease); file != "" {
+		resp.Options[OptBootFile] = []byte(file)
+		if len(file) < 128 {
+			resp.File = file
+		}
+		if s.IP != nil {
+			resp.Options[OptTFTPServerName] = []byte(s.IP.String())
+		}
+	}
+	return resp
+}
+
+// bootFile returns the file the client of req boots: the URL of its node's iPXE script for iPXE,
+// or the bootloader of its architecture for PXE firmware
+func (s *Server) bootFile(req *Packet, lease *Lease) string {
+	if bytes.Equal(req.Options[OptUserClass], []byte("iPXE")) {
+		if s.HTTPURL == "" {
+			return ""
+		}
+		return strings.TrimRight(s.HTTPURL, "/") + provision.HWAddrPath(lease.HWAddr.String(), provision.FileIPXE)
+	}
+	if !bytes.HasPrefix(req.Options[OptVendorClass], []byte("PXEClient")) {
+		return ""
+	}
+	arch := tftp.NodeClientArch(lease.Arch)
+	if a, ok := req.Options.Uint16(OptClientArch); ok {
+		arch = tftp.ClientArch(a)
+	}
+	return s.Bootloaders[arch]
+}
+
+// Serve answers the requests received on conn until ctx is done, then closes conn. Replies are
+// sent as RFC 2131 section 4.1 specifies, except that a client without an address and without
+// the broadcast flag set is answered by broadcast, as a unicast would need an ARP entry.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		req, err := Parse(buf[:n])
+		if err != nil {
+			log.Printf("dhcp: %v: %v", addr, err)
+			continue
+		}
+		resp := s.Handle(req)
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp.Marshal(), destination(req, resp)); err != nil {
+			log.Printf("dhcp: reply to %v: %v", req.CHAddr, err)
+		}
+	}
+}
+
+// destination returns the address resp is sent to
+func destination(req, resp *Packet) *net.UDPAddr {
+	switch {
+	case req.GIAddr != nil && !req.GIAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.GIAddr, Port: ServerPort}
+	case resp.Type() == Nak:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+	case req.CIAddr != nil && !req.CIAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.CIAddr, Port: ClientPort}
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+}
@@ -0,0 +1,188 @@
+package dhcp
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	"github.com/bensallen/warewulf4/tftp"
+)
+
+func request(t byte, hwaddr string, options Options) *Packet {
+	mac, _ := net.ParseMAC(hwaddr)
+	p := &Packet{Op: bootRequest, HType: 1, HLen: 6, XID: 0x1234, CHAddr: mac, Options: Options{OptMessageType: {t}}}
+	for code, v := range options {
+		p.Options[code] = v
+	}
+	// Round trip through the wire format, as Serve does
+	parsed, err := Parse(p.Marshal())
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := context.Background()
+	nodes := []node.Node{
+		{ID: "n0001", Arch: "x86_64", Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:01", IP: "10.0.0.1", Gateway: "10.0.0.254", Domain: "cluster"},
+		}},
+		{ID: "n0002", Arch: "aarch64", Netdevs: map[string]*node.Netdev{
+			"10.0.1.0/24": {HWAddr: "00:11:22:33:44:02", IP: "10.0.1.2", Netmask: "255.255.255.0"},
+		}},
+		{ID: "n0003", Arch: "x86_64", Netdevs: map[string]*node.Netdev{
+			"10.0.2.0/24": {Name: "bond0", Type: node.NetdevBond, Members: []string{"eth0", "eth1"}, HWAddr: "00:11:22:33:44:05", IP: "10.0.2.3"},
+			"eth0":        {Name: "eth0", HWAddr: "00:11:22:33:44:05"},
+			"eth1":        {Name: "eth1", HWAddr: "00:11:22:33:44:06"},
+		}},
+	}
+	for _, n := range nodes {
+		if err := n.Create(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	p, err := projection.New(ctx, store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	s := NewServer(p, net.IPv4(10, 0, 0, 250))
+	s.HTTPURL = "http://10.0.0.250:9873/"
+
+	t.Run("Discover", func(t *testing.T) {
+		resp := s.Handle(request(Discover, "00:11:22:33:44:01", Options{OptVendorClass: []byte("PXEClient:Arch:00007"), OptClientArch: {0, 7}}))
+		if resp == nil || resp.Type() != Offer {
+			t.Fatalf("Expected an offer, got %+v", resp)
+		}
+		if !resp.YIAddr.Equal(net.IPv4(10, 0, 0, 1)) || !resp.SIAddr.Equal(s.IP) || resp.XID != 0x1234 {
+			t.Fatalf("Mismatch: %+v", resp)
+		}
+		if got := net.IP(resp.Options[OptSubnetMask]).String(); got != "255.255.255.0" {
+			t.Fatalf("Mismatch: %v", got)
+		}
+		if !resp.Options.IP(OptRouter).Equal(net.IPv4(10, 0, 0, 254)) || string(resp.Options[OptDomainName]) != "cluster" || string(resp.Options[OptHostname]) != "n0001" {
+			t.Fatalf("Mismatch: %+v", resp.Options)
+		}
+		if resp.File != "ipxe.efi" || string(resp.Options[OptVendorClass]) != "PXEClient" {
+			t.Fatalf("Mismatch: %q", resp.File)
+		}
+		if arch, ok := s.ClientArch(net.IPv4(10, 0, 0, 1)); !ok || arch != tftp.EFIBC {
+			t.Fatalf("Mismatch: %v", arch)
+		}
+	})
+
+	t.Run("NodeArch", func(t *testing.T) {
+		resp := s.Handle(request(Discover, "00:11:22:33:44:02", Options{OptVendorClass: []byte("PXEClient")}))
+		if resp == nil || resp.File != "ipxe-arm64.efi" || net.IP(resp.Options[OptSubnetMask]).String() != "255.255.255.0" {
+			t.Fatalf("Mismatch: %+v", resp)
+		}
+		if _, ok := resp.Options[OptRouter]; ok {
+			t.Fatalf("Unexpected router: %+v", resp.Options)
+		}
+	})
+
+	t.Run("BondMember", func(t *testing.T) {
+		for _, hwaddr := range []string{"00:11:22:33:44:05", "00:11:22:33:44:06"} {
+			if lease, ok := s.Lease(hwaddr); !ok || !lease.IP.Equal(net.IPv4(10, 0, 2, 3)) || lease.Node != "n0003" {
+				t.Fatalf("Mismatch for %v: %+v", hwaddr, lease)
+			}
+		}
+	})
+
+	t.Run("IPXE", func(t *testing.T) {
+		resp := s.Handle(request(Discover, "00:11:22:33:44:01", Options{OptVendorClass: []byte("PXEClient:Arch:00000"), OptUserClass: []byte("iPXE")}))
+		if resp == nil || resp.File != "http://10.0.0.250:9873/provision/hwaddr/00:11:22:33:44:01/ipxe" {
+			t.Fatalf("Mismatch: %+v", resp)
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		resp := s.Handle(request(Request, "00:11:22:33:44:01", Options{OptRequestedIP: net.IPv4(10, 0, 0, 1).To4(), OptServerID: s.IP.To4()}))
+		if resp == nil || resp.Type() != Ack {
+			t.Fatalf("Expected an ack, got %+v", resp)
+		}
+		resp = s.Handle(request(Request, "00:11:22:33:44:01", Options{OptRequestedIP: net.IPv4(10, 0, 0, 9).To4()}))
+		if resp == nil || resp.Type() != Nak || destination(&Packet{}, resp).IP.String() != "255.255.255.255" {
+			t.Fatalf("Expected a nak, got %+v", resp)
+		}
+		resp = s.Handle(request(Request, "00:11:22:33:44:01", Options{OptRequestedIP: net.IPv4(10, 0, 0, 1).To4(), OptServerID: net.IPv4(10, 0, 0, 253).To4()}))
+		if resp != nil {
+			t.Fatalf("Request for another server answered: %+v", resp)
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		var unknown []Client
+		s.Unknown = func(c Client) { unknown = append(unknown, c) }
+		defer func() { s.Unknown = nil }()
+		if resp := s.Handle(request(Discover, "00:11:22:33:44:03", Options{OptClientArch: {0, 11}})); resp != nil {
+			t.Fatalf("Unknown hardware address answered: %+v", resp)
+		}
+		if len(unknown) != 1 || unknown[0].HWAddr.String() != "00:11:22:33:44:03" || !unknown[0].ClientArchSet || unknown[0].ClientArch != tftp.EFIARM64 {
+			t.Fatalf("Mismatch: %+v", unknown)
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		n := node.Node{ID: "n0001"}
+		if err := n.Read(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n.Netdevs = map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:03", IP: "10.0.0.3"},
+		}
+		if err := n.Update(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, ok := s.Lease("00:11:22:33:44:01"); ok {
+			t.Fatal("Lease of a removed netdev kept")
+		}
+		if lease, ok := s.Lease("00:11:22:33:44:03"); !ok || !lease.IP.Equal(net.IPv4(10, 0, 0, 3)) {
+			t.Fatalf("Mismatch: %+v", lease)
+		}
+		if arch, ok := s.ClientArch(net.IPv4(10, 0, 0, 1)); ok {
+			t.Fatalf("Client architecture of a dropped lease kept, %v", arch)
+		}
+	})
+
+	t.Run("ReloadArch", func(t *testing.T) {
+		n := node.Node{ID: "n0002"}
+		if err := n.Read(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n.Arch = "x86_64"
+		if err := n.Update(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		resp := s.Handle(request(Discover, "00:11:22:33:44:02", Options{OptVendorClass: []byte("PXEClient")}))
+		if resp == nil || resp.File != "undionly.kpxe" {
+			t.Fatalf("Mismatch: %+v", resp)
+		}
+	})
+}
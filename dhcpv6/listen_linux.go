@@ -0,0 +1,98 @@
+package dhcpv6
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// ListenAndServe answers requests received on port 547 of the interface named iface, or of all
+// interfaces when iface is empty, until ctx is done. The socket joins the AllServers group of
+// iface, or of the default interface when iface is empty.
+func (s *Server) ListenAndServe(ctx context.Context, iface string) error {
+	index, err := ifaceIndex(iface)
+	if err != nil {
+		return err
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+				if iface != "" {
+					if err = syscall.BindToDevice(int(fd), iface); err != nil {
+						return
+					}
+				}
+				err = joinGroup(int(fd), AllServers.As16(), index)
+			})
+			return err
+		},
+	}
+	conn, err := lc.ListenPacket(ctx, "udp6", ":"+strconv.Itoa(ServerPort))
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// allRouters is the multicast address router solicitations are sent to
+var allRouters = [16]byte{0: 0xff, 1: 0x02, 15: 0x02}
+
+// ListenAndServe sends router advertisements on the interface named iface, and answers router
+// solicitations received on it, until ctx is done
+func (a *Advertiser) ListenAndServe(ctx context.Context, iface string) error {
+	if iface == "" {
+		return fmt.Errorf("dhcpv6: router advertisements need an interface")
+	}
+	index, err := ifaceIndex(iface)
+	if err != nil {
+		return err
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				if err = syscall.BindToDevice(int(fd), iface); err != nil {
+					return
+				}
+				// Hosts discard neighbor discovery messages with another hop limit
+				if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+					return
+				}
+				if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, 255); err != nil {
+					return
+				}
+				err = joinGroup(int(fd), allRouters, index)
+			})
+			return err
+		},
+	}
+	conn, err := lc.ListenPacket(ctx, "ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	return a.Serve(ctx, conn, iface)
+}
+
+// ifaceIndex returns the index of the interface named iface, or 0 when iface is empty
+func ifaceIndex(iface string) (int, error) {
+	if iface == "" {
+		return 0, nil
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return 0, err
+	}
+	return ifi.Index, nil
+}
+
+// joinGroup joins the socket fd to multicast group on the interface with index
+func joinGroup(fd int, group [16]byte, index int) error {
+	mreq := &syscall.IPv6Mreq{Multiaddr: group, Interface: uint32(index)}
+	return syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+}
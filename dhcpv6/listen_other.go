@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package dhcpv6
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// ListenAndServe is only supported on Linux
+func (s *Server) ListenAndServe(ctx context.Context, iface string) error {
+	return fmt.Errorf("dhcpv6: serving is not supported on %s", runtime.GOOS)
+}
+
+// ListenAndServe is only supported on Linux
+func (a *Advertiser) ListenAndServe(ctx context.Context, iface string) error {
+	return fmt.Errorf("dhcpv6: serving is not supported on %s", runtime.GOOS)
+}
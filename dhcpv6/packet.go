@@ -0,0 +1,307 @@
+package dhcpv6
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Message types of RFC 8415
+const (
+	Solicit            = 1
+	Advertise          = 2
+	Request            = 3
+	Confirm            = 4
+	Renew              = 5
+	Rebind             = 6
+	Reply              = 7
+	Release            = 8
+	Decline            = 9
+	InformationRequest = 11
+	RelayForw          = 12
+	RelayRepl          = 13
+)
+
+// Options used by the server
+const (
+	OptClientID            = 1
+	OptServerID            = 2
+	OptIANA                = 3
+	OptIAAddr              = 5
+	OptORO                 = 6
+	OptPreference          = 7
+	OptElapsedTime         = 8
+	OptRelayMsg            = 9
+	OptStatusCode          = 13
+	OptRapidCommit         = 14
+	OptUserClass           = 15
+	OptVendorClass         = 16
+	OptInterfaceID         = 18
+	OptDNSServers          = 23
+	OptDomainList          = 24
+	OptBootFileURL         = 59
+	OptClientArchType      = 61
+	OptClientLinkLayerAddr = 79
+)
+
+// Status codes of OptStatusCode
+const (
+	StatusSuccess      = 0
+	StatusNoAddrsAvail = 2
+	StatusNoBinding    = 3
+	StatusNotOnLink    = 4
+)
+
+const (
+	headerLen      = 4
+	relayHeaderLen = 34
+)
+
+// Message is a DHCPv6 message of RFC 8415, either a client/server message or, when Type is
+// RelayForw or RelayRepl, a relay agent message
+type Message struct {
+	Type          byte
+	TransactionID [3]byte
+
+	// Relay agent messages only
+	HopCount byte
+	LinkAddr netip.Addr
+	PeerAddr netip.Addr
+
+	Options Options
+}
+
+// Option is a DHCPv6 option. Options may repeat, e.g. one OptIANA per identity association.
+type Option struct {
+	Code uint16
+	Data []byte
+}
+
+// Options holds the options of a Message in order
+type Options []Option
+
+// Parse decodes a DHCPv6 message
+func Parse(b []byte) (*Message, error) {
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("short message, %d bytes", len(b))
+	}
+	m := &Message{Type: b[0]}
+	opts := b[headerLen:]
+	if m.Type == RelayForw || m.Type == RelayRepl {
+		if len(b) < relayHeaderLen {
+			return nil, fmt.Errorf("short relay message, %d bytes", len(b))
+		}
+		m.HopCount = b[1]
+		m.LinkAddr, _ = netip.AddrFromSlice(b[2:18])
+		m.PeerAddr, _ = netip.AddrFromSlice(b[18:34])
+		opts = b[relayHeaderLen:]
+	} else {
+		copy(m.TransactionID[:], b[1:4])
+	}
+	var err error
+	if m.Options, err = parseOptions(opts); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseOptions(b []byte) (Options, error) {
+	var opts Options
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated option header")
+		}
+		code, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		opts = append(opts, Option{Code: code, Data: append([]byte(nil), b[4:4+n]...)})
+		b = b[4+n:]
+	}
+	return opts, nil
+}
+
+// Marshal encodes m
+func (m *Message) Marshal() []byte {
+	var b []byte
+	if m.Type == RelayForw || m.Type == RelayRepl {
+		b = make([]byte, relayHeaderLen)
+		b[0], b[1] = m.Type, m.HopCount
+		if m.LinkAddr.IsValid() {
+			copy(b[2:18], m.LinkAddr.AsSlice())
+		}
+		if m.PeerAddr.IsValid() {
+			copy(b[18:34], m.PeerAddr.AsSlice())
+		}
+	} else {
+		b = []byte{m.Type, m.TransactionID[0], m.TransactionID[1], m.TransactionID[2]}
+	}
+	return m.Options.append(b)
+}
+
+func (o Options) append(b []byte) []byte {
+	for _, opt := range o {
+		b = binary.BigEndian.AppendUint16(b, opt.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	return b
+}
+
+// Get returns the data of the first option code
+func (o Options) Get(code uint16) ([]byte, bool) {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt.Data, true
+		}
+	}
+	return nil, false
+}
+
+// All returns the data of every option code
+func (o Options) All(code uint16) [][]byte {
+	var all [][]byte
+	for _, opt := range o {
+		if opt.Code == code {
+			all = append(all, opt.Data)
+		}
+	}
+	return all
+}
+
+// Add appends option code with data
+func (o *Options) Add(code uint16, data []byte) {
+	*o = append(*o, Option{Code: code, Data: data})
+}
+
+// Uint16 returns the first 16-bit value carried by option code
+func (o Options) Uint16(code uint16) (uint16, bool) {
+	if v, ok := o.Get(code); ok && len(v) >= 2 {
+		return binary.BigEndian.Uint16(v), true
+	}
+	return 0, false
+}
+
+// Requested returns true if the client asked for option code in its option request option
+func (o Options) Requested(code uint16) bool {
+	oro, _ := o.Get(OptORO)
+	for i := 0; i+1 < len(oro); i += 2 {
+		if binary.BigEndian.Uint16(oro[i:]) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// DUIDLL returns the DUID based on link-layer address of RFC 8415 section 11.4 for an Ethernet
+// hardware address, which suits a server identifier
+func DUIDLL(hwaddr net.HardwareAddr) []byte {
+	duid := []byte{0, 3, 0, 1}
+	return append(duid, hwaddr...)
+}
+
+// duidHWAddr returns the Ethernet hardware address of a DUID-LLT or DUID-LL, or nil for other
+// DUIDs
+func duidHWAddr(duid []byte) net.HardwareAddr {
+	if len(duid) < 4 || binary.BigEndian.Uint16(duid[2:]) != 1 {
+		return nil
+	}
+	switch binary.BigEndian.Uint16(duid) {
+	case 1:
+		if len(duid) == 14 {
+			return net.HardwareAddr(duid[8:14])
+		}
+	case 3:
+		if len(duid) == 10 {
+			return net.HardwareAddr(duid[4:10])
+		}
+	}
+	return nil
+}
+
+// eui64HWAddr returns the hardware address a link-local address was derived from by modified
+// EUI-64, or nil if ip was not derived so
+func eui64HWAddr(ip netip.Addr) net.HardwareAddr {
+	if !ip.Is6() || !ip.IsLinkLocalUnicast() {
+		return nil
+	}
+	b := ip.As16()
+	if b[11] != 0xff || b[12] != 0xfe {
+		return nil
+	}
+	return net.HardwareAddr{b[8] ^ 0x02, b[9], b[10], b[13], b[14], b[15]}
+}
+
+// iaNA is an identity association for non-temporary addresses of an OptIANA
+type iaNA struct {
+	IAID    uint32
+	T1, T2  uint32
+	Options Options
+}
+
+func parseIANA(b []byte) (*iaNA, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("short IA_NA option")
+	}
+	opts, err := parseOptions(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	return &iaNA{
+		IAID:    binary.BigEndian.Uint32(b),
+		T1:      binary.BigEndian.Uint32(b[4:]),
+		T2:      binary.BigEndian.Uint32(b[8:]),
+		Options: opts,
+	}, nil
+}
+
+func (ia *iaNA) marshal() []byte {
+	b := binary.BigEndian.AppendUint32(nil, ia.IAID)
+	b = binary.BigEndian.AppendUint32(b, ia.T1)
+	b = binary.BigEndian.AppendUint32(b, ia.T2)
+	return ia.Options.append(b)
+}
+
+// iaAddr encodes an OptIAAddr
+func iaAddr(addr netip.Addr, preferred, valid uint32) []byte {
+	b := addr.AsSlice()
+	b = binary.BigEndian.AppendUint32(b, preferred)
+	return binary.BigEndian.AppendUint32(b, valid)
+}
+
+// statusCode encodes an OptStatusCode
+func statusCode(code uint16, message string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), message...)
+}
+
+// domainList encodes domain names in the DNS wire format of RFC 1035 section 3.1
+func domainList(domains ...string) []byte {
+	var b []byte
+	for _, domain := range domains {
+		for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+			if label == "" || len(label) > 63 {
+				continue
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	return b
+}
+
+// userClasses decodes the user class data of an OptUserClass
+func userClasses(b []byte) []string {
+	var classes []string
+	for len(b) >= 2 {
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			break
+		}
+		classes = append(classes, string(b[2:2+n]))
+		b = b[2+n:]
+	}
+	return classes
+}
@@ -0,0 +1,217 @@
+package dhcpv6
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+)
+
+// ICMPv6 types of RFC 4861
+const (
+	icmpRouterSolicitation  = 133
+	icmpRouterAdvertisement = 134
+)
+
+// AllNodes is the multicast address of all nodes on a link, which router advertisements are sent
+// to
+var AllNodes = netip.MustParseAddr("ff02::1")
+
+// DefaultInterval is the interval between unsolicited router advertisements when
+// Advertiser.Interval is zero
+const DefaultInterval = 200 * time.Second
+
+// Prefix is a prefix announced in router advertisements
+type Prefix struct {
+	Prefix     netip.Prefix
+	Autonomous bool // Hosts autoconfigure addresses in the prefix, for netdevs in node.IPv6SLAAC mode
+}
+
+// Advertiser sends router advertisements announcing the IPv6 prefixes of the netdevs in
+// node.IPv6SLAAC and node.IPv6DHCP mode of the nodes in a Projection. The managed flag is set when
+// a netdev is in node.IPv6DHCP mode, so that hosts ask the Server for their address. Its prefixes
+// are rebuilt whenever the Projection applies NodeNetdevsSet or NodeDeleted events, or events
+// changing the profiles nodes inherit their Netdevs from.
+type Advertiser struct {
+	HWAddr         net.HardwareAddr // Sent as source link-layer address, when set
+	Interval       time.Duration
+	RouterLifetime time.Duration // Zero unless the host is a default router of the link, see RFC 4861 section 4.2
+	Lifetime       time.Duration // Valid and preferred lifetime of the prefixes, DefaultLeaseTime when zero
+
+	nodes    *projection.Projection
+	mux      sync.RWMutex
+	prefixes []Prefix
+	managed  bool
+}
+
+// NewAdvertiser returns an Advertiser announcing the prefixes of the nodes in p
+func NewAdvertiser(p *projection.Projection) *Advertiser {
+	a := &Advertiser{nodes: p}
+	a.Reload()
+	p.Subscribe(a.onEvents)
+	return a
+}
+
+// onEvents reloads the prefixes when events changing the Netdevs of nodes were applied
+func (a *Advertiser) onEvents(events []eventsource.Event) {
+	for _, event := range events {
+		switch event.(type) {
+		case *node.NodeNetdevsSet, *node.NodeDeleted,
+			*node.NodeProfilesSet, *node.ProfileUpdated, *node.ProfileDeleted:
+			a.Reload()
+			return
+		}
+	}
+}
+
+// Reload rebuilds the prefixes from the nodes of the Projection
+func (a *Advertiser) Reload() {
+	autonomous := map[netip.Prefix]bool{}
+	managed := false
+	for _, n := range a.nodes.Nodes() {
+		for key, netdev := range n.Netdevs {
+			if netdev == nil || netdev.IPv6Mode == node.IPv6Static {
+				continue
+			}
+			managed = managed || netdev.IPv6Mode == node.IPv6DHCP
+			for _, prefix := range ipv6Prefixes(key, netdev) {
+				autonomous[prefix] = autonomous[prefix] || netdev.IPv6Mode == node.IPv6SLAAC
+			}
+		}
+	}
+	prefixes := make([]Prefix, 0, len(autonomous))
+	for prefix, auto := range autonomous {
+		prefixes = append(prefixes, Prefix{Prefix: prefix, Autonomous: auto})
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Prefix.Addr().Less(prefixes[j].Prefix.Addr()) })
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.prefixes, a.managed = prefixes, managed
+}
+
+// ipv6Prefixes returns the IPv6 prefixes of the netdev keyed by key: key itself when it is an IPv6
+// subnet, and those of its IPv6 addresses. Link-local prefixes are left out.
+func ipv6Prefixes(key string, netdev *node.Netdev) []netip.Prefix {
+	var prefixes []netip.Prefix
+	if prefix, err := netip.ParsePrefix(key); err == nil && prefix.Addr().Is6() {
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	addrs, _ := netdev.Prefixes(key)
+	for _, addr := range addrs {
+		if addr.Addr().Is6() && !addr.Addr().Is4In6() && !addr.Addr().IsLinkLocalUnicast() {
+			prefixes = append(prefixes, addr.Masked())
+		}
+	}
+	return prefixes
+}
+
+// Prefixes returns the announced prefixes, and whether the managed flag is set
+func (a *Advertiser) Prefixes() ([]Prefix, bool) {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	return append([]Prefix(nil), a.prefixes...), a.managed
+}
+
+// Message returns the ICMPv6 router advertisement, without checksum, which the kernel fills in
+func (a *Advertiser) Message() []byte {
+	prefixes, managed := a.Prefixes()
+	lifetime := a.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultLeaseTime
+	}
+
+	b := make([]byte, 16)
+	b[0] = icmpRouterAdvertisement
+	b[4] = 64 // Current hop limit
+	if managed {
+		// Managed and other configuration flags
+		b[5] = 0xc0
+	}
+	binary.BigEndian.PutUint16(b[6:], uint16(a.RouterLifetime/time.Second))
+	if len(a.HWAddr) == 6 {
+		b = append(b, 1, 1)
+		b = append(b, a.HWAddr...)
+	}
+	for _, p := range prefixes {
+		opt := make([]byte, 32)
+		opt[0], opt[1] = 3, 4
+		opt[2] = byte(p.Prefix.Bits())
+		opt[3] = 0x80 // On-link
+		if p.Autonomous {
+			opt[3] |= 0x40
+		}
+		binary.BigEndian.PutUint32(opt[4:], uint32(lifetime/time.Second))
+		binary.BigEndian.PutUint32(opt[8:], uint32(lifetime/time.Second))
+		copy(opt[16:], p.Prefix.Addr().AsSlice())
+		b = append(b, opt...)
+	}
+	return b
+}
+
+// Serve sends router advertisements on conn, an ICMPv6 connection of the link's interface named
+// iface, every Interval and in answer to router solicitations, until ctx is done, then closes
+// conn. Nothing is sent while there is no prefix to announce.
+func (a *Advertiser) Serve(ctx context.Context, conn net.PacketConn, iface string) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	interval := a.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	allNodes := &net.IPAddr{IP: net.IP(AllNodes.AsSlice()), Zone: iface}
+	advertise := func() {
+		if prefixes, _ := a.Prefixes(); len(prefixes) == 0 {
+			return
+		}
+		if _, err := conn.WriteTo(a.Message(), allNodes); err != nil {
+			log.Printf("dhcpv6: router advertisement on %v: %v", iface, err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			advertise()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if n > 0 && buf[0] == icmpRouterSolicitation {
+			// Answered by multicast, which RFC 4861 section 6.2.6 allows and which reaches
+			// hosts that have no address yet
+			advertise()
+		}
+	}
+}
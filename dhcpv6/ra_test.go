@@ -0,0 +1,75 @@
+package dhcpv6
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+)
+
+func TestAdvertiser(t *testing.T) {
+	p, nodeRepo := newProjection(t, []node.Node{
+		{ID: "n0001", Netdevs: map[string]*node.Netdev{
+			"fd00:1::/64": {HWAddr: "00:11:22:33:44:01", IP: "fd00:1::1", IPv6Mode: node.IPv6DHCP},
+		}},
+		{ID: "n0002", Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:02", IP: "10.0.0.2", Addresses: []string{"fd00:2::2/64"}, IPv6Mode: node.IPv6SLAAC},
+		}},
+		{ID: "n0003", Netdevs: map[string]*node.Netdev{
+			"fd00:3::/64": {HWAddr: "00:11:22:33:44:03", IP: "fd00:3::3"},
+		}},
+	})
+	a := NewAdvertiser(p)
+	a.HWAddr, _ = net.ParseMAC("00:11:22:33:44:ff")
+	a.Lifetime = time.Hour
+
+	prefixes, managed := a.Prefixes()
+	if !managed || len(prefixes) != 2 {
+		t.Fatalf("Mismatch: %v %v", prefixes, managed)
+	}
+	if prefixes[0].Prefix.String() != "fd00:1::/64" || prefixes[0].Autonomous ||
+		prefixes[1].Prefix.String() != "fd00:2::/64" || !prefixes[1].Autonomous {
+		t.Fatalf("Mismatch: %v", prefixes)
+	}
+
+	m := a.Message()
+	if len(m) != 16+8+2*32 || m[0] != icmpRouterAdvertisement || m[5] != 0xc0 || binary.BigEndian.Uint16(m[6:]) != 0 {
+		t.Fatalf("Mismatch: %x", m)
+	}
+	if m[16] != 1 || m[17] != 1 || net.HardwareAddr(m[18:24]).String() != "00:11:22:33:44:ff" {
+		t.Fatalf("Mismatch: %x", m[16:24])
+	}
+	for i, prefix := range prefixes {
+		opt := m[24+32*i : 24+32*(i+1)]
+		flags := byte(0x80)
+		if prefix.Autonomous {
+			flags |= 0x40
+		}
+		if opt[0] != 3 || opt[1] != 4 || opt[2] != 64 || opt[3] != flags || binary.BigEndian.Uint32(opt[4:]) != 3600 ||
+			net.IP(opt[16:]).String() != prefix.Prefix.Addr().String() {
+			t.Fatalf("Mismatch: %x", opt)
+		}
+	}
+
+	// Dropping the only DHCPv6 netdev clears the managed flag
+	ctx := context.Background()
+	cmd := &node.SetNetdevs{CommandModel: eventsource.CommandModel{ID: "n0001"}, Netdevs: map[string]*node.Netdev{
+		"fd00:1::/64": {HWAddr: "00:11:22:33:44:01", IP: "fd00:1::1"},
+	}}
+	if _, err := nodeRepo.Apply(ctx, cmd); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if prefixes, managed := a.Prefixes(); managed || len(prefixes) != 1 {
+		t.Fatalf("Mismatch: %v %v", prefixes, managed)
+	}
+	if m := a.Message(); m[5] != 0 {
+		t.Fatalf("Mismatch: %x", m[5])
+	}
+}
@@ -0,0 +1,387 @@
+// Package dhcpv6 serves the IPv6 side of node netdevs: a DHCPv6 server leasing the IPv6 address
+// of netdevs in node.IPv6DHCP mode and directing network boot firmware to its bootloader, and a
+// router advertisement sender announcing the prefixes of netdevs in node.IPv6SLAAC and
+// node.IPv6DHCP mode.
+package dhcpv6
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	"github.com/bensallen/warewulf4/provision"
+	"github.com/bensallen/warewulf4/tftp"
+)
+
+// Ports of RFC 8415
+const (
+	ClientPort = 546
+	ServerPort = 547
+)
+
+// AllServers is the multicast address of DHCPv6 relay agents and servers on a link
+var AllServers = netip.MustParseAddr("ff02::1:2")
+
+// DefaultLeaseTime is the valid lifetime handed out when Server.LeaseTime is zero. Addresses are
+// fixed per node, so leases are long.
+const DefaultLeaseTime = 24 * time.Hour
+
+// Lease is the configuration handed to a hardware address
+type Lease struct {
+	Node   string // ID of the node
+	Arch   string // Arch of the node
+	HWAddr net.HardwareAddr
+	Addr   netip.Prefix // Leased address with the prefix length of its link
+	Domain string
+}
+
+// Server answers DHCPv6 requests from the hardware addresses of the netdevs in node.IPv6DHCP mode
+// of the nodes in a Projection. Clients are identified by the hardware address of their DUID, of
+// the client link-layer address option of a relay agent, or of the EUI-64 link-local address they
+// send from. Its leases are rebuilt whenever the Projection applies NodeNetdevsSet or NodeDeleted
+// events, or events changing the profiles nodes inherit their Netdevs from.
+type Server struct {
+	ServerID    []byte           // DUID of the server, see DUIDLL
+	IP          netip.Addr       // Address of the server, for TFTP boot file URLs
+	HTTPURL     string           // Base URL of the provisioning server; iPXE clients are sent their node's script
+	Bootloaders tftp.Bootloaders // Boot file by client architecture for network boot firmware
+	DNS         []netip.Addr     // Recursive name servers handed out, if any
+	LeaseTime   time.Duration
+
+	nodes  *projection.Projection
+	mux    sync.RWMutex
+	leases map[string]*Lease // By hardware address
+}
+
+// NewServer returns a Server identified by serverID handing out the IPv6 addresses of the nodes
+// in p
+func NewServer(p *projection.Projection, serverID []byte) *Server {
+	s := &Server{
+		ServerID:    serverID,
+		Bootloaders: tftp.DefaultBootloaders(),
+		nodes:       p,
+	}
+	s.Reload()
+	p.Subscribe(s.onEvents)
+	return s
+}
+
+// onEvents reloads the leases when events changing the Netdevs of nodes were applied
+func (s *Server) onEvents(events []eventsource.Event) {
+	for _, event := range events {
+		switch event.(type) {
+		case *node.NodeNetdevsSet, *node.NodeDeleted,
+			*node.NodeProfilesSet, *node.ProfileUpdated, *node.ProfileDeleted:
+			s.Reload()
+			return
+		}
+	}
+}
+
+// Reload rebuilds the leases from the nodes of the Projection. Netdevs are skipped unless they
+// have a hardware address and, themselves or the bond or bridge they are a member of, are in
+// node.IPv6DHCP mode with an IPv6 address. Hardware addresses used by several nodes are logged
+// and skipped.
+func (s *Server) Reload() {
+	leases := map[string]*Lease{}
+	conflicts := map[string]bool{}
+	for _, n := range s.nodes.Nodes() {
+		for key, netdev := range n.Netdevs {
+			if netdev == nil || netdev.HWAddr == "" {
+				continue
+			}
+			subnet, addressed, ok := node.Addressed(n.Netdevs, key)
+			if !ok || addressed.IPv6Mode != node.IPv6DHCP {
+				continue
+			}
+			lease, err := newLease(n, subnet, addressed, netdev.HWAddr)
+			if err != nil {
+				log.Printf("dhcpv6: node %v: %v", n.ID, err)
+				continue
+			}
+			hwaddr := lease.HWAddr.String()
+			if other, ok := leases[hwaddr]; ok && other.Node == n.ID && other.Addr == lease.Addr {
+				continue
+			}
+			if other, ok := leases[hwaddr]; ok || conflicts[hwaddr] {
+				if ok {
+					log.Printf("dhcpv6: hardware address %v is used by nodes %v and %v, not answering it", hwaddr, other.Node, n.ID)
+				}
+				delete(leases, hwaddr)
+				conflicts[hwaddr] = true
+				continue
+			}
+			leases[hwaddr] = lease
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.leases = leases
+}
+
+// newLease returns the lease of hardware address mac, given the first IPv6 address of netdev on
+// subnet of node n
+func newLease(n node.Node, subnet string, netdev *node.Netdev, mac string) (*Lease, error) {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil || len(hwaddr) != 6 {
+		return nil, fmt.Errorf("netdev on %v has invalid hardware address, %v", subnet, mac)
+	}
+	prefixes, err := netdev.Prefixes(subnet)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is6() && !prefix.Addr().Is4In6() {
+			return &Lease{Node: n.ID, Arch: n.Arch, HWAddr: hwaddr, Addr: prefix, Domain: netdev.Domain}, nil
+		}
+	}
+	return nil, fmt.Errorf("netdev on %v is in mode %v but has no IPv6 address", subnet, node.IPv6DHCP)
+}
+
+// Lease returns the lease of hwaddr
+func (s *Server) Lease(hwaddr string) (*Lease, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	lease, ok := s.leases[strings.ToLower(hwaddr)]
+	return lease, ok
+}
+
+// Handle returns the reply to req received from src, or nil if req is not answered. Relay-forward
+// messages are answered with a relay-reply to the relay agent.
+func (s *Server) Handle(req *Message, src netip.Addr) *Message {
+	if req.Type == RelayForw {
+		inner, ok := req.Options.Get(OptRelayMsg)
+		if !ok {
+			return nil
+		}
+		msg, err := Parse(inner)
+		if err != nil || msg.Type == RelayForw {
+			// Nested relays are not supported
+			return nil
+		}
+		var hwaddr net.HardwareAddr
+		if lla, ok := req.Options.Get(OptClientLinkLayerAddr); ok && len(lla) == 8 && lla[0] == 0 && lla[1] == 1 {
+			hwaddr = net.HardwareAddr(lla[2:])
+		}
+		resp := s.handle(msg, hwaddr, req.PeerAddr)
+		if resp == nil {
+			return nil
+		}
+		relay := &Message{Type: RelayRepl, HopCount: req.HopCount, LinkAddr: req.LinkAddr, PeerAddr: req.PeerAddr}
+		if id, ok := req.Options.Get(OptInterfaceID); ok {
+			relay.Options.Add(OptInterfaceID, id)
+		}
+		relay.Options.Add(OptRelayMsg, resp.Marshal())
+		return relay
+	}
+	return s.handle(req, nil, src)
+}
+
+// handle answers a client message from peer; hwaddr is the client's hardware address when a relay
+// agent told it
+func (s *Server) handle(req *Message, hwaddr net.HardwareAddr, peer netip.Addr) *Message {
+	clientID, ok := req.Options.Get(OptClientID)
+	if !ok {
+		return nil
+	}
+	if serverID, ok := req.Options.Get(OptServerID); ok && string(serverID) != string(s.ServerID) {
+		// The client chose another server, or this is not meant for us
+		return nil
+	}
+	if _, ok := req.Options.Get(OptServerID); !ok && (req.Type == Request || req.Type == Renew || req.Type == Release || req.Type == Decline) {
+		return nil
+	}
+	if hwaddr == nil {
+		hwaddr = duidHWAddr(clientID)
+	}
+	lease, ok := s.lookup(hwaddr, peer)
+	if !ok {
+		return nil
+	}
+
+	resp := &Message{Type: Reply, TransactionID: req.TransactionID}
+	resp.Options.Add(OptClientID, clientID)
+	resp.Options.Add(OptServerID, s.ServerID)
+
+	switch req.Type {
+	case Solicit:
+		if _, ok := req.Options.Get(OptRapidCommit); ok {
+			resp.Options.Add(OptRapidCommit, nil)
+		} else {
+			resp.Type = Advertise
+			// The highest preference makes clients request at once
+			resp.Options.Add(OptPreference, []byte{255})
+		}
+		s.addIAs(req, resp, lease)
+
+	case Request, Renew, Rebind:
+		s.addIAs(req, resp, lease)
+		log.Printf("dhcpv6: %v (node %v) leased %v", lease.HWAddr, lease.Node, lease.Addr.Addr())
+
+	case Confirm:
+		status := uint16(StatusSuccess)
+		for _, ia := range iaNAs(req) {
+			for _, a := range ia.Options.All(OptIAAddr) {
+				if addr, ok := netip.AddrFromSlice(a[:min(len(a), 16)]); !ok || !lease.Addr.Masked().Contains(addr) {
+					status = StatusNotOnLink
+				}
+			}
+		}
+		resp.Options.Add(OptStatusCode, statusCode(status, ""))
+		return resp
+
+	case Release:
+		resp.Options.Add(OptStatusCode, statusCode(StatusSuccess, ""))
+		return resp
+
+	case Decline:
+		log.Printf("dhcpv6: %v (node %v) declined %v, it may be in use by another host", lease.HWAddr, lease.Node, lease.Addr.Addr())
+		resp.Options.Add(OptStatusCode, statusCode(StatusSuccess, ""))
+		return resp
+
+	case InformationRequest:
+
+	default:
+		return nil
+	}
+
+	if len(s.DNS) > 0 {
+		var dns []byte
+		for _, addr := range s.DNS {
+			dns = append(dns, addr.AsSlice()...)
+		}
+		resp.Options.Add(OptDNSServers, dns)
+	}
+	if lease.Domain != "" {
+		resp.Options.Add(OptDomainList, domainList(lease.Domain))
+	}
+	if url := s.bootFileURL(req, lease); url != "" {
+		resp.Options.Add(OptBootFileURL, []byte(url))
+	}
+	return resp
+}
+
+// lookup returns the lease of hwaddr, or, when it is nil or has none, of the hardware address
+// the link-local address peer was derived from
+func (s *Server) lookup(hwaddr net.HardwareAddr, peer netip.Addr) (*Lease, bool) {
+	if hwaddr != nil {
+		if lease, ok := s.Lease(hwaddr.String()); ok {
+			return lease, true
+		}
+	}
+	if mac := eui64HWAddr(peer); mac != nil {
+		return s.Lease(mac.String())
+	}
+	return nil, false
+}
+
+// addIAs adds to resp an OptIANA with the leased address for each OptIANA of req, and a status of
+// StatusNoAddrsAvail if req has none
+func (s *Server) addIAs(req, resp *Message, lease *Lease) {
+	valid := s.LeaseTime
+	if valid == 0 {
+		valid = DefaultLeaseTime
+	}
+	seconds := uint32(valid / time.Second)
+
+	ias := iaNAs(req)
+	if len(ias) == 0 {
+		resp.Options.Add(OptStatusCode, statusCode(StatusNoAddrsAvail, "only IA_NA is served"))
+		return
+	}
+	for _, ia := range ias {
+		reply := &iaNA{IAID: ia.IAID, T1: seconds / 2, T2: seconds / 5 * 4}
+		reply.Options.Add(OptIAAddr, iaAddr(lease.Addr.Addr(), seconds, seconds))
+		resp.Options.Add(OptIANA, reply.marshal())
+	}
+}
+
+// iaNAs returns the valid OptIANA of m
+func iaNAs(m *Message) []*iaNA {
+	var ias []*iaNA
+	for _, b := range m.Options.All(OptIANA) {
+		if ia, err := parseIANA(b); err == nil {
+			ias = append(ias, ia)
+		}
+	}
+	return ias
+}
+
+// bootFileURL returns the URL of the file the client of req boots: the URL of its node's iPXE
+// script for iPXE, or the TFTP URL of the bootloader of its architecture for network boot firmware
+func (s *Server) bootFileURL(req *Message, lease *Lease) string {
+	if uc, ok := req.Options.Get(OptUserClass); ok {
+		for _, class := range userClasses(uc) {
+			if class == "iPXE" {
+				if s.HTTPURL == "" {
+					return ""
+				}
+				return strings.TrimRight(s.HTTPURL, "/") + provision.HWAddrPath(lease.HWAddr.String(), provision.FileIPXE)
+			}
+		}
+	}
+	arch, ok := req.Options.Uint16(OptClientArchType)
+	if !ok && !req.Options.Requested(OptBootFileURL) {
+		return ""
+	}
+	clientArch := tftp.NodeClientArch(lease.Arch)
+	if ok {
+		clientArch = tftp.ClientArch(arch)
+	}
+	file := s.Bootloaders[clientArch]
+	if file == "" || !s.IP.IsValid() {
+		return ""
+	}
+	return "tftp://[" + s.IP.String() + "]/" + file
+}
+
+// Serve answers the requests received on conn until ctx is done, then closes conn. Replies are
+// sent to the address and port the request came from.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		req, err := Parse(buf[:n])
+		if err != nil {
+			log.Printf("dhcpv6: %v: %v", addr, err)
+			continue
+		}
+		var src netip.Addr
+		if udp, ok := addr.(*net.UDPAddr); ok {
+			src = udp.AddrPort().Addr()
+		}
+		resp := s.Handle(req, src)
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp.Marshal(), addr); err != nil {
+			log.Printf("dhcpv6: reply to %v: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package dhcpv6
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	"github.com/bensallen/warewulf4/provision"
+)
+
+func request(t byte, hwaddr string, options ...Option) *Message {
+	mac, _ := net.ParseMAC(hwaddr)
+	m := &Message{Type: t, TransactionID: [3]byte{1, 2, 3}}
+	m.Options.Add(OptClientID, DUIDLL(mac))
+	m.Options = append(m.Options, options...)
+	// Round trip through the wire format, as Serve does
+	parsed, err := Parse(m.Marshal())
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func iaNAOption(iaid uint32) Option {
+	return Option{Code: OptIANA, Data: (&iaNA{IAID: iaid}).marshal()}
+}
+
+// leased returns the addresses of the OptIANA of m
+func leased(m *Message) []string {
+	var addrs []string
+	for _, ia := range iaNAs(m) {
+		for _, a := range ia.Options.All(OptIAAddr) {
+			addr, _ := netip.AddrFromSlice(a[:16])
+			addrs = append(addrs, addr.String())
+		}
+	}
+	return addrs
+}
+
+func status(m *Message) (uint16, bool) {
+	return m.Options.Uint16(OptStatusCode)
+}
+
+func newProjection(t *testing.T, nodes []node.Node) (*projection.Projection, *eventsource.Repository) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := context.Background()
+	for _, n := range nodes {
+		if err := n.Create(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	p, err := projection.New(ctx, store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return p, nodeRepo
+}
+
+func TestServer(t *testing.T) {
+	p, nodeRepo := newProjection(t, []node.Node{
+		{ID: "n0001", Arch: "x86_64", Netdevs: map[string]*node.Netdev{
+			"fd00:1::/64": {HWAddr: "00:11:22:33:44:01", IP: "fd00:1::1", IPv6Mode: node.IPv6DHCP, Domain: "cluster"},
+		}},
+		{ID: "n0002", Arch: "aarch64", Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:02", IP: "10.0.0.2", Addresses: []string{"fd00:1::2/64"}, IPv6Mode: node.IPv6DHCP},
+		}},
+		{ID: "n0003", Arch: "x86_64", Netdevs: map[string]*node.Netdev{
+			"fd00:1::/64": {HWAddr: "00:11:22:33:44:03", IP: "fd00:1::3"},
+		}},
+	})
+	serverMAC, _ := net.ParseMAC("00:11:22:33:44:ff")
+	s := NewServer(p, DUIDLL(serverMAC))
+	s.IP = netip.MustParseAddr("fd00:1::ff")
+	s.HTTPURL = "http://[fd00:1::ff]:9873/"
+	s.DNS = []netip.Addr{netip.MustParseAddr("fd00:1::53")}
+	linkLocal := netip.MustParseAddr("fe80::1")
+
+	t.Run("Solicit", func(t *testing.T) {
+		resp := s.Handle(request(Solicit, "00:11:22:33:44:01", iaNAOption(7), Option{Code: OptClientArchType, Data: []byte{0, 7}}), linkLocal)
+		if resp == nil || resp.Type != Advertise || resp.TransactionID != [3]byte{1, 2, 3} {
+			t.Fatalf("Expected an advertise, got %+v", resp)
+		}
+		if addrs := leased(resp); len(addrs) != 1 || addrs[0] != "fd00:1::1" {
+			t.Fatalf("Mismatch: %v", addrs)
+		}
+		if ias := iaNAs(resp); ias[0].IAID != 7 || ias[0].T1 != 43200 || ias[0].T2 != 69120 {
+			t.Fatalf("Mismatch: %+v", ias[0])
+		}
+		if id, _ := resp.Options.Get(OptServerID); string(id) != string(s.ServerID) {
+			t.Fatalf("Mismatch: %x", id)
+		}
+		if pref, _ := resp.Options.Get(OptPreference); len(pref) != 1 || pref[0] != 255 {
+			t.Fatalf("Mismatch: %v", pref)
+		}
+		if url, _ := resp.Options.Get(OptBootFileURL); string(url) != "tftp://[fd00:1::ff]/ipxe.efi" {
+			t.Fatalf("Mismatch: %s", url)
+		}
+		if dns, _ := resp.Options.Get(OptDNSServers); len(dns) != 16 {
+			t.Fatalf("Mismatch: %x", dns)
+		}
+		if domains, _ := resp.Options.Get(OptDomainList); string(domains) != "\x07cluster\x00" {
+			t.Fatalf("Mismatch: %q", domains)
+		}
+	})
+
+	t.Run("RapidCommit", func(t *testing.T) {
+		resp := s.Handle(request(Solicit, "00:11:22:33:44:02", iaNAOption(1), Option{Code: OptRapidCommit}), linkLocal)
+		if resp == nil || resp.Type != Reply {
+			t.Fatalf("Expected a reply, got %+v", resp)
+		}
+		if addrs := leased(resp); len(addrs) != 1 || addrs[0] != "fd00:1::2" {
+			t.Fatalf("Mismatch: %v", addrs)
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		serverID := Option{Code: OptServerID, Data: s.ServerID}
+		resp := s.Handle(request(Request, "00:11:22:33:44:01", serverID, iaNAOption(7)), linkLocal)
+		if resp == nil || resp.Type != Reply {
+			t.Fatalf("Expected a reply, got %+v", resp)
+		}
+		if addrs := leased(resp); len(addrs) != 1 || addrs[0] != "fd00:1::1" {
+			t.Fatalf("Mismatch: %v", addrs)
+		}
+		if resp := s.Handle(request(Request, "00:11:22:33:44:01", iaNAOption(7)), linkLocal); resp != nil {
+			t.Fatalf("Should have ignored a request without server ID, got %+v", resp)
+		}
+		other := Option{Code: OptServerID, Data: DUIDLL(net.HardwareAddr{0, 1, 2, 3, 4, 5})}
+		if resp := s.Handle(request(Request, "00:11:22:33:44:01", other, iaNAOption(7)), linkLocal); resp != nil {
+			t.Fatalf("Should have ignored a request to another server, got %+v", resp)
+		}
+		resp = s.Handle(request(Renew, "00:11:22:33:44:01", serverID), linkLocal)
+		if code, ok := status(resp); !ok || code != StatusNoAddrsAvail {
+			t.Fatalf("Mismatch: %v %v", code, ok)
+		}
+	})
+
+	t.Run("Confirm", func(t *testing.T) {
+		confirm := func(addr string) *Message {
+			ia := &iaNA{IAID: 7}
+			ia.Options.Add(OptIAAddr, iaAddr(netip.MustParseAddr(addr), 0, 0))
+			return request(Confirm, "00:11:22:33:44:01", Option{Code: OptIANA, Data: ia.marshal()})
+		}
+		if code, ok := status(s.Handle(confirm("fd00:1::1"), linkLocal)); !ok || code != StatusSuccess {
+			t.Fatalf("Mismatch: %v %v", code, ok)
+		}
+		if code, ok := status(s.Handle(confirm("fd00:2::1"), linkLocal)); !ok || code != StatusNotOnLink {
+			t.Fatalf("Mismatch: %v %v", code, ok)
+		}
+	})
+
+	t.Run("IPXE", func(t *testing.T) {
+		userClass := binary.BigEndian.AppendUint16(nil, 4)
+		userClass = append(userClass, "iPXE"...)
+		resp := s.Handle(request(Solicit, "00:11:22:33:44:01", iaNAOption(7), Option{Code: OptUserClass, Data: userClass}), linkLocal)
+		url, _ := resp.Options.Get(OptBootFileURL)
+		if string(url) != "http://[fd00:1::ff]:9873"+provision.HWAddrPath("00:11:22:33:44:01", provision.FileIPXE) {
+			t.Fatalf("Mismatch: %s", url)
+		}
+	})
+
+	t.Run("EUI64", func(t *testing.T) {
+		// A DUID-UUID gives no hardware address, the link-local address does
+		m := &Message{Type: Solicit}
+		m.Options.Add(OptClientID, append([]byte{0, 4}, make([]byte, 16)...))
+		m.Options = append(m.Options, iaNAOption(1))
+		resp := s.Handle(m, netip.MustParseAddr("fe80::211:22ff:fe33:4401"))
+		if addrs := leased(resp); len(addrs) != 1 || addrs[0] != "fd00:1::1" {
+			t.Fatalf("Mismatch: %v", addrs)
+		}
+		if resp := s.Handle(m, linkLocal); resp != nil {
+			t.Fatalf("Should have ignored an unknown client, got %+v", resp)
+		}
+	})
+
+	t.Run("Relay", func(t *testing.T) {
+		m := &Message{Type: Solicit}
+		m.Options.Add(OptClientID, append([]byte{0, 4}, make([]byte, 16)...))
+		m.Options = append(m.Options, iaNAOption(1))
+		relay := &Message{Type: RelayForw, HopCount: 1, LinkAddr: netip.MustParseAddr("fd00:1::fe"), PeerAddr: linkLocal}
+		relay.Options.Add(OptInterfaceID, []byte("port1"))
+		relay.Options.Add(OptClientLinkLayerAddr, []byte{0, 1, 0x00, 0x11, 0x22, 0x33, 0x44, 0x02})
+		relay.Options.Add(OptRelayMsg, m.Marshal())
+		req, err := Parse(relay.Marshal())
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		resp := s.Handle(req, netip.MustParseAddr("fd00:1::fe"))
+		if resp == nil || resp.Type != RelayRepl || resp.PeerAddr != linkLocal || resp.LinkAddr != relay.LinkAddr {
+			t.Fatalf("Expected a relay reply, got %+v", resp)
+		}
+		if id, _ := resp.Options.Get(OptInterfaceID); string(id) != "port1" {
+			t.Fatalf("Mismatch: %s", id)
+		}
+		inner, _ := resp.Options.Get(OptRelayMsg)
+		msg, err := Parse(inner)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if addrs := leased(msg); msg.Type != Advertise || len(addrs) != 1 || addrs[0] != "fd00:1::2" {
+			t.Fatalf("Mismatch: %v %v", msg.Type, addrs)
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		// n0003 is in static mode
+		for _, hwaddr := range []string{"00:11:22:33:44:03", "00:11:22:33:44:99"} {
+			if resp := s.Handle(request(Solicit, hwaddr, iaNAOption(1)), linkLocal); resp != nil {
+				t.Fatalf("Should have ignored %v, got %+v", hwaddr, resp)
+			}
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		ctx := context.Background()
+		n := node.Node{ID: "n0003"}
+		netdevs := map[string]*node.Netdev{
+			"fd00:1::/64": {HWAddr: "00:11:22:33:44:03", IP: "fd00:1::3", IPv6Mode: node.IPv6DHCP},
+		}
+		if _, err := nodeRepo.Apply(ctx, &node.SetNetdevs{CommandModel: eventsource.CommandModel{ID: n.ID}, Netdevs: netdevs}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if lease, ok := s.Lease("00:11:22:33:44:03"); !ok || lease.Addr.String() != "fd00:1::3/64" {
+			t.Fatalf("Mismatch: %+v", lease)
+		}
+	})
+}
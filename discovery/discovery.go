@@ -0,0 +1,262 @@
+package warewulf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+// Discovery represents a hardware address that asked to boot without belonging to any node. It is
+// Pending until an operator accepts it as a node or rejects it.
+type Discovery struct {
+	ID            string
+	Version       int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	State         string // Pending, Accepted or Rejected
+	HWAddr        string
+	ClientArch    uint16 // Client architecture of DHCP option 93, when ClientArchSet
+	ClientArchSet bool
+	VendorClass   string
+	Node          string // ID of the node created on acceptance
+}
+
+// ID returns the aggregate ID of the Discovery of hwaddr. Discoveries share the event store with
+// nodes, so their IDs are prefixed to stay apart from node IDs.
+func ID(hwaddr string) string {
+	return "discovery:" + strings.ToLower(hwaddr)
+}
+
+// Record records a request from d.HWAddr by applying a RecordDiscovery command against the
+// repository. Recording an address that is Pending with nothing new, or one that was Rejected,
+// does nothing.
+func (d *Discovery) Record(ctx context.Context, repo *eventsource.Repository) error {
+	hwaddr, err := net.ParseMAC(d.HWAddr)
+	if err != nil {
+		return fmt.Errorf("invalid hardware address, %v: %v", d.HWAddr, err)
+	}
+	d.ID = ID(hwaddr.String())
+
+	recordDiscovery := &RecordDiscovery{
+		CommandModel:  eventsource.CommandModel{ID: d.ID},
+		HWAddr:        hwaddr.String(),
+		ClientArch:    d.ClientArch,
+		ClientArchSet: d.ClientArchSet,
+		VendorClass:   d.VendorClass,
+	}
+	version, err := repo.Apply(ctx, recordDiscovery)
+	if err != nil {
+		return err
+	}
+	d.Version = version
+	return nil
+}
+
+// Read attempts to fetch the Discovery aggregate from the event repository. d.ID or d.HWAddr must
+// be specified.
+func (d *Discovery) Read(ctx context.Context, repo *eventsource.Repository) error {
+	if d.ID == "" && d.HWAddr != "" {
+		d.ID = ID(d.HWAddr)
+	}
+	if d.ID == "" {
+		return fmt.Errorf("ID of Discovery must be specified")
+	}
+
+	aggregate, err := repo.Load(ctx, d.ID)
+	if err != nil {
+		return err
+	}
+
+	discovery, ok := aggregate.(*Discovery)
+	if !ok {
+		return fmt.Errorf("ID returned an aggregate that is not a Discovery")
+	}
+
+	// Copy values of casted aggregate to *d
+	*d = *discovery
+
+	return nil
+}
+
+// Accept marks the Discovery as accepted as the node with ID nodeID, with d.Version as the
+// expected version. On success d.Version is set to the new version.
+func (d *Discovery) Accept(ctx context.Context, repo *eventsource.Repository, nodeID string) error {
+	if d.ID == "" {
+		return fmt.Errorf("ID of Discovery must be specified")
+	}
+	acceptDiscovery := &AcceptDiscovery{
+		CommandModel:    eventsource.CommandModel{ID: d.ID},
+		ExpectedVersion: d.Version,
+		Node:            nodeID,
+	}
+	version, err := repo.Apply(ctx, acceptDiscovery)
+	if err != nil {
+		return err
+	}
+	d.Version = version
+	return nil
+}
+
+// Reject marks the Discovery as rejected, with d.Version as the expected version. On success
+// d.Version is set to the new version.
+func (d *Discovery) Reject(ctx context.Context, repo *eventsource.Repository) error {
+	if d.ID == "" {
+		return fmt.Errorf("ID of Discovery must be specified")
+	}
+	rejectDiscovery := &RejectDiscovery{
+		CommandModel:    eventsource.CommandModel{ID: d.ID},
+		ExpectedVersion: d.Version,
+	}
+	version, err := repo.Apply(ctx, rejectDiscovery)
+	if err != nil {
+		return err
+	}
+	d.Version = version
+	return nil
+}
+
+// Events returns an instance of every event type of the Discovery aggregate, for binding to a
+// serializer
+func Events() []eventsource.Event {
+	return []eventsource.Event{
+		DiscoveryRecorded{},
+		DiscoveryAccepted{},
+		DiscoveryRejected{},
+	}
+}
+
+// DiscoveryRecorded represents the event of a request from an unknown hardware address
+type DiscoveryRecorded struct {
+	eventsource.Model
+	HWAddr        string
+	ClientArch    uint16
+	ClientArchSet bool
+	VendorClass   string
+}
+
+// DiscoveryAccepted represents the event of a discovered hardware address being made a node
+type DiscoveryAccepted struct {
+	eventsource.Model
+	Node string
+}
+
+// DiscoveryRejected represents the event of a discovered hardware address being ignored
+type DiscoveryRejected struct {
+	eventsource.Model
+}
+
+// On applies the event's changes to the Discovery object
+func (d *Discovery) On(event eventsource.Event) error {
+	switch e := event.(type) {
+	case *DiscoveryRecorded:
+		d.Version = e.Model.Version
+		d.ID = e.Model.ID
+		if d.State != "Pending" {
+			d.CreatedAt = e.At
+			d.Node = ""
+		}
+		d.UpdatedAt = e.At
+		d.State = "Pending"
+		d.HWAddr = e.HWAddr
+		if e.ClientArchSet {
+			d.ClientArch, d.ClientArchSet = e.ClientArch, true
+		}
+		if e.VendorClass != "" {
+			d.VendorClass = e.VendorClass
+		}
+
+	case *DiscoveryAccepted:
+		d.Version = e.Model.Version
+		d.UpdatedAt = e.At
+		d.State = "Accepted"
+		d.Node = e.Node
+
+	case *DiscoveryRejected:
+		d.Version = e.Model.Version
+		d.UpdatedAt = e.At
+		d.State = "Rejected"
+
+	default:
+		return fmt.Errorf("unhandled event, %v, type: %s", e, reflect.TypeOf(e))
+	}
+
+	return nil
+}
+
+// RecordDiscovery represents the command to record a request from an unknown hardware address
+type RecordDiscovery struct {
+	eventsource.CommandModel
+	HWAddr        string
+	ClientArch    uint16
+	ClientArchSet bool
+	VendorClass   string
+}
+
+// AcceptDiscovery represents the command to record that a discovered hardware address was made
+// the node Node
+type AcceptDiscovery struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the discovery is at this version
+	Node            string
+}
+
+// RejectDiscovery represents the command to ignore a discovered hardware address
+type RejectDiscovery struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the discovery is at this version
+}
+
+// Apply implements the CommandHandler interface for Discovery
+func (d *Discovery) Apply(ctx context.Context, command eventsource.Command) ([]eventsource.Event, error) {
+	model := eventsource.Model{ID: command.AggregateID(), Version: d.Version + 1, At: time.Now()}
+
+	switch c := command.(type) {
+	case *RecordDiscovery:
+		if d.State == "Rejected" {
+			return nil, nil
+		}
+		// A node retrying DHCP must not grow the event log, so repeated requests are only
+		// recorded when they tell something new
+		if d.State == "Pending" && (!c.ClientArchSet || d.ClientArchSet && d.ClientArch == c.ClientArch) &&
+			(c.VendorClass == "" || c.VendorClass == d.VendorClass) {
+			return nil, nil
+		}
+		return []eventsource.Event{&DiscoveryRecorded{
+			Model:         model,
+			HWAddr:        c.HWAddr,
+			ClientArch:    c.ClientArch,
+			ClientArchSet: c.ClientArchSet,
+			VendorClass:   c.VendorClass,
+		}}, nil
+
+	case *AcceptDiscovery:
+		if d.State != "Pending" {
+			return nil, fmt.Errorf("discovery, %v, is not pending", command.AggregateID())
+		}
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, d.Version); err != nil {
+			return nil, err
+		}
+		if c.Node == "" {
+			return nil, fmt.Errorf("node of accepted discovery, %v, must be specified", command.AggregateID())
+		}
+		return []eventsource.Event{&DiscoveryAccepted{Model: model, Node: c.Node}}, nil
+
+	case *RejectDiscovery:
+		if d.State != "Pending" {
+			return nil, fmt.Errorf("discovery, %v, is not pending", command.AggregateID())
+		}
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, d.Version); err != nil {
+			return nil, err
+		}
+		return []eventsource.Event{&DiscoveryRejected{Model: model}}, nil
+
+	default:
+		return nil, fmt.Errorf("unhandled command, %v", c)
+	}
+}
@@ -0,0 +1,74 @@
+package warewulf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+)
+
+func TestDiscovery(t *testing.T) {
+	repo := eventsource.New(&Discovery{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(Events()...)),
+	)
+	ctx := context.Background()
+
+	d := Discovery{HWAddr: "00:11:22:33:44:AA"}
+	if err := d.Record(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if d.ID != "discovery:00:11:22:33:44:aa" || d.Version != 1 {
+		t.Fatalf("Mismatch: %+v", d)
+	}
+
+	// Repeated requests are only recorded when they carry something new
+	for _, arch := range []uint16{0, 0, 11} {
+		r := Discovery{HWAddr: d.HWAddr, ClientArch: arch, ClientArchSet: arch != 0}
+		if err := r.Record(ctx, repo); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	if err := d.Read(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if d.Version != 2 || d.State != "Pending" || !d.ClientArchSet || d.ClientArch != 11 {
+		t.Fatalf("Mismatch: %+v", d)
+	}
+
+	stale := d
+	if err := d.Accept(ctx, repo, "n0001"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := stale.Reject(ctx, repo); err == nil {
+		t.Fatal("Accepted discovery rejected")
+	}
+	if err := d.Read(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if d.State != "Accepted" || d.Node != "n0001" {
+		t.Fatalf("Mismatch: %+v", d)
+	}
+
+	// The address showing up again, e.g. after its node was deleted, is pending anew
+	if err := (&Discovery{HWAddr: d.HWAddr}).Record(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := d.Read(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if d.State != "Pending" || d.Node != "" {
+		t.Fatalf("Mismatch: %+v", d)
+	}
+	if err := d.Reject(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := (&Discovery{HWAddr: d.HWAddr}).Record(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := d.Read(ctx, repo); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if d.State != "Rejected" {
+		t.Fatalf("Mismatch: %+v", d)
+	}
+}
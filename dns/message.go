@@ -0,0 +1,142 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Resource record types and class of RFC 1035 and RFC 3596
+const (
+	TypeA    = 1
+	TypeNS   = 2
+	TypeSOA  = 6
+	TypePTR  = 12
+	TypeAAAA = 28
+	TypeANY  = 255
+
+	ClassIN  = 1
+	ClassANY = 255
+)
+
+// Response codes
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeNameError      = 3 // NXDOMAIN
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+// Header flags
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+)
+
+const (
+	headerLen = 12
+
+	// maxUDPSize is the size of UDP messages without EDNS
+	maxUDPSize = 512
+	// maxTCPSize is the size of TCP messages, which are prefixed by a 16 bit length
+	maxTCPSize = 65535
+)
+
+// Question is the question of a query
+type Question struct {
+	Name  string // Lowercased, without the trailing dot
+	Type  uint16
+	Class uint16
+}
+
+// parseQuery returns the ID, flags and question of a query, and the end of the question.
+// Queries must hold exactly one question.
+func parseQuery(b []byte) (id, flags uint16, q Question, end int, err error) {
+	if len(b) < headerLen {
+		return 0, 0, q, 0, fmt.Errorf("short message, %d bytes", len(b))
+	}
+	id, flags = binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:])
+	if n := binary.BigEndian.Uint16(b[4:]); n != 1 {
+		return id, flags, q, 0, fmt.Errorf("%d questions", n)
+	}
+	q.Name, end, err = readName(b, headerLen)
+	if err != nil {
+		return id, flags, q, 0, err
+	}
+	if len(b) < end+4 {
+		return id, flags, q, 0, fmt.Errorf("truncated question")
+	}
+	q.Type, q.Class = binary.BigEndian.Uint16(b[end:]), binary.BigEndian.Uint16(b[end+2:])
+	return id, flags, q, end + 4, nil
+}
+
+// readName decodes the name at offset off of message b, following compression pointers, and
+// returns it lowercased and without the trailing dot, along with the offset following it
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, fmt.Errorf("truncated name")
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, fmt.Errorf("truncated name")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, fmt.Errorf("too many compression pointers")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, fmt.Errorf("invalid label type")
+		default:
+			if off+1+n > len(b) {
+				return "", 0, fmt.Errorf("truncated name")
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// appendName appends name, without the trailing dot, in the uncompressed wire format
+func appendName(b []byte, name string) []byte {
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// rr is a resource record of a response
+type rr struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// appendRR appends r of class IN
+func appendRR(b []byte, r rr) []byte {
+	b = appendName(b, r.Name)
+	b = binary.BigEndian.AppendUint16(b, r.Type)
+	b = binary.BigEndian.AppendUint16(b, ClassIN)
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+	return append(b, r.Data...)
+}
@@ -0,0 +1,200 @@
+// Package dns names the nodes of a Projection: it generates hosts files and the forward and
+// reverse zone files of BIND from their netdevs, and answers A, AAAA and PTR queries for them as
+// an authoritative name server.
+package dns
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+)
+
+// Record names an address of a node
+type Record struct {
+	Name   string       // Fully qualified, without the trailing dot, or the node ID when no domain applies
+	Node   string       // ID of the node
+	Prefix netip.Prefix // Address with the prefix length of its link
+}
+
+// Domain returns the domain the record is named in, or "" when it has none
+func (r Record) Domain() string {
+	if i := strings.IndexByte(r.Name, '.'); i >= 0 {
+		return r.Name[i+1:]
+	}
+	return ""
+}
+
+// Records returns the records of the nodes in p, sorted by name then address. Each address of
+// a netdev is named after its node in the domain of the netdev, or else of the Subnet aggregate
+// of its key, or else domain. Nodes whose ID is not a valid host name are logged and skipped.
+func Records(p *projection.Projection, domain string) []Record {
+	var records []Record
+	seen := map[Record]bool{}
+	for _, n := range p.Nodes() {
+		if !validLabel(n.ID) {
+			log.Printf("dns: node %v: ID is not a valid host name, not naming it", n.ID)
+			continue
+		}
+		for key, netdev := range n.Netdevs {
+			if netdev == nil {
+				continue
+			}
+			prefixes, err := netdev.Prefixes(key)
+			if err != nil {
+				log.Printf("dns: node %v: %v", n.ID, err)
+				continue
+			}
+			d := netdevDomain(p, key, netdev, domain)
+			for _, prefix := range prefixes {
+				r := Record{Name: n.ID, Node: n.ID, Prefix: netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits())}
+				if d != "" {
+					r.Name += "." + d
+				}
+				if !seen[r] {
+					seen[r] = true
+					records = append(records, r)
+				}
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Prefix.Addr().Less(records[j].Prefix.Addr())
+	})
+	return records
+}
+
+// netdevDomain returns the domain of netdev keyed by key, lowercased and without trailing dot
+func netdevDomain(p *projection.Projection, key string, netdev *node.Netdev, domain string) string {
+	d := netdev.Domain
+	if d == "" {
+		if s, ok := p.Subnet(key); ok && s.State != "Deleted" {
+			d = s.Domain
+		}
+	}
+	if d == "" {
+		d = domain
+	}
+	return strings.ToLower(strings.TrimSuffix(d, "."))
+}
+
+// validLabel returns true if label is a valid host name label of RFC 1123
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ReverseName returns the name of the PTR record of addr, e.g. 5.0.0.10.in-addr.arpa
+func ReverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	return reverseName(addr, addr.BitLen())
+}
+
+// reverseName returns the reverse name of the first bits of addr, which are a multiple of 8 for
+// IPv4 and of 4 for IPv6
+func reverseName(addr netip.Addr, bits int) string {
+	addr = addr.Unmap()
+	b := addr.AsSlice()
+	var labels []string
+	if addr.Is4() {
+		for i := bits/8 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		}
+		return strings.Join(append(labels, "in-addr.arpa"), ".")
+	}
+	for i := bits/4 - 1; i >= 0; i-- {
+		nibble := b[i/2] >> 4
+		if i%2 == 1 {
+			nibble = b[i/2] & 0xf
+		}
+		labels = append(labels, strconv.FormatUint(uint64(nibble), 16))
+	}
+	return strings.Join(append(labels, "ip6.arpa"), ".")
+}
+
+// reverseZone returns the reverse zone of prefix: that of its network rounded down to an octet
+// boundary for IPv4, between /8 and /24, or a nibble boundary for IPv6, between /16 and /124
+func reverseZone(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr().Unmap()
+	bits := prefix.Bits()
+	if addr.Is4() {
+		bits = min(max(bits/8*8, 8), 24)
+	} else {
+		bits = min(max(bits/4*4, 16), 124)
+	}
+	zone, _ := addr.Prefix(bits)
+	return zone
+}
+
+// Zones returns the records of each zone the records fall in, by origin: the forward zone of
+// each domain, and the reverse zones of the addresses, see reverseZone. A reverse zone within
+// another is merged into it. Records without a domain are in no zone.
+func Zones(records []Record) map[string][]Record {
+	named := make([]Record, 0, len(records))
+	for _, r := range records {
+		if r.Domain() != "" {
+			named = append(named, r)
+		}
+	}
+	records = named
+
+	var reverse []netip.Prefix
+	for _, r := range records {
+		reverse = append(reverse, reverseZone(r.Prefix))
+	}
+	// Widest first, so that addresses fall in the widest zone they are in
+	sort.Slice(reverse, func(i, j int) bool { return reverse[i].Bits() < reverse[j].Bits() })
+
+	zones := map[string][]Record{}
+	for _, r := range records {
+		zones[r.Domain()] = append(zones[r.Domain()], r)
+		for _, zone := range reverse {
+			if zone.Contains(r.Prefix.Addr()) {
+				origin := reverseName(zone.Addr(), zone.Bits())
+				zones[origin] = append(zones[origin], r)
+				break
+			}
+		}
+	}
+	return zones
+}
+
+// Hosts returns a hosts file of records, see hosts(5): a line per address with the names of the
+// address, each followed by the node ID when it differs
+func Hosts(records []Record) []byte {
+	var addrs []netip.Addr
+	names := map[netip.Addr][]string{}
+	for _, r := range records {
+		addr := r.Prefix.Addr()
+		if _, ok := names[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		names[addr] = append(names[addr], r.Name)
+		if r.Name != r.Node {
+			names[addr] = append(names[addr], r.Node)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+
+	var b strings.Builder
+	b.WriteString("# Generated from the nodes of warewulf, do not edit\n")
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "%s\t%s\n", addr, strings.Join(names[addr], " "))
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	subnet "github.com/bensallen/warewulf4/subnet"
+)
+
+// newProjection returns a caught up Projection of nodes and subnets, and the node repository
+func newProjection(t *testing.T, nodes []node.Node, subnets []subnet.Subnet) (*projection.Projection, *eventsource.Repository) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	subnetRepo := eventsource.New(&subnet.Subnet{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(subnet.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := context.Background()
+	for _, s := range subnets {
+		if err := s.Create(ctx, subnetRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for _, n := range nodes {
+		if err := n.Create(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	p, err := projection.New(ctx, store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return p, nodeRepo
+}
+
+var testNodes = []node.Node{
+	{ID: "n0001", Netdevs: map[string]*node.Netdev{
+		"10.0.0.0/24": {HWAddr: "00:11:22:33:44:01", IP: "10.0.0.1", Addresses: []string{"fd00:1::1/64"}},
+	}},
+	{ID: "n0002", Netdevs: map[string]*node.Netdev{
+		"10.0.0.0/24": {HWAddr: "00:11:22:33:44:02", IP: "10.0.0.2"},
+		"10.1.0.0/16": {HWAddr: "00:11:22:33:44:03", IP: "10.1.2.2", Domain: "IB.Cluster."},
+	}},
+	{ID: "n0003", Netdevs: map[string]*node.Netdev{
+		"192.168.0.0/24": {HWAddr: "00:11:22:33:44:04", IP: "192.168.0.3"},
+	}},
+	{ID: "n0004", Netdevs: map[string]*node.Netdev{
+		"eth0": {Name: "eth0", HWAddr: "00:11:22:33:44:05"},
+	}},
+}
+
+var testSubnets = []subnet.Subnet{{CIDR: "10.0.0.0/24", Domain: "cluster"}}
+
+func TestRecords(t *testing.T) {
+	p, _ := newProjection(t, testNodes, testSubnets)
+
+	var got []string
+	for _, r := range Records(p, "") {
+		got = append(got, r.Name+" "+r.Prefix.String())
+	}
+	want := []string{
+		"n0001.cluster 10.0.0.1/24",
+		"n0001.cluster fd00:1::1/64",
+		"n0002.cluster 10.0.0.2/24",
+		"n0002.ib.cluster 10.1.2.2/16",
+		"n0003 192.168.0.3/24",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Mismatch: %v", got)
+	}
+	if records := Records(p, "site"); records[4].Name != "n0003.site" || records[4].Domain() != "site" {
+		t.Fatalf("Mismatch: %+v", records[4])
+	}
+}
+
+func TestZones(t *testing.T) {
+	p, _ := newProjection(t, testNodes, testSubnets)
+	zones := Zones(Records(p, ""))
+
+	names := func(records []Record) string {
+		var s []string
+		for _, r := range records {
+			s = append(s, r.Name)
+		}
+		return strings.Join(s, " ")
+	}
+	want := map[string]string{
+		"cluster":    "n0001.cluster n0001.cluster n0002.cluster",
+		"ib.cluster": "n0002.ib.cluster",
+		// 1.10.in-addr.arpa does not contain 10.0.0.0/24, so the zones stay apart
+		"0.0.10.in-addr.arpa":                      "n0001.cluster n0002.cluster",
+		"1.10.in-addr.arpa":                        "n0002.ib.cluster",
+		"0.0.0.0.0.0.0.0.1.0.0.0.0.0.d.f.ip6.arpa": "n0001.cluster",
+	}
+	if len(zones) != len(want) {
+		t.Fatalf("Mismatch: %v", zones)
+	}
+	for origin, records := range zones {
+		if names(records) != want[origin] {
+			t.Fatalf("Mismatch: %v: %v", origin, names(records))
+		}
+	}
+
+	// Narrower reverse zones are merged into wider ones
+	records := []Record{
+		{Name: "a.cluster", Node: "a", Prefix: netip.MustParsePrefix("10.0.1.5/24")},
+		{Name: "b.cluster", Node: "b", Prefix: netip.MustParsePrefix("10.0.2.5/16")},
+	}
+	if zones := Zones(records); len(zones) != 2 || len(zones["0.10.in-addr.arpa"]) != 2 {
+		t.Fatalf("Mismatch: %v", zones)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if name := ReverseName(netip.MustParseAddr("10.0.1.5")); name != "5.1.0.10.in-addr.arpa" {
+		t.Fatalf("Mismatch: %v", name)
+	}
+	if name := ReverseName(netip.MustParseAddr("::ffff:10.0.1.5")); name != "5.1.0.10.in-addr.arpa" {
+		t.Fatalf("Mismatch: %v", name)
+	}
+	name := ReverseName(netip.MustParseAddr("2001:db8::567:89ab"))
+	if name != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Fatalf("Mismatch: %v", name)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	p, _ := newProjection(t, testNodes, testSubnets)
+	want := `# Generated from the nodes of warewulf, do not edit
+10.0.0.1	n0001.cluster n0001
+10.0.0.2	n0002.cluster n0002
+10.1.2.2	n0002.ib.cluster n0002
+192.168.0.3	n0003
+fd00:1::1	n0001.cluster n0001
+`
+	if got := string(Hosts(Records(p, ""))); got != want {
+		t.Fatalf("Mismatch: %v", got)
+	}
+}
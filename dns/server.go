@@ -0,0 +1,342 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	subnet "github.com/bensallen/warewulf4/subnet"
+)
+
+// Server is an authoritative name server for the zones of the nodes in a Projection, see Zones.
+// It answers A, AAAA and PTR queries for their names and addresses, and SOA and NS queries for
+// the zones, over UDP and TCP; queries for names outside the zones are refused, as it does not recurse.
+// Its records are rebuilt whenever the Projection applies events changing the netdevs of nodes,
+// directly or through their profiles, or the domain of subnets, and the serial of its zones is
+// bumped then.
+type Server struct {
+	Domain string // Of netdevs without a domain of their own or of their Subnet aggregate
+	SOA    SOA
+
+	nodes  *projection.Projection
+	mux    sync.RWMutex
+	zones  map[string]bool         // Origins
+	addrs  map[string][]netip.Addr // By name
+	ptrs   map[string][]string     // Names by reverse name
+	exists map[string]bool         // Names owning records and their ancestors in a zone
+	serial uint32
+}
+
+// NewServer returns a Server answering for the nodes in p, naming them in domain when their
+// netdevs have no domain
+func NewServer(p *projection.Projection, domain string) *Server {
+	s := &Server{Domain: domain, nodes: p}
+	s.Reload()
+	p.Subscribe(s.onEvents)
+	return s
+}
+
+// onEvents reloads the records when events changing names or addresses were applied
+func (s *Server) onEvents(events []eventsource.Event) {
+	for _, event := range events {
+		switch event.(type) {
+		case *node.NodeNetdevsSet, *node.NodeDeleted,
+			*node.NodeProfilesSet, *node.ProfileUpdated, *node.ProfileDeleted,
+			*subnet.SubnetCreated, *subnet.SubnetUpdated, *subnet.SubnetDeleted:
+			s.Reload()
+			return
+		}
+	}
+}
+
+// Reload rebuilds the records from the nodes of the Projection
+func (s *Server) Reload() {
+	zones := map[string]bool{}
+	addrs := map[string][]netip.Addr{}
+	ptrs := map[string][]string{}
+	exists := map[string]bool{}
+	for origin, records := range Zones(Records(s.nodes, s.Domain)) {
+		zones[origin] = true
+		for _, r := range records {
+			name := r.Name
+			if strings.HasSuffix(origin, ".arpa") {
+				name = ReverseName(r.Prefix.Addr())
+				ptrs[name] = append(ptrs[name], r.Name)
+			} else {
+				addrs[name] = append(addrs[name], r.Prefix.Addr())
+			}
+			for ; name != origin && strings.HasSuffix(name, "."+origin); name = name[strings.IndexByte(name, '.')+1:] {
+				exists[name] = true
+			}
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.zones, s.addrs, s.ptrs, s.exists = zones, addrs, ptrs, exists
+	// Seconds since the epoch keep serials increasing across restarts
+	serial := uint32(time.Now().Unix())
+	if serial <= s.serial {
+		serial = s.serial + 1
+	}
+	s.serial = serial
+}
+
+// Handle returns the response to the query req received over UDP, or nil if req is not answered
+func (s *Server) Handle(req []byte) []byte {
+	return s.handle(req, maxUDPSize)
+}
+
+// handle returns the response to the query req of at most limit bytes, or nil if req is not
+// answered
+func (s *Server) handle(req []byte, limit int) []byte {
+	id, flags, q, end, err := parseQuery(req)
+	if len(req) < headerLen || flags&flagQR != 0 {
+		// Not a query
+		return nil
+	}
+	if err != nil {
+		return response(limit, id, flags, RcodeFormatError, false, nil, nil, nil)
+	}
+	question := req[headerLen:end]
+	if opcode := flags >> 11 & 0xf; opcode != 0 {
+		return response(limit, id, flags, RcodeNotImplemented, false, question, nil, nil)
+	}
+	if q.Class != ClassIN && q.Class != ClassANY {
+		return response(limit, id, flags, RcodeRefused, false, question, nil, nil)
+	}
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	origin, ok := s.zone(q.Name)
+	if !ok {
+		return response(limit, id, flags, RcodeRefused, false, question, nil, nil)
+	}
+	soa := s.SOA.withDefaults()
+	ttl := uint32(soa.TTL / time.Second)
+
+	var answers []rr
+	if q.Name == origin {
+		if q.Type == TypeSOA || q.Type == TypeANY {
+			answers = append(answers, s.soa(origin, soa, ttl))
+		}
+		if q.Type == TypeNS || q.Type == TypeANY {
+			answers = append(answers, rr{Name: origin, Type: TypeNS, TTL: ttl, Data: appendName(nil, strings.TrimSuffix(soa.NS, "."))})
+		}
+	}
+	for _, addr := range s.addrs[q.Name] {
+		switch {
+		case addr.Is4() && (q.Type == TypeA || q.Type == TypeANY):
+			answers = append(answers, rr{Name: q.Name, Type: TypeA, TTL: ttl, Data: addr.AsSlice()})
+		case addr.Is6() && (q.Type == TypeAAAA || q.Type == TypeANY):
+			answers = append(answers, rr{Name: q.Name, Type: TypeAAAA, TTL: ttl, Data: addr.AsSlice()})
+		}
+	}
+	if q.Type == TypePTR || q.Type == TypeANY {
+		for _, name := range s.ptrs[q.Name] {
+			answers = append(answers, rr{Name: q.Name, Type: TypePTR, TTL: ttl, Data: appendName(nil, name)})
+		}
+	}
+	if len(answers) > 0 {
+		return response(limit, id, flags, RcodeSuccess, true, question, answers, nil)
+	}
+
+	// Negative answers carry the SOA for caching, see RFC 2308
+	negative := s.soa(origin, soa, min(ttl, uint32(soa.Minimum/time.Second)))
+	rcode := RcodeSuccess
+	if q.Name != origin && !s.exists[q.Name] {
+		rcode = RcodeNameError
+	}
+	return response(limit, id, flags, rcode, true, question, nil, []rr{negative})
+}
+
+// zone returns the origin of the most specific zone name is in
+func (s *Server) zone(name string) (string, bool) {
+	for n := name; ; n = n[strings.IndexByte(n, '.')+1:] {
+		if s.zones[n] {
+			return n, true
+		}
+		if !strings.Contains(n, ".") {
+			return "", false
+		}
+	}
+}
+
+// soa returns the SOA record of origin
+func (s *Server) soa(origin string, soa SOA, ttl uint32) rr {
+	data := appendName(nil, strings.TrimSuffix(soa.NS, "."))
+	data = appendName(data, strings.TrimSuffix(soa.Mbox, "."))
+	for _, v := range []uint32{
+		s.serial,
+		uint32(soa.Refresh / time.Second),
+		uint32(soa.Retry / time.Second),
+		uint32(soa.Expire / time.Second),
+		uint32(soa.Minimum / time.Second),
+	} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return rr{Name: origin, Type: TypeSOA, TTL: ttl, Data: data}
+}
+
+// response encodes a response of at most limit bytes to the query with id and flags. Answers that
+// do not fit are left out and the response is marked truncated, so that a client asking over UDP
+// retries over TCP, see RFC 1035 section 4.2.1.
+func response(limit int, id, flags uint16, rcode int, authoritative bool, question []byte, answers, authority []rr) []byte {
+	out := flagQR | flags&(0xf<<11|flagRD) | uint16(rcode)
+	if authoritative {
+		out |= flagAA
+	}
+	for {
+		b := binary.BigEndian.AppendUint16(nil, id)
+		b = binary.BigEndian.AppendUint16(b, out)
+		qdcount := 0
+		if question != nil {
+			qdcount = 1
+		}
+		for _, n := range []int{qdcount, len(answers), len(authority), 0} {
+			b = binary.BigEndian.AppendUint16(b, uint16(n))
+		}
+		b = append(b, question...)
+		for _, r := range answers {
+			b = appendRR(b, r)
+		}
+		for _, r := range authority {
+			b = appendRR(b, r)
+		}
+		if len(b) <= limit || len(answers) == 0 {
+			return b
+		}
+		answers, authority = answers[:len(answers)-1], nil
+		out |= flagTC
+	}
+}
+
+// Serve answers the queries received on conn until ctx is done, then closes conn
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		resp := s.Handle(buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			log.Printf("dns: reply to %v: %v", addr, err)
+		}
+	}
+}
+
+// ServeTCP answers the queries received on the connections accepted from l until ctx is done,
+// then closes l. Messages are prefixed by their length, see RFC 1035 section 4.2.2, and a
+// connection is closed once idle for tcpIdleTimeout.
+func (s *Server) ServeTCP(ctx context.Context, l net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// tcpIdleTimeout is how long a TCP connection is kept open waiting for the next query
+const tcpIdleTimeout = 10 * time.Second
+
+// serveConn answers the queries received on conn until it is closed or idle, or ctx is done
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+		resp := s.handle(req, maxTCPSize)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			log.Printf("dns: reply to %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// ListenAndServe answers queries received on the UDP and TCP address addr, e.g. ":53", until ctx
+// is done or either fails
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() { errs <- s.Serve(ctx, conn) }()
+	go func() { errs <- s.ServeTCP(ctx, l) }()
+	err = <-errs
+	cancel()
+	<-errs
+	return err
+}
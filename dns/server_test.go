@@ -0,0 +1,206 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func query(name string, typ uint16) []byte {
+	b := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	return binary.BigEndian.AppendUint16(b, ClassIN)
+}
+
+// answer is a decoded resource record of a response
+type answer struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// parseResponse returns the flags, answers and authority records of a response
+func parseResponse(t *testing.T, b []byte) (uint16, []answer, []answer) {
+	t.Helper()
+	_, flags, _, off, err := parseQuery(b)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var sections [2][]answer
+	for i, n := range []uint16{binary.BigEndian.Uint16(b[6:]), binary.BigEndian.Uint16(b[8:])} {
+		for ; n > 0; n-- {
+			var a answer
+			if a.Name, off, err = readName(b, off); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			a.Type, a.TTL = binary.BigEndian.Uint16(b[off:]), binary.BigEndian.Uint32(b[off+4:])
+			size := int(binary.BigEndian.Uint16(b[off+8:]))
+			a.Data = b[off+10 : off+10+size]
+			off += 10 + size
+			sections[i] = append(sections[i], a)
+		}
+	}
+	return flags, sections[0], sections[1]
+}
+
+func TestServer(t *testing.T) {
+	p, _ := newProjection(t, testNodes, testSubnets)
+	s := NewServer(p, "")
+	s.SOA = SOA{NS: "head.cluster", TTL: time.Minute}
+
+	tests := []struct {
+		name    string
+		typ     uint16
+		rcode   uint16
+		answers []string
+	}{
+		{"n0001.cluster", TypeA, RcodeSuccess, []string{"10.0.0.1"}},
+		{"N0001.Cluster", TypeAAAA, RcodeSuccess, []string{"fd00:1::1"}},
+		{"n0001.cluster", TypeANY, RcodeSuccess, []string{"10.0.0.1", "fd00:1::1"}},
+		{"n0002.ib.cluster", TypeA, RcodeSuccess, []string{"10.1.2.2"}},
+		{"2.0.0.10.in-addr.arpa", TypePTR, RcodeSuccess, []string{"n0002.cluster"}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.0.0.0.d.f.ip6.arpa", TypePTR, RcodeSuccess, []string{"n0001.cluster"}},
+		{"cluster", TypeNS, RcodeSuccess, []string{"head.cluster"}},
+		{"n0002.cluster", TypeAAAA, RcodeSuccess, nil},
+		{"n0009.cluster", TypeA, RcodeNameError, nil},
+		{ReverseName(netip.MustParseAddr("fd00:1::2")), TypePTR, RcodeNameError, nil},
+		// Empty non-terminal above the name of fd00:1::1
+		{strings.TrimPrefix(ReverseName(netip.MustParseAddr("fd00:1::1")), "1."), TypePTR, RcodeSuccess, nil},
+		{"example.com", TypeA, RcodeRefused, nil},
+		{"n0003", TypeA, RcodeRefused, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, answers, authority := parseResponse(t, s.Handle(query(tt.name, tt.typ)))
+			if rcode := flags & 0xf; rcode != tt.rcode {
+				t.Fatalf("Mismatch: rcode %v", rcode)
+			}
+			if flags&flagQR == 0 || flags&flagRD == 0 || (flags&flagAA != 0) == (tt.rcode == RcodeRefused) {
+				t.Fatalf("Mismatch: flags %x", flags)
+			}
+			var got []string
+			for _, a := range answers {
+				switch a.Type {
+				case TypeA, TypeAAAA:
+					got = append(got, net.IP(a.Data).String())
+				case TypePTR, TypeNS:
+					name, _, _ := readName(a.Data, 0)
+					got = append(got, name)
+				}
+				if a.TTL != 60 {
+					t.Fatalf("Mismatch: TTL %v", a.TTL)
+				}
+			}
+			if len(got) != len(tt.answers) {
+				t.Fatalf("Mismatch: %v", got)
+			}
+			for i := range got {
+				if got[i] != tt.answers[i] {
+					t.Fatalf("Mismatch: %v", got)
+				}
+			}
+			if len(answers) == 0 && tt.rcode != RcodeRefused && (len(authority) != 1 || authority[0].Type != TypeSOA) {
+				t.Fatalf("Mismatch: authority %v", authority)
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		if resp := s.Handle([]byte{1, 2, 3}); resp != nil {
+			t.Fatalf("Should have ignored a short message, got %x", resp)
+		}
+		req := query("n0001.cluster", TypeA)
+		req[2] |= 0x80
+		if resp := s.Handle(req); resp != nil {
+			t.Fatalf("Should have ignored a response, got %x", resp)
+		}
+		req = query("n0001.cluster", TypeA)
+		req[5] = 2
+		if resp := s.Handle(req); resp == nil || resp[3]&0xf != RcodeFormatError {
+			t.Fatalf("Mismatch: %x", resp)
+		}
+	})
+
+	t.Run("Serve", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.Serve(ctx, conn)
+
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write(query("n0001.cluster", TypeA)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		buf := make([]byte, maxUDPSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, answers, _ := parseResponse(t, buf[:n]); len(answers) != 1 || net.IP(answers[0].Data).String() != "10.0.0.1" {
+			t.Fatalf("Mismatch: %v", answers)
+		}
+	})
+	t.Run("ServeTCP", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.ServeTCP(ctx, l)
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, name := range []string{"n0001.cluster", "n0002.cluster"} {
+			req := query(name, TypeA)
+			if _, err := client.Write(append([]byte{byte(len(req) >> 8), byte(len(req))}, req...)); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(client, length); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			resp := make([]byte, int(length[0])<<8|int(length[1]))
+			if _, err := io.ReadFull(client, resp); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if _, answers, _ := parseResponse(t, resp); len(answers) != 1 {
+				t.Fatalf("Mismatch: %v", answers)
+			}
+		}
+	})
+}
+
+func TestResponseTruncated(t *testing.T) {
+	var answers []rr
+	for i := 0; i < 100; i++ {
+		answers = append(answers, rr{Name: "n0001.cluster", Type: TypeA, TTL: 60, Data: []byte{10, 0, 0, byte(i)}})
+	}
+	udp := response(maxUDPSize, 1, 0, RcodeSuccess, true, nil, answers, nil)
+	if len(udp) > maxUDPSize || binary.BigEndian.Uint16(udp[2:])&flagTC == 0 {
+		t.Fatalf("Should have truncated to %d bytes, %d instead", maxUDPSize, len(udp))
+	}
+	tcp := response(maxTCPSize, 1, 0, RcodeSuccess, true, nil, answers, nil)
+	if binary.BigEndian.Uint16(tcp[2:])&flagTC != 0 || binary.BigEndian.Uint16(tcp[6:]) != 100 {
+		t.Fatal("Should not have truncated the answers over TCP")
+	}
+}
@@ -0,0 +1,254 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	subnet "github.com/bensallen/warewulf4/subnet"
+)
+
+// SOA holds the start of authority parameters of zones. Zero fields take the value of
+// DefaultSOA.
+type SOA struct {
+	NS      string // Fully qualified name of the name server of the zones
+	Mbox    string // Mailbox of the person responsible for the zones, in domain name form
+	TTL     time.Duration
+	Refresh time.Duration
+	Retry   time.Duration
+	Expire  time.Duration
+	Minimum time.Duration // Negative caching TTL
+}
+
+// DefaultSOA is the SOA of zones served from the local host only
+var DefaultSOA = SOA{
+	NS:      "localhost",
+	Mbox:    "root.localhost",
+	TTL:     time.Hour,
+	Refresh: time.Hour,
+	Retry:   15 * time.Minute,
+	Expire:  7 * 24 * time.Hour,
+	Minimum: time.Hour,
+}
+
+// withDefaults returns soa with zero fields set from DefaultSOA
+func (soa SOA) withDefaults() SOA {
+	if soa.NS == "" {
+		soa.NS = DefaultSOA.NS
+	}
+	if soa.Mbox == "" {
+		soa.Mbox = DefaultSOA.Mbox
+	}
+	for _, f := range []struct{ v, d *time.Duration }{
+		{&soa.TTL, &DefaultSOA.TTL},
+		{&soa.Refresh, &DefaultSOA.Refresh},
+		{&soa.Retry, &DefaultSOA.Retry},
+		{&soa.Expire, &DefaultSOA.Expire},
+		{&soa.Minimum, &DefaultSOA.Minimum},
+	} {
+		if *f.v == 0 {
+			*f.v = *f.d
+		}
+	}
+	return soa
+}
+
+// ZoneFile returns the BIND zone file of origin with serial, holding the A and AAAA records of
+// records for a forward zone, or their PTR records for a reverse zone under in-addr.arpa or
+// ip6.arpa. Records outside origin are left out.
+func ZoneFile(origin string, soa SOA, serial uint32, records []Record) []byte {
+	soa = soa.withDefaults()
+	seconds := func(d time.Duration) int64 { return int64(d / time.Second) }
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; Generated from the nodes of warewulf, do not edit\n")
+	fmt.Fprintf(&b, "$ORIGIN %s.\n", origin)
+	fmt.Fprintf(&b, "$TTL %d\n", seconds(soa.TTL))
+	fmt.Fprintf(&b, "@\tIN\tSOA\t%s. %s. (\n", strings.TrimSuffix(soa.NS, "."), strings.TrimSuffix(soa.Mbox, "."))
+	fmt.Fprintf(&b, "\t\t%d\t; serial\n", serial)
+	fmt.Fprintf(&b, "\t\t%d\t; refresh\n", seconds(soa.Refresh))
+	fmt.Fprintf(&b, "\t\t%d\t; retry\n", seconds(soa.Retry))
+	fmt.Fprintf(&b, "\t\t%d\t; expire\n", seconds(soa.Expire))
+	fmt.Fprintf(&b, "\t\t%d )\t; minimum\n", seconds(soa.Minimum))
+	fmt.Fprintf(&b, "@\tIN\tNS\t%s.\n", strings.TrimSuffix(soa.NS, "."))
+
+	reverse := strings.HasSuffix(origin, ".in-addr.arpa") || strings.HasSuffix(origin, ".ip6.arpa")
+	for _, r := range sortedRecords(records, reverse) {
+		if reverse {
+			name, ok := relative(ReverseName(r.Prefix.Addr()), origin)
+			if ok {
+				fmt.Fprintf(&b, "%s\tIN\tPTR\t%s.\n", name, r.Name)
+			}
+			continue
+		}
+		name, ok := relative(r.Name, origin)
+		if !ok {
+			continue
+		}
+		typ := "A"
+		if r.Prefix.Addr().Is6() {
+			typ = "AAAA"
+		}
+		fmt.Fprintf(&b, "%s\tIN\t%s\t%s\n", name, typ, r.Prefix.Addr())
+	}
+	return b.Bytes()
+}
+
+// sortedRecords returns records sorted by address for reverse zones, and as given otherwise
+func sortedRecords(records []Record, reverse bool) []Record {
+	if !reverse {
+		return records
+	}
+	sorted := append([]Record(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Prefix.Addr().Less(sorted[j].Prefix.Addr()) })
+	return sorted
+}
+
+// relative returns name relative to origin, or false if name is not in origin
+func relative(name, origin string) (string, bool) {
+	if name == origin {
+		return "@", true
+	}
+	if strings.HasSuffix(name, "."+origin) {
+		return strings.TrimSuffix(name, "."+origin), true
+	}
+	return "", false
+}
+
+// Serial returns the serial of a zone file written by ZoneFile, or false if it has none
+func Serial(zone []byte) (uint32, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(zone))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasSuffix(line, "; serial") {
+			continue
+		}
+		if serial, err := strconv.ParseUint(strings.Fields(line)[0], 10, 32); err == nil {
+			return uint32(serial), true
+		}
+	}
+	return 0, false
+}
+
+// Generator writes the hosts file and the zone files of the nodes in a Projection to a
+// directory: hosts, and <origin>.zone for each zone of Zones. Files are only rewritten when their
+// content changes, and zone files then get the next serial; zones left without records are kept,
+// with only their SOA and NS records, so that name server configurations referring to them stay
+// valid. Call Generate to write the files, which happens again whenever the Projection applies
+// events changing the netdevs of nodes, directly or through their profiles, or the domain of
+// subnets.
+type Generator struct {
+	Dir    string
+	Domain string // Of netdevs without a domain of their own or of their Subnet aggregate
+	SOA    SOA
+
+	nodes *projection.Projection
+	mux   sync.Mutex
+	zones map[string]bool // Origins written so far
+}
+
+// NewGenerator returns a Generator writing the files of the nodes in p to dir, naming them in
+// domain when their netdevs have no domain
+func NewGenerator(p *projection.Projection, dir, domain string) *Generator {
+	g := &Generator{Dir: dir, Domain: domain, nodes: p, zones: map[string]bool{}}
+	p.Subscribe(g.onEvents)
+	return g
+}
+
+// onEvents regenerates the files when events changing names or addresses were applied
+func (g *Generator) onEvents(events []eventsource.Event) {
+	for _, event := range events {
+		switch event.(type) {
+		case *node.NodeNetdevsSet, *node.NodeDeleted,
+			*node.NodeProfilesSet, *node.ProfileUpdated, *node.ProfileDeleted,
+			*subnet.SubnetCreated, *subnet.SubnetUpdated, *subnet.SubnetDeleted:
+			if err := g.Generate(); err != nil {
+				log.Printf("dns: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// Generate writes the files that changed
+func (g *Generator) Generate() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if err := os.MkdirAll(g.Dir, 0755); err != nil {
+		return err
+	}
+	records := Records(g.nodes, g.Domain)
+	if err := writeFile(filepath.Join(g.Dir, "hosts"), Hosts(records)); err != nil {
+		return err
+	}
+
+	zones := Zones(records)
+	for origin := range g.zones {
+		if _, ok := zones[origin]; !ok {
+			zones[origin] = nil
+		}
+	}
+	for origin, records := range zones {
+		if err := g.writeZone(origin, records); err != nil {
+			return err
+		}
+		g.zones[origin] = true
+	}
+	return nil
+}
+
+// writeZone writes the zone file of origin with the serial of the existing file if its records
+// are unchanged, and with the next serial otherwise
+func (g *Generator) writeZone(origin string, records []Record) error {
+	path := filepath.Join(g.Dir, origin+".zone")
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	serial, ok := Serial(existing)
+	if ok && bytes.Equal(existing, ZoneFile(origin, g.SOA, serial, records)) {
+		return nil
+	}
+	// Serial arithmetic of RFC 1982 wraps, skipping zero which some tools treat as unset
+	if serial++; serial == 0 {
+		serial = 1
+	}
+	return writeFile(path, ZoneFile(origin, g.SOA, serial, records))
+}
+
+// writeFile atomically replaces path with data, unless it already holds data
+func writeFile(path string, data []byte) error {
+	if existing, err := ioutil.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
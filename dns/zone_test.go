@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"context"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+)
+
+func TestZoneFile(t *testing.T) {
+	records := []Record{
+		{Name: "n0002.cluster", Node: "n0002", Prefix: netip.MustParsePrefix("10.0.0.2/24")},
+		{Name: "n0001.cluster", Node: "n0001", Prefix: netip.MustParsePrefix("10.0.0.1/24")},
+		{Name: "n0001.cluster", Node: "n0001", Prefix: netip.MustParsePrefix("fd00:1::1/64")},
+		{Name: "n0003.ib.cluster", Node: "n0003", Prefix: netip.MustParsePrefix("10.1.0.3/24")},
+	}
+	soa := SOA{NS: "head.cluster.", Mbox: "hostmaster.cluster"}
+
+	forward := string(ZoneFile("cluster", soa, 7, records))
+	for _, line := range []string{
+		"$ORIGIN cluster.\n",
+		"$TTL 3600\n",
+		"@\tIN\tSOA\thead.cluster. hostmaster.cluster. (\n",
+		"\t\t7\t; serial\n",
+		"@\tIN\tNS\thead.cluster.\n",
+		"n0002\tIN\tA\t10.0.0.2\nn0001\tIN\tA\t10.0.0.1\nn0001\tIN\tAAAA\tfd00:1::1\n",
+		"n0003.ib\tIN\tA\t10.1.0.3\n",
+	} {
+		if !strings.Contains(forward, line) {
+			t.Fatalf("Mismatch: %q not in\n%v", line, forward)
+		}
+	}
+
+	reverse := string(ZoneFile("0.0.10.in-addr.arpa", soa, 7, records))
+	if !strings.HasSuffix(reverse, "@\tIN\tNS\thead.cluster.\n1\tIN\tPTR\tn0001.cluster.\n2\tIN\tPTR\tn0002.cluster.\n") {
+		t.Fatalf("Mismatch: %v", reverse)
+	}
+	if serial, ok := Serial([]byte(reverse)); !ok || serial != 7 {
+		t.Fatalf("Mismatch: %v %v", serial, ok)
+	}
+	if _, ok := Serial(nil); ok {
+		t.Fatal("Should have found no serial")
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	p, nodeRepo := newProjection(t, testNodes, testSubnets)
+	dir := filepath.Join(t.TempDir(), "dns")
+	g := NewGenerator(p, dir, "")
+
+	serial := func(origin string) uint32 {
+		zone, err := ioutil.ReadFile(filepath.Join(dir, origin+".zone"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		serial, _ := Serial(zone)
+		return serial
+	}
+
+	if err := g.Generate(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	hosts, err := ioutil.ReadFile(filepath.Join(dir, "hosts"))
+	if err != nil || !strings.Contains(string(hosts), "10.0.0.1\tn0001.cluster n0001\n") {
+		t.Fatalf("Mismatch: %s %v", hosts, err)
+	}
+	if serial("cluster") != 1 || serial("1.10.in-addr.arpa") != 1 {
+		t.Fatalf("Mismatch: %v %v", serial("cluster"), serial("1.10.in-addr.arpa"))
+	}
+
+	// Unchanged zones keep their serial, also across generators
+	if err := NewGenerator(p, dir, "").Generate(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if serial("cluster") != 1 {
+		t.Fatalf("Mismatch: %v", serial("cluster"))
+	}
+
+	// Moving n0002 off the ib network bumps the zones it leaves, and keeps them
+	ctx := context.Background()
+	cmd := &node.SetNetdevs{CommandModel: eventsource.CommandModel{ID: "n0002"}, Netdevs: map[string]*node.Netdev{
+		"10.0.0.0/24": {HWAddr: "00:11:22:33:44:02", IP: "10.0.0.2"},
+	}}
+	if _, err := nodeRepo.Apply(ctx, cmd); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if serial("cluster") != 1 || serial("ib.cluster") != 2 || serial("1.10.in-addr.arpa") != 2 {
+		t.Fatalf("Mismatch: %v %v %v", serial("cluster"), serial("ib.cluster"), serial("1.10.in-addr.arpa"))
+	}
+	zone, _ := ioutil.ReadFile(filepath.Join(dir, "ib.cluster.zone"))
+	if strings.Contains(string(zone), "n0002") {
+		t.Fatalf("Mismatch: %s", zone)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 6 {
+		t.Fatalf("Mismatch: %v", entries)
+	}
+}
@@ -0,0 +1,393 @@
+// Package filestore provides an eventsource.Store backed by an append-only log on local disk,
+// whose records can also be read in the order they were saved as a stream.
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+const (
+	// ErrVersionConflict is returned by Save when the versions of the records being saved do not
+	// directly follow the latest version already stored for the aggregate
+	ErrVersionConflict = concurrency.ErrVersionConflict
+
+	// ErrCorrupt is returned by New when a record other than the last one in the log fails its
+	// checksum, or when bytes that do not form a record are followed by a valid record
+	ErrCorrupt = "Corrupt"
+)
+
+// maxTail bounds the bytes following the last valid record that recovery takes for the torn
+// write of a crash during Save; a longer tail is reported as corruption instead
+const maxTail = 64 << 20
+
+// Each record in the log is framed as
+//
+//	length   uint32 (size of the body)
+//	checksum uint32 (CRC-32C of the body)
+//	body     offset uint64, version uint64, aggregate ID length uint16, aggregate ID, data
+//
+// with all integers big endian.
+const (
+	frameHeaderSize = 8
+	bodyHeaderSize  = 18
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// position locates a record inside the log file
+type position struct {
+	at      int64
+	size    int64
+	version int
+}
+
+// Store provides an eventsource.Store implementation backed by an append-only log on local disk.
+// A Store must be the only writer of its log file.
+type Store struct {
+	mux         sync.RWMutex
+	file        *os.File
+	size        int64
+	offsets     []position
+	byAggregate map[string][]position
+}
+
+// New opens the log at path, creating it and its parent directories if needed. Records are
+// indexed on open; a partially written record at the end of the log, left by a crash during
+// Save, is moved to path.tail-<byte>, named after the byte it started at, and truncated away.
+func New(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		file:        file,
+		byAggregate: map[string][]position{},
+	}
+	if err := s.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// recover scans the log, rebuilding the in-memory index, and sets aside a torn final record
+func (s *Store) recover() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	var at int64
+	header := make([]byte, frameHeaderSize)
+	for at < end {
+		if end-at < frameHeaderSize {
+			break
+		}
+		if _, err := s.file.ReadAt(header, at); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if at+frameHeaderSize+length > end {
+			break
+		}
+
+		body := make([]byte, length)
+		if _, err := s.file.ReadAt(body, at+frameHeaderSize); err != nil {
+			return err
+		}
+		next := at + frameHeaderSize + length
+		if crc32.Checksum(body, crcTable) != sum || length < bodyHeaderSize {
+			if next == end {
+				break
+			}
+			return eventsource.NewError(nil, ErrCorrupt, "record at byte %d of %v failed its checksum", at, s.file.Name())
+		}
+
+		record, err := decode(body)
+		if err != nil {
+			return err
+		}
+		if record.Offset != uint64(len(s.offsets)) {
+			return eventsource.NewError(nil, ErrCorrupt, "record at byte %d of %v has offset %d, expected %d", at, s.file.Name(), record.Offset, len(s.offsets))
+		}
+
+		pos := position{at: at, size: next - at, version: record.Version}
+		s.offsets = append(s.offsets, pos)
+		s.byAggregate[record.AggregateID] = append(s.byAggregate[record.AggregateID], pos)
+		at = next
+	}
+
+	s.size = at
+	if at < end {
+		return s.setAsideTail(at, end)
+	}
+
+	return nil
+}
+
+// setAsideTail copies the bytes of the log from at to end, which do not form a valid record, to a
+// file next to the log and truncates the log at at. The bytes are only taken for a torn write
+// when no valid record follows them, as truncating would otherwise lose saved records; an error
+// with the ErrCorrupt code is returned then, leaving the log as it is.
+func (s *Store) setAsideTail(at, end int64) error {
+	if end-at > maxTail {
+		return eventsource.NewError(nil, ErrCorrupt, "%d bytes at byte %d of %v do not form a record", end-at, at, s.file.Name())
+	}
+	tail := make([]byte, end-at)
+	if _, err := s.file.ReadAt(tail, at); err != nil {
+		return err
+	}
+	if i, ok := findFrame(tail, uint64(len(s.offsets))); ok {
+		return eventsource.NewError(nil, ErrCorrupt, "record at byte %d of %v is damaged but followed by a valid record at byte %d", at, s.file.Name(), at+int64(i))
+	}
+
+	aside, err := os.OpenFile(fmt.Sprintf("%s.tail-%d", s.file.Name(), at), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := aside.Write(tail); err != nil {
+		aside.Close()
+		return err
+	}
+	if err := aside.Sync(); err != nil {
+		aside.Close()
+		return err
+	}
+	if err := aside.Close(); err != nil {
+		return err
+	}
+
+	if err := s.file.Truncate(at); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// findFrame returns the position in tail of a valid frame of a record with an offset past next,
+// the offset of the damaged record tail starts with
+func findFrame(tail []byte, next uint64) (int, bool) {
+	for i := 1; i+frameHeaderSize+bodyHeaderSize <= len(tail); i++ {
+		length := int(binary.BigEndian.Uint32(tail[i:]))
+		if length < bodyHeaderSize || length > len(tail)-i-frameHeaderSize {
+			continue
+		}
+		body := tail[i+frameHeaderSize : i+frameHeaderSize+length]
+		if offset := binary.BigEndian.Uint64(body); offset <= next || offset > next+uint64(len(tail)) {
+			continue
+		}
+		if crc32.Checksum(body, crcTable) == binary.BigEndian.Uint32(tail[i+4:]) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Close closes the underlying log file
+func (s *Store) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.file.Close()
+}
+
+// Save the provided serialized records to the store. The records must continue the aggregate's
+// history without gaps; otherwise an error with the ErrVersionConflict code is returned unless
+// the records are identical to ones already stored. Save returns once the records are synced to
+// disk.
+func (s *Store) Save(ctx context.Context, aggregateID string, records ...eventsource.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if len(aggregateID) > 0xffff {
+		return fmt.Errorf("aggregate id, %v..., is too long", aggregateID[:32])
+	}
+
+	items := make(eventsource.History, len(records))
+	copy(items, records)
+	sort.Sort(items)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	existing := s.byAggregate[aggregateID]
+	latest := 0
+	if len(existing) > 0 {
+		latest = existing[len(existing)-1].version
+	}
+
+	if items[0].Version <= latest {
+		return s.isIdempotent(aggregateID, items)
+	}
+	for i, record := range items {
+		if record.Version != latest+i+1 {
+			return eventsource.NewError(nil, ErrVersionConflict, "aggregate, %v, is at version %d; unable to save version %d", aggregateID, latest+i, record.Version)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	positions := make([]position, 0, len(items))
+	at := s.size
+	for i, record := range items {
+		frame := encode(uint64(len(s.offsets)+i), aggregateID, record)
+		positions = append(positions, position{at: at, size: int64(len(frame)), version: record.Version})
+		at += int64(len(frame))
+		buf.Write(frame)
+	}
+
+	if _, err := s.file.WriteAt(buf.Bytes(), s.size); err != nil {
+		// Leave the log as it was so that later saves do not append after a partial write
+		s.file.Truncate(s.size)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.size = at
+	s.offsets = append(s.offsets, positions...)
+	s.byAggregate[aggregateID] = append(existing, positions...)
+
+	return nil
+}
+
+// isIdempotent returns nil when the records have all been saved before with the same data
+func (s *Store) isIdempotent(aggregateID string, items eventsource.History) error {
+	for _, record := range items {
+		stored, ok, err := s.loadVersion(aggregateID, record.Version)
+		if err != nil {
+			return err
+		}
+		if !ok || !bytes.Equal(stored.Data, record.Data) {
+			return eventsource.NewError(nil, ErrVersionConflict, "conflicting records detected for aggregate, %v, at version %d", aggregateID, record.Version)
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadVersion(aggregateID string, version int) (eventsource.StreamRecord, bool, error) {
+	for _, pos := range s.byAggregate[aggregateID] {
+		if pos.version == version {
+			record, err := s.readAt(pos)
+			return record, err == nil, err
+		}
+	}
+	return eventsource.StreamRecord{}, false, nil
+}
+
+// Load the history of events up to the version specified.
+// When toVersion is 0, all events will be loaded.
+// To start at the beginning, fromVersion should be set to 0
+func (s *Store) Load(ctx context.Context, aggregateID string, fromVersion, toVersion int) (eventsource.History, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	positions, ok := s.byAggregate[aggregateID]
+	if !ok {
+		return nil, eventsource.NewError(nil, eventsource.ErrAggregateNotFound, "no aggregate found with id, %v", aggregateID)
+	}
+
+	history := make(eventsource.History, 0, len(positions))
+	for _, pos := range positions {
+		if pos.version < fromVersion || (toVersion != 0 && pos.version > toVersion) {
+			continue
+		}
+		record, err := s.readAt(pos)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, record.Record)
+	}
+
+	return history, nil
+}
+
+// Read reads the next recordCount records from the log starting at the specified offset. Offsets
+// start at 0 and increase by one for every record saved.
+func (s *Store) Read(ctx context.Context, startingOffset uint64, recordCount int) ([]eventsource.StreamRecord, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if startingOffset >= uint64(len(s.offsets)) || recordCount <= 0 {
+		return []eventsource.StreamRecord{}, nil
+	}
+
+	end := startingOffset + uint64(recordCount)
+	if end > uint64(len(s.offsets)) {
+		end = uint64(len(s.offsets))
+	}
+
+	records := make([]eventsource.StreamRecord, 0, end-startingOffset)
+	for _, pos := range s.offsets[startingOffset:end] {
+		record, err := s.readAt(pos)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *Store) readAt(pos position) (eventsource.StreamRecord, error) {
+	frame := make([]byte, pos.size)
+	if _, err := s.file.ReadAt(frame, pos.at); err != nil && err != io.EOF {
+		return eventsource.StreamRecord{}, err
+	}
+	return decode(frame[frameHeaderSize:])
+}
+
+func encode(offset uint64, aggregateID string, record eventsource.Record) []byte {
+	body := make([]byte, bodyHeaderSize+len(aggregateID)+len(record.Data))
+	binary.BigEndian.PutUint64(body[0:8], offset)
+	binary.BigEndian.PutUint64(body[8:16], uint64(record.Version))
+	binary.BigEndian.PutUint16(body[16:18], uint16(len(aggregateID)))
+	copy(body[bodyHeaderSize:], aggregateID)
+	copy(body[bodyHeaderSize+len(aggregateID):], record.Data)
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(body, crcTable))
+	return append(frame, body...)
+}
+
+func decode(body []byte) (eventsource.StreamRecord, error) {
+	if len(body) < bodyHeaderSize {
+		return eventsource.StreamRecord{}, fmt.Errorf("record too short, %d bytes", len(body))
+	}
+	idLen := int(binary.BigEndian.Uint16(body[16:18]))
+	if len(body) < bodyHeaderSize+idLen {
+		return eventsource.StreamRecord{}, fmt.Errorf("record too short for aggregate id of %d bytes", idLen)
+	}
+
+	data := make([]byte, len(body)-bodyHeaderSize-idLen)
+	copy(data, body[bodyHeaderSize+idLen:])
+
+	return eventsource.StreamRecord{
+		Offset:      binary.BigEndian.Uint64(body[0:8]),
+		AggregateID: string(body[bodyHeaderSize : bodyHeaderSize+idLen]),
+		Record: eventsource.Record{
+			Version: int(binary.BigEndian.Uint64(body[8:16])),
+			Data:    data,
+		},
+	}, nil
+}
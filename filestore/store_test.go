@@ -0,0 +1,208 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+)
+
+func TestStoreImplements(t *testing.T) {
+	var _ eventsource.Store = &Store{}
+	var _ eventsource.StreamReader = &Store{}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events", "log")
+	ctx := context.Background()
+
+	store, err := New(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	history := eventsource.History{
+		{Version: 1, Data: []byte("a")},
+		{Version: 2, Data: []byte("b")},
+	}
+
+	t.Run("SaveAndLoad", func(t *testing.T) {
+		if err := store.Save(ctx, "abc", history...); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := store.Save(ctx, "def", eventsource.Record{Version: 1, Data: []byte("c")}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		found, err := store.Load(ctx, "abc", 0, 0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(found, history) {
+			t.Fatalf("Mismatch: %v", found)
+		}
+
+		found, err = store.Load(ctx, "abc", 2, 0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(found, history[1:]) {
+			t.Fatalf("Mismatch: %v", found)
+		}
+
+		_, err = store.Load(ctx, "missing", 0, 0)
+		if !eventsource.IsNotFound(err) {
+			t.Fatalf("Should have failed with not found error, %v instead", err)
+		}
+	})
+
+	t.Run("VersionConflict", func(t *testing.T) {
+		err := store.Save(ctx, "abc", eventsource.Record{Version: 2, Data: []byte("x")})
+		if !eventsource.ErrHasCode(err, ErrVersionConflict) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+		err = store.Save(ctx, "abc", eventsource.Record{Version: 4, Data: []byte("x")})
+		if !eventsource.ErrHasCode(err, ErrVersionConflict) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+		if err := store.Save(ctx, "abc", history[1]); err != nil {
+			t.Fatalf("Resaving an identical record should succeed, %v instead", err)
+		}
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		records, err := store.Read(ctx, 1, 10)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("Expected 2 records, %d instead", len(records))
+		}
+		if records[0].Offset != 1 || records[0].AggregateID != "abc" || records[0].Version != 2 {
+			t.Fatalf("Mismatch: %v", records[0])
+		}
+		if records[1].Offset != 2 || records[1].AggregateID != "def" || string(records[1].Data) != "c" {
+			t.Fatalf("Mismatch: %v", records[1])
+		}
+
+		records, err = store.Read(ctx, 3, 10)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(records) != 0 {
+			t.Fatalf("Expected no records past the end of the log, %d instead", len(records))
+		}
+	})
+
+	t.Run("TornWrite", func(t *testing.T) {
+		if err := store.Close(); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		// Simulate a crash part way through appending a record
+		frame := encode(3, "abc", eventsource.Record{Version: 3, Data: []byte("torn")})
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		f.Write(frame[:len(frame)-2])
+		f.Close()
+
+		store, err = New(path)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer store.Close()
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		aside, err := ioutil.ReadFile(fmt.Sprintf("%s.tail-%d", path, info.Size()))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !bytes.Equal(aside, frame[:len(frame)-2]) {
+			t.Fatalf("Mismatch: torn record set aside as %x", aside)
+		}
+
+		found, err := store.Load(ctx, "abc", 0, 0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(found, history) {
+			t.Fatalf("Mismatch: %v", found)
+		}
+
+		if err := store.Save(ctx, "abc", eventsource.Record{Version: 3, Data: []byte("d")}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		records, err := store.Read(ctx, 3, 1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(records) != 1 || string(records[0].Data) != "d" {
+			t.Fatalf("Mismatch: %v", records)
+		}
+	})
+}
+
+func TestStoreCorrupt(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		corrupt func(log []byte)
+	}{
+		// The length of the second record runs past the end of the log
+		{"Length", func(log []byte) { binary.BigEndian.PutUint32(log[frameLen:], 1<<30) }},
+		// The length of the second record ends it within the third one
+		{"ShortLength", func(log []byte) { binary.BigEndian.PutUint32(log[frameLen:], uint32(frameLen)) }},
+		{"Checksum", func(log []byte) { log[frameLen+4]++ }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log")
+			store, err := New(path)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			for version := 1; version <= 3; version++ {
+				if err := store.Save(ctx, "abc", eventsource.Record{Version: version, Data: []byte("data")}); err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+			}
+			store.Close()
+
+			log, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			tt.corrupt(log)
+			if err := ioutil.WriteFile(path, log, 0644); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			if _, err := New(path); !eventsource.ErrHasCode(err, ErrCorrupt) {
+				t.Fatalf("Should have failed with corrupt error, %v instead", err)
+			}
+			after, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !bytes.Equal(after, log) {
+				t.Fatal("Should have left the corrupt log as it was")
+			}
+		})
+	}
+}
+
+// frameLen is the size of the frame of a record of aggregate abc with 4 bytes of data
+var frameLen = len(encode(0, "abc", eventsource.Record{Version: 1, Data: []byte("data")}))
@@ -0,0 +1,327 @@
+// Package ipam manages the addresses of node netdevs against the subnets defined as Subnet
+// aggregates: it rejects netdevs whose address or hardware address is already assigned, and
+// allocates the next free address of a subnet.
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+
+	"github.com/altairsix/eventsource"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	subnet "github.com/bensallen/warewulf4/subnet"
+)
+
+// ErrAddressConflict is the eventsource.Error code of errors returned when a netdev is assigned an
+// address or hardware address that is already assigned elsewhere, or reserved
+const ErrAddressConflict = "AddressConflict"
+
+// IsAddressConflict returns true if any error in the cause chain has the ErrAddressConflict code
+func IsAddressConflict(err error) bool {
+	return eventsource.ErrHasCode(err, ErrAddressConflict)
+}
+
+// maxScan bounds the number of addresses Next considers, as IPv6 subnets are too large to scan
+const maxScan = 1 << 20
+
+// IPAM checks and allocates addresses against the nodes and subnets of a Projection. Checks are
+// made against the read model once caught up, so callers creating nodes concurrently must
+// serialize allocations themselves.
+type IPAM struct {
+	projection *projection.Projection
+
+	// RequireSubnets rejects netdevs on subnets without a Subnet aggregate
+	RequireSubnets bool
+}
+
+// New returns an IPAM working against the nodes and subnets of p. Pass it to node.WithNetdevChecker
+// to have the Node command handler reject conflicting netdevs.
+func New(p *projection.Projection) *IPAM {
+	return &IPAM{projection: p}
+}
+
+// CheckNetdevs implements node.NetdevChecker. It returns an error with the ErrAddressConflict
+// code if a netdev uses an IP or the hardware address of a netdev of another node, or an address
+// reserved for another hardware address, and an error without it if a netdev uses the network,
+// broadcast or gateway address of its subnet, or a deleted or, with RequireSubnets, undefined
+// subnet. Further addresses of netdevs are checked against the subnets of their prefixes.
+func (m *IPAM) CheckNetdevs(ctx context.Context, nodeID string, netdevs map[string]*node.Netdev) error {
+	if err := m.projection.CatchUp(ctx); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(netdevs))
+	for key := range netdevs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		netdev := netdevs[key]
+		if netdev == nil {
+			continue
+		}
+		// Netdevs without an address are keyed by name and only checked by hardware address
+		if _, _, err := net.ParseCIDR(key); err == nil {
+			if _, err := m.subnet(key); err != nil {
+				return err
+			}
+		}
+		if netdev.HWAddr != "" {
+			if other, found := m.otherNode(projection.ByHWAddr, netdev.HWAddr, nodeID); found {
+				return eventsource.NewError(nil, ErrAddressConflict, "hardware address, %v, is already assigned to node %v", netdev.HWAddr, other)
+			}
+		}
+		prefixes, err := netdev.Prefixes(key)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			if err := m.checkAddress(nodeID, netdev, prefix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subnet returns the Subnet of cidr, or an empty one if it is not defined, and an error if it is
+// deleted or, with RequireSubnets, not defined
+func (m *IPAM) subnet(cidr string) (subnet.Subnet, error) {
+	s, ok := m.projection.Subnet(cidr)
+	if ok && s.State == "Deleted" {
+		return s, fmt.Errorf("subnet, %v, is deleted", cidr)
+	}
+	if !ok && m.RequireSubnets {
+		return s, fmt.Errorf("subnet, %v, is not defined", cidr)
+	}
+	return s, nil
+}
+
+// checkAddress checks address prefix of netdev of node nodeID against the subnet of prefix
+func (m *IPAM) checkAddress(nodeID string, netdev *node.Netdev, prefix netip.Prefix) error {
+	cidr := prefix.Masked().String()
+	s, err := m.subnet(cidr)
+	if err != nil {
+		return err
+	}
+
+	ip := net.IP(prefix.Addr().AsSlice())
+	network := &net.IPNet{IP: net.IP(prefix.Masked().Addr().AsSlice()), Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())}
+	if ip.Equal(network.IP) {
+		return fmt.Errorf("netdev IP, %v, is the network address of %v", ip, cidr)
+	}
+	if broadcast := Broadcast(network); broadcast != nil && ip.Equal(broadcast) {
+		return fmt.Errorf("netdev IP, %v, is the broadcast address of %v", ip, cidr)
+	}
+	v4, v6 := netdev.Gateways()
+	if ip.Equal(net.ParseIP(s.Gateway)) || prefix.Addr() == v4 || prefix.Addr() == v6 {
+		return fmt.Errorf("netdev IP, %v, is the gateway of %v", ip, cidr)
+	}
+	if other, found := m.otherNode(projection.ByIP, ip.String(), nodeID); found {
+		return eventsource.NewError(nil, ErrAddressConflict, "IP, %v, is already assigned to node %v", ip, other)
+	}
+	if r, reserved := s.Reservations[ip.String()]; reserved && !sameHWAddr(r.HWAddr, netdev.HWAddr) {
+		if r.HWAddr == "" {
+			return eventsource.NewError(nil, ErrAddressConflict, "IP, %v, is reserved", ip)
+		}
+		return eventsource.NewError(nil, ErrAddressConflict, "IP, %v, is reserved for %v", ip, r.HWAddr)
+	}
+	return nil
+}
+
+// otherNode returns the ID of a node other than nodeID whose attribute idx has value
+func (m *IPAM) otherNode(idx projection.Index, value, nodeID string) (string, bool) {
+	for _, n := range m.projection.NodesBy(idx, value) {
+		if n.ID != nodeID {
+			return n.ID, true
+		}
+	}
+	return "", false
+}
+
+// Request describes an address to allocate
+type Request struct {
+	Subnet  string   // Subnet in CIDR notation
+	HWAddr  string   // Hardware address the address is for; its reservation is returned, if any
+	Offset  int      // Offset in Subnet of the first address considered, 1 when zero
+	Exclude []string // Addresses to skip besides those in use, e.g. ones handed out but not yet assigned
+}
+
+// Next returns the lowest free address of r.Subnet from r.Offset. The address reserved for
+// r.HWAddr is returned if there is one. Otherwise addresses are taken from the ranges of the
+// subnet, or from the whole subnet if it has none or is not defined, skipping the network,
+// broadcast and gateway addresses, reserved addresses and those assigned to a node.
+func (m *IPAM) Next(ctx context.Context, r Request) (net.IP, error) {
+	s, network, err := m.request(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if r.HWAddr != "" {
+		for _, reservation := range sortedReservations(s.Reservations) {
+			if sameHWAddr(reservation.HWAddr, r.HWAddr) {
+				return net.ParseIP(reservation.IP), nil
+			}
+		}
+	}
+	ips, err := m.free(s, network, r, 1)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// Free returns the n lowest free addresses of r.Subnet from r.Offset, in order, as Next would
+// return them one after the other if each were assigned before the next is requested.
+// Reservations are skipped, r.HWAddr being ignored.
+func (m *IPAM) Free(ctx context.Context, r Request, n int) ([]net.IP, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	s, network, err := m.request(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return m.free(s, network, r, n)
+}
+
+// request returns the subnet addresses are requested from by r
+func (m *IPAM) request(ctx context.Context, r Request) (subnet.Subnet, *net.IPNet, error) {
+	if err := m.projection.CatchUp(ctx); err != nil {
+		return subnet.Subnet{}, nil, err
+	}
+	_, network, err := net.ParseCIDR(r.Subnet)
+	if err != nil {
+		return subnet.Subnet{}, nil, fmt.Errorf("invalid subnet, %v: %v", r.Subnet, err)
+	}
+	s, ok := m.projection.Subnet(r.Subnet)
+	if ok && s.State == "Deleted" {
+		return s, nil, fmt.Errorf("subnet, %v, is deleted", r.Subnet)
+	}
+	if !ok {
+		if m.RequireSubnets {
+			return s, nil, fmt.Errorf("subnet, %v, is not defined", r.Subnet)
+		}
+		s = subnet.Subnet{CIDR: network.String()}
+	}
+	return s, network, nil
+}
+
+// free returns the n lowest free addresses of network, whose Subnet aggregate is s, from r.Offset
+func (m *IPAM) free(s subnet.Subnet, network *net.IPNet, r Request, n int) ([]net.IP, error) {
+	offset := r.Offset
+	if offset == 0 {
+		offset = 1
+	}
+	from := add(network.IP, offset)
+	exclude := map[string]bool{}
+	for _, ip := range r.Exclude {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			exclude[parsed.String()] = true
+		}
+	}
+	broadcast := Broadcast(network)
+	gateway := net.ParseIP(s.Gateway)
+
+	ranges := s.Ranges
+	if len(ranges) == 0 {
+		ranges = []subnet.Range{{Start: network.IP.String(), End: last(network).String()}}
+	}
+	var ips []net.IP
+	for _, rng := range sortedRanges(ranges) {
+		ip, end := net.ParseIP(rng.Start), net.ParseIP(rng.End)
+		if compare(ip, from) < 0 {
+			ip = from
+		}
+		for i := 0; i < maxScan && compare(ip, end) <= 0 && network.Contains(ip); i++ {
+			if !ip.Equal(network.IP) && !ip.Equal(broadcast) && !ip.Equal(gateway) && !exclude[ip.String()] {
+				if _, reserved := s.Reservations[ip.String()]; !reserved && len(m.projection.NodesBy(projection.ByIP, ip.String())) == 0 {
+					if ips = append(ips, ip); len(ips) == n {
+						return ips, nil
+					}
+				}
+			}
+			ip = add(ip, 1)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no free address in %v", r.Subnet)
+	}
+	return nil, fmt.Errorf("only %d of %d addresses free in %v", len(ips), n, r.Subnet)
+}
+
+// Broadcast returns the broadcast address of an IPv4 network, or nil for IPv6 networks
+func Broadcast(network *net.IPNet) net.IP {
+	if network.IP.To4() == nil {
+		return nil
+	}
+	return last(network)
+}
+
+// last returns the highest address of network
+func last(network *net.IPNet) net.IP {
+	ip := normalizeIP(network.IP)
+	mask := network.Mask
+	end := make(net.IP, len(ip))
+	for i := range ip {
+		end[i] = ip[i] | ^mask[i]
+	}
+	return end
+}
+
+// add returns ip plus n, wrapping at the end of the address space
+func add(ip net.IP, n int) net.IP {
+	ip = normalizeIP(ip)
+	sum := make(net.IP, len(ip))
+	copy(sum, ip)
+	carry := n
+	for i := len(sum) - 1; i >= 0 && carry > 0; i-- {
+		v := int(sum[i]) + carry
+		sum[i] = byte(v)
+		carry = v >> 8
+	}
+	return sum
+}
+
+func compare(a, b net.IP) int {
+	return bytes.Compare(normalizeIP(a), normalizeIP(b))
+}
+
+// normalizeIP returns the 4-byte form of IPv4 addresses so that addresses compare bytewise
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func sameHWAddr(a, b string) bool {
+	x, errX := net.ParseMAC(a)
+	y, errY := net.ParseMAC(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
+
+func sortedRanges(ranges []subnet.Range) []subnet.Range {
+	sorted := make([]subnet.Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return compare(net.ParseIP(sorted[i].Start), net.ParseIP(sorted[j].Start)) < 0
+	})
+	return sorted
+}
+
+func sortedReservations(reservations map[string]subnet.Reservation) []subnet.Reservation {
+	sorted := make([]subnet.Reservation, 0, len(reservations))
+	for _, r := range reservations {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return compare(net.ParseIP(sorted[i].IP), net.ParseIP(sorted[j].IP)) < 0
+	})
+	return sorted
+}
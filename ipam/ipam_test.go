@@ -0,0 +1,198 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	subnet "github.com/bensallen/warewulf4/subnet"
+)
+
+func TestIPAM(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	subnetRepo := eventsource.New(&subnet.Subnet{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(subnet.Events()...)),
+		eventsource.WithStore(store),
+	)
+
+	p, err := projection.New(context.Background(), store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	m := New(p)
+	ctx := node.WithNetdevChecker(context.Background(), m)
+
+	s := subnet.Subnet{
+		CIDR:         "10.0.0.0/24",
+		Gateway:      "10.0.0.1",
+		Ranges:       []subnet.Range{{Start: "10.0.0.10", End: "10.0.0.13"}},
+		Reservations: map[string]subnet.Reservation{"10.0.0.11": {IP: "10.0.0.11", HWAddr: "00:11:22:33:44:0b"}},
+	}
+	if err := s.Create(ctx, subnetRepo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	n1 := node.Node{ID: "n0001", Netdevs: map[string]*node.Netdev{
+		"10.0.0.0/24": {HWAddr: "00:11:22:33:44:01", IP: "10.0.0.10"},
+	}}
+	if err := n1.Create(ctx, nodeRepo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	t.Run("Conflicts", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			netdev   node.Netdev
+			conflict bool
+		}{
+			{"IP", node.Netdev{HWAddr: "00:11:22:33:44:02", IP: "10.0.0.10"}, true},
+			{"HWAddr", node.Netdev{HWAddr: "00:11:22:33:44:01", IP: "10.0.0.20"}, true},
+			{"Reserved", node.Netdev{HWAddr: "00:11:22:33:44:02", IP: "10.0.0.11"}, true},
+			{"Network", node.Netdev{HWAddr: "00:11:22:33:44:02", IP: "10.0.0.0"}, false},
+			{"Broadcast", node.Netdev{HWAddr: "00:11:22:33:44:02", IP: "10.0.0.255"}, false},
+			{"Gateway", node.Netdev{HWAddr: "00:11:22:33:44:02", IP: "10.0.0.1"}, false},
+		}
+		for _, tt := range tests {
+			netdev := tt.netdev
+			n := node.Node{ID: "n0002", Netdevs: map[string]*node.Netdev{"10.0.0.0/24": &netdev}}
+			err := n.Create(ctx, nodeRepo)
+			if err == nil {
+				t.Fatalf("%s: should have been rejected", tt.name)
+			}
+			if IsAddressConflict(err) != tt.conflict {
+				t.Fatalf("%s: unexpected error, %v", tt.name, err)
+			}
+		}
+
+		// A node keeps its own addresses, and may take the address reserved for its netdev
+		n1.Netdevs["10.0.0.0/24"].Name = "eth0"
+		if err := n1.Update(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n := node.Node{ID: "n0002", Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:0B", IP: "10.0.0.11"},
+		}}
+		if err := n.Create(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	})
+
+	t.Run("Next", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			request Request
+			ip      string
+		}{
+			{"Range", Request{Subnet: "10.0.0.0/24"}, "10.0.0.12"},
+			{"Exclude", Request{Subnet: "10.0.0.0/24", Exclude: []string{"10.0.0.12"}}, "10.0.0.13"},
+			{"Reservation", Request{Subnet: "10.0.0.0/24", HWAddr: "00:11:22:33:44:0b"}, "10.0.0.11"},
+			{"Undefined", Request{Subnet: "10.1.0.0/24", Offset: 5}, "10.1.0.5"},
+			{"IPv6", Request{Subnet: "fd00::/64", Offset: 255}, "fd00::ff"},
+		}
+		for _, tt := range tests {
+			ip, err := m.Next(context.Background(), tt.request)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if ip.String() != tt.ip {
+				t.Fatalf("%s: expected %v, %v instead", tt.name, tt.ip, ip)
+			}
+		}
+
+		_, err := m.Next(context.Background(), Request{Subnet: "10.0.0.0/24", Exclude: []string{"10.0.0.12", "10.0.0.13"}})
+		if err == nil {
+			t.Fatal("Should have failed with no free address")
+		}
+	})
+
+	t.Run("Free", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			request Request
+			n       int
+			ips     string
+		}{
+			{"Range", Request{Subnet: "10.0.0.0/24"}, 2, "[10.0.0.12 10.0.0.13]"},
+			{"RangeExhausted", Request{Subnet: "10.0.0.0/24"}, 3, ""},
+			{"Undefined", Request{Subnet: "10.1.0.0/24", Offset: 253}, 2, "[10.1.0.253 10.1.0.254]"},
+			{"UndefinedExhausted", Request{Subnet: "10.1.0.0/24", Offset: 253}, 3, ""},
+			{"Gateway", Request{Subnet: "10.1.0.0/24", Exclude: []string{"10.1.0.2"}}, 2, "[10.1.0.1 10.1.0.3]"},
+		}
+		for _, tt := range tests {
+			ips, err := m.Free(context.Background(), tt.request, tt.n)
+			if tt.ips == "" {
+				if err == nil {
+					t.Fatalf("%s: should have failed, got %v", tt.name, ips)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if fmt.Sprint(ips) != tt.ips {
+				t.Fatalf("%s: expected %v, %v instead", tt.name, tt.ips, ips)
+			}
+		}
+	})
+
+	t.Run("DualStack", func(t *testing.T) {
+		n := node.Node{ID: "n0004", Netdevs: map[string]*node.Netdev{
+			"fd00:1::/64": {HWAddr: "00:11:22:33:44:04", IP: "fd00:1::4", Addresses: []string{"10.0.2.4/24", "fd00:2::4/64"}},
+		}}
+		if err := n.Create(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		// Addresses are compared in their normalized form, whether IP or further address
+		for _, netdev := range []*node.Netdev{
+			{HWAddr: "00:11:22:33:44:05", IP: "fd00:1:0:0::4"},
+			{HWAddr: "00:11:22:33:44:05", IP: "fd00:1::5", Addresses: []string{"fd00:2:0::4/64"}},
+			{HWAddr: "00:11:22:33:44:05", IP: "fd00:1::5", Addresses: []string{"10.0.2.4/24"}},
+		} {
+			other := node.Node{ID: "n0005", Netdevs: map[string]*node.Netdev{"fd00:1::/64": netdev}}
+			if err := other.Create(ctx, nodeRepo); !IsAddressConflict(err) {
+				t.Fatalf("Should have been an address conflict, got %v", err)
+			}
+		}
+		other := node.Node{ID: "n0005", Netdevs: map[string]*node.Netdev{
+			"fd00:1::/64": {HWAddr: "00:11:22:33:44:05", IP: "fd00:1::5", Gateway: "fd00:1::5"},
+		}}
+		if err := other.Create(ctx, nodeRepo); err == nil {
+			t.Fatal("Should have rejected the gateway address")
+		}
+
+		ip, err := m.Next(context.Background(), Request{Subnet: "fd00:1::/64", Offset: 4})
+		if err != nil || ip.String() != "fd00:1::5" {
+			t.Fatalf("Mismatch: %v %v", ip, err)
+		}
+	})
+
+	t.Run("RequireSubnets", func(t *testing.T) {
+		strict := &IPAM{projection: p, RequireSubnets: true}
+		err := strict.CheckNetdevs(context.Background(), "n0003", map[string]*node.Netdev{
+			"10.1.0.0/24": {IP: "10.1.0.5"},
+		})
+		if err == nil {
+			t.Fatal("Should have rejected an undefined subnet")
+		}
+		err = strict.CheckNetdevs(context.Background(), "n0003", map[string]*node.Netdev{
+			"10.0.0.0/24": {IP: "10.0.0.20", Addresses: []string{"fd00:3::5/64"}},
+		})
+		if err == nil {
+			t.Fatal("Should have rejected an address on an undefined subnet")
+		}
+	})
+}
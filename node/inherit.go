@@ -0,0 +1,122 @@
+package warewulf
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// SourceNode is the source of values set on the node itself, see Resolved
+const SourceNode = "node"
+
+// Resolved is a node with the settings it inherits from its profiles merged in, along with the
+// sources of its settings
+type Resolved struct {
+	Node
+
+	// Sources lists by setting the sources its value came from: SourceNode or the ID of a
+	// Profile. Settings are "Arch", "Bootstrap", "VNFS", "KernelArgs" and "Netdevs[key].Field"
+	// for each field of a netdev, e.g. "Netdevs[10.0.0.0/24].MTU". Every setting has a single
+	// source except KernelArgs, which lists each contributor in order. Settings left unset have
+	// no entry.
+	Sources map[string][]string
+}
+
+// Inherit merges the settings of profiles into n. Profiles are applied in the order given, which
+// should be that of n.Profiles, each overriding the ones before it, and the settings of n
+// override them all. A setting counts as set when it is not its zero value. KernelArgs are the
+// exception, being joined with spaces in the same order so that later arguments take precedence
+// on the kernel command line. Netdevs are merged by key, then field by field, so a profile can
+// provide the MTU or gateway of a netdev whose address is set on the node; lists such as the
+// Members of a bond are replaced as a whole. Templates keyed by a subnet only apply to nodes with
+// a netdev in that subnet, while those keyed by name, such as a bond, are added to every node.
+// Deleted profiles are skipped. n and profiles are not modified.
+func Inherit(n Node, profiles []Profile) Resolved {
+	r := Resolved{Node: n, Sources: map[string][]string{}}
+	r.Arch, r.Bootstrap, r.VNFS, r.KernelArgs = "", Ref{}, Ref{}, ""
+	r.Netdevs = nil
+
+	var args []string
+	apply := func(source string, s ProfileSettings) {
+		if s.Arch != "" {
+			r.Arch = s.Arch
+			r.Sources["Arch"] = []string{source}
+		}
+		if s.Bootstrap.ID != "" {
+			r.Bootstrap = s.Bootstrap
+			r.Sources["Bootstrap"] = []string{source}
+		}
+		if s.VNFS.ID != "" {
+			r.VNFS = s.VNFS
+			r.Sources["VNFS"] = []string{source}
+		}
+		if s.KernelArgs != "" {
+			args = append(args, s.KernelArgs)
+			r.Sources["KernelArgs"] = append(r.Sources["KernelArgs"], source)
+		}
+		for key, netdev := range s.Netdevs {
+			if netdev == nil {
+				continue
+			}
+			if _, ok := n.Netdevs[key]; !ok && isCIDR(key) {
+				// Addresses are per node, so there is nothing to template
+				continue
+			}
+			if r.Netdevs == nil {
+				r.Netdevs = map[string]*Netdev{}
+			}
+			if r.Netdevs[key] == nil {
+				r.Netdevs[key] = &Netdev{}
+			}
+			mergeNetdev(r.Netdevs[key], netdev, "Netdevs["+key+"].", source, r.Sources)
+		}
+	}
+
+	for _, p := range profiles {
+		if p.State == "Deleted" {
+			continue
+		}
+		apply(p.ID, p.settings())
+	}
+	apply(SourceNode, ProfileSettings{Arch: n.Arch, Bootstrap: n.Bootstrap, VNFS: n.VNFS, KernelArgs: n.KernelArgs, Netdevs: n.Netdevs})
+	r.KernelArgs = strings.Join(args, " ")
+
+	if r.Netdevs == nil && n.Netdevs != nil {
+		r.Netdevs = map[string]*Netdev{}
+	}
+	return r
+}
+
+// ValidateInherited returns an error if the Netdevs of n are invalid once merged with those of
+// profiles by Inherit, e.g. when a profile adds a bond whose members n does not have
+func ValidateInherited(n Node, profiles []Profile) error {
+	if err := ValidateNetdevs(Inherit(n, profiles).Netdevs); err != nil {
+		return fmt.Errorf("netdevs of node, %v, merged with its profiles are invalid: %v", n.ID, err)
+	}
+	return nil
+}
+
+// mergeNetdev sets the fields of dst to those of src that are set, recording source for each of
+// them in sources under prefix followed by the name of the field
+func mergeNetdev(dst, src *Netdev, prefix, source string, sources map[string][]string) {
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Field(i)
+		if f.IsZero() {
+			continue
+		}
+		if f.Kind() == reflect.Slice {
+			// Copy, so that dst shares no backing array with src
+			f = reflect.AppendSlice(reflect.MakeSlice(f.Type(), 0, f.Len()), f)
+		}
+		d.Field(i).Set(f)
+		sources[prefix+s.Type().Field(i).Name] = []string{source}
+	}
+}
+
+// isCIDR returns true if key is a subnet in CIDR notation
+func isCIDR(key string) bool {
+	_, _, err := net.ParseCIDR(key)
+	return err == nil
+}
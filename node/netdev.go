@@ -0,0 +1,405 @@
+package warewulf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// NetdevChecker checks the Netdevs assigned to a node against the rest of the cluster, e.g. that
+// no other node uses the same address, see the ipam package
+type NetdevChecker interface {
+	CheckNetdevs(ctx context.Context, nodeID string, netdevs map[string]*Netdev) error
+}
+
+type netdevCheckerKey struct{}
+
+// WithNetdevChecker returns a copy of ctx carrying c. The Node command handler uses the
+// NetdevChecker found in the context, if any, to check the Netdevs a node is assigned.
+func WithNetdevChecker(ctx context.Context, c NetdevChecker) context.Context {
+	return context.WithValue(ctx, netdevCheckerKey{}, c)
+}
+
+// NetdevCheckerFrom returns the NetdevChecker carried by ctx, if any
+func NetdevCheckerFrom(ctx context.Context) (NetdevChecker, bool) {
+	c, ok := ctx.Value(netdevCheckerKey{}).(NetdevChecker)
+	return c, ok && c != nil
+}
+
+// Types of Netdev
+const (
+	NetdevEthernet = ""
+	NetdevBond     = "bond"
+	NetdevBridge   = "bridge"
+	NetdevVLAN     = "vlan"
+)
+
+// BondModes are the valid values of Netdev.BondMode, as named and numbered by the Linux bonding
+// driver
+var BondModes = []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}
+
+// IPv6 modes of Netdev. With IPv6SLAAC the IPv6 addresses of a Netdev are those it is expected to
+// autoconfigure from router advertisements of their prefixes; with IPv6DHCP they are leased by
+// DHCPv6.
+const (
+	IPv6Static = ""
+	IPv6SLAAC  = "slaac"
+	IPv6DHCP   = "dhcpv6"
+)
+
+// ValidateNetdevs returns an error if a key of netdevs is neither a subnet in CIDR notation nor
+// the Name of a Netdev without an address, if a Netdev has an invalid hardware address, an IP
+// outside its subnet, a Netmask other than the subnet's or an invalid gateway, address or IPv6
+// mode, or if the bonds, bridges and VLANs of netdevs do not form a valid topology
+func ValidateNetdevs(netdevs map[string]*Netdev) error {
+	return validateNetdevs(netdevs, true)
+}
+
+// ValidateTemplates returns an error if the Netdevs of a Profile are invalid. They are checked as
+// by ValidateNetdevs, except that the netdevs a bond, bridge or VLAN is built on, and the IPv6
+// addresses an IPv6 mode applies to, may be left to nodes, and that templates cannot have the
+// hardware address, IP or addresses of a single node.
+func ValidateTemplates(netdevs map[string]*Netdev) error {
+	for key, netdev := range netdevs {
+		if netdev != nil && (netdev.HWAddr != "" || netdev.IP != "" || len(netdev.Addresses) > 0) {
+			return fmt.Errorf("netdev template on %v has a hardware address or address, which are set on nodes", key)
+		}
+	}
+	return validateNetdevs(netdevs, false)
+}
+
+// validateNetdevs implements ValidateNetdevs, and ValidateTemplates when complete is false
+func validateNetdevs(netdevs map[string]*Netdev, complete bool) error {
+	keys := make([]string, 0, len(netdevs))
+	for key := range netdevs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := map[netip.Addr]string{}
+	for _, subnet := range keys {
+		netdev := netdevs[subnet]
+		if netdev == nil {
+			continue
+		}
+		if netdev.HWAddr != "" {
+			if _, err := net.ParseMAC(netdev.HWAddr); err != nil {
+				return fmt.Errorf("netdev on %v has invalid hardware address, %v", subnet, netdev.HWAddr)
+			}
+		}
+		if netdev.IPv6Mode != IPv6Static && netdev.IPv6Mode != IPv6SLAAC && netdev.IPv6Mode != IPv6DHCP {
+			return fmt.Errorf("netdev on %v has invalid IPv6 mode, %v", subnet, netdev.IPv6Mode)
+		}
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			if subnet != netdev.Name {
+				return fmt.Errorf("netdev key, %v, is neither a subnet in CIDR notation nor the name of the netdev", subnet)
+			}
+			if netdev.IP != "" || netdev.Netmask != "" || netdev.Gateway != "" || netdev.Gateway6 != "" ||
+				len(netdev.Addresses) > 0 || netdev.IPv6Mode != IPv6Static {
+				return fmt.Errorf("netdev %v is not keyed by a subnet, so cannot have an address", subnet)
+			}
+			continue
+		}
+		if prefix != prefix.Masked() {
+			return fmt.Errorf("netdev subnet, %v, has host bits set, use %v", subnet, prefix.Masked())
+		}
+		if err := validateAddresses(subnet, prefix, netdev, complete); err != nil {
+			return err
+		}
+		addrs, err := netdev.Prefixes(subnet)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if other, ok := seen[addr.Addr()]; ok {
+				return fmt.Errorf("netdevs on %v and %v have the same address, %v", other, subnet, addr.Addr())
+			}
+			seen[addr.Addr()] = subnet
+		}
+	}
+	return validateTopology(netdevs, keys, complete)
+}
+
+// validateAddresses checks the addresses, gateways and IPv6 mode of netdev, keyed by subnet
+// prefix. Unless complete, an IPv6 mode is accepted without IPv6 addresses.
+func validateAddresses(subnet string, prefix netip.Prefix, netdev *Netdev, complete bool) error {
+	family := prefix.Addr()
+	if netdev.IP != "" {
+		ip, err := netip.ParseAddr(netdev.IP)
+		if err != nil || ip.Zone() != "" {
+			return fmt.Errorf("netdev on %v has invalid IP, %v", subnet, netdev.IP)
+		}
+		if !prefix.Contains(ip) {
+			return fmt.Errorf("netdev IP, %v, is not in subnet %v", netdev.IP, subnet)
+		}
+		family = ip
+	}
+	if netdev.Netmask != "" {
+		if !prefix.Addr().Is4() {
+			return fmt.Errorf("netdev on %v has a netmask, which only applies to IPv4 subnets", subnet)
+		}
+		mask, err := netip.ParseAddr(netdev.Netmask)
+		if err != nil || !mask.Is4() {
+			return fmt.Errorf("netdev on %v has invalid netmask, %v", subnet, netdev.Netmask)
+		}
+		if ones, bits := net.IPMask(mask.AsSlice()).Size(); bits == 0 || ones != prefix.Bits() {
+			return fmt.Errorf("netdev netmask, %v, does not match subnet %v", netdev.Netmask, subnet)
+		}
+	}
+	if netdev.Gateway != "" {
+		gw, err := netip.ParseAddr(netdev.Gateway)
+		if err != nil {
+			return fmt.Errorf("netdev on %v has invalid gateway, %v", subnet, netdev.Gateway)
+		}
+		if gw.Is4() != family.Is4() {
+			return fmt.Errorf("netdev gateway, %v, is not of the family of %v", netdev.Gateway, family)
+		}
+	}
+	if netdev.Gateway6 != "" {
+		gw, err := netip.ParseAddr(netdev.Gateway6)
+		if err != nil || !gw.Is6() || gw.Is4In6() {
+			return fmt.Errorf("netdev on %v has invalid IPv6 gateway, %v", subnet, netdev.Gateway6)
+		}
+	}
+
+	v6 := family.Is6()
+	for _, a := range netdev.Addresses {
+		addr, err := netip.ParsePrefix(a)
+		if err != nil || addr.Addr().Zone() != "" || addr.Addr().Is4In6() {
+			return fmt.Errorf("netdev on %v has invalid address, %v, addresses must be in CIDR notation", subnet, a)
+		}
+		if addr.Addr().IsUnspecified() || addr.Addr().IsMulticast() || addr.Addr().IsLoopback() {
+			return fmt.Errorf("netdev on %v has invalid address, %v", subnet, a)
+		}
+		v6 = v6 || addr.Addr().Is6()
+	}
+	if netdev.IPv6Mode != IPv6Static && !v6 && complete {
+		return fmt.Errorf("netdev on %v is in IPv6 mode %v but has no IPv6 subnet or address", subnet, netdev.IPv6Mode)
+	}
+	return nil
+}
+
+// Prefixes returns the addresses of the netdev keyed by subnet along with their prefix lengths:
+// IP with the prefix length of subnet, or of Netmask when set, followed by Addresses
+func (netdev *Netdev) Prefixes(subnet string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	if netdev.IP != "" {
+		ip, err := netip.ParseAddr(netdev.IP)
+		if err != nil {
+			return nil, fmt.Errorf("netdev on %v has invalid IP, %v", subnet, netdev.IP)
+		}
+		bits := -1
+		if netdev.Netmask != "" {
+			if mask, err := netip.ParseAddr(netdev.Netmask); err == nil && mask.Is4() {
+				if ones, size := net.IPMask(mask.AsSlice()).Size(); size != 0 {
+					bits = ones
+				}
+			}
+		} else if prefix, err := netip.ParsePrefix(subnet); err == nil {
+			bits = prefix.Bits()
+		}
+		if bits < 0 {
+			return nil, fmt.Errorf("netdev on %v has no valid prefix length for %v", subnet, netdev.IP)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip, bits))
+	}
+	for _, a := range netdev.Addresses {
+		prefix, err := netip.ParsePrefix(a)
+		if err != nil {
+			return nil, fmt.Errorf("netdev on %v has invalid address, %v", subnet, a)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// Gateways returns the IPv4 and IPv6 gateways of the netdev, each invalid if it has none
+func (netdev *Netdev) Gateways() (v4, v6 netip.Addr) {
+	if gw, err := netip.ParseAddr(netdev.Gateway); err == nil {
+		if gw.Is4() {
+			v4 = gw
+		} else {
+			v6 = gw
+		}
+	}
+	if gw, err := netip.ParseAddr(netdev.Gateway6); err == nil && !v6.IsValid() {
+		v6 = gw
+	}
+	return v4, v6
+}
+
+// validateTopology checks the links between netdevs, whose sorted keys are given: that the
+// netdevs a VLAN, bond or bridge is built on exist, that they do not form a cycle, that a netdev
+// is enslaved at most once, and that a parent carries a VLAN ID at most once. Unless complete,
+// the netdevs a VLAN, bond or bridge is built on may be missing.
+func validateTopology(netdevs map[string]*Netdev, keys []string, complete bool) error {
+	byName := map[string]*Netdev{}
+	for _, key := range keys {
+		netdev := netdevs[key]
+		if netdev == nil || netdev.Name == "" {
+			continue
+		}
+		if _, ok := byName[netdev.Name]; ok {
+			return fmt.Errorf("netdev name, %v, is used more than once", netdev.Name)
+		}
+		byName[netdev.Name] = netdev
+	}
+
+	masters := map[string]string{}
+	vlans := map[string]string{}
+	for _, key := range keys {
+		netdev := netdevs[key]
+		if netdev == nil {
+			continue
+		}
+		if netdev.MTU != 0 && (netdev.MTU < 68 || netdev.MTU > 65535) {
+			return fmt.Errorf("netdev on %v has invalid MTU, %d", key, netdev.MTU)
+		}
+		if netdev.Type != NetdevEthernet && netdev.Name == "" {
+			return fmt.Errorf("netdev on %v is a %v, so must have a name", key, netdev.Type)
+		}
+		if netdev.Type != NetdevVLAN && (netdev.VLAN != 0 || netdev.Parent != "") {
+			return fmt.Errorf("netdev on %v has a VLAN ID or parent but is not a vlan", key)
+		}
+		if netdev.Type != NetdevBond && netdev.BondMode != "" {
+			return fmt.Errorf("netdev on %v has a bond mode but is not a bond", key)
+		}
+		if netdev.Type != NetdevBond && netdev.Type != NetdevBridge && len(netdev.Members) > 0 {
+			return fmt.Errorf("netdev on %v has members but is not a bond or bridge", key)
+		}
+
+		switch netdev.Type {
+		case NetdevEthernet:
+		case NetdevVLAN:
+			if netdev.VLAN < 1 || netdev.VLAN > 4094 {
+				return fmt.Errorf("vlan %v has invalid VLAN ID, %d", netdev.Name, netdev.VLAN)
+			}
+			if _, ok := byName[netdev.Parent]; !ok && complete {
+				return fmt.Errorf("parent of vlan %v, %q, is not a netdev of the node", netdev.Name, netdev.Parent)
+			}
+			vlan := fmt.Sprintf("%v.%d", netdev.Parent, netdev.VLAN)
+			if other, ok := vlans[vlan]; ok {
+				return fmt.Errorf("vlans %v and %v have the same VLAN ID, %d, on %v", other, netdev.Name, netdev.VLAN, netdev.Parent)
+			}
+			vlans[vlan] = netdev.Name
+		case NetdevBond, NetdevBridge:
+			if netdev.Type == NetdevBond && len(netdev.Members) == 0 {
+				return fmt.Errorf("bond %v has no members", netdev.Name)
+			}
+			if netdev.BondMode != "" && !contains(BondModes, netdev.BondMode) {
+				return fmt.Errorf("bond %v has invalid mode, %v", netdev.Name, netdev.BondMode)
+			}
+			for _, name := range netdev.Members {
+				member, ok := byName[name]
+				if !ok && complete {
+					return fmt.Errorf("member of %v %v, %q, is not a netdev of the node", netdev.Type, netdev.Name, name)
+				}
+				if other, ok := masters[name]; ok {
+					return fmt.Errorf("netdev %v is a member of both %v and %v", name, other, netdev.Name)
+				}
+				masters[name] = netdev.Name
+				if member != nil && member.IP != "" {
+					return fmt.Errorf("member of %v %v, %v, cannot have an address", netdev.Type, netdev.Name, name)
+				}
+			}
+		default:
+			return fmt.Errorf("netdev on %v has invalid type, %v", key, netdev.Type)
+		}
+	}
+
+	// Each netdev is built on at most a parent or members, so a cycle is found by walking down
+	// from every netdev
+	state := map[string]int{}
+	var walk func(name string) error
+	walk = func(name string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("netdev %v is built on itself", name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, lower := range lowerNames(byName[name]) {
+			if err := walk(lower); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := walk(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lowerNames returns the names of the netdevs netdev is built on
+func lowerNames(netdev *Netdev) []string {
+	if netdev == nil {
+		return nil
+	}
+	if netdev.Type == NetdevVLAN {
+		return []string{netdev.Parent}
+	}
+	return netdev.Members
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Master returns the key and netdev of the bond or bridge the netdev named name is a member of
+func Master(netdevs map[string]*Netdev, name string) (string, *Netdev, bool) {
+	if name == "" {
+		return "", nil, false
+	}
+	for key, netdev := range netdevs {
+		if netdev != nil && contains(netdev.Members, name) {
+			return key, netdev, true
+		}
+	}
+	return "", nil, false
+}
+
+// Addressed returns the key and netdev carrying the address of the netdev with key key: the
+// netdev itself when it has an IP, otherwise the nearest bond or bridge it is enslaved to that
+// has one. It suits finding the address of a node booting from a bond member.
+func Addressed(netdevs map[string]*Netdev, key string) (string, *Netdev, bool) {
+	netdev := netdevs[key]
+	for i := 0; netdev != nil && i <= len(netdevs); i++ {
+		if netdev.IP != "" {
+			return key, netdev, true
+		}
+		var ok bool
+		if key, netdev, ok = Master(netdevs, netdev.Name); !ok {
+			break
+		}
+	}
+	return "", nil, false
+}
+
+// checkNetdevs validates netdevs and checks them with the NetdevChecker carried by ctx, if any
+func checkNetdevs(ctx context.Context, nodeID string, netdevs map[string]*Netdev) error {
+	if err := ValidateNetdevs(netdevs); err != nil {
+		return err
+	}
+	if c, ok := NetdevCheckerFrom(ctx); ok {
+		return c.CheckNetdevs(ctx, nodeID, netdevs)
+	}
+	return nil
+}
@@ -1,35 +1,155 @@
 package warewulf
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
 )
 
 //Node represents a physical or virtual system that is to be managed, provision, etc
 type Node struct {
-	ID        string
-	Version   int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	State     string
-	Arch      string
-	Bootstrap *Bootstrap
-	VNFS      *VNFS
-	Netdevs   map[string]*Netdev // Key of map[string]*Netdev is CIDR subnet, eg. 196.168.1.0/16
+	ID         string
+	Version    int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	State      string
+	Arch       string
+	Bootstrap  Ref
+	VNFS       Ref
+	Netdevs    map[string]*Netdev // Key of map[string]*Netdev is CIDR subnet, eg. 196.168.1.0/16, or the Name of a Netdev without an address
+	Profiles   []string           // Names of the profiles the node inherits from, in increasing precedence
+	KernelArgs string             // Appended to the KernelArgs of the profiles
 }
 
 //Netdev reprents a physical or virtual network adapter in a node
 type Netdev struct {
-	HWAddr  string
-	Name    string
-	IP      string
-	Netmask string
-	Gateway string
-	Domain  string
-	// VLAN    int
-	// SubNetDev []*Netdev
+	HWAddr    string
+	Name      string
+	IP        string   // IPv4 or IPv6 address in the subnet the Netdev is keyed by
+	Netmask   string   // Of IPv4 subnets only
+	Gateway   string   // Of the same family as IP
+	Gateway6  string   // IPv6 gateway of a dual-stack Netdev whose IP is IPv4
+	Addresses []string // Further addresses in CIDR notation, e.g. the IPv6 addresses of a dual-stack Netdev
+	IPv6Mode  string   // How IPv6 addresses are configured, IPv6Static when empty, or IPv6SLAAC or IPv6DHCP
+	Domain    string
+	Type      string   // NetdevEthernet when empty, or NetdevBond, NetdevBridge or NetdevVLAN
+	MTU       int      // Kernel default when zero
+	VLAN      int      // VLAN ID of a NetdevVLAN
+	Parent    string   // Name of the Netdev a NetdevVLAN is on
+	Members   []string // Names of the Netdevs enslaved to a NetdevBond or NetdevBridge
+	BondMode  string   // Mode of a NetdevBond, one of BondModes; balance-rr when empty
+}
+
+// Create saves a new Node by building a CreateNode command and applying it against the repository.
+func (n *Node) Create(ctx context.Context, repo *eventsource.Repository) error {
+	if n.ID == "" {
+		return fmt.Errorf("ID of Node must be specified")
+	}
+
+	createNode := &CreateNode{
+		CommandModel: eventsource.CommandModel{ID: n.ID},
+		Arch:         n.Arch,
+		Bootstrap:    n.Bootstrap,
+		VNFS:         n.VNFS,
+		Netdevs:      n.Netdevs,
+		Profiles:     n.Profiles,
+		KernelArgs:   n.KernelArgs,
+	}
+
+	version, err := repo.Apply(ctx, createNode)
+	if err != nil {
+		return err
+	}
+	n.Version = version
+	return nil
+}
+
+// Read attempts to fetch the Node aggregate from the event repository. n.ID must be specified
+// as it is used the aggregate ID.
+func (n *Node) Read(ctx context.Context, repo *eventsource.Repository) error {
+	if n.ID == "" {
+		return fmt.Errorf("ID of Node must be specified")
+	}
+
+	aggregate, err := repo.Load(ctx, n.ID)
+	if err != nil {
+		return err
+	}
+
+	node, ok := aggregate.(*Node)
+	if !ok {
+		return fmt.Errorf("ID returned an aggregate that is not a Node")
+	}
+
+	// Copy values of casted aggregate to *n
+	*n = *node
+
+	return nil
+}
+
+// Update applies an UpdateNode command setting each of Arch, Bootstrap, VNFS, Netdevs, Profiles
+// and KernelArgs that is set on n. Fields left at their zero value are not changed, and the
+// fields are recorded all together or, on error, not at all. n.Version is sent as the expected
+// version, so an Update of a Node obtained from Read fails with a concurrency.ErrVersionConflict
+// error if the Node has been changed since. On success n.Version is set to the new version.
+func (n *Node) Update(ctx context.Context, repo *eventsource.Repository) error {
+	if n.ID == "" {
+		return fmt.Errorf("ID of Node must be specified")
+	}
+	updateNode := &UpdateNode{
+		CommandModel:    eventsource.CommandModel{ID: n.ID},
+		ExpectedVersion: n.Version,
+		Arch:            n.Arch,
+		Bootstrap:       n.Bootstrap,
+		VNFS:            n.VNFS,
+		Netdevs:         n.Netdevs,
+		Profiles:        n.Profiles,
+		KernelArgs:      n.KernelArgs,
+	}
+	version, err := repo.Apply(ctx, updateNode)
+	if err != nil {
+		return err
+	}
+	n.Version = version
+
+	return nil
+}
+
+// Delete marks the Node as deleted by applying a DeleteNode command against the repository, with
+// n.Version as the expected version. On success n.Version is set to the new version.
+func (n *Node) Delete(ctx context.Context, repo *eventsource.Repository) error {
+	if n.ID == "" {
+		return fmt.Errorf("ID of Node must be specified")
+	}
+	deleteNode := &DeleteNode{
+		CommandModel:    eventsource.CommandModel{ID: n.ID},
+		ExpectedVersion: n.Version,
+	}
+	version, err := repo.Apply(ctx, deleteNode)
+	if err != nil {
+		return err
+	}
+	n.Version = version
+	return nil
+}
+
+// Events returns an instance of every event type of the Node aggregate, for binding to a serializer
+func Events() []eventsource.Event {
+	return []eventsource.Event{
+		NodeCreated{},
+		NodeDeleted{},
+		NodeArchSet{},
+		NodeBootstrapSet{},
+		NodeVNFSSet{},
+		NodeNetdevsSet{},
+		NodeProfilesSet{},
+		NodeKernelArgsSet{},
+		NodeSnapshotted{},
+	}
 }
 
 // NodeCreated type represents the event of a node creation
@@ -44,9 +164,9 @@ type NodeDisabled struct {
 	State string
 }
 
-// NodeDelete type represents the event disabling a node
-type NodeDelete struct {
-	eventsource.CommandModel
+// NodeDeleted type represents the event of a node being deleted
+type NodeDeleted struct {
+	eventsource.Model
 	State string
 }
 
@@ -59,13 +179,13 @@ type NodeArchSet struct {
 //NodeBootstrapSet type represents the event of a bootstrap of a node being set
 type NodeBootstrapSet struct {
 	eventsource.Model
-	Bootstrap *Bootstrap
+	Bootstrap Ref
 }
 
 //NodeVNFSSet type represents the event of a VNFS of a node being set
 type NodeVNFSSet struct {
 	eventsource.Model
-	VNFS *VNFS
+	VNFS Ref
 }
 
 //NodeNetdevsSet type represents the event of a Netdev of a node being set
@@ -74,32 +194,411 @@ type NodeNetdevsSet struct {
 	Netdevs map[string]*Netdev
 }
 
+// NodeProfilesSet represents the event of the profiles a node inherits from being set
+type NodeProfilesSet struct {
+	eventsource.Model
+	Profiles []string
+}
+
+// NodeKernelArgsSet represents the event of the kernel arguments of a node being set
+type NodeKernelArgsSet struct {
+	eventsource.Model
+	KernelArgs string
+}
+
+// NodeSnapshotted carries the full state of a Node at a version. It is produced by Snapshot for
+// snapshot stores and is not saved to the event log.
+type NodeSnapshotted struct {
+	eventsource.Model
+	Node Node
+}
+
+// Snapshot captures the current state of the Node as a NodeSnapshotted event
+func (n *Node) Snapshot() eventsource.Event {
+	return &NodeSnapshotted{
+		Model: eventsource.Model{ID: n.ID, Version: n.Version, At: time.Now()},
+		Node:  *n,
+	}
+}
+
 //On parses an event and applies the event's changes to the Node object
 func (n *Node) On(event eventsource.Event) error {
 	switch e := event.(type) {
 	case *NodeCreated:
 		n.Version = e.Model.Version
 		n.ID = e.Model.ID
+		n.State = "Created"
+		n.CreatedAt = e.At
+		n.UpdatedAt = e.At
 
 	case *NodeArchSet:
 		n.Version = e.Model.Version
+		n.UpdatedAt = e.At
 		n.Arch = e.Arch
 
 	case *NodeBootstrapSet:
 		n.Version = e.Model.Version
+		n.UpdatedAt = e.At
 		n.Bootstrap = e.Bootstrap
 
 	case *NodeVNFSSet:
 		n.Version = e.Model.Version
+		n.UpdatedAt = e.At
 		n.VNFS = e.VNFS
 
 	case *NodeNetdevsSet:
 		n.Version = e.Model.Version
+		n.UpdatedAt = e.At
 		n.Netdevs = e.Netdevs
 
+	case *NodeProfilesSet:
+		n.Version = e.Model.Version
+		n.UpdatedAt = e.At
+		n.Profiles = e.Profiles
+
+	case *NodeKernelArgsSet:
+		n.Version = e.Model.Version
+		n.UpdatedAt = e.At
+		n.KernelArgs = e.KernelArgs
+
+	case *NodeDeleted:
+		n.Version = e.Model.Version
+		n.UpdatedAt = e.At
+		n.State = "Deleted"
+
+	case *NodeSnapshotted:
+		*n = e.Node
+		n.Version = e.Model.Version
+
 	default:
-		return fmt.Errorf("unhandled event, %v", e)
+		return fmt.Errorf("unhandled event, %v, type: %s", e, reflect.TypeOf(e))
 	}
 
 	return nil
 }
+
+// CreateNode represents the command to create a node. Any of Arch, Bootstrap, VNFS, Netdevs,
+// Profiles and KernelArgs that are set are recorded along with the creation.
+type CreateNode struct {
+	eventsource.CommandModel
+	Arch       string
+	Bootstrap  Ref
+	VNFS       Ref
+	Netdevs    map[string]*Netdev
+	Profiles   []string
+	KernelArgs string
+}
+
+// SetArch represents the command to set the architecture of a node
+type SetArch struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+	Arch            string
+}
+
+// SetBootstrap represents the command to set the bootstrap of a node
+type SetBootstrap struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+	Bootstrap       Ref
+}
+
+// SetVNFS represents the command to set the VNFS of a node
+type SetVNFS struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+	VNFS            Ref
+}
+
+// SetNetdevs represents the command to set the network devices of a node
+type SetNetdevs struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+	Netdevs         map[string]*Netdev
+}
+
+// SetProfiles represents the command to set the profiles a node inherits from
+type SetProfiles struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+	Profiles        []string
+}
+
+// SetKernelArgs represents the command to set the kernel arguments of a node
+type SetKernelArgs struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+	KernelArgs      string
+}
+
+// UpdateNode represents the command to set any of the Arch, Bootstrap, VNFS, Netdevs, Profiles
+// and KernelArgs of a node at once. Fields left at their zero value are not changed.
+type UpdateNode struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+	Arch            string
+	Bootstrap       Ref
+	VNFS            Ref
+	Netdevs         map[string]*Netdev
+	Profiles        []string
+	KernelArgs      string
+}
+
+// DeleteNode represents the command to delete a node
+type DeleteNode struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the node is at this version
+}
+
+// Apply implements the CommandHandler interface for Node
+func (n *Node) Apply(ctx context.Context, command eventsource.Command) ([]eventsource.Event, error) {
+	switch command.(type) {
+	case *CreateNode:
+		if n.State != "" {
+			return nil, fmt.Errorf("node, %v, already exists", command.AggregateID())
+		}
+	default:
+		if n.State == "" {
+			return nil, fmt.Errorf("node, %v, does not exist", command.AggregateID())
+		}
+		if n.State == "Deleted" {
+			return nil, fmt.Errorf("node, %v, is deleted", command.AggregateID())
+		}
+		if err := concurrency.CheckVersion(command.AggregateID(), expectedVersion(command), n.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	version := n.Version
+	model := func() eventsource.Model {
+		version++
+		return eventsource.Model{ID: command.AggregateID(), Version: version, At: time.Now()}
+	}
+
+	switch c := command.(type) {
+	case *CreateNode:
+		events := []eventsource.Event{&NodeCreated{Model: model()}}
+		if c.Arch != "" {
+			events = append(events, &NodeArchSet{Model: model(), Arch: c.Arch})
+		}
+		if c.Bootstrap.ID != "" {
+			if err := checkBootstrap(ctx, c.Bootstrap); err != nil {
+				return nil, err
+			}
+			events = append(events, &NodeBootstrapSet{Model: model(), Bootstrap: c.Bootstrap})
+		}
+		if c.VNFS.ID != "" {
+			if err := checkVNFS(ctx, c.VNFS); err != nil {
+				return nil, err
+			}
+			events = append(events, &NodeVNFSSet{Model: model(), VNFS: c.VNFS})
+		}
+		if c.Netdevs != nil {
+			if err := checkNetdevs(ctx, command.AggregateID(), c.Netdevs); err != nil {
+				return nil, err
+			}
+			events = append(events, &NodeNetdevsSet{Model: model(), Netdevs: c.Netdevs})
+		}
+		if c.Profiles != nil {
+			if err := checkProfiles(ctx, c.Profiles); err != nil {
+				return nil, err
+			}
+			events = append(events, &NodeProfilesSet{Model: model(), Profiles: c.Profiles})
+		}
+		if c.KernelArgs != "" {
+			events = append(events, &NodeKernelArgsSet{Model: model(), KernelArgs: c.KernelArgs})
+		}
+		if err := checkInherited(ctx, command.AggregateID(), c.Netdevs, c.Profiles); err != nil {
+			return nil, err
+		}
+		return events, nil
+
+	case *SetArch:
+		if c.Arch == n.Arch {
+			return nil, nil
+		}
+		return []eventsource.Event{&NodeArchSet{Model: model(), Arch: c.Arch}}, nil
+
+	case *SetBootstrap:
+		if c.Bootstrap == n.Bootstrap {
+			return nil, nil
+		}
+		if c.Bootstrap.ID != "" {
+			if err := checkBootstrap(ctx, c.Bootstrap); err != nil {
+				return nil, err
+			}
+		}
+		return []eventsource.Event{&NodeBootstrapSet{Model: model(), Bootstrap: c.Bootstrap}}, nil
+
+	case *SetVNFS:
+		if c.VNFS == n.VNFS {
+			return nil, nil
+		}
+		if c.VNFS.ID != "" {
+			if err := checkVNFS(ctx, c.VNFS); err != nil {
+				return nil, err
+			}
+		}
+		return []eventsource.Event{&NodeVNFSSet{Model: model(), VNFS: c.VNFS}}, nil
+
+	case *SetNetdevs:
+		if reflect.DeepEqual(c.Netdevs, n.Netdevs) {
+			return nil, nil
+		}
+		if err := checkNetdevs(ctx, command.AggregateID(), c.Netdevs); err != nil {
+			return nil, err
+		}
+		if err := checkInherited(ctx, command.AggregateID(), c.Netdevs, n.Profiles); err != nil {
+			return nil, err
+		}
+		return []eventsource.Event{&NodeNetdevsSet{Model: model(), Netdevs: c.Netdevs}}, nil
+
+	case *SetProfiles:
+		if reflect.DeepEqual(c.Profiles, n.Profiles) {
+			return nil, nil
+		}
+		if err := checkProfiles(ctx, c.Profiles); err != nil {
+			return nil, err
+		}
+		if err := checkInherited(ctx, command.AggregateID(), n.Netdevs, c.Profiles); err != nil {
+			return nil, err
+		}
+		return []eventsource.Event{&NodeProfilesSet{Model: model(), Profiles: c.Profiles}}, nil
+
+	case *SetKernelArgs:
+		if c.KernelArgs == n.KernelArgs {
+			return nil, nil
+		}
+		return []eventsource.Event{&NodeKernelArgsSet{Model: model(), KernelArgs: c.KernelArgs}}, nil
+
+	case *UpdateNode:
+		var events []eventsource.Event
+		if c.Arch != "" && c.Arch != n.Arch {
+			events = append(events, &NodeArchSet{Model: model(), Arch: c.Arch})
+		}
+		if c.Bootstrap.ID != "" && c.Bootstrap != n.Bootstrap {
+			if err := checkBootstrap(ctx, c.Bootstrap); err != nil {
+				return nil, err
+			}
+			events = append(events, &NodeBootstrapSet{Model: model(), Bootstrap: c.Bootstrap})
+		}
+		if c.VNFS.ID != "" && c.VNFS != n.VNFS {
+			if err := checkVNFS(ctx, c.VNFS); err != nil {
+				return nil, err
+			}
+			events = append(events, &NodeVNFSSet{Model: model(), VNFS: c.VNFS})
+		}
+		netdevs, profiles := n.Netdevs, n.Profiles
+		if c.Netdevs != nil && !reflect.DeepEqual(c.Netdevs, n.Netdevs) {
+			if err := checkNetdevs(ctx, command.AggregateID(), c.Netdevs); err != nil {
+				return nil, err
+			}
+			netdevs = c.Netdevs
+			events = append(events, &NodeNetdevsSet{Model: model(), Netdevs: c.Netdevs})
+		}
+		if c.Profiles != nil && !reflect.DeepEqual(c.Profiles, n.Profiles) {
+			if err := checkProfiles(ctx, c.Profiles); err != nil {
+				return nil, err
+			}
+			profiles = c.Profiles
+			events = append(events, &NodeProfilesSet{Model: model(), Profiles: c.Profiles})
+		}
+		if c.KernelArgs != "" && c.KernelArgs != n.KernelArgs {
+			events = append(events, &NodeKernelArgsSet{Model: model(), KernelArgs: c.KernelArgs})
+		}
+		if !reflect.DeepEqual(netdevs, n.Netdevs) || !reflect.DeepEqual(profiles, n.Profiles) {
+			if err := checkInherited(ctx, command.AggregateID(), netdevs, profiles); err != nil {
+				return nil, err
+			}
+		}
+		return events, nil
+
+	case *DeleteNode:
+		return []eventsource.Event{&NodeDeleted{Model: model()}}, nil
+
+	default:
+		return nil, fmt.Errorf("unhandled command, %v", c)
+	}
+}
+
+// checkBootstrap ensures the Bootstrap referenced by ref exists and is not deleted, using the
+// Resolver carried by ctx, if any
+func checkBootstrap(ctx context.Context, ref Ref) error {
+	if r, ok := ResolverFrom(ctx); ok {
+		return r.checkBootstrap(ctx, ref)
+	}
+	return nil
+}
+
+// checkProfiles ensures the profiles named by names are listed once and, using the Resolver
+// carried by ctx, if any, that they exist and are not deleted
+func checkProfiles(ctx context.Context, names []string) error {
+	r, ok := ResolverFrom(ctx)
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return fmt.Errorf("profile, %v, is listed more than once", name)
+		}
+		seen[name] = true
+		if !ok {
+			continue
+		}
+		if err := r.checkProfile(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkInherited ensures the netdevs of node id are valid once merged with those of the profiles
+// named by names, which are loaded with the Resolver carried by ctx, if any
+func checkInherited(ctx context.Context, id string, netdevs map[string]*Netdev, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	r, ok := ResolverFrom(ctx)
+	if !ok {
+		return nil
+	}
+	profiles := make([]Profile, 0, len(names))
+	for _, name := range names {
+		p, err := r.Profile(ctx, name)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, *p)
+	}
+	return ValidateInherited(Node{ID: id, Netdevs: netdevs, Profiles: names}, profiles)
+}
+
+// checkVNFS ensures the VNFS referenced by ref exists and is not deleted, using the Resolver
+// carried by ctx, if any
+func checkVNFS(ctx context.Context, ref Ref) error {
+	if r, ok := ResolverFrom(ctx); ok {
+		return r.checkVNFS(ctx, ref)
+	}
+	return nil
+}
+
+// expectedVersion returns the ExpectedVersion carried by a node command
+func expectedVersion(command eventsource.Command) int {
+	switch c := command.(type) {
+	case *SetArch:
+		return c.ExpectedVersion
+	case *SetBootstrap:
+		return c.ExpectedVersion
+	case *SetVNFS:
+		return c.ExpectedVersion
+	case *SetNetdevs:
+		return c.ExpectedVersion
+	case *SetProfiles:
+		return c.ExpectedVersion
+	case *SetKernelArgs:
+		return c.ExpectedVersion
+	case *UpdateNode:
+		return c.ExpectedVersion
+	case *DeleteNode:
+		return c.ExpectedVersion
+	}
+	return 0
+}
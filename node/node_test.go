@@ -0,0 +1,525 @@
+package warewulf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	bootstrap "github.com/bensallen/warewulf4/bootstrap"
+	"github.com/bensallen/warewulf4/concurrency"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+func TestNodeOn(t *testing.T) {
+
+	t.Run("NodeCreated", func(t *testing.T) {
+		n1 := Node{}
+		timeNow := time.Now()
+		n2 := Node{
+			ID:        "test",
+			Version:   1,
+			CreatedAt: timeNow,
+			UpdatedAt: timeNow,
+			State:     "Created",
+		}
+		nodeCreated := NodeCreated{
+			Model: eventsource.Model{ID: n2.ID, Version: n2.Version, At: n2.CreatedAt},
+		}
+		err := n1.On(&nodeCreated)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if !reflect.DeepEqual(n1, n2) {
+			t.Fatalf("Mismatch: %v", n1)
+		}
+	})
+
+	t.Run("NodeDeleted", func(t *testing.T) {
+		n1 := Node{
+			ID:      "test",
+			Version: 1,
+			State:   "Created",
+		}
+		n2 := Node{
+			ID:        "test",
+			Version:   2,
+			UpdatedAt: time.Now(),
+			State:     "Deleted",
+		}
+		nodeDeleted := NodeDeleted{
+			Model: eventsource.Model{ID: n2.ID, Version: n2.Version, At: n2.UpdatedAt},
+		}
+		err := n1.On(&nodeDeleted)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if !reflect.DeepEqual(n1, n2) {
+			t.Fatalf("Mismatch: %v", n1)
+		}
+	})
+}
+
+func TestRefUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ref  Ref
+	}{
+		{"Latest", `{"Bootstrap":{"ID":"el7","Version":0}}`, Ref{ID: "el7"}},
+		{"Pinned", `{"Bootstrap":{"ID":"el7","Version":3}}`, Ref{ID: "el7", Version: 3}},
+		{"LegacyCopy", `{"Bootstrap":{"ID":"el7","Version":3,"State":"Created","Arch":"x86_64","Cmdline":"quiet"}}`, Ref{ID: "el7"}},
+		{"LegacyNil", `{"Bootstrap":null}`, Ref{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e NodeBootstrapSet
+			if err := json.Unmarshal([]byte(tt.data), &e); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if e.Bootstrap != tt.ref {
+				t.Fatalf("Mismatch: %+v", e.Bootstrap)
+			}
+		})
+	}
+}
+
+func TestNodeApply(t *testing.T) {
+	nodeID := "n0001"
+
+	serializer := eventsource.NewJSONSerializer(
+		NodeCreated{},
+		NodeArchSet{},
+		NodeBootstrapSet{},
+		NodeVNFSSet{},
+		NodeNetdevsSet{},
+		NodeDeleted{},
+	)
+	repo := eventsource.New(&Node{},
+		eventsource.WithSerializer(serializer),
+	)
+	resolver := newTestResolver(t)
+	ctx := WithResolver(context.Background(), resolver)
+
+	t.Run("SetArchBeforeCreate", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &SetArch{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			Arch:         "x86_64",
+		})
+		if err == nil {
+			t.Fatal("Should have failed with does not exist error")
+		}
+	})
+
+	t.Run("CreateNode", func(t *testing.T) {
+		vers, err := repo.Apply(ctx, &CreateNode{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			Arch:         "x86_64",
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if vers != 2 {
+			t.Fatalf("Version not 2, %d instead", vers)
+		}
+
+		node := Node{ID: nodeID}
+		if err := node.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if node.State != "Created" {
+			t.Fatalf("State not set to created, set to %s instead", node.State)
+		}
+		if node.Arch != "x86_64" {
+			t.Fatalf("Arch mismatch, set to %s instead", node.Arch)
+		}
+
+		_, err = repo.Apply(ctx, &CreateNode{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with already exists error")
+		}
+	})
+
+	t.Run("SetArch", func(t *testing.T) {
+		vers, err := repo.Apply(ctx, &SetArch{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			Arch:         "aarch64",
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if vers != 3 {
+			t.Fatalf("Version not 3, %d instead", vers)
+		}
+
+		vers, err = repo.Apply(ctx, &SetArch{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			Arch:         "aarch64",
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if vers != 3 {
+			t.Fatalf("Version changed by setting an unchanged Arch, %d instead", vers)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		node := Node{
+			ID:   nodeID,
+			VNFS: Ref{ID: "centos7"},
+			Netdevs: map[string]*Netdev{
+				"192.168.1.0/24": {HWAddr: "00:11:22:33:44:55", Name: "eth0", IP: "192.168.1.10", Netmask: "255.255.255.0"},
+			},
+		}
+		if err := node.Update(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		node = Node{ID: nodeID}
+		if err := node.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if node.Version != 5 {
+			t.Fatalf("Version not 5, %d instead", node.Version)
+		}
+		if node.VNFS.ID != "centos7" {
+			t.Fatalf("VNFS mismatch, set to %v instead", node.VNFS)
+		}
+		if nd, ok := node.Netdevs["192.168.1.0/24"]; !ok || nd.IP != "192.168.1.10" {
+			t.Fatalf("Netdevs mismatch, set to %v instead", node.Netdevs)
+		}
+		if node.Arch != "aarch64" {
+			t.Fatalf("Arch changed by Update, set to %s instead", node.Arch)
+		}
+	})
+
+	t.Run("UpdateConflict", func(t *testing.T) {
+		n1 := Node{ID: nodeID}
+		if err := n1.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n2 := n1
+
+		n1.Arch = "x86_64"
+		if err := n1.Update(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if n1.Version != 6 {
+			t.Fatalf("Version not 6, %d instead", n1.Version)
+		}
+
+		n2.Arch = "ppc64le"
+		err := n2.Update(ctx, repo)
+		if !concurrency.IsVersionConflict(err) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+	})
+
+	t.Run("UpdatePartial", func(t *testing.T) {
+		n := Node{ID: nodeID}
+		if err := n.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		version := n.Version
+
+		n.Arch = "ppc64le"
+		n.VNFS = Ref{ID: "missing"}
+		if err := n.Update(ctx, repo); err == nil {
+			t.Fatal("Should have failed with VNFS does not exist error")
+		}
+		n = Node{ID: nodeID}
+		if err := n.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if n.Version != version || n.Arch == "ppc64le" {
+			t.Fatalf("Should not have recorded the Arch of a failed Update, %v at version %d", n.Arch, n.Version)
+		}
+	})
+
+	t.Run("SetVNFSMissing", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &SetVNFS{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			VNFS:         Ref{ID: "missing"},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with VNFS does not exist error")
+		}
+
+		_, err = repo.Apply(ctx, &SetVNFS{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			VNFS:         Ref{ID: "centos7", Version: 5},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with missing version error")
+		}
+
+		// Without a Resolver in the context references are not checked
+		_, err = repo.Apply(context.Background(), &SetVNFS{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			VNFS:         Ref{ID: "sles12"},
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		_, err = repo.Apply(ctx, &SetVNFS{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			VNFS:         Ref{ID: "centos7"},
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	})
+
+	t.Run("SetVNFSDeleted", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &SetVNFS{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			VNFS:         Ref{ID: "deleted"},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with VNFS deleted error")
+		}
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		_, err := resolver.VNFSs.Apply(ctx, &vnfs.UpdateVNFS{
+			CommandModel: eventsource.CommandModel{ID: "centos7"},
+			Checksum:     "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		_, err = repo.Apply(ctx, &SetBootstrap{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			Bootstrap:    Ref{ID: "el7", Version: 1},
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		node := Node{ID: nodeID}
+		if err := node.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		b, v, err := resolver.Resolve(ctx, &node)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if v.Checksum != "sha256:3333333333333333333333333333333333333333333333333333333333333333" {
+			t.Fatalf("VNFS update not seen by node, Checksum set to %s instead", v.Checksum)
+		}
+		if b.Version != 1 || b.Initramfs.Checksum != "sha256:1111111111111111111111111111111111111111111111111111111111111111" {
+			t.Fatalf("Pinned Bootstrap version not loaded, version %d with Checksum %s instead", b.Version, b.Initramfs.Checksum)
+		}
+	})
+
+	t.Run("DeleteNode", func(t *testing.T) {
+		node := Node{ID: nodeID}
+		if err := node.Delete(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := node.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if node.State != "Deleted" {
+			t.Fatalf("State not updated to deleted, set to %s instead", node.State)
+		}
+
+		_, err := repo.Apply(ctx, &SetArch{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+			Arch:         "x86_64",
+		})
+		if err == nil {
+			t.Fatal("Should have failed with deleted error")
+		}
+		_, err = repo.Apply(ctx, &DeleteNode{
+			CommandModel: eventsource.CommandModel{ID: nodeID},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with deleted error")
+		}
+	})
+}
+
+func newTestResolver(t *testing.T) *Resolver {
+	ctx := context.Background()
+	resolver := &Resolver{
+		Bootstraps: eventsource.New(&bootstrap.Bootstrap{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(
+				bootstrap.BootstrapCreated{},
+				bootstrap.BootstrapChanged{},
+				bootstrap.BootstrapDeleted{},
+			)),
+		),
+		VNFSs: eventsource.New(&vnfs.VNFS{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(
+				vnfs.VNFSCreated{},
+				vnfs.VNFSUpdated{},
+				vnfs.VNFSDeleted{},
+			)),
+		),
+		Profiles: eventsource.New(&Profile{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(ProfileEvents()...)),
+		),
+	}
+
+	commands := []struct {
+		repo    *eventsource.Repository
+		command eventsource.Command
+	}{
+		{resolver.Bootstraps, &bootstrap.CreateBootstrap{CommandModel: eventsource.CommandModel{ID: "el7"}, Initramfs: bootstrap.File{Checksum: "sha256:1111111111111111111111111111111111111111111111111111111111111111"}}},
+		{resolver.Bootstraps, &bootstrap.UpdateBootstrap{CommandModel: eventsource.CommandModel{ID: "el7"}, Initramfs: bootstrap.File{Checksum: "sha256:2222222222222222222222222222222222222222222222222222222222222222"}}},
+		{resolver.VNFSs, &vnfs.CreateVNFS{CommandModel: eventsource.CommandModel{ID: "centos7"}, Checksum: "sha256:1111111111111111111111111111111111111111111111111111111111111111"}},
+		{resolver.VNFSs, &vnfs.CreateVNFS{CommandModel: eventsource.CommandModel{ID: "deleted"}}},
+		{resolver.VNFSs, &vnfs.DeleteVNFS{CommandModel: eventsource.CommandModel{ID: "deleted"}}},
+	}
+	for _, c := range commands {
+		if _, err := c.repo.Apply(ctx, c.command); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	return resolver
+}
+
+func TestValidateNetdevs(t *testing.T) {
+	tests := []struct {
+		name    string
+		netdevs map[string]*Netdev
+		valid   bool
+	}{
+		{"Valid", map[string]*Netdev{"10.0.0.0/24": {HWAddr: "00:11:22:33:44:55", IP: "10.0.0.10", Netmask: "255.255.255.0"}}, true},
+		{"NoAddress", map[string]*Netdev{"10.0.0.0/24": {HWAddr: "00:11:22:33:44:55"}}, true},
+		{"InvalidSubnet", map[string]*Netdev{"eth0": {IP: "10.0.0.10"}}, false},
+		{"HostBits", map[string]*Netdev{"10.0.0.1/24": {IP: "10.0.0.10"}}, false},
+		{"InvalidHWAddr", map[string]*Netdev{"10.0.0.0/24": {HWAddr: "00:11:22"}}, false},
+		{"IPOutsideSubnet", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.1.10"}}, false},
+		{"NetmaskMismatch", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10", Netmask: "255.255.0.0"}}, false},
+		{"IPv6", map[string]*Netdev{"fd00:1::/64": {IP: "fd00:1::10", Gateway: "fd00:1::1", IPv6Mode: IPv6DHCP}}, true},
+		{"DualStack", map[string]*Netdev{"10.0.0.0/24": {
+			IP: "10.0.0.10", Gateway: "10.0.0.1", Gateway6: "fe80::1",
+			Addresses: []string{"fd00:1::10/64", "10.0.1.10/24"}, IPv6Mode: IPv6SLAAC,
+		}}, true},
+		{"IPv6Netmask", map[string]*Netdev{"fd00:1::/64": {IP: "fd00:1::10", Netmask: "255.255.255.0"}}, false},
+		{"IPv6OutsideSubnet", map[string]*Netdev{"fd00:1::/64": {IP: "fd00:2::10"}}, false},
+		{"GatewayFamily", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10", Gateway: "fd00:1::1"}}, false},
+		{"Gateway6Family", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10", Gateway6: "10.0.0.1"}}, false},
+		{"InvalidAddress", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10", Addresses: []string{"fd00:1::10"}}}, false},
+		{"MulticastAddress", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10", Addresses: []string{"ff02::1/64"}}}, false},
+		{"DuplicateAddress", map[string]*Netdev{
+			"10.0.0.0/24": {IP: "10.0.0.10", Addresses: []string{"fd00:1::10/64"}},
+			"fd00:1::/64": {IP: "fd00:1::10"},
+		}, false},
+		{"InvalidIPv6Mode", map[string]*Netdev{"fd00:1::/64": {IP: "fd00:1::10", IPv6Mode: "auto"}}, false},
+		{"IPv6ModeWithoutIPv6", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10", IPv6Mode: IPv6SLAAC}}, false},
+		{"NameKeyWithAddresses", map[string]*Netdev{"eth0": {Name: "eth0", Addresses: []string{"fd00:1::10/64"}}}, false},
+		{"BondVLAN", map[string]*Netdev{
+			"eth0":           {Name: "eth0", HWAddr: "00:11:22:33:44:01"},
+			"eth1":           {Name: "eth1", HWAddr: "00:11:22:33:44:02"},
+			"bond0":          {Name: "bond0", Type: NetdevBond, BondMode: "802.3ad", Members: []string{"eth0", "eth1"}, MTU: 9000},
+			"10.0.0.0/24":    {Name: "bond0.100", Type: NetdevVLAN, Parent: "bond0", VLAN: 100, IP: "10.0.0.10"},
+			"10.0.1.0/24":    {Name: "bond0.200", Type: NetdevVLAN, Parent: "bond0", VLAN: 200, IP: "10.0.1.10"},
+			"192.168.0.0/24": {Name: "br0", Type: NetdevBridge, IP: "192.168.0.1"},
+		}, true},
+		{"NameKeyWithAddress", map[string]*Netdev{"eth0": {Name: "eth0", IP: "10.0.0.10"}}, false},
+		{"NameKeyMismatch", map[string]*Netdev{"eth0": {Name: "eth1"}}, false},
+		{"DuplicateName", map[string]*Netdev{"eth0": {Name: "eth0"}, "10.0.0.0/24": {Name: "eth0", IP: "10.0.0.10"}}, false},
+		{"InvalidType", map[string]*Netdev{"eth0": {Name: "eth0", Type: "team"}}, false},
+		{"InvalidMTU", map[string]*Netdev{"eth0": {Name: "eth0", MTU: 20}}, false},
+		{"MissingMember", map[string]*Netdev{"bond0": {Name: "bond0", Type: NetdevBond, Members: []string{"eth0"}}}, false},
+		{"NoMembers", map[string]*Netdev{"bond0": {Name: "bond0", Type: NetdevBond}}, false},
+		{"InvalidBondMode", map[string]*Netdev{
+			"eth0":  {Name: "eth0"},
+			"bond0": {Name: "bond0", Type: NetdevBond, BondMode: "lacp", Members: []string{"eth0"}},
+		}, false},
+		{"MemberTwice", map[string]*Netdev{
+			"eth0":  {Name: "eth0"},
+			"bond0": {Name: "bond0", Type: NetdevBond, Members: []string{"eth0"}},
+			"bond1": {Name: "bond1", Type: NetdevBond, Members: []string{"eth0"}},
+		}, false},
+		{"MemberWithAddress", map[string]*Netdev{
+			"10.0.0.0/24": {Name: "eth0", IP: "10.0.0.10"},
+			"bond0":       {Name: "bond0", Type: NetdevBond, Members: []string{"eth0"}},
+		}, false},
+		{"MissingParent", map[string]*Netdev{"eth0.100": {Name: "eth0.100", Type: NetdevVLAN, Parent: "eth0", VLAN: 100}}, false},
+		{"InvalidVLANID", map[string]*Netdev{
+			"eth0":     {Name: "eth0"},
+			"eth0.100": {Name: "eth0.100", Type: NetdevVLAN, Parent: "eth0", VLAN: 4095},
+		}, false},
+		{"DuplicateVLAN", map[string]*Netdev{
+			"eth0": {Name: "eth0"},
+			"mgmt": {Name: "mgmt", Type: NetdevVLAN, Parent: "eth0", VLAN: 100},
+			"stor": {Name: "stor", Type: NetdevVLAN, Parent: "eth0", VLAN: 100},
+		}, false},
+		{"Cycle", map[string]*Netdev{
+			"br0": {Name: "br0", Type: NetdevBridge, Members: []string{"v1"}},
+			"v1":  {Name: "v1", Type: NetdevVLAN, Parent: "br0", VLAN: 1},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateNetdevs(tt.netdevs)
+			if tt.valid && err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("Should have failed validation")
+			}
+		})
+	}
+}
+
+type rejectChecker struct{}
+
+func (rejectChecker) CheckNetdevs(ctx context.Context, nodeID string, netdevs map[string]*Netdev) error {
+	return fmt.Errorf("%v rejected", nodeID)
+}
+
+func TestNodeApplyNetdevChecker(t *testing.T) {
+	repo := eventsource.New(&Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(Events()...)),
+	)
+	ctx := WithNetdevChecker(context.Background(), rejectChecker{})
+
+	n := Node{ID: "n0001", Netdevs: map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.1"}}}
+	if err := n.Create(ctx, repo); err == nil {
+		t.Fatal("Should have been rejected by the checker")
+	}
+
+	// Commands not touching netdevs are not checked
+	n = Node{ID: "n0001", Arch: "x86_64"}
+	if err := n.Create(ctx, repo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err := repo.Apply(ctx, &SetNetdevs{
+		CommandModel: eventsource.CommandModel{ID: n.ID},
+		Netdevs:      map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.1"}},
+	})
+	if err == nil {
+		t.Fatal("Should have been rejected by the checker")
+	}
+}
+
+func TestAddressed(t *testing.T) {
+	netdevs := map[string]*Netdev{
+		"eth0":        {Name: "eth0", HWAddr: "00:11:22:33:44:01"},
+		"bond0":       {Name: "bond0", Type: NetdevBond, Members: []string{"eth0"}},
+		"10.0.0.0/24": {Name: "br0", Type: NetdevBridge, Members: []string{"bond0"}, IP: "10.0.0.10"},
+		"eth1":        {Name: "eth1", HWAddr: "00:11:22:33:44:02"},
+	}
+	if key, netdev, ok := Addressed(netdevs, "eth0"); !ok || key != "10.0.0.0/24" || netdev.Name != "br0" {
+		t.Fatalf("Mismatch: %v %+v", key, netdev)
+	}
+	if key, _, ok := Addressed(netdevs, "10.0.0.0/24"); !ok || key != "10.0.0.0/24" {
+		t.Fatalf("Mismatch: %v", key)
+	}
+	if _, _, ok := Addressed(netdevs, "eth1"); ok {
+		t.Fatal("Unaddressed netdev has an address")
+	}
+}
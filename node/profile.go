@@ -0,0 +1,339 @@
+package warewulf
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+// Profile holds settings shared by nodes. Nodes list the profiles they inherit from in
+// Node.Profiles, see Inherit for how the settings are merged.
+type Profile struct {
+	ID         string
+	Version    int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	State      string
+	Name       string
+	Arch       string
+	Bootstrap  Ref
+	VNFS       Ref
+	KernelArgs string             // Appended to the Cmdline of the Bootstrap
+	Netdevs    map[string]*Netdev // Templates merged into the Netdevs of nodes with the same key
+}
+
+// ProfileChecker checks an update of a Profile against the nodes inheriting from it, e.g. that
+// their netdevs stay valid, see projection.Projection.CheckProfile
+type ProfileChecker interface {
+	CheckProfile(ctx context.Context, p Profile) error
+}
+
+type profileCheckerKey struct{}
+
+// WithProfileChecker returns a copy of ctx carrying c. The Profile command handler uses the
+// ProfileChecker found in the context, if any, to check the settings a profile is updated to.
+func WithProfileChecker(ctx context.Context, c ProfileChecker) context.Context {
+	return context.WithValue(ctx, profileCheckerKey{}, c)
+}
+
+// ProfileCheckerFrom returns the ProfileChecker carried by ctx, if any
+func ProfileCheckerFrom(ctx context.Context) (ProfileChecker, bool) {
+	c, ok := ctx.Value(profileCheckerKey{}).(ProfileChecker)
+	return c, ok && c != nil
+}
+
+// ProfileID returns the aggregate ID of the Profile named name. Profiles share the event store
+// with nodes, so their IDs are prefixed to stay apart from node IDs.
+func ProfileID(name string) string {
+	return "profile:" + name
+}
+
+// Create saves a new Profile by building a CreateProfile command and applying it against the
+// repository. p.ID is set from p.Name.
+func (p *Profile) Create(ctx context.Context, repo *eventsource.Repository) error {
+	if p.Name == "" {
+		return fmt.Errorf("Name of Profile must be specified")
+	}
+	p.ID = ProfileID(p.Name)
+
+	createProfile := &CreateProfile{
+		CommandModel: eventsource.CommandModel{ID: p.ID},
+		Name:         p.Name,
+		Arch:         p.Arch,
+		Bootstrap:    p.Bootstrap,
+		VNFS:         p.VNFS,
+		KernelArgs:   p.KernelArgs,
+		Netdevs:      p.Netdevs,
+	}
+	version, err := repo.Apply(ctx, createProfile)
+	if err != nil {
+		return err
+	}
+	p.Version = version
+	return nil
+}
+
+// Read attempts to fetch the Profile aggregate from the event repository. p.ID or p.Name must be
+// specified.
+func (p *Profile) Read(ctx context.Context, repo *eventsource.Repository) error {
+	if p.ID == "" && p.Name != "" {
+		p.ID = ProfileID(p.Name)
+	}
+	if p.ID == "" {
+		return fmt.Errorf("ID of Profile must be specified")
+	}
+
+	aggregate, err := repo.Load(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+
+	profile, ok := aggregate.(*Profile)
+	if !ok {
+		return fmt.Errorf("ID returned an aggregate that is not a Profile")
+	}
+
+	// Copy values of casted aggregate to *p
+	*p = *profile
+
+	return nil
+}
+
+// Update replaces the settings of the Profile by applying an UpdateProfile command against the
+// repository, with p.Version as the expected version. On success p.Version is set to the new
+// version.
+func (p *Profile) Update(ctx context.Context, repo *eventsource.Repository) error {
+	if p.ID == "" {
+		return fmt.Errorf("ID of Profile must be specified")
+	}
+	updateProfile := &UpdateProfile{
+		CommandModel:    eventsource.CommandModel{ID: p.ID},
+		ExpectedVersion: p.Version,
+		Arch:            p.Arch,
+		Bootstrap:       p.Bootstrap,
+		VNFS:            p.VNFS,
+		KernelArgs:      p.KernelArgs,
+		Netdevs:         p.Netdevs,
+	}
+	version, err := repo.Apply(ctx, updateProfile)
+	if err != nil {
+		return err
+	}
+	p.Version = version
+	return nil
+}
+
+// Delete marks the Profile as deleted by applying a DeleteProfile command against the repository,
+// with p.Version as the expected version. Nodes still listing the profile no longer inherit from
+// it. On success p.Version is set to the new version.
+func (p *Profile) Delete(ctx context.Context, repo *eventsource.Repository) error {
+	if p.ID == "" {
+		return fmt.Errorf("ID of Profile must be specified")
+	}
+	deleteProfile := &DeleteProfile{
+		CommandModel:    eventsource.CommandModel{ID: p.ID},
+		ExpectedVersion: p.Version,
+	}
+	version, err := repo.Apply(ctx, deleteProfile)
+	if err != nil {
+		return err
+	}
+	p.Version = version
+	return nil
+}
+
+// ProfileEvents returns an instance of every event type of the Profile aggregate, for binding to
+// a serializer
+func ProfileEvents() []eventsource.Event {
+	return []eventsource.Event{
+		ProfileCreated{},
+		ProfileUpdated{},
+		ProfileDeleted{},
+	}
+}
+
+// ProfileSettings are the settings of a Profile that nodes inherit
+type ProfileSettings struct {
+	Arch       string
+	Bootstrap  Ref
+	VNFS       Ref
+	KernelArgs string
+	Netdevs    map[string]*Netdev
+}
+
+// ProfileCreated represents the event of a profile being defined
+type ProfileCreated struct {
+	eventsource.Model
+	Name string
+	ProfileSettings
+}
+
+// ProfileUpdated represents the event of the settings of a profile being replaced
+type ProfileUpdated struct {
+	eventsource.Model
+	ProfileSettings
+}
+
+// ProfileDeleted represents the event of a profile being deleted
+type ProfileDeleted struct {
+	eventsource.Model
+}
+
+// settings returns the settings of p
+func (p *Profile) settings() ProfileSettings {
+	return ProfileSettings{Arch: p.Arch, Bootstrap: p.Bootstrap, VNFS: p.VNFS, KernelArgs: p.KernelArgs, Netdevs: p.Netdevs}
+}
+
+// set replaces the settings of p
+func (p *Profile) set(s ProfileSettings) {
+	p.Arch, p.Bootstrap, p.VNFS, p.KernelArgs, p.Netdevs = s.Arch, s.Bootstrap, s.VNFS, s.KernelArgs, s.Netdevs
+}
+
+// On applies the event's changes to the Profile object
+func (p *Profile) On(event eventsource.Event) error {
+	switch e := event.(type) {
+	case *ProfileCreated:
+		p.Version = e.Model.Version
+		p.ID = e.Model.ID
+		p.State = "Created"
+		p.CreatedAt = e.At
+		p.UpdatedAt = e.At
+		p.Name = e.Name
+		p.set(e.ProfileSettings)
+
+	case *ProfileUpdated:
+		p.Version = e.Model.Version
+		p.UpdatedAt = e.At
+		p.set(e.ProfileSettings)
+
+	case *ProfileDeleted:
+		p.Version = e.Model.Version
+		p.UpdatedAt = e.At
+		p.State = "Deleted"
+
+	default:
+		return fmt.Errorf("unhandled event, %v, type: %s", e, reflect.TypeOf(e))
+	}
+
+	return nil
+}
+
+// CreateProfile represents the command to define a profile
+type CreateProfile struct {
+	eventsource.CommandModel
+	Name       string
+	Arch       string
+	Bootstrap  Ref
+	VNFS       Ref
+	KernelArgs string
+	Netdevs    map[string]*Netdev
+}
+
+// UpdateProfile represents the command to replace the settings of a profile
+type UpdateProfile struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the profile is at this version
+	Arch            string
+	Bootstrap       Ref
+	VNFS            Ref
+	KernelArgs      string
+	Netdevs         map[string]*Netdev
+}
+
+// DeleteProfile represents the command to delete a profile
+type DeleteProfile struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the profile is at this version
+}
+
+// Apply implements the CommandHandler interface for Profile. The Bootstrap and VNFS a profile
+// refers to are checked with the Resolver carried by ctx, and updates with its ProfileChecker, if
+// any.
+func (p *Profile) Apply(ctx context.Context, command eventsource.Command) ([]eventsource.Event, error) {
+	switch command.(type) {
+	case *CreateProfile:
+		if p.State != "" {
+			return nil, fmt.Errorf("profile, %v, already exists", command.AggregateID())
+		}
+	default:
+		if p.State == "" {
+			return nil, fmt.Errorf("profile, %v, does not exist", command.AggregateID())
+		}
+		if p.State == "Deleted" {
+			return nil, fmt.Errorf("profile, %v, is deleted", command.AggregateID())
+		}
+	}
+	model := eventsource.Model{ID: command.AggregateID(), Version: p.Version + 1, At: time.Now()}
+
+	switch c := command.(type) {
+	case *CreateProfile:
+		if err := validateProfileName(c.Name); err != nil {
+			return nil, err
+		}
+		if command.AggregateID() != ProfileID(c.Name) {
+			return nil, fmt.Errorf("profile, %v, must have ID %v", c.Name, ProfileID(c.Name))
+		}
+		settings := ProfileSettings{Arch: c.Arch, Bootstrap: c.Bootstrap, VNFS: c.VNFS, KernelArgs: c.KernelArgs, Netdevs: c.Netdevs}
+		if err := checkSettings(ctx, settings); err != nil {
+			return nil, err
+		}
+		return []eventsource.Event{&ProfileCreated{Model: model, Name: c.Name, ProfileSettings: settings}}, nil
+
+	case *UpdateProfile:
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, p.Version); err != nil {
+			return nil, err
+		}
+		settings := ProfileSettings{Arch: c.Arch, Bootstrap: c.Bootstrap, VNFS: c.VNFS, KernelArgs: c.KernelArgs, Netdevs: c.Netdevs}
+		if reflect.DeepEqual(settings, p.settings()) {
+			return nil, nil
+		}
+		if err := checkSettings(ctx, settings); err != nil {
+			return nil, err
+		}
+		if checker, ok := ProfileCheckerFrom(ctx); ok {
+			updated := *p
+			updated.set(settings)
+			if err := checker.CheckProfile(ctx, updated); err != nil {
+				return nil, err
+			}
+		}
+		return []eventsource.Event{&ProfileUpdated{Model: model, ProfileSettings: settings}}, nil
+
+	case *DeleteProfile:
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, p.Version); err != nil {
+			return nil, err
+		}
+		return []eventsource.Event{&ProfileDeleted{Model: model}}, nil
+
+	default:
+		return nil, fmt.Errorf("unhandled command, %v", c)
+	}
+}
+
+// validateProfileName returns an error if name cannot name a profile in Node.Profiles
+func validateProfileName(name string) error {
+	if name == "" || strings.ContainsAny(name, ", \t\n") {
+		return fmt.Errorf("profile name, %q, must be non-empty without commas or spaces", name)
+	}
+	return nil
+}
+
+// checkSettings checks the references and netdev templates of profile settings
+func checkSettings(ctx context.Context, s ProfileSettings) error {
+	if s.Bootstrap.ID != "" {
+		if err := checkBootstrap(ctx, s.Bootstrap); err != nil {
+			return err
+		}
+	}
+	if s.VNFS.ID != "" {
+		if err := checkVNFS(ctx, s.VNFS); err != nil {
+			return err
+		}
+	}
+	return ValidateTemplates(s.Netdevs)
+}
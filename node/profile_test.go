@@ -0,0 +1,296 @@
+package warewulf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+func TestProfileApply(t *testing.T) {
+	resolver := newTestResolver(t)
+	ctx := WithResolver(context.Background(), resolver)
+	nodes := eventsource.New(&Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(Events()...)),
+	)
+
+	t.Run("Create", func(t *testing.T) {
+		p := Profile{
+			Name:       "compute",
+			Arch:       "x86_64",
+			VNFS:       Ref{ID: "centos7"},
+			KernelArgs: "quiet",
+			Netdevs:    map[string]*Netdev{"10.0.0.0/24": {Name: "eth0", MTU: 9000}},
+		}
+		if err := p.Create(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if p.ID != "profile:compute" || p.Version != 1 {
+			t.Fatalf("Mismatch: ID %v at version %d", p.ID, p.Version)
+		}
+
+		p = Profile{Name: "compute"}
+		if err := p.Read(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if p.State != "Created" || p.Arch != "x86_64" || p.VNFS.ID != "centos7" || p.Netdevs["10.0.0.0/24"].MTU != 9000 {
+			t.Fatalf("Mismatch: %+v", p)
+		}
+
+		if err := (&Profile{Name: "compute"}).Create(ctx, resolver.Profiles); err == nil {
+			t.Fatal("Should have failed with already exists error")
+		}
+	})
+
+	t.Run("CreateInvalid", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			profile Profile
+		}{
+			{"NoName", Profile{}},
+			{"Space", Profile{Name: "big memory"}},
+			{"Comma", Profile{Name: "a,b"}},
+			{"MissingVNFS", Profile{Name: "missing", VNFS: Ref{ID: "missing"}}},
+			{"DeletedVNFS", Profile{Name: "deleted", VNFS: Ref{ID: "deleted"}}},
+			{"HWAddr", Profile{Name: "hwaddr", Netdevs: map[string]*Netdev{"10.0.0.0/24": {HWAddr: "00:11:22:33:44:55"}}}},
+			{"IP", Profile{Name: "ip", Netdevs: map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10"}}}},
+			{"InvalidMTU", Profile{Name: "mtu", Netdevs: map[string]*Netdev{"10.0.0.0/24": {MTU: 10}}}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if err := tt.profile.Create(ctx, resolver.Profiles); err == nil {
+					t.Fatal("Should have failed")
+				}
+			})
+		}
+
+		_, err := resolver.Profiles.Apply(ctx, &CreateProfile{CommandModel: eventsource.CommandModel{ID: "other"}, Name: "other"})
+		if err == nil {
+			t.Fatal("Should have failed with an ID not matching the name")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		p := Profile{Name: "compute"}
+		if err := p.Read(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		stale := p
+
+		if err := p.Update(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if p.Version != 1 {
+			t.Fatalf("Version changed by an unchanged Update, %d instead", p.Version)
+		}
+
+		p.KernelArgs = "quiet console=ttyS0"
+		if err := p.Update(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if p.Version != 2 {
+			t.Fatalf("Version not 2, %d instead", p.Version)
+		}
+
+		stale.Arch = "aarch64"
+		if err := stale.Update(ctx, resolver.Profiles); !concurrency.IsVersionConflict(err) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+	})
+
+	t.Run("NodeProfiles", func(t *testing.T) {
+		if err := (&Profile{Name: "ib"}).Create(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		n := Node{ID: "n0001", Profiles: []string{"compute", "ib"}, KernelArgs: "debug"}
+		if err := n.Create(ctx, nodes); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n = Node{ID: "n0001"}
+		if err := n.Read(ctx, nodes); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(n.Profiles, []string{"compute", "ib"}) || n.KernelArgs != "debug" {
+			t.Fatalf("Mismatch: Profiles %v, KernelArgs %q", n.Profiles, n.KernelArgs)
+		}
+
+		for _, profiles := range [][]string{{"missing"}, {"ib", "ib"}} {
+			_, err := nodes.Apply(ctx, &SetProfiles{CommandModel: eventsource.CommandModel{ID: "n0001"}, Profiles: profiles})
+			if err == nil {
+				t.Fatalf("Should have failed to set profiles %v", profiles)
+			}
+		}
+
+		version := n.Version
+		n.Profiles = []string{"compute", "ib"}
+		if err := n.Update(ctx, nodes); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if n.Version != version {
+			t.Fatalf("Version changed by setting unchanged profiles, %d instead", n.Version)
+		}
+	})
+
+	t.Run("InheritedNetdevs", func(t *testing.T) {
+		bonded := Profile{Name: "bonded", Netdevs: map[string]*Netdev{
+			"bond0": {Name: "bond0", Type: NetdevBond, Members: []string{"eth0", "eth1"}},
+		}}
+		if err := bonded.Create(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		members := map[string]*Netdev{
+			"eth0": {Name: "eth0", HWAddr: "00:11:22:33:44:00"},
+			"eth1": {Name: "eth1", HWAddr: "00:11:22:33:44:01"},
+		}
+
+		if err := (&Node{ID: "n0002", Profiles: []string{"bonded"}}).Create(ctx, nodes); err == nil {
+			t.Fatal("Should have failed with a bond whose members the node lacks")
+		}
+		n := Node{ID: "n0002", Profiles: []string{"bonded"}, Netdevs: members}
+		if err := n.Create(ctx, nodes); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		_, err := nodes.Apply(ctx, &SetNetdevs{CommandModel: eventsource.CommandModel{ID: "n0002"}, Netdevs: map[string]*Netdev{"eth0": members["eth0"]}})
+		if err == nil {
+			t.Fatal("Should have failed to remove a member of the inherited bond")
+		}
+		_, err = nodes.Apply(ctx, &SetProfiles{CommandModel: eventsource.CommandModel{ID: "n0001"}, Profiles: []string{"compute", "bonded"}})
+		if err == nil {
+			t.Fatal("Should have failed to inherit a bond whose members the node lacks")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		p := Profile{Name: "ib"}
+		if err := p.Read(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.Delete(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.Read(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if p.State != "Deleted" {
+			t.Fatalf("State not updated to deleted, set to %s instead", p.State)
+		}
+
+		if err := p.Update(ctx, resolver.Profiles); err == nil {
+			t.Fatal("Should have failed with deleted error")
+		}
+		_, err := nodes.Apply(ctx, &SetProfiles{CommandModel: eventsource.CommandModel{ID: "n0001"}, Profiles: []string{"ib"}})
+		if err == nil {
+			t.Fatal("Should have failed with profile deleted error")
+		}
+	})
+}
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name    string
+		netdevs map[string]*Netdev
+		valid   bool
+	}{
+		{"MTU", map[string]*Netdev{"10.0.0.0/24": {MTU: 9000, Gateway: "10.0.0.1"}}, true},
+		{"VLANWithoutParent", map[string]*Netdev{"eth0.100": {Name: "eth0.100", Type: NetdevVLAN, VLAN: 100, Parent: "eth0"}}, true},
+		{"BondWithoutMembers", map[string]*Netdev{"bond0": {Name: "bond0", Type: NetdevBond, Members: []string{"eth0", "eth1"}, BondMode: "802.3ad"}}, true},
+		{"HWAddr", map[string]*Netdev{"10.0.0.0/24": {HWAddr: "00:11:22:33:44:55"}}, false},
+		{"IP", map[string]*Netdev{"10.0.0.0/24": {IP: "10.0.0.10"}}, false},
+		{"Addresses", map[string]*Netdev{"10.0.0.0/24": {Addresses: []string{"fd00::10/64"}}}, false},
+		{"GatewayFamily", map[string]*Netdev{"10.0.0.0/24": {Gateway: "fd00::1"}}, false},
+		{"InvalidType", map[string]*Netdev{"10.0.0.0/24": {Type: "tun"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTemplates(tt.netdevs)
+			if tt.valid && err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("Should have failed validation")
+			}
+		})
+	}
+}
+
+func TestInherit(t *testing.T) {
+	base := Profile{
+		ID:         "profile:base",
+		State:      "Created",
+		Name:       "base",
+		Arch:       "x86_64",
+		Bootstrap:  Ref{ID: "el7"},
+		VNFS:       Ref{ID: "centos7"},
+		KernelArgs: "quiet",
+		Netdevs: map[string]*Netdev{
+			"10.0.0.0/24": {Name: "eth0", MTU: 1500, Gateway: "10.0.0.1"},
+			"10.1.0.0/24": {Name: "ib0", MTU: 65520},
+			"bond0":       {Name: "bond0", Type: NetdevBond, Members: []string{"eth1", "eth2"}},
+		},
+	}
+	gpu := Profile{
+		ID:         "profile:gpu",
+		State:      "Created",
+		Name:       "gpu",
+		VNFS:       Ref{ID: "cuda"},
+		KernelArgs: "nouveau.modeset=0",
+		Netdevs:    map[string]*Netdev{"10.0.0.0/24": {MTU: 9000}},
+	}
+	deleted := Profile{ID: "profile:deleted", State: "Deleted", Name: "deleted", Arch: "ppc64le"}
+	n := Node{
+		ID:         "n0001",
+		State:      "Created",
+		Bootstrap:  Ref{ID: "el8", Version: 2},
+		KernelArgs: "debug",
+		Profiles:   []string{"base", "gpu", "deleted"},
+		Netdevs: map[string]*Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:55", IP: "10.0.0.10"},
+		},
+	}
+
+	r := Inherit(n, []Profile{base, gpu, deleted})
+
+	want := map[string]*Netdev{
+		"10.0.0.0/24": {HWAddr: "00:11:22:33:44:55", Name: "eth0", IP: "10.0.0.10", Gateway: "10.0.0.1", MTU: 9000},
+		"bond0":       {Name: "bond0", Type: NetdevBond, Members: []string{"eth1", "eth2"}},
+	}
+	if r.Arch != "x86_64" || r.Bootstrap != (Ref{ID: "el8", Version: 2}) || r.VNFS.ID != "cuda" {
+		t.Fatalf("Mismatch: Arch %v, Bootstrap %v, VNFS %v", r.Arch, r.Bootstrap, r.VNFS)
+	}
+	if r.KernelArgs != "quiet nouveau.modeset=0 debug" {
+		t.Fatalf("Mismatch: KernelArgs %q", r.KernelArgs)
+	}
+	if !reflect.DeepEqual(r.Netdevs, want) {
+		t.Fatalf("Mismatch: Netdevs %v", r.Netdevs)
+	}
+	if !reflect.DeepEqual(r.Profiles, n.Profiles) || r.ID != n.ID || r.State != n.State {
+		t.Fatalf("Mismatch: %+v", r.Node)
+	}
+
+	sources := map[string][]string{
+		"Arch":                         {"profile:base"},
+		"Bootstrap":                    {SourceNode},
+		"VNFS":                         {"profile:gpu"},
+		"KernelArgs":                   {"profile:base", "profile:gpu", SourceNode},
+		"Netdevs[10.0.0.0/24].HWAddr":  {SourceNode},
+		"Netdevs[10.0.0.0/24].Name":    {"profile:base"},
+		"Netdevs[10.0.0.0/24].IP":      {SourceNode},
+		"Netdevs[10.0.0.0/24].Gateway": {"profile:base"},
+		"Netdevs[10.0.0.0/24].MTU":     {"profile:gpu"},
+		"Netdevs[bond0].Name":          {"profile:base"},
+		"Netdevs[bond0].Type":          {"profile:base"},
+		"Netdevs[bond0].Members":       {"profile:base"},
+	}
+	if !reflect.DeepEqual(r.Sources, sources) {
+		t.Fatalf("Mismatch: Sources %v", r.Sources)
+	}
+
+	// Neither the node nor the profiles are modified
+	r.Netdevs["bond0"].Members[0] = "eth3"
+	if n.Netdevs["10.0.0.0/24"].MTU != 0 || base.Netdevs["10.0.0.0/24"].MTU != 1500 || base.Netdevs["bond0"].Members[0] != "eth1" {
+		t.Fatal("Should not have modified the node or profiles")
+	}
+}
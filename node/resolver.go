@@ -0,0 +1,214 @@
+package warewulf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/altairsix/eventsource"
+	bootstrap "github.com/bensallen/warewulf4/bootstrap"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+// Ref refers to a Bootstrap or VNFS aggregate by ID. When Version is 0 the reference follows the
+// latest version of the aggregate, otherwise it is pinned to that version.
+//
+// Events recorded before nodes stored references embedded a full copy of the aggregate; those
+// copies decode into a Ref to the same ID following the latest version, see UnmarshalJSON.
+type Ref struct {
+	ID      string
+	Version int
+}
+
+// UnmarshalJSON decodes a Ref, or the copy of an aggregate embedded by an event recorded before
+// nodes stored references. The Version of such a copy is that of the aggregate when it was copied
+// rather than one the node was pinned to, so it is dropped and the Ref follows the latest version.
+func (r *Ref) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		// null, from a copy that was never set
+		return nil
+	}
+	type plain Ref
+	var ref plain
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return err
+	}
+	for key := range fields {
+		if !strings.EqualFold(key, "ID") && !strings.EqualFold(key, "Version") {
+			ref.Version = 0
+			break
+		}
+	}
+	*r = Ref(ref)
+	return nil
+}
+
+// Resolver looks up the Bootstrap, VNFS and Profile aggregates a node refers to
+type Resolver struct {
+	Bootstraps *eventsource.Repository
+	VNFSs      *eventsource.Repository
+	Profiles   *eventsource.Repository
+}
+
+type resolverKey struct{}
+
+// WithResolver returns a copy of ctx carrying r. The Node command handler uses the Resolver found
+// in the context to check that the bootstrap, VNFS and profiles a node refers to exist; with no
+// Resolver in the context references are recorded unchecked.
+func WithResolver(ctx context.Context, r *Resolver) context.Context {
+	return context.WithValue(ctx, resolverKey{}, r)
+}
+
+// ResolverFrom returns the Resolver carried by ctx, if any
+func ResolverFrom(ctx context.Context) (*Resolver, bool) {
+	r, ok := ctx.Value(resolverKey{}).(*Resolver)
+	return r, ok && r != nil
+}
+
+// Bootstrap loads the Bootstrap referenced by ref
+func (r *Resolver) Bootstrap(ctx context.Context, ref Ref) (*bootstrap.Bootstrap, error) {
+	if r.Bootstraps == nil {
+		return nil, fmt.Errorf("resolver has no Bootstrap repository")
+	}
+	aggregate, err := loadAt(ctx, r.Bootstraps, ref)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := aggregate.(*bootstrap.Bootstrap)
+	if !ok {
+		return nil, fmt.Errorf("ID, %v, returned an aggregate that is not a Bootstrap", ref.ID)
+	}
+	return b, nil
+}
+
+// VNFS loads the VNFS referenced by ref
+func (r *Resolver) VNFS(ctx context.Context, ref Ref) (*vnfs.VNFS, error) {
+	if r.VNFSs == nil {
+		return nil, fmt.Errorf("resolver has no VNFS repository")
+	}
+	aggregate, err := loadAt(ctx, r.VNFSs, ref)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := aggregate.(*vnfs.VNFS)
+	if !ok {
+		return nil, fmt.Errorf("ID, %v, returned an aggregate that is not a VNFS", ref.ID)
+	}
+	return v, nil
+}
+
+// Profile loads the latest version of the Profile named name
+func (r *Resolver) Profile(ctx context.Context, name string) (*Profile, error) {
+	if r.Profiles == nil {
+		return nil, fmt.Errorf("resolver has no Profile repository")
+	}
+	aggregate, err := r.Profiles.Load(ctx, ProfileID(name))
+	if err != nil {
+		return nil, err
+	}
+	p, ok := aggregate.(*Profile)
+	if !ok {
+		return nil, fmt.Errorf("profile, %v, returned an aggregate that is not a Profile", name)
+	}
+	return p, nil
+}
+
+// Resolve loads the Bootstrap and VNFS referenced by n. Either is nil when n has no reference set.
+func (r *Resolver) Resolve(ctx context.Context, n *Node) (*bootstrap.Bootstrap, *vnfs.VNFS, error) {
+	var (
+		b   *bootstrap.Bootstrap
+		v   *vnfs.VNFS
+		err error
+	)
+	if n.Bootstrap.ID != "" {
+		if b, err = r.Bootstrap(ctx, n.Bootstrap); err != nil {
+			return nil, nil, err
+		}
+	}
+	if n.VNFS.ID != "" {
+		if v, err = r.VNFS(ctx, n.VNFS); err != nil {
+			return nil, nil, err
+		}
+	}
+	return b, v, nil
+}
+
+// checkBootstrap returns an error if ref points to a Bootstrap that does not exist or is deleted
+func (r *Resolver) checkBootstrap(ctx context.Context, ref Ref) error {
+	b, err := r.Bootstrap(ctx, Ref{ID: ref.ID})
+	if err != nil {
+		return fmt.Errorf("Bootstrap, %v, cannot be referenced: %v", ref.ID, err)
+	}
+	return checkRef("Bootstrap", ref, b.State, b.Version)
+}
+
+// checkVNFS returns an error if ref points to a VNFS that does not exist or is deleted
+func (r *Resolver) checkVNFS(ctx context.Context, ref Ref) error {
+	v, err := r.VNFS(ctx, Ref{ID: ref.ID})
+	if err != nil {
+		return fmt.Errorf("VNFS, %v, cannot be referenced: %v", ref.ID, err)
+	}
+	return checkRef("VNFS", ref, v.State, v.Version)
+}
+
+// checkProfile returns an error if the Profile named name does not exist or is deleted
+func (r *Resolver) checkProfile(ctx context.Context, name string) error {
+	p, err := r.Profile(ctx, name)
+	if err != nil {
+		return fmt.Errorf("profile, %v, cannot be referenced: %v", name, err)
+	}
+	if p.State == "Deleted" {
+		return fmt.Errorf("profile, %v, is deleted", name)
+	}
+	return nil
+}
+
+func checkRef(kind string, ref Ref, state string, latest int) error {
+	if state == "Deleted" {
+		return fmt.Errorf("%s, %v, is deleted", kind, ref.ID)
+	}
+	if ref.Version < 0 || ref.Version > latest {
+		return fmt.Errorf("%s, %v, has no version %d", kind, ref.ID, ref.Version)
+	}
+	return nil
+}
+
+// loadAt replays the history of the aggregate referenced by ref up to and including ref.Version,
+// or its full history when ref.Version is 0.
+func loadAt(ctx context.Context, repo *eventsource.Repository, ref Ref) (eventsource.Aggregate, error) {
+	if ref.Version == 0 {
+		return repo.Load(ctx, ref.ID)
+	}
+
+	history, err := repo.Store().Load(ctx, ref.ID, 0, ref.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregate := repo.New()
+	version := 0
+	for _, record := range history {
+		if record.Version > ref.Version {
+			break
+		}
+		event, err := repo.Serializer().UnmarshalEvent(record)
+		if err != nil {
+			return nil, err
+		}
+		if err := aggregate.On(event); err != nil {
+			return nil, err
+		}
+		version = record.Version
+	}
+
+	if version != ref.Version {
+		return nil, eventsource.NewError(nil, eventsource.ErrAggregateNotFound, "no version %d of aggregate id, %v", ref.Version, ref.ID)
+	}
+
+	return aggregate, nil
+}
@@ -0,0 +1,79 @@
+package projection
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint persists the State of a Projection so that it can resume without replaying the
+// stream from offset zero
+type Checkpoint interface {
+	// Save records state, replacing any earlier checkpoint
+	Save(ctx context.Context, state State) error
+
+	// Load returns the last saved state; ok is false when nothing has been saved
+	Load(ctx context.Context) (state State, ok bool, err error)
+}
+
+// FileCheckpoint provides a Checkpoint stored as JSON in a single file
+type FileCheckpoint struct {
+	path string
+}
+
+// NewFileCheckpoint returns a FileCheckpoint stored at path
+func NewFileCheckpoint(path string) *FileCheckpoint {
+	return &FileCheckpoint{path: path}
+}
+
+// Save atomically replaces the checkpoint file
+func (f *FileCheckpoint) Save(ctx context.Context, state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".checkpoint-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Load reads the checkpoint file
+func (f *FileCheckpoint) Load(ctx context.Context) (State, bool, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return State{}, false, nil
+	}
+	if err != nil {
+		return State{}, false, err
+	}
+
+	state := State{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return State{}, false, err
+	}
+	return state, true, nil
+}
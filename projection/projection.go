@@ -0,0 +1,679 @@
+// Package projection maintains queryable read models of nodes, profiles, VNFS images,
+// bootstraps, discovered hardware addresses and subnets built from the event stream, since
+// repositories can only load aggregates by ID.
+package projection
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	bootstrap "github.com/bensallen/warewulf4/bootstrap"
+	discovery "github.com/bensallen/warewulf4/discovery"
+	node "github.com/bensallen/warewulf4/node"
+	subnet "github.com/bensallen/warewulf4/subnet"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+// Index names a node attribute the Projection can be queried by
+type Index string
+
+// Indexes maintained for nodes, on the values they resolve to with their profiles, see
+// node.Inherit. Deleted nodes are only indexed by State.
+const (
+	ByState     Index = "state"
+	ByArch      Index = "arch"
+	ByVNFS      Index = "vnfs"
+	ByBootstrap Index = "bootstrap"
+	ByHWAddr    Index = "hwaddr"
+	ByIP        Index = "ip"
+	BySubnet    Index = "subnet"
+	ByProfile   Index = "profile"
+)
+
+// batchSize is the number of records requested from the stream at a time
+const batchSize = 100
+
+// Projection builds read models of nodes, profiles, VNFS images, bootstraps, discoveries and
+// subnets from an event stream
+type Projection struct {
+	mux         sync.RWMutex
+	reader      eventsource.StreamReader
+	checkpoint  Checkpoint
+	nodes       *eventsource.JSONSerializer
+	images      *eventsource.JSONSerializer
+	bootstraps  *eventsource.JSONSerializer
+	discoveries *eventsource.JSONSerializer
+	subnets     *eventsource.JSONSerializer
+	profiles    *eventsource.JSONSerializer
+
+	state   State
+	indexes map[Index]map[string]map[string]bool
+	keys    map[string]map[Index][]string
+
+	handlers []Handler
+}
+
+// Handler is called with the events a CatchUp applied to the read model
+type Handler func(events []eventsource.Event)
+
+// State is the read model of a Projection, along with the offset of the next record to process
+type State struct {
+	Offset     uint64
+	Nodes      map[string]*node.Node
+	VNFS       map[string]*vnfs.VNFS
+	Bootstraps map[string]*bootstrap.Bootstrap
+	Discovery  map[string]*discovery.Discovery
+	Subnets    map[string]*subnet.Subnet
+	Profiles   map[string]*node.Profile
+
+	// Checksums of the artifacts referenced by any version of each VNFS and bootstrap, by ID
+	VNFSArtifacts      map[string][]string
+	BootstrapArtifacts map[string][]string
+}
+
+// New returns a Projection reading events from reader. When checkpoint is not nil the
+// Projection resumes from the last checkpoint saved to it and saves a new one after each catch
+// up; otherwise it starts from offset zero.
+func New(ctx context.Context, reader eventsource.StreamReader, checkpoint Checkpoint) (*Projection, error) {
+	p := &Projection{
+		reader:      reader,
+		checkpoint:  checkpoint,
+		nodes:       eventsource.NewJSONSerializer(node.Events()...),
+		images:      eventsource.NewJSONSerializer(vnfs.Events()...),
+		bootstraps:  eventsource.NewJSONSerializer(bootstrap.Events()...),
+		discoveries: eventsource.NewJSONSerializer(discovery.Events()...),
+		subnets:     eventsource.NewJSONSerializer(subnet.Events()...),
+		profiles:    eventsource.NewJSONSerializer(node.ProfileEvents()...),
+	}
+	p.reset(State{})
+
+	if checkpoint != nil {
+		state, ok, err := checkpoint.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			p.reset(state)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Projection) reset(state State) {
+	if state.Nodes == nil {
+		state.Nodes = map[string]*node.Node{}
+	}
+	if state.VNFS == nil {
+		state.VNFS = map[string]*vnfs.VNFS{}
+	}
+	if state.Bootstraps == nil {
+		state.Bootstraps = map[string]*bootstrap.Bootstrap{}
+	}
+	if state.Discovery == nil {
+		state.Discovery = map[string]*discovery.Discovery{}
+	}
+	if state.Subnets == nil {
+		state.Subnets = map[string]*subnet.Subnet{}
+	}
+	if state.Profiles == nil {
+		state.Profiles = map[string]*node.Profile{}
+	}
+	if state.VNFSArtifacts == nil {
+		state.VNFSArtifacts = map[string][]string{}
+	}
+	if state.BootstrapArtifacts == nil {
+		state.BootstrapArtifacts = map[string][]string{}
+	}
+
+	p.state = state
+	p.indexes = map[Index]map[string]map[string]bool{}
+	p.keys = map[string]map[Index][]string{}
+	for _, n := range state.Nodes {
+		p.index(n)
+	}
+}
+
+// Offset returns the offset of the next record the Projection will process
+func (p *Projection) Offset() uint64 {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return p.state.Offset
+}
+
+// Subscribe registers h to be called after each CatchUp that applied events, with those events
+// in stream order. Handlers run on the goroutine of CatchUp and may query the Projection.
+func (p *Projection) Subscribe(h Handler) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.handlers = append(p.handlers, h)
+}
+
+// CatchUp processes all records available from the stream, then saves a checkpoint and notifies
+// subscribers if any were processed
+func (p *Projection) CatchUp(ctx context.Context) error {
+	processed := false
+	var applied []eventsource.Event
+	for {
+		records, err := p.reader.Read(ctx, p.Offset(), batchSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		p.mux.Lock()
+		for _, record := range records {
+			if record.Offset < p.state.Offset {
+				continue
+			}
+			event, err := p.apply(record)
+			if err != nil {
+				p.mux.Unlock()
+				return err
+			}
+			if event != nil {
+				applied = append(applied, event)
+			}
+			p.state.Offset = record.Offset + 1
+		}
+		p.mux.Unlock()
+		processed = true
+	}
+
+	if !processed {
+		return nil
+	}
+
+	p.mux.RLock()
+	handlers := p.handlers
+	var err error
+	if p.checkpoint != nil {
+		err = p.checkpoint.Save(ctx, p.state)
+	}
+	p.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if len(applied) > 0 {
+		for _, h := range handlers {
+			h(applied)
+		}
+	}
+	return nil
+}
+
+// Run calls CatchUp every interval until ctx is done
+func (p *Projection) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.CatchUp(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// apply folds a record into the read model and returns its event; records of other aggregate
+// types are skipped and a nil event returned
+func (p *Projection) apply(record eventsource.StreamRecord) (eventsource.Event, error) {
+	if event, err := p.nodes.UnmarshalEvent(record.Record); err == nil {
+		n, ok := p.state.Nodes[record.AggregateID]
+		if !ok {
+			n = &node.Node{}
+		}
+		if err := n.On(event); err != nil {
+			return nil, err
+		}
+		p.state.Nodes[record.AggregateID] = n
+		p.index(n)
+		return event, nil
+	} else if !eventsource.ErrHasCode(err, eventsource.ErrUnboundEventType) {
+		return nil, err
+	}
+
+	if event, err := p.images.UnmarshalEvent(record.Record); err == nil {
+		v, ok := p.state.VNFS[record.AggregateID]
+		if !ok {
+			v = &vnfs.VNFS{}
+		}
+		if err := v.On(event); err != nil {
+			return nil, err
+		}
+		p.state.VNFS[record.AggregateID] = v
+		p.state.VNFSArtifacts[record.AggregateID] = addArtifact(p.state.VNFSArtifacts[record.AggregateID], v.Checksum)
+		return event, nil
+	} else if !eventsource.ErrHasCode(err, eventsource.ErrUnboundEventType) {
+		return nil, err
+	}
+
+	if event, err := p.bootstraps.UnmarshalEvent(record.Record); err == nil {
+		b, ok := p.state.Bootstraps[record.AggregateID]
+		if !ok {
+			b = &bootstrap.Bootstrap{}
+		}
+		if err := b.On(event); err != nil {
+			return nil, err
+		}
+		p.state.Bootstraps[record.AggregateID] = b
+		for _, f := range b.Files() {
+			p.state.BootstrapArtifacts[record.AggregateID] = addArtifact(p.state.BootstrapArtifacts[record.AggregateID], f.Checksum)
+		}
+		return event, nil
+	} else if !eventsource.ErrHasCode(err, eventsource.ErrUnboundEventType) {
+		return nil, err
+	}
+
+	if event, err := p.discoveries.UnmarshalEvent(record.Record); err == nil {
+		d, ok := p.state.Discovery[record.AggregateID]
+		if !ok {
+			d = &discovery.Discovery{}
+		}
+		if err := d.On(event); err != nil {
+			return nil, err
+		}
+		p.state.Discovery[record.AggregateID] = d
+		return event, nil
+	} else if !eventsource.ErrHasCode(err, eventsource.ErrUnboundEventType) {
+		return nil, err
+	}
+
+	if event, err := p.subnets.UnmarshalEvent(record.Record); err == nil {
+		s, ok := p.state.Subnets[record.AggregateID]
+		if !ok {
+			s = &subnet.Subnet{}
+		}
+		if err := s.On(event); err != nil {
+			return nil, err
+		}
+		p.state.Subnets[record.AggregateID] = s
+		return event, nil
+	} else if !eventsource.ErrHasCode(err, eventsource.ErrUnboundEventType) {
+		return nil, err
+	}
+
+	if event, err := p.profiles.UnmarshalEvent(record.Record); err == nil {
+		pr, ok := p.state.Profiles[record.AggregateID]
+		if !ok {
+			pr = &node.Profile{}
+		}
+		if err := pr.On(event); err != nil {
+			return nil, err
+		}
+		p.state.Profiles[record.AggregateID] = pr
+		// Nodes inheriting from the profile resolve to new values
+		for id := range p.indexes[ByProfile][pr.Name] {
+			p.index(p.state.Nodes[id])
+		}
+		return event, nil
+	} else if !eventsource.ErrHasCode(err, eventsource.ErrUnboundEventType) {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// addArtifact adds sum to the checksums of an aggregate's artifacts
+func addArtifact(sums []string, sum string) []string {
+	if sum == "" {
+		return sums
+	}
+	for _, s := range sums {
+		if s == sum {
+			return sums
+		}
+	}
+	return append(sums, sum)
+}
+
+// resolve returns n with the settings of its profiles merged in
+func (p *Projection) resolve(n *node.Node) node.Resolved {
+	profiles := make([]node.Profile, 0, len(n.Profiles))
+	for _, name := range n.Profiles {
+		if pr, ok := p.state.Profiles[node.ProfileID(name)]; ok {
+			profiles = append(profiles, *pr)
+		}
+	}
+	return node.Inherit(*n, profiles)
+}
+
+// index replaces the index entries of n
+func (p *Projection) index(n *node.Node) {
+	for idx, values := range p.keys[n.ID] {
+		for _, value := range values {
+			delete(p.indexes[idx][value], n.ID)
+			if len(p.indexes[idx][value]) == 0 {
+				delete(p.indexes[idx], value)
+			}
+		}
+	}
+
+	keys := map[Index][]string{
+		ByState: {n.State},
+	}
+	if n.State != "Deleted" {
+		keys[ByProfile] = n.Profiles
+		n := p.resolve(n)
+		keys[ByArch] = []string{n.Arch}
+		keys[ByVNFS] = []string{n.VNFS.ID}
+		keys[ByBootstrap] = []string{n.Bootstrap.ID}
+		for subnet, netdev := range n.Netdevs {
+			if netdev == nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(subnet); err == nil {
+				keys[BySubnet] = append(keys[BySubnet], subnet)
+			}
+			keys[ByHWAddr] = append(keys[ByHWAddr], normalize(ByHWAddr, netdev.HWAddr))
+			keys[ByIP] = append(keys[ByIP], normalize(ByIP, netdev.IP))
+			for _, addr := range netdev.Addresses {
+				if prefix, err := netip.ParsePrefix(addr); err == nil {
+					keys[ByIP] = append(keys[ByIP], prefix.Addr().String())
+				}
+			}
+		}
+	}
+
+	for idx, values := range keys {
+		for _, value := range values {
+			if value == "" {
+				continue
+			}
+			if p.indexes[idx] == nil {
+				p.indexes[idx] = map[string]map[string]bool{}
+			}
+			if p.indexes[idx][value] == nil {
+				p.indexes[idx][value] = map[string]bool{}
+			}
+			p.indexes[idx][value][n.ID] = true
+		}
+	}
+	p.keys[n.ID] = keys
+}
+
+func normalize(idx Index, value string) string {
+	switch idx {
+	case ByHWAddr:
+		return strings.ToLower(value)
+	case ByIP:
+		if ip, err := netip.ParseAddr(value); err == nil {
+			return ip.String()
+		}
+	}
+	return value
+}
+
+// Node returns the node with the given ID, with the settings of its profiles merged in
+func (p *Projection) Node(id string) (node.Node, bool) {
+	r, ok := p.Resolved(id)
+	return r.Node, ok
+}
+
+// Resolved returns the node with the given ID with the settings of its profiles merged in, along
+// with the sources of its settings, see node.Inherit
+func (p *Projection) Resolved(id string) (node.Resolved, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	n, ok := p.state.Nodes[id]
+	if !ok {
+		return node.Resolved{}, false
+	}
+	return p.resolve(n), true
+}
+
+// Nodes returns all nodes that are not deleted, sorted by ID, with the settings of their
+// profiles merged in
+func (p *Projection) Nodes() []node.Node {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	nodes := make([]node.Node, 0, len(p.state.Nodes))
+	for _, n := range p.state.Nodes {
+		if n.State != "Deleted" {
+			nodes = append(nodes, p.resolve(n).Node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// NodesBy returns the nodes whose attribute idx has value, sorted by ID, with the settings of
+// their profiles merged in
+func (p *Projection) NodesBy(idx Index, value string) []node.Node {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	ids := p.indexes[idx][normalize(idx, value)]
+	nodes := make([]node.Node, 0, len(ids))
+	for id := range ids {
+		nodes = append(nodes, p.resolve(p.state.Nodes[id]).Node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Profile returns the profile with the given name
+func (p *Projection) Profile(name string) (node.Profile, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	pr, ok := p.state.Profiles[node.ProfileID(name)]
+	if !ok {
+		return node.Profile{}, false
+	}
+	return *pr, true
+}
+
+// Profiles returns all profiles that are not deleted, sorted by name
+func (p *Projection) Profiles() []node.Profile {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	profiles := make([]node.Profile, 0, len(p.state.Profiles))
+	for _, pr := range p.state.Profiles {
+		if pr.State != "Deleted" {
+			profiles = append(profiles, *pr)
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// CheckProfile implements node.ProfileChecker. It returns an error naming the nodes inheriting
+// from pr whose netdevs would be invalid with pr in place of the current version of the profile.
+// Pass the Projection to node.WithProfileChecker to have the Profile command handler reject such
+// updates.
+func (p *Projection) CheckProfile(ctx context.Context, pr node.Profile) error {
+	if err := p.CatchUp(ctx); err != nil {
+		return err
+	}
+
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	var broken []string
+	errs := map[string]error{}
+	for id := range p.indexes[ByProfile][pr.Name] {
+		n := p.state.Nodes[id]
+		profiles := make([]node.Profile, 0, len(n.Profiles))
+		for _, name := range n.Profiles {
+			if name == pr.Name {
+				profiles = append(profiles, pr)
+			} else if other, ok := p.state.Profiles[node.ProfileID(name)]; ok {
+				profiles = append(profiles, *other)
+			}
+		}
+		if err := node.ValidateInherited(*n, profiles); err != nil {
+			broken = append(broken, id)
+			errs[id] = err
+		}
+	}
+	if len(broken) > 0 {
+		sort.Strings(broken)
+		return fmt.Errorf("profile, %v, would break nodes %v: %v", pr.Name, strings.Join(broken, ","), errs[broken[0]])
+	}
+	return nil
+}
+
+// VNFS returns the VNFS with the given ID
+func (p *Projection) VNFS(id string) (vnfs.VNFS, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	v, ok := p.state.VNFS[id]
+	if !ok {
+		return vnfs.VNFS{}, false
+	}
+	return *v, true
+}
+
+// VNFSs returns all VNFS images that are not deleted, sorted by ID
+func (p *Projection) VNFSs() []vnfs.VNFS {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	images := make([]vnfs.VNFS, 0, len(p.state.VNFS))
+	for _, v := range p.state.VNFS {
+		if v.State != "Deleted" {
+			images = append(images, *v)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images
+}
+
+// Bootstrap returns the bootstrap with the given ID
+func (p *Projection) Bootstrap(id string) (bootstrap.Bootstrap, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	b, ok := p.state.Bootstraps[id]
+	if !ok {
+		return bootstrap.Bootstrap{}, false
+	}
+	return *b, true
+}
+
+// Bootstraps returns all bootstraps that are not deleted, sorted by ID
+func (p *Projection) Bootstraps() []bootstrap.Bootstrap {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	bootstraps := make([]bootstrap.Bootstrap, 0, len(p.state.Bootstraps))
+	for _, b := range p.state.Bootstraps {
+		if b.State != "Deleted" {
+			bootstraps = append(bootstraps, *b)
+		}
+	}
+	sort.Slice(bootstraps, func(i, j int) bool { return bootstraps[i].ID < bootstraps[j].ID })
+	return bootstraps
+}
+
+// Discovery returns the discovery of the hardware address hwaddr
+func (p *Projection) Discovery(hwaddr string) (discovery.Discovery, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	d, ok := p.state.Discovery[discovery.ID(hwaddr)]
+	if !ok {
+		return discovery.Discovery{}, false
+	}
+	return *d, true
+}
+
+// Discoveries returns the discoveries in state, Pending, Accepted or Rejected, in the order they
+// were first seen
+func (p *Projection) Discoveries(state string) []discovery.Discovery {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	discoveries := []discovery.Discovery{}
+	for _, d := range p.state.Discovery {
+		if d.State == state {
+			discoveries = append(discoveries, *d)
+		}
+	}
+	sort.Slice(discoveries, func(i, j int) bool {
+		if !discoveries[i].CreatedAt.Equal(discoveries[j].CreatedAt) {
+			return discoveries[i].CreatedAt.Before(discoveries[j].CreatedAt)
+		}
+		return discoveries[i].HWAddr < discoveries[j].HWAddr
+	})
+	return discoveries
+}
+
+// Subnet returns the subnet with the given CIDR
+func (p *Projection) Subnet(cidr string) (subnet.Subnet, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	s, ok := p.state.Subnets[subnet.ID(cidr)]
+	if !ok {
+		return subnet.Subnet{}, false
+	}
+	return *s, true
+}
+
+// Subnets returns all subnets that are not deleted, sorted by CIDR
+func (p *Projection) Subnets() []subnet.Subnet {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	subnets := make([]subnet.Subnet, 0, len(p.state.Subnets))
+	for _, s := range p.state.Subnets {
+		if s.State != "Deleted" {
+			subnets = append(subnets, *s)
+		}
+	}
+	sort.Slice(subnets, func(i, j int) bool { return subnets[i].CIDR < subnets[j].CIDR })
+	return subnets
+}
+
+// Artifacts returns the checksums of the artifacts referenced by any version of a VNFS or bootstrap
+// that is not deleted, sorted. Nodes may be pinned to any version of these, so their artifacts
+// must be kept; see artifact.Store.GC.
+func (p *Projection) Artifacts() []string {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	live := map[string]bool{}
+	for id, sums := range p.state.VNFSArtifacts {
+		if v := p.state.VNFS[id]; v != nil && v.State != "Deleted" {
+			for _, sum := range sums {
+				live[sum] = true
+			}
+		}
+	}
+	for id, sums := range p.state.BootstrapArtifacts {
+		if b := p.state.Bootstraps[id]; b != nil && b.State != "Deleted" {
+			for _, sum := range sums {
+				live[sum] = true
+			}
+		}
+	}
+
+	sums := make([]string, 0, len(live))
+	for sum := range live {
+		sums = append(sums, sum)
+	}
+	sort.Strings(sums)
+	return sums
+}
@@ -0,0 +1,362 @@
+package projection
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/artifact"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+func TestProjection(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+
+	vnfsRepo := eventsource.New(&vnfs.VNFS{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(vnfs.Events()...)),
+		eventsource.WithStore(store),
+	)
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := node.WithResolver(context.Background(), &node.Resolver{VNFSs: vnfsRepo})
+
+	for _, id := range []string{"centos7", "sles12"} {
+		v := vnfs.VNFS{ID: id, Arch: "x86_64"}
+		if err := v.Create(ctx, vnfsRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	nodes := []node.Node{
+		{ID: "n0001", Arch: "x86_64", VNFS: node.Ref{ID: "centos7"}, Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:01", IP: "10.0.0.1"},
+		}},
+		{ID: "n0002", Arch: "x86_64", VNFS: node.Ref{ID: "centos7"}, Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:02", IP: "10.0.0.2"},
+		}},
+		{ID: "n0003", Arch: "aarch64", VNFS: node.Ref{ID: "sles12"}},
+	}
+	for _, n := range nodes {
+		if err := n.Create(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	checkpoint := NewFileCheckpoint(filepath.Join(dir, "checkpoint"))
+	p, err := New(ctx, store, checkpoint)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	t.Run("CatchUp", func(t *testing.T) {
+		if err := p.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		if got := len(p.Nodes()); got != 3 {
+			t.Fatalf("Expected 3 nodes, %d instead", got)
+		}
+		if got := len(p.VNFSs()); got != 2 {
+			t.Fatalf("Expected 2 VNFS, %d instead", got)
+		}
+		if got := ids(p.NodesBy(ByVNFS, "centos7")); got != "n0001,n0002" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(ByArch, "aarch64")); got != "n0003" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(ByHWAddr, "00:11:22:33:44:0A")); got != "" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(ByHWAddr, "00:11:22:33:44:01")); got != "n0001" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(ByIP, "10.0.0.2")); got != "n0002" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(BySubnet, "10.0.0.0/24")); got != "n0001,n0002" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		n := node.Node{ID: "n0001"}
+		if err := n.Read(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n.VNFS = node.Ref{ID: "sles12"}
+		if err := n.Update(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n2 := node.Node{ID: "n0002"}
+		if err := n2.Delete(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		resumed, err := New(ctx, store, checkpoint)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if resumed.Offset() != p.Offset() {
+			t.Fatalf("Checkpoint offset %d, expected %d", resumed.Offset(), p.Offset())
+		}
+		var applied []eventsource.Event
+		resumed.Subscribe(func(events []eventsource.Event) { applied = append(applied, events...) })
+		if err := resumed.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(applied) != 2 {
+			t.Fatalf("Expected 2 events, %d instead", len(applied))
+		}
+		if _, ok := applied[0].(*node.NodeVNFSSet); !ok {
+			t.Fatalf("Mismatch: %T", applied[0])
+		}
+		if _, ok := applied[1].(*node.NodeDeleted); !ok {
+			t.Fatalf("Mismatch: %T", applied[1])
+		}
+
+		if got := ids(resumed.NodesBy(ByVNFS, "centos7")); got != "" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(resumed.NodesBy(ByVNFS, "sles12")); got != "n0001,n0003" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(resumed.NodesBy(ByState, "Deleted")); got != "n0002" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(resumed.NodesBy(ByIP, "10.0.0.2")); got != "" {
+			t.Fatalf("Deleted node still indexed by IP: %s", got)
+		}
+		if got := len(resumed.Nodes()); got != 2 {
+			t.Fatalf("Expected 2 nodes, %d instead", got)
+		}
+	})
+}
+
+func TestProjectionArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+	artifacts, err := artifact.New(filepath.Join(dir, "artifacts"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	repo := eventsource.New(&vnfs.VNFS{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(vnfs.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := artifact.WithStore(context.Background(), artifacts)
+
+	put := func(data string) (string, string) {
+		sum, path, err := artifacts.Put(strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return sum, path
+	}
+	v1Sum, v1Path := put("centos7 v1")
+	v2Sum, v2Path := put("centos7 v2")
+	slesSum, slesPath := put("sles12")
+
+	if err := (&vnfs.VNFS{ID: "centos7", Path: "/srv/centos7.img", Checksum: v1Sum}).Create(ctx, repo); err == nil {
+		t.Fatal("Path outside the artifact store should have been rejected")
+	}
+
+	centos := vnfs.VNFS{ID: "centos7", Path: v1Path, Checksum: v1Sum}
+	if err := centos.Create(ctx, repo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	centos.Path, centos.Checksum = v2Path, v2Sum
+	if err := centos.Update(ctx, repo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sles := vnfs.VNFS{ID: "sles12", Path: slesPath, Checksum: slesSum}
+	if err := sles.Create(ctx, repo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := sles.Delete(ctx, repo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	p, err := New(ctx, store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	live := p.Artifacts()
+	if strings.Join(live, ",") != strings.Join(sorted(v1Sum, v2Sum), ",") {
+		t.Fatalf("Mismatch: %v", live)
+	}
+	removed, err := artifacts.GC(live, 0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != slesPath || !artifacts.Has(v1Sum) {
+		t.Fatalf("Only the deleted VNFS image should be collected: %v", removed)
+	}
+}
+
+func TestProjectionProfiles(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+
+	resolver := &node.Resolver{
+		VNFSs: eventsource.New(&vnfs.VNFS{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(vnfs.Events()...)),
+			eventsource.WithStore(store),
+		),
+		Profiles: eventsource.New(&node.Profile{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(node.ProfileEvents()...)),
+			eventsource.WithStore(store),
+		),
+	}
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := node.WithResolver(context.Background(), resolver)
+
+	for _, id := range []string{"centos7", "sles12"} {
+		if err := (&vnfs.VNFS{ID: id}).Create(ctx, resolver.VNFSs); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	compute := node.Profile{Name: "compute", Arch: "x86_64", VNFS: node.Ref{ID: "centos7"}, Netdevs: map[string]*node.Netdev{
+		"10.0.0.0/24": {Name: "eth0", MTU: 9000},
+	}}
+	if err := compute.Create(ctx, resolver.Profiles); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	nodes := []node.Node{
+		{ID: "n0001", Profiles: []string{"compute"}, Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:01", IP: "10.0.0.1"},
+		}},
+		{ID: "n0002", Profiles: []string{"compute"}, VNFS: node.Ref{ID: "sles12"}},
+		{ID: "n0003", Arch: "aarch64"},
+	}
+	for _, n := range nodes {
+		if err := n.Create(ctx, nodeRepo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	p, err := New(ctx, store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	t.Run("Resolved", func(t *testing.T) {
+		n, ok := p.Node("n0001")
+		if !ok || n.Arch != "x86_64" || n.VNFS.ID != "centos7" || n.Netdevs["10.0.0.0/24"].MTU != 9000 || n.Netdevs["10.0.0.0/24"].IP != "10.0.0.1" {
+			t.Fatalf("Mismatch: %+v", n)
+		}
+		r, ok := p.Resolved("n0002")
+		if !ok || r.VNFS.ID != "sles12" || r.Sources["VNFS"][0] != node.SourceNode || r.Sources["Arch"][0] != "profile:compute" {
+			t.Fatalf("Mismatch: %+v", r)
+		}
+		if pr, ok := p.Profile("compute"); !ok || pr.Version != 1 {
+			t.Fatalf("Mismatch: %+v", pr)
+		}
+		if got := ids(p.NodesBy(ByArch, "x86_64")); got != "n0001,n0002" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(ByProfile, "compute")); got != "n0001,n0002" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+	})
+
+	t.Run("ProfileUpdated", func(t *testing.T) {
+		compute.Arch = "aarch64"
+		if err := compute.Update(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if got := ids(p.NodesBy(ByArch, "aarch64")); got != "n0001,n0002,n0003" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(ByArch, "x86_64")); got != "" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+	})
+
+	t.Run("ProfileBreaksNodes", func(t *testing.T) {
+		ctx := node.WithProfileChecker(ctx, p)
+		bonded := compute
+		bonded.Netdevs = map[string]*node.Netdev{
+			"10.0.0.0/24": {Name: "eth0", MTU: 9000},
+			"bond0":       {Name: "bond0", Type: node.NetdevBond, Members: []string{"eth1", "eth2"}},
+		}
+		err := bonded.Update(ctx, resolver.Profiles)
+		if err == nil || !strings.Contains(err.Error(), "n0001,n0002") {
+			t.Fatalf("Should have failed naming the broken nodes, %v instead", err)
+		}
+
+		mtu := compute
+		mtu.Netdevs = map[string]*node.Netdev{"10.0.0.0/24": {Name: "eth0", MTU: 1500}}
+		if err := mtu.Update(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		compute = mtu
+	})
+
+	t.Run("ProfileDeleted", func(t *testing.T) {
+		if err := compute.Delete(ctx, resolver.Profiles); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.CatchUp(ctx); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if got := ids(p.NodesBy(ByArch, "aarch64")); got != "n0003" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := ids(p.NodesBy(ByVNFS, "centos7")); got != "" {
+			t.Fatalf("Mismatch: %s", got)
+		}
+		if got := len(p.Profiles()); got != 0 {
+			t.Fatalf("Expected no profiles, %d instead", got)
+		}
+	})
+}
+
+func sorted(s ...string) []string {
+	sort.Strings(s)
+	return s
+}
+
+func ids(nodes []node.Node) string {
+	s := ""
+	for i, n := range nodes {
+		if i > 0 {
+			s += ","
+		}
+		s += n.ID
+	}
+	return s
+}
@@ -0,0 +1,223 @@
+package provision
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	node "github.com/bensallen/warewulf4/node"
+)
+
+// Names of the iPXE script templates. A node is rendered with the template named after its ID,
+// then the one named after its Arch, then IPXEDefault, whichever is defined first. Requests for
+// hardware addresses of no node are rendered with IPXEUnknown.
+const (
+	IPXEDefault = "default.ipxe"
+	IPXEUnknown = "unknown.ipxe"
+)
+
+const defaultIPXE = `#!ipxe
+echo Warewulf: booting {{.Node.ID}}
+{{- if not .KernelURL}}
+echo Warewulf: node {{.Node.ID}} has no bootstrap
+goto retry
+{{- end}}
+{{- if eq .BuildArch "x86_64"}}
+cpuid --ext 29 || goto wrongarch
+{{- else if .BuildArch}}
+iseq ${buildarch} {{.BuildArch}} || goto wrongarch
+{{- end}}
+kernel --name kernel {{.KernelURL}} {{.Cmdline}} || goto retry
+initrd --name initrd {{.InitrdURL}} || goto retry
+boot || goto retry
+
+:wrongarch
+echo Warewulf: node {{.Node.ID}} is {{.Node.Arch}}, this iPXE cannot boot it
+
+:retry
+echo Warewulf: retrying in 30 seconds
+sleep 30
+chain --replace --autofree {{.ScriptURL}}
+`
+
+const unknownIPXE = `#!ipxe
+echo Warewulf: no node is registered{{with .HWAddr}} with hardware address {{.}}{{end}}
+echo Warewulf: retrying in 60 seconds
+sleep 60
+chain --replace --autofree {{.ScriptURL}}
+`
+
+// IPXEData is the data iPXE script templates are executed with
+type IPXEData struct {
+	Node      node.Node // Zero when rendering IPXEUnknown
+	Config    *Config   // nil when rendering IPXEUnknown
+	HWAddr    string    // Hardware address the script was requested for, if any
+	BaseURL   string    // URL of the controller, e.g. http://10.0.0.1:9873
+	ScriptURL string    // URL of the script itself, chained to again on failure
+	KernelURL string    // Empty when the node has no Bootstrap
+	InitrdURL string
+	VNFSURL   string
+	Cmdline   string // Cmdline of the Bootstrap followed by the parameters read by wwinit
+	BuildArch string // Value of iPXE's ${buildarch} able to boot Node.Arch, empty if unknown
+}
+
+// IPXETemplates renders the iPXE scripts of nodes
+type IPXETemplates struct {
+	t *template.Template
+}
+
+// DefaultIPXETemplates returns the built-in IPXEDefault and IPXEUnknown templates
+func DefaultIPXETemplates() *IPXETemplates {
+	t := template.Must(template.New(IPXEDefault).Parse(defaultIPXE))
+	template.Must(t.New(IPXEUnknown).Parse(unknownIPXE))
+	return &IPXETemplates{t: t}
+}
+
+// ParseIPXETemplates returns the built-in templates overridden and extended by the site templates
+// in the files matching pattern, each named by its base name, e.g. n0001.ipxe, aarch64.ipxe or
+// default.ipxe
+func ParseIPXETemplates(pattern string) (*IPXETemplates, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	t := DefaultIPXETemplates().t
+	if len(files) == 0 {
+		return &IPXETemplates{t: t}, nil
+	}
+	if t, err = t.ParseFiles(files...); err != nil {
+		return nil, err
+	}
+	return &IPXETemplates{t: t}, nil
+}
+
+// Node renders the script of the node in data
+func (t *IPXETemplates) Node(w io.Writer, data *IPXEData) error {
+	names := []string{IPXEDefault}
+	if data.Node.Arch != "" {
+		names = append([]string{data.Node.Arch + ".ipxe"}, names...)
+	}
+	names = append([]string{data.Node.ID + ".ipxe"}, names...)
+	for _, name := range names {
+		if tmpl := t.t.Lookup(name); tmpl != nil {
+			return tmpl.Execute(w, data)
+		}
+	}
+	return fmt.Errorf("no iPXE template for node %v", data.Node.ID)
+}
+
+// Unknown renders the script for a hardware address of no node
+func (t *IPXETemplates) Unknown(w io.Writer, data *IPXEData) error {
+	return t.t.ExecuteTemplate(w, IPXEUnknown, data)
+}
+
+// IPXEArch returns the value of iPXE's ${buildarch} that boots kernels of arch, or an empty
+// string for architectures without a check. An i386 iPXE such as undionly.kpxe boots x86_64
+// kernels, which is checked with cpuid instead.
+func IPXEArch(arch string) string {
+	switch arch {
+	case "x86_64", "amd64":
+		return "x86_64"
+	case "i386", "i486", "i586", "i686":
+		return "i386"
+	case "aarch64", "arm64":
+		return "arm64"
+	}
+	return ""
+}
+
+// newIPXEData returns the data to render the script of n, for a request to the controller at
+// baseURL for the node's hardware address hwaddr, or by ID when hwaddr is empty
+func newIPXEData(n node.Node, config *Config, baseURL, hwaddr string) (*IPXEData, error) {
+	data := &IPXEData{
+		Node:      n,
+		Config:    config,
+		HWAddr:    hwaddr,
+		BaseURL:   baseURL,
+		ScriptURL: baseURL + NodePath(n.ID, FileIPXE),
+		VNFSURL:   baseURL + NodePath(n.ID, FileVNFS),
+		BuildArch: IPXEArch(n.Arch),
+	}
+	if hwaddr != "" {
+		data.ScriptURL = baseURL + HWAddrPath(hwaddr, FileIPXE)
+	}
+	if config.Kernel.ID == "" {
+		return data, nil
+	}
+	data.KernelURL = baseURL + NodePath(n.ID, FileKernel)
+	data.InitrdURL = baseURL + NodePath(n.ID, FileInitramfs)
+
+	args := []string{}
+	if config.Cmdline != "" {
+		args = append(args, config.Cmdline)
+	}
+	// EFI kernels only find the initrd loaded by iPXE when it is named on the command line
+	args = append(args, "initrd=initrd", "wwid="+n.ID, "wwserver="+baseURL, "wwvnfs="+data.VNFSURL)
+
+	netdev, ip, err := bootNetdev(n.Netdevs, hwaddr)
+	if err != nil {
+		return nil, err
+	}
+	if netdev != nil {
+		hw, err := net.ParseMAC(netdev.HWAddr)
+		if err != nil {
+			return nil, fmt.Errorf("netdev of node %v has invalid hardware address, %v", n.ID, netdev.HWAddr)
+		}
+		args = append(args, "BOOTIF=01-"+strings.Replace(hw.String(), ":", "-", -1), "wwip="+ip)
+		if netdev.Gateway != "" {
+			args = append(args, "wwgw="+netdev.Gateway)
+		}
+	}
+	data.Cmdline = strings.Join(args, " ")
+	return data, nil
+}
+
+// bootNetdev returns the netdev the node boots from along with its address in CIDR notation: the
+// netdev with hardware address hwaddr, or the first with a hardware address by key when hwaddr is
+// empty. A member of a bond or bridge boots with the address of its master, which is returned with
+// the hardware address of the member. It returns a nil netdev if there is none.
+func bootNetdev(netdevs map[string]*node.Netdev, hwaddr string) (*node.Netdev, string, error) {
+	keys := make([]string, 0, len(netdevs))
+	for key, netdev := range netdevs {
+		if netdev != nil && netdev.HWAddr != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if hwaddr != "" && !strings.EqualFold(netdevs[key].HWAddr, hwaddr) {
+			continue
+		}
+		subnet, netdev, ok := node.Addressed(netdevs, key)
+		if !ok {
+			continue
+		}
+		ip := net.ParseIP(netdev.IP)
+		if ip == nil {
+			return nil, "", fmt.Errorf("netdev on %v has invalid IP, %v", subnet, netdev.IP)
+		}
+		var mask net.IPMask
+		if netdev.Netmask != "" {
+			m := net.ParseIP(netdev.Netmask).To4()
+			if m == nil {
+				return nil, "", fmt.Errorf("netdev on %v has invalid netmask, %v", subnet, netdev.Netmask)
+			}
+			mask = net.IPMask(m)
+		} else {
+			_, network, err := net.ParseCIDR(subnet)
+			if err != nil {
+				return nil, "", fmt.Errorf("netdev subnet, %v, is invalid: %v", subnet, err)
+			}
+			mask = network.Mask
+		}
+		boot := *netdev
+		boot.HWAddr = netdevs[key].HWAddr
+		return &boot, (&net.IPNet{IP: ip, Mask: mask}).String(), nil
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,77 @@
+package provision
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	node "github.com/bensallen/warewulf4/node"
+)
+
+func TestIPXETemplates(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "aarch64.ipxe"), []byte("#!ipxe\necho arm {{.Node.ID}} {{.BuildArch}}\n"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "n0002.ipxe"), []byte("#!ipxe\necho site {{.Node.ID}}\n"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	templates, err := ParseIPXETemplates(filepath.Join(dir, "*.ipxe"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	config := &Config{Kernel: Artifact{ID: "el7"}, Cmdline: "quiet"}
+	for _, test := range []struct {
+		node node.Node
+		want string
+	}{
+		{node.Node{ID: "n0001", Arch: "aarch64"}, "echo arm n0001 arm64"},
+		{node.Node{ID: "n0002", Arch: "aarch64"}, "echo site n0002"},
+		{node.Node{ID: "n0003", Arch: "ppc64le"}, "kernel --name kernel http://ctl/provision/node/n0003/kernel quiet initrd=initrd wwid=n0003"},
+	} {
+		data, err := newIPXEData(test.node, config, "http://ctl", "")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := templates.Node(&buf, data); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !strings.Contains(buf.String(), test.want) {
+			t.Fatalf("Missing %q in:\n%s", test.want, buf.String())
+		}
+		if test.node.Arch == "ppc64le" && strings.Contains(buf.String(), "goto wrongarch") {
+			t.Fatalf("Unexpected arch check for %v:\n%s", test.node.Arch, buf.String())
+		}
+	}
+}
+
+func TestBootNetdev(t *testing.T) {
+	netdevs := map[string]*node.Netdev{
+		"10.0.0.0/16":    {HWAddr: "00:11:22:33:44:01", IP: "10.0.1.1"},
+		"192.168.0.0/24": {HWAddr: "00:11:22:33:44:02", IP: "192.168.0.1", Netmask: "255.255.255.128"},
+		"172.16.0.0/24":  {Name: "ib0", IP: "172.16.0.1"},
+		"10.1.0.0/24":    {Name: "bond0", Type: node.NetdevBond, Members: []string{"eth2"}, IP: "10.1.0.5"},
+		"eth2":           {Name: "eth2", HWAddr: "00:11:22:33:44:03"},
+	}
+	for hwaddr, want := range map[string]string{
+		"":                  "10.0.1.1/16",
+		"00:11:22:33:44:02": "192.168.0.1/25",
+		"00:11:22:33:44:03": "10.1.0.5/24",
+		"00:11:22:33:44:04": "",
+	} {
+		netdev, ip, err := bootNetdev(netdevs, hwaddr)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if ip != want {
+			t.Fatalf("Mismatch for %q: %v, expected %v", hwaddr, ip, want)
+		}
+		if hwaddr != "" && netdev != nil && netdev.HWAddr != hwaddr {
+			t.Fatalf("Mismatch for %q: booting from %v", hwaddr, netdev.HWAddr)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Package provision defines what the controller serves to booting nodes: the files of a node's
+// Bootstrap and VNFS, and the node's configuration, addressed by node ID or hardware address.
+package provision
+
+import (
+	"net/url"
+	"strings"
+
+	node "github.com/bensallen/warewulf4/node"
+)
+
+// Files served for each node
+const (
+	FileConfig    = "config"
+	FileKernel    = "kernel"
+	FileInitramfs = "initramfs"
+	FileModules   = "modules"
+	FileVNFS      = "vnfs"
+	FileIPXE      = "ipxe"
+)
+
+// Prefix is the path under which the controller serves provisioning requests
+const Prefix = "/provision/"
+
+// NodePath returns the path of file for the node with the given ID
+func NodePath(id, file string) string {
+	return Prefix + "node/" + url.PathEscape(id) + "/" + file
+}
+
+// HWAddrPath returns the path of file for the node with a Netdev of the given hardware address
+func HWAddrPath(hwaddr, file string) string {
+	return Prefix + "hwaddr/" + url.PathEscape(strings.ToLower(hwaddr)) + "/" + file
+}
+
+// Config is the configuration of a node served as JSON at its FileConfig path
+type Config struct {
+	ID        string
+	Arch      string
+	Netdevs   map[string]*node.Netdev // Keyed by the subnet in CIDR notation, as in node.Node
+	Cmdline   string                  // Kernel command line of the Bootstrap followed by the KernelArgs of the node
+	Kernel    Artifact
+	Initramfs Artifact
+	Modules   Artifact // Unset when the Bootstrap has no modules archive
+	VNFS      Artifact
+}
+
+// Artifact describes a file served for a node. Size and Checksum describe the file as served,
+// i.e. compressed with CompressAlgo.
+type Artifact struct {
+	ID           string // ID of the Bootstrap or VNFS aggregate
+	Version      int
+	Checksum     string
+	Size         int64
+	CompressAlgo string
+}
@@ -0,0 +1,274 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	bootstrap "github.com/bensallen/warewulf4/bootstrap"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+// Server serves the files and configuration of nodes under Prefix. Nodes are looked up in a
+// Projection, by ID or by the hardware address of one of their Netdevs, and the Bootstrap and VNFS
+// versions they reference are loaded through a Resolver.
+type Server struct {
+	nodes    *projection.Projection
+	resolver *node.Resolver
+
+	// IPXE renders the FileIPXE scripts of nodes, DefaultIPXETemplates unless replaced
+	IPXE *IPXETemplates
+}
+
+// NewServer returns a Server finding nodes in p and resolving their references with r
+func NewServer(p *projection.Projection, r *node.Resolver) *Server {
+	return &Server{nodes: p, resolver: r, IPXE: DefaultIPXETemplates()}
+}
+
+// errNotFound is returned when a node or one of its files does not exist
+type errNotFound struct {
+	msg string
+}
+
+func (e *errNotFound) Error() string { return e.msg }
+
+// ServeHTTP serves the file of the node named by the request path. Files are served with
+// http.ServeContent, so Range and conditional requests are supported, with a strong ETag of the
+// file's checksum.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n, file, err := s.lookup(r.URL.EscapedPath())
+	if file == FileIPXE {
+		s.serveIPXE(w, r, n, err)
+		return
+	}
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+
+	// The files are served from the same versions the configuration describes, so that an update
+	// in between cannot serve a new file under the checksum of the old one
+	b, v, err := s.resolve(r.Context(), n)
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	config := newConfig(n, b, v)
+
+	if file == FileConfig {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := json.NewEncoder(w).Encode(config); err != nil {
+			log.Printf("provision: %v: %v", r.URL.Path, err)
+		}
+		return
+	}
+
+	path, artifact, modTime, err := serveFile(n, b, v, config, file)
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		s.error(w, r, &errNotFound{fmt.Sprintf("%v of node %v is missing", file, n.ID)})
+		return
+	}
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if artifact.Checksum != "" {
+		w.Header().Set("ETag", `"`+artifact.Checksum+`"`)
+	}
+	http.ServeContent(w, r, "", modTime, f)
+}
+
+// serveIPXE renders the iPXE script of n, or the script for unknown nodes when lookupErr is not
+// found, so that unregistered nodes keep retrying rather than falling through to the next boot device
+func (s *Server) serveIPXE(w http.ResponseWriter, r *http.Request, n node.Node, lookupErr error) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	baseURL := scheme + "://" + r.Host
+
+	hwaddr := ""
+	if by, key, ok := pathKey(r.URL.EscapedPath()); ok && by == "hwaddr" {
+		hwaddr = strings.ToLower(key)
+	}
+
+	var buf bytes.Buffer
+	if _, ok := lookupErr.(*errNotFound); ok {
+		data := &IPXEData{HWAddr: hwaddr, BaseURL: baseURL, ScriptURL: baseURL + r.URL.EscapedPath()}
+		if err := s.IPXE.Unknown(&buf, data); err != nil {
+			s.error(w, r, err)
+			return
+		}
+		log.Printf("provision: %v: unknown node", r.URL.Path)
+	} else {
+		if lookupErr != nil {
+			s.error(w, r, lookupErr)
+			return
+		}
+		config, err := s.Config(r.Context(), n)
+		if err != nil {
+			s.error(w, r, err)
+			return
+		}
+		data, err := newIPXEData(n, config, baseURL, hwaddr)
+		if err != nil {
+			s.error(w, r, err)
+			return
+		}
+		if err := s.IPXE.Node(&buf, data); err != nil {
+			s.error(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) error(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*errNotFound); ok {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("provision: %v: %v", r.URL.Path, err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+// lookup returns the node and file named by a request path of the form
+// Prefix/node/<id>/<file> or Prefix/hwaddr/<hwaddr>/<file>
+func (s *Server) lookup(path string) (node.Node, string, error) {
+	by, key, ok := pathKey(path)
+	if !ok {
+		return node.Node{}, "", &errNotFound{fmt.Sprintf("%v not found", path)}
+	}
+	n, err := s.Node(by, key)
+	return n, path[strings.LastIndex(path, "/")+1:], err
+}
+
+// pathKey returns how a request path identifies a node, "node" or "hwaddr", and the unescaped
+// ID or hardware address
+func pathKey(path string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, Prefix), "/")
+	if !strings.HasPrefix(path, Prefix) || len(parts) != 3 {
+		return "", "", false
+	}
+	key, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	return parts[0], key, true
+}
+
+// Node returns the node identified by key, which is a node ID when by is "node" and a hardware
+// address when by is "hwaddr"
+func (s *Server) Node(by, key string) (node.Node, error) {
+	switch by {
+	case "node":
+		if n, ok := s.nodes.Node(key); ok && n.State != "Deleted" {
+			return n, nil
+		}
+	case "hwaddr":
+		if nodes := s.nodes.NodesBy(projection.ByHWAddr, key); len(nodes) == 1 {
+			return nodes[0], nil
+		} else if len(nodes) > 1 {
+			return node.Node{}, fmt.Errorf("hardware address %v is used by %d nodes", key, len(nodes))
+		}
+	}
+	return node.Node{}, &errNotFound{fmt.Sprintf("no node with %v %v", by, key)}
+}
+
+// Config returns the configuration of n, with the versions of its Bootstrap and VNFS resolved
+func (s *Server) Config(ctx context.Context, n node.Node) (*Config, error) {
+	b, v, err := s.resolve(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return newConfig(n, b, v), nil
+}
+
+// resolve returns the versions of the Bootstrap and VNFS of n, either of which is nil when n has none
+func (s *Server) resolve(ctx context.Context, n node.Node) (*bootstrap.Bootstrap, *vnfs.VNFS, error) {
+	b, v, err := s.resolver.Resolve(ctx, &n)
+	if eventsource.IsNotFound(err) {
+		return nil, nil, &errNotFound{err.Error()}
+	}
+	return b, v, err
+}
+
+// newConfig returns the configuration of n booting b and v
+func newConfig(n node.Node, b *bootstrap.Bootstrap, v *vnfs.VNFS) *Config {
+	config := &Config{ID: n.ID, Arch: n.Arch, Netdevs: n.Netdevs}
+	if b != nil {
+		config.Cmdline = strings.TrimSpace(b.Cmdline + " " + n.KernelArgs)
+		config.Kernel = Artifact{ID: b.ID, Version: b.Version, Checksum: b.Kernel.Checksum, Size: b.Kernel.Size}
+		config.Initramfs = Artifact{ID: b.ID, Version: b.Version, Checksum: b.Initramfs.Checksum, Size: b.Initramfs.Size, CompressAlgo: b.CompressAlgo}
+		if b.Modules.Path != "" {
+			config.Modules = Artifact{ID: b.ID, Version: b.Version, Checksum: b.Modules.Checksum, Size: b.Modules.Size, CompressAlgo: b.CompressAlgo}
+		}
+	}
+	if v != nil {
+		config.VNFS = Artifact{ID: v.ID, Version: v.Version, Checksum: v.Checksum, Size: v.Size, CompressAlgo: v.CompressAlgo}
+	}
+	return config
+}
+
+// serveFile returns the path of file for n, which boots b and v, along with its description in
+// config and modification time
+func serveFile(n node.Node, b *bootstrap.Bootstrap, v *vnfs.VNFS, config *Config, file string) (string, Artifact, time.Time, error) {
+	notFound := &errNotFound{fmt.Sprintf("node %v has no %v", n.ID, file)}
+
+	switch file {
+	case FileKernel, FileInitramfs, FileModules:
+		if b == nil {
+			return "", Artifact{}, time.Time{}, notFound
+		}
+		switch file {
+		case FileKernel:
+			return nonEmpty(b.Kernel.Path, config.Kernel, b.UpdatedAt, notFound)
+		case FileInitramfs:
+			return nonEmpty(b.Initramfs.Path, config.Initramfs, b.UpdatedAt, notFound)
+		default:
+			return nonEmpty(b.Modules.Path, config.Modules, b.UpdatedAt, notFound)
+		}
+
+	case FileVNFS:
+		if v == nil {
+			return "", Artifact{}, time.Time{}, notFound
+		}
+		return nonEmpty(v.Path, config.VNFS, v.UpdatedAt, notFound)
+	}
+	return "", Artifact{}, time.Time{}, &errNotFound{fmt.Sprintf("unknown file, %v", file)}
+}
+
+func nonEmpty(path string, a Artifact, modTime time.Time, notFound error) (string, Artifact, time.Time, error) {
+	if path == "" {
+		return "", Artifact{}, time.Time{}, notFound
+	}
+	return path, a, modTime, nil
+}
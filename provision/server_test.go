@@ -0,0 +1,261 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	bootstrap "github.com/bensallen/warewulf4/bootstrap"
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+func writeArtifact(t *testing.T, dir, name string, data []byte) (string, string) {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sum, err := checksum.Sum(bytes.NewReader(data), checksum.Default)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return path, sum
+}
+
+// hookStore calls onLoad after each aggregate is loaded, when it is set
+type hookStore struct {
+	eventsource.Store
+	onLoad func(aggregateID string)
+}
+
+func (s *hookStore) Load(ctx context.Context, aggregateID string, fromVersion, toVersion int) (eventsource.History, error) {
+	history, err := s.Store.Load(ctx, aggregateID, fromVersion, toVersion)
+	if s.onLoad != nil {
+		s.onLoad(aggregateID)
+	}
+	return history, err
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+	hooked := &hookStore{Store: store}
+
+	resolver := &node.Resolver{
+		Bootstraps: eventsource.New(&bootstrap.Bootstrap{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(bootstrap.Events()...)),
+			eventsource.WithStore(store),
+		),
+		VNFSs: eventsource.New(&vnfs.VNFS{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(vnfs.Events()...)),
+			eventsource.WithStore(hooked),
+		),
+	}
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := node.WithResolver(context.Background(), resolver)
+
+	kernel := []byte("kernel image")
+	initramfs := []byte("initramfs archive")
+	image := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	b := bootstrap.Bootstrap{ID: "el7", Arch: "x86_64", Cmdline: "console=ttyS0", CompressAlgo: "gzip"}
+	b.Kernel.Path, b.Kernel.Checksum = writeArtifact(t, dir, "vmlinuz", kernel)
+	b.Kernel.Size = int64(len(kernel))
+	b.Initramfs.Path, b.Initramfs.Checksum = writeArtifact(t, dir, "initramfs", initramfs)
+	b.Initramfs.Size = int64(len(initramfs))
+	if err := b.Create(ctx, resolver.Bootstraps); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	v := vnfs.VNFS{ID: "centos7", Arch: "x86_64", CompressAlgo: "none", Size: int64(len(image))}
+	v.Path, v.Checksum = writeArtifact(t, dir, "centos7.img", image)
+	if err := v.Create(ctx, resolver.VNFSs); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	n := node.Node{
+		ID:         "n0001",
+		Arch:       "x86_64",
+		Bootstrap:  node.Ref{ID: "el7"},
+		VNFS:       node.Ref{ID: "centos7"},
+		KernelArgs: "quiet",
+		Netdevs: map[string]*node.Netdev{
+			"10.0.0.0/24": {HWAddr: "00:11:22:33:44:01", IP: "10.0.0.1"},
+		},
+	}
+	if err := n.Create(ctx, nodeRepo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	p, err := projection.New(ctx, store, projection.NewFileCheckpoint(filepath.Join(dir, "checkpoint")))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := p.CatchUp(ctx); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	server := httptest.NewServer(NewServer(p, resolver))
+	defer server.Close()
+
+	get := func(t *testing.T, path string, header map[string]string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return resp, body
+	}
+
+	t.Run("Config", func(t *testing.T) {
+		resp, body := get(t, HWAddrPath("00:11:22:33:44:01", FileConfig), nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, %v instead", resp.Status)
+		}
+		var config Config
+		if err := json.Unmarshal(body, &config); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if config.ID != "n0001" || config.Arch != "x86_64" || config.Cmdline != "console=ttyS0 quiet" {
+			t.Fatalf("Mismatch: %+v", config)
+		}
+		if config.Kernel != (Artifact{ID: "el7", Version: 1, Checksum: b.Kernel.Checksum, Size: int64(len(kernel))}) {
+			t.Fatalf("Mismatch: %+v", config.Kernel)
+		}
+		if config.Initramfs.CompressAlgo != "gzip" || config.Modules != (Artifact{}) {
+			t.Fatalf("Mismatch: %+v", config)
+		}
+		if config.VNFS != (Artifact{ID: "centos7", Version: 1, Checksum: v.Checksum, Size: int64(len(image)), CompressAlgo: "none"}) {
+			t.Fatalf("Mismatch: %+v", config.VNFS)
+		}
+		if nd := config.Netdevs["10.0.0.0/24"]; nd == nil || nd.IP != "10.0.0.1" {
+			t.Fatalf("Mismatch: %+v", config.Netdevs)
+		}
+	})
+
+	t.Run("File", func(t *testing.T) {
+		resp, body := get(t, NodePath("n0001", FileKernel), nil)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, kernel) {
+			t.Fatalf("Mismatch: %v %q", resp.Status, body)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `"`+b.Kernel.Checksum+`"` {
+			t.Fatalf("Mismatch: %v", etag)
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		resp, body := get(t, NodePath("n0001", FileVNFS), map[string]string{"Range": "bytes=10-15"})
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("Expected 206, %v instead", resp.Status)
+		}
+		if string(body) != "abcdef" {
+			t.Fatalf("Mismatch: %q", body)
+		}
+	})
+
+	t.Run("IfNoneMatch", func(t *testing.T) {
+		resp, _ := get(t, NodePath("n0001", FileVNFS), map[string]string{"If-None-Match": `"` + v.Checksum + `"`})
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("Expected 304, %v instead", resp.Status)
+		}
+	})
+
+	t.Run("IPXE", func(t *testing.T) {
+		resp, body := get(t, HWAddrPath("00:11:22:33:44:01", FileIPXE), nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, %v instead", resp.Status)
+		}
+		for _, want := range []string{
+			"kernel --name kernel " + server.URL + NodePath("n0001", FileKernel) + " console=ttyS0 quiet initrd=initrd wwid=n0001 wwserver=" + server.URL,
+			"wwvnfs=" + server.URL + NodePath("n0001", FileVNFS),
+			"BOOTIF=01-00-11-22-33-44-01 wwip=10.0.0.1/24",
+			"initrd --name initrd " + server.URL + NodePath("n0001", FileInitramfs),
+			"cpuid --ext 29",
+		} {
+			if !bytes.Contains(body, []byte(want)) {
+				t.Fatalf("Missing %q in:\n%s", want, body)
+			}
+		}
+	})
+
+	t.Run("IPXEUnknown", func(t *testing.T) {
+		resp, body := get(t, HWAddrPath("00:11:22:33:44:02", FileIPXE), nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, %v instead", resp.Status)
+		}
+		if !bytes.Contains(body, []byte("hardware address 00:11:22:33:44:02")) || !bytes.Contains(body, []byte("chain --replace --autofree "+server.URL+HWAddrPath("00:11:22:33:44:02", FileIPXE))) {
+			t.Fatalf("Mismatch:\n%s", body)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		for _, path := range []string{
+			NodePath("n0002", FileConfig),
+			HWAddrPath("00:11:22:33:44:02", FileKernel),
+			NodePath("n0001", FileModules),
+			NodePath("n0001", "unknown"),
+			Prefix + "node/n0001",
+		} {
+			if resp, _ := get(t, path, nil); resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("Expected 404 for %v, %v instead", path, resp.Status)
+			}
+		}
+	})
+	t.Run("UpdatedWhileServing", func(t *testing.T) {
+		vnfsRepo := eventsource.New(&vnfs.VNFS{},
+			eventsource.WithSerializer(eventsource.NewJSONSerializer(vnfs.Events()...)),
+			eventsource.WithStore(store),
+		)
+		updated := v
+		updated.Path, updated.Checksum = writeArtifact(t, dir, "centos7-2.img", []byte("updated image"))
+		updated.Size = int64(len("updated image"))
+		hooked.onLoad = func(id string) {
+			// Update the VNFS once the request has resolved it
+			hooked.onLoad = nil
+			if err := updated.Update(ctx, vnfsRepo); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+		}
+		defer func() { hooked.onLoad = nil }()
+
+		resp, body := get(t, NodePath("n0001", FileVNFS), nil)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, image) {
+			t.Fatalf("Mismatch: %v %q", resp.Status, body)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `"`+v.Checksum+`"` {
+			t.Fatalf("Served a version under the ETag of another, %v", etag)
+		}
+
+		resp, body = get(t, NodePath("n0001", FileVNFS), nil)
+		if !bytes.Equal(body, []byte("updated image")) || resp.Header.Get("ETag") != `"`+updated.Checksum+`"` {
+			t.Fatalf("Mismatch: %q %v", body, resp.Header.Get("ETag"))
+		}
+	})
+}
@@ -0,0 +1,290 @@
+// Package registration turns hardware addresses that asked to boot without belonging to a node
+// into nodes. Requests are recorded as pending Discovery aggregates which an operator accepts or
+// rejects, or which are accepted automatically for a bounded number of them.
+package registration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/dhcp"
+	discovery "github.com/bensallen/warewulf4/discovery"
+	"github.com/bensallen/warewulf4/ipam"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	"github.com/bensallen/warewulf4/tftp"
+)
+
+// queueSize is the number of observed clients waiting to be recorded before more are dropped
+const queueSize = 256
+
+// maxNames bounds the search for a free node name
+const maxNames = 1000000
+
+// Policy describes the nodes created from accepted discoveries
+type Policy struct {
+	Subnet    string // IPv4 subnet in CIDR notation the netdev is addressed in, its key in node.Node.Netdevs
+	Offset    int    // Offset in Subnet of the first address to assign, 1 when zero
+	Gateway   string
+	Domain    string
+	Netdev    string // Name of the netdev, may be empty
+	Names     string // Pattern of node names with one integer verb, e.g. n%04d
+	First     int    // First index tried in Names, 1 when zero
+	Arch      string // Arch of the nodes; when empty it follows the client architecture, if known
+	Bootstrap node.Ref
+	VNFS      node.Ref
+}
+
+// Validate returns an error if p cannot be used to create nodes
+func (p Policy) Validate() error {
+	_, network, err := net.ParseCIDR(p.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet, %v: %v", p.Subnet, err)
+	}
+	if network.IP.To4() == nil {
+		return fmt.Errorf("subnet, %v, is not an IPv4 subnet", p.Subnet)
+	}
+	if p.Gateway != "" && net.ParseIP(p.Gateway) == nil {
+		return fmt.Errorf("invalid gateway, %v", p.Gateway)
+	}
+	if name := fmt.Sprintf(p.Names, 1); strings.Contains(name, "%!") || name == fmt.Sprintf(p.Names, 2) {
+		return fmt.Errorf("name pattern, %q, must contain an integer verb such as %%04d", p.Names)
+	}
+	return nil
+}
+
+// NodeArch returns the Node.Arch of a client of the given architecture, or an empty string if it
+// cannot be told
+func NodeArch(arch tftp.ClientArch) string {
+	switch arch {
+	case tftp.BIOS, tftp.EFIBC, tftp.EFIX8664:
+		return "x86_64"
+	case tftp.EFIIA32:
+		return "i686"
+	case tftp.EFIARM64:
+		return "aarch64"
+	}
+	return ""
+}
+
+// Registrar records discoveries and accepts them as nodes
+type Registrar struct {
+	nodes       *eventsource.Repository
+	discoveries *eventsource.Repository
+	projection  *projection.Projection
+	ipam        *ipam.IPAM
+
+	observed chan dhcp.Client
+
+	mux      sync.Mutex // Serializes acceptances, which allocate names and addresses
+	auto     Policy
+	autoLeft int
+}
+
+// New returns a Registrar saving discoveries to discoveries and creating nodes in nodes. Names and
+// addresses of new nodes are allocated against the nodes and subnets of p.
+func New(nodes, discoveries *eventsource.Repository, p *projection.Projection) *Registrar {
+	return &Registrar{
+		nodes:       nodes,
+		discoveries: discoveries,
+		projection:  p,
+		ipam:        ipam.New(p),
+		observed:    make(chan dhcp.Client, queueSize),
+	}
+}
+
+// Observe queues client to be recorded by Run, dropping it if the queue is full. It suits
+// dhcp.Server.Unknown.
+func (r *Registrar) Observe(client dhcp.Client) {
+	select {
+	case r.observed <- client:
+	default:
+	}
+}
+
+// Run records the clients queued by Observe until ctx is done. ctx should carry the node.Resolver
+// checking the Bootstrap and VNFS created nodes reference.
+func (r *Registrar) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case client := <-r.observed:
+			if err := r.Record(ctx, client); err != nil {
+				log.Printf("registration: %v: %v", client.HWAddr, err)
+			}
+		}
+	}
+}
+
+// Record records a request from client as a pending discovery and accepts it if automatic
+// acceptance is on
+func (r *Registrar) Record(ctx context.Context, client dhcp.Client) error {
+	d := &discovery.Discovery{
+		HWAddr:        client.HWAddr.String(),
+		ClientArch:    uint16(client.ClientArch),
+		ClientArchSet: client.ClientArchSet,
+		VendorClass:   client.VendorClass,
+	}
+	if err := d.Record(ctx, r.discoveries); err != nil {
+		return err
+	}
+	if err := r.projection.CatchUp(ctx); err != nil {
+		return err
+	}
+
+	r.mux.Lock()
+	policy, auto := r.auto, r.autoLeft > 0
+	r.mux.Unlock()
+	if !auto {
+		return nil
+	}
+	if current, ok := r.projection.Discovery(d.HWAddr); !ok || current.State != "Pending" {
+		return nil
+	}
+	n, err := r.accept(ctx, d.HWAddr, policy, true)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		log.Printf("registration: accepted %v as node %v", d.HWAddr, n.ID)
+	}
+	return nil
+}
+
+// Pending returns the discoveries awaiting acceptance, in the order they were first seen
+func (r *Registrar) Pending() []discovery.Discovery {
+	return r.projection.Discoveries("Pending")
+}
+
+// AutoAccept makes the next count discoveries recorded be accepted with policy. A count of 0
+// turns automatic acceptance off.
+func (r *Registrar) AutoAccept(policy Policy, count int) error {
+	if count > 0 {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.auto, r.autoLeft = policy, count
+	return nil
+}
+
+// AutoRemaining returns the number of discoveries left to accept automatically
+func (r *Registrar) AutoRemaining() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.autoLeft
+}
+
+// Accept creates a node for the pending discovery of hwaddr as described by policy and marks the
+// discovery accepted. The node is named with the first free index of policy.Names and its netdev
+// is given the address of policy.Subnet reserved for hwaddr, or else the first free one.
+func (r *Registrar) Accept(ctx context.Context, hwaddr string, policy Policy) (*node.Node, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return r.accept(ctx, hwaddr, policy, false)
+}
+
+// accept implements Accept; when auto is set the acceptance counts against AutoRemaining and
+// nothing is done once it is exhausted
+func (r *Registrar) accept(ctx context.Context, hwaddr string, policy Policy, auto bool) (*node.Node, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if auto && r.autoLeft <= 0 {
+		return nil, nil
+	}
+
+	d := &discovery.Discovery{HWAddr: hwaddr}
+	if err := d.Read(ctx, r.discoveries); err != nil {
+		return nil, err
+	}
+	if d.State != "Pending" {
+		return nil, fmt.Errorf("discovery of %v is %v, not pending", d.HWAddr, d.State)
+	}
+	if err := r.projection.CatchUp(ctx); err != nil {
+		return nil, err
+	}
+
+	id, err := r.freeName(policy)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := r.ipam.Next(ctx, ipam.Request{
+		Subnet:  policy.Subnet,
+		HWAddr:  d.HWAddr,
+		Offset:  policy.Offset,
+		Exclude: []string{policy.Gateway},
+	})
+	if err != nil {
+		return nil, err
+	}
+	arch := policy.Arch
+	if arch == "" && d.ClientArchSet {
+		arch = NodeArch(tftp.ClientArch(d.ClientArch))
+	}
+
+	n := &node.Node{
+		ID:        id,
+		Arch:      arch,
+		Bootstrap: policy.Bootstrap,
+		VNFS:      policy.VNFS,
+		Netdevs: map[string]*node.Netdev{
+			policy.Subnet: {
+				HWAddr:  d.HWAddr,
+				Name:    policy.Netdev,
+				IP:      ip.String(),
+				Gateway: policy.Gateway,
+				Domain:  policy.Domain,
+			},
+		},
+	}
+	if err := n.Create(node.WithNetdevChecker(ctx, r.ipam), r.nodes); err != nil {
+		return nil, err
+	}
+	if err := d.Accept(ctx, r.discoveries, n.ID); err != nil {
+		return nil, err
+	}
+	if auto {
+		r.autoLeft--
+	}
+	return n, r.projection.CatchUp(ctx)
+}
+
+// freeName returns the name of policy.Names with the lowest index from policy.First that is not
+// the ID of a node, deleted or not
+func (r *Registrar) freeName(policy Policy) (string, error) {
+	first := policy.First
+	if first == 0 {
+		first = 1
+	}
+	for i := first; i < first+maxNames; i++ {
+		name := fmt.Sprintf(policy.Names, i)
+		if _, ok := r.projection.Node(name); !ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free node name in %v", policy.Names)
+}
+
+// Reject marks the pending discovery of hwaddr rejected, so that its requests are ignored
+func (r *Registrar) Reject(ctx context.Context, hwaddr string) error {
+	d := &discovery.Discovery{HWAddr: hwaddr}
+	if err := d.Read(ctx, r.discoveries); err != nil {
+		return err
+	}
+	if err := d.Reject(ctx, r.discoveries); err != nil {
+		return err
+	}
+	return r.projection.CatchUp(ctx)
+}
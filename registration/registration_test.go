@@ -0,0 +1,122 @@
+package registration
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/dhcp"
+	discovery "github.com/bensallen/warewulf4/discovery"
+	"github.com/bensallen/warewulf4/filestore"
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+	"github.com/bensallen/warewulf4/tftp"
+)
+
+func client(hwaddr string, arch tftp.ClientArch) dhcp.Client {
+	mac, _ := net.ParseMAC(hwaddr)
+	return dhcp.Client{HWAddr: mac, ClientArch: arch, ClientArchSet: true, VendorClass: "PXEClient"}
+}
+
+func TestRegistrar(t *testing.T) {
+	dir := t.TempDir()
+	store, err := filestore.New(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer store.Close()
+
+	nodeRepo := eventsource.New(&node.Node{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(node.Events()...)),
+		eventsource.WithStore(store),
+	)
+	discoveryRepo := eventsource.New(&discovery.Discovery{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(discovery.Events()...)),
+		eventsource.WithStore(store),
+	)
+	ctx := context.Background()
+
+	// n0001 and 10.0.0.1 are taken
+	existing := node.Node{ID: "n0001", Netdevs: map[string]*node.Netdev{
+		"10.0.0.0/24": {HWAddr: "00:11:22:33:44:01", IP: "10.0.0.1"},
+	}}
+	if err := existing.Create(ctx, nodeRepo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	p, err := projection.New(ctx, store, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	r := New(nodeRepo, discoveryRepo, p)
+	policy := Policy{Subnet: "10.0.0.0/24", Gateway: "10.0.0.2", Names: "n%04d", Netdev: "eth0"}
+
+	for _, c := range []dhcp.Client{
+		client("00:11:22:33:44:0a", tftp.EFIX8664),
+		client("00:11:22:33:44:0b", tftp.EFIARM64),
+		client("00:11:22:33:44:0a", tftp.EFIX8664),
+	} {
+		if err := r.Record(ctx, c); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	pending := r.Pending()
+	if len(pending) != 2 || pending[0].HWAddr != "00:11:22:33:44:0a" || pending[0].Version != 1 {
+		t.Fatalf("Mismatch: %+v", pending)
+	}
+
+	t.Run("Accept", func(t *testing.T) {
+		n, err := r.Accept(ctx, "00:11:22:33:44:0A", policy)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if n.ID != "n0002" || n.Arch != "x86_64" {
+			t.Fatalf("Mismatch: %+v", n)
+		}
+		if nd := n.Netdevs["10.0.0.0/24"]; nd.IP != "10.0.0.3" || nd.HWAddr != "00:11:22:33:44:0a" || nd.Name != "eth0" {
+			t.Fatalf("Mismatch: %+v", nd)
+		}
+		if d, _ := p.Discovery("00:11:22:33:44:0a"); d.State != "Accepted" || d.Node != "n0002" {
+			t.Fatalf("Mismatch: %+v", d)
+		}
+		if _, err := r.Accept(ctx, "00:11:22:33:44:0a", policy); err == nil {
+			t.Fatal("Accepted discovery accepted twice")
+		}
+		if _, err := r.Accept(ctx, "00:11:22:33:44:0b", Policy{Subnet: "10.0.0.0/24", Names: "node"}); err == nil {
+			t.Fatal("Name pattern without a verb should have been rejected")
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		if err := r.Reject(ctx, "00:11:22:33:44:0b"); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := r.Record(ctx, client("00:11:22:33:44:0b", tftp.EFIARM64)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if got := len(r.Pending()); got != 0 {
+			t.Fatalf("Expected no pending discovery, %d instead", got)
+		}
+	})
+
+	t.Run("AutoAccept", func(t *testing.T) {
+		if err := r.AutoAccept(policy, 1); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := r.Record(ctx, client("00:11:22:33:44:0c", tftp.EFIARM64)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := r.Record(ctx, client("00:11:22:33:44:0d", tftp.BIOS)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		nodes := p.NodesBy(projection.ByHWAddr, "00:11:22:33:44:0c")
+		if len(nodes) != 1 || nodes[0].ID != "n0003" || nodes[0].Arch != "aarch64" || nodes[0].Netdevs["10.0.0.0/24"].IP != "10.0.0.4" {
+			t.Fatalf("Mismatch: %+v", nodes)
+		}
+		if pending := r.Pending(); r.AutoRemaining() != 0 || len(pending) != 1 || pending[0].HWAddr != "00:11:22:33:44:0d" {
+			t.Fatalf("Mismatch: %+v", pending)
+		}
+	})
+}
@@ -0,0 +1,269 @@
+// Package snapshot bounds the time needed to load long-lived aggregates by periodically storing
+// their serialized state and loading that state plus the events recorded after it.
+//
+// A snapshot Store wraps the eventsource.Store of a repository. When an aggregate is loaded it
+// returns the latest snapshot, encoded as an event by the aggregate's Snapshot method, followed by
+// the remaining history, so repositories and the CRUD helpers built on them work unchanged. The
+// snapshot event type of each aggregate must be bound to the repository's serializer.
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/altairsix/eventsource"
+)
+
+// DefaultEvery is the number of events recorded after a snapshot before a new one is taken
+const DefaultEvery = 100
+
+// Snapshotter is implemented by aggregates that can be captured in a snapshot. The returned event
+// must carry the aggregate's version and restore its full state when passed to On.
+type Snapshotter interface {
+	Snapshot() eventsource.Event
+}
+
+// Storage persists the latest snapshot record of each aggregate
+type Storage interface {
+	// Save replaces the snapshot of the aggregate unless the stored one has a higher version
+	Save(ctx context.Context, aggregateID string, record eventsource.Record) error
+
+	// Load returns the snapshot of the aggregate; ok is false when there is none
+	Load(ctx context.Context, aggregateID string) (record eventsource.Record, ok bool, err error)
+}
+
+// Store provides an eventsource.Store that layers snapshots over another Store
+type Store struct {
+	store   eventsource.Store
+	storage Storage
+	every   int
+	repo    *eventsource.Repository
+}
+
+// Option provides functional configuration for a *Store
+type Option func(*Store)
+
+// WithEvery sets how many events are recorded after a snapshot before a new one is taken. A value
+// of 0 disables automatic snapshots; Rebuild can still be used to take them.
+func WithEvery(every int) Option {
+	return func(s *Store) {
+		s.every = every
+	}
+}
+
+// New returns a Store saving events to store and snapshots to storage
+func New(store eventsource.Store, storage Storage, opts ...Option) *Store {
+	s := &Store{
+		store:   store,
+		storage: storage,
+		every:   DefaultEvery,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Bind sets the repository used to build and serialize snapshots. The repository should be the one
+// using s as its store. Snapshots are not taken until Bind has been called.
+func (s *Store) Bind(repo *eventsource.Repository) {
+	s.repo = repo
+}
+
+// Save the provided serialized records to the underlying store, then take a snapshot of the
+// aggregate if at least the configured number of events were recorded since the last one. A
+// failure to take a snapshot does not fail the Save, as the events are already recorded.
+func (s *Store) Save(ctx context.Context, aggregateID string, records ...eventsource.Record) error {
+	if err := s.store.Save(ctx, aggregateID, records...); err != nil {
+		return err
+	}
+	if len(records) == 0 || s.every <= 0 || s.repo == nil {
+		return nil
+	}
+
+	latest := 0
+	for _, record := range records {
+		if record.Version > latest {
+			latest = record.Version
+		}
+	}
+
+	snap, ok, err := s.storage.Load(ctx, aggregateID)
+	if err != nil {
+		return nil
+	}
+	if ok && latest-snap.Version < s.every {
+		return nil
+	}
+	if !ok && latest < s.every {
+		return nil
+	}
+
+	s.take(ctx, aggregateID, s.repo.Load)
+	return nil
+}
+
+// Load the history of events up to the version specified. When the range starts at the beginning
+// and a snapshot within the range exists, the history begins with the snapshot.
+func (s *Store) Load(ctx context.Context, aggregateID string, fromVersion, toVersion int) (eventsource.History, error) {
+	if fromVersion > 1 {
+		return s.store.Load(ctx, aggregateID, fromVersion, toVersion)
+	}
+
+	snap, ok, err := s.storage.Load(ctx, aggregateID)
+	if err != nil || !ok || (toVersion != 0 && toVersion < snap.Version) {
+		return s.store.Load(ctx, aggregateID, fromVersion, toVersion)
+	}
+
+	tail, err := s.store.Load(ctx, aggregateID, snap.Version+1, toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(eventsource.History, 0, len(tail)+1)
+	history = append(history, snap)
+	for _, record := range tail {
+		// Not every Store honors fromVersion
+		if record.Version > snap.Version && (toVersion == 0 || record.Version <= toVersion) {
+			history = append(history, record)
+		}
+	}
+
+	return history, nil
+}
+
+// Read implements eventsource.StreamReader when the underlying store does. Snapshots are never part
+// of the stream.
+func (s *Store) Read(ctx context.Context, startingOffset uint64, recordCount int) ([]eventsource.StreamRecord, error) {
+	reader, ok := s.store.(eventsource.StreamReader)
+	if !ok {
+		return nil, fmt.Errorf("underlying store, %T, does not implement StreamReader", s.store)
+	}
+	return reader.Read(ctx, startingOffset, recordCount)
+}
+
+// Replay loads the aggregate from its full history, ignoring any snapshot
+func (s *Store) Replay(ctx context.Context, aggregateID string) (eventsource.Aggregate, error) {
+	if s.repo == nil {
+		return nil, fmt.Errorf("snapshot store is not bound to a repository")
+	}
+
+	history, err := s.store.Load(ctx, aggregateID, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, eventsource.NewError(nil, eventsource.ErrAggregateNotFound, "unable to load %v, %v", s.repo.New(), aggregateID)
+	}
+
+	aggregate := s.repo.New()
+	for _, record := range history {
+		event, err := s.repo.Serializer().UnmarshalEvent(record)
+		if err != nil {
+			return nil, err
+		}
+		if err := aggregate.On(event); err != nil {
+			eventType, _ := eventsource.EventType(event)
+			return nil, eventsource.NewError(err, eventsource.ErrUnhandledEvent, "aggregate was unable to handle event, %v", eventType)
+		}
+	}
+
+	return aggregate, nil
+}
+
+// Verify compares the aggregate loaded from its snapshot plus tail with the aggregate rebuilt from
+// its full history and returns an error if they differ
+func (s *Store) Verify(ctx context.Context, aggregateID string) error {
+	if s.repo == nil {
+		return fmt.Errorf("snapshot store is not bound to a repository")
+	}
+
+	fromSnapshot, err := s.repo.Load(ctx, aggregateID)
+	if err != nil {
+		return err
+	}
+	replayed, err := s.Replay(ctx, aggregateID)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(fromSnapshot, replayed) {
+		return fmt.Errorf("snapshot of aggregate, %v, does not match its history: %+v != %+v", aggregateID, fromSnapshot, replayed)
+	}
+
+	return nil
+}
+
+// Rebuild replaces the snapshot of the aggregate with one built from its full history
+func (s *Store) Rebuild(ctx context.Context, aggregateID string) error {
+	if s.repo == nil {
+		return fmt.Errorf("snapshot store is not bound to a repository")
+	}
+	return s.take(ctx, aggregateID, s.Replay)
+}
+
+// VerifyAll verifies every aggregate found in the event stream of reader, rebuilding snapshots
+// that do not match when rebuild is true. It returns the IDs of the aggregates whose snapshots did
+// not match.
+func (s *Store) VerifyAll(ctx context.Context, reader eventsource.StreamReader, rebuild bool) ([]string, error) {
+	seen := map[string]bool{}
+	mismatched := []string{}
+
+	var offset uint64
+	for {
+		records, err := reader.Read(ctx, offset, 100)
+		if err != nil {
+			return mismatched, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, record := range records {
+			offset = record.Offset + 1
+			if seen[record.AggregateID] {
+				continue
+			}
+			seen[record.AggregateID] = true
+
+			if _, ok, err := s.storage.Load(ctx, record.AggregateID); err != nil || !ok {
+				continue
+			}
+			if err := s.Verify(ctx, record.AggregateID); err == nil {
+				continue
+			}
+
+			mismatched = append(mismatched, record.AggregateID)
+			if rebuild {
+				if err := s.Rebuild(ctx, record.AggregateID); err != nil {
+					return mismatched, err
+				}
+			}
+		}
+	}
+
+	return mismatched, nil
+}
+
+// take stores a snapshot of the aggregate as returned by load
+func (s *Store) take(ctx context.Context, aggregateID string, load func(context.Context, string) (eventsource.Aggregate, error)) error {
+	aggregate, err := load(ctx, aggregateID)
+	if err != nil {
+		return err
+	}
+
+	snapshotter, ok := aggregate.(Snapshotter)
+	if !ok {
+		return fmt.Errorf("aggregate, %T, does not implement Snapshotter", aggregate)
+	}
+
+	record, err := s.repo.Serializer().MarshalEvent(snapshotter.Snapshot())
+	if err != nil {
+		return err
+	}
+
+	return s.storage.Save(ctx, aggregateID, record)
+}
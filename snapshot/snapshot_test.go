@@ -0,0 +1,116 @@
+package snapshot
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/filestore"
+	vnfs "github.com/bensallen/warewulf4/vnfs"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	vnfsID := "test"
+
+	events, err := filestore.New(filepath.Join(t.TempDir(), "events"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer events.Close()
+
+	storage, err := NewDirStorage(filepath.Join(t.TempDir(), "snapshots"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	store := New(events, storage, WithEvery(3))
+	serializer := eventsource.NewJSONSerializer(
+		vnfs.VNFSCreated{},
+		vnfs.VNFSUpdated{},
+		vnfs.VNFSDeleted{},
+		vnfs.VNFSSnapshotted{},
+	)
+	repo := eventsource.New(&vnfs.VNFS{},
+		eventsource.WithSerializer(serializer),
+		eventsource.WithStore(store),
+	)
+	store.Bind(repo)
+
+	t.Run("Snapshot", func(t *testing.T) {
+		v := vnfs.VNFS{ID: vnfsID, Arch: "x86_64", Path: "/vnfs/1"}
+		if err := v.Create(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, ok, _ := storage.Load(ctx, vnfsID); ok {
+			t.Fatal("Snapshot taken before 3 events were recorded")
+		}
+
+		for _, path := range []string{"/vnfs/2", "/vnfs/3", "/vnfs/4"} {
+			v.Path = path
+			if err := v.Update(ctx, repo); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+		}
+
+		snap, ok, err := storage.Load(ctx, vnfsID)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !ok || snap.Version != 3 {
+			t.Fatalf("Snapshot not taken at version 3, %v instead", snap.Version)
+		}
+
+		history, err := store.Load(ctx, vnfsID, 0, 0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("Expected a snapshot and 1 event, %d records instead", len(history))
+		}
+
+		loaded := vnfs.VNFS{ID: vnfsID}
+		if err := loaded.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if loaded.Version != 4 || loaded.Path != "/vnfs/4" || loaded.Arch != "x86_64" || loaded.State != "Created" {
+			t.Fatalf("Mismatch: %v", loaded)
+		}
+
+		if err := store.Verify(ctx, vnfsID); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	})
+
+	t.Run("Rebuild", func(t *testing.T) {
+		bad, err := serializer.MarshalEvent(&vnfs.VNFSSnapshotted{
+			Model: eventsource.Model{ID: vnfsID, Version: 3},
+			VNFS:  vnfs.VNFS{ID: vnfsID, Version: 3, Path: "/wrong"},
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := storage.Save(ctx, vnfsID, bad); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := store.Verify(ctx, vnfsID); err == nil {
+			t.Fatal("Verify should have failed with mismatched snapshot")
+		}
+
+		mismatched, err := store.VerifyAll(ctx, store, true)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(mismatched, []string{vnfsID}) {
+			t.Fatalf("Mismatch: %v", mismatched)
+		}
+		if err := store.Verify(ctx, vnfsID); err != nil {
+			t.Fatalf("Error after rebuild: %v", err)
+		}
+		if snap, _, _ := storage.Load(ctx, vnfsID); snap.Version != 4 {
+			t.Fatalf("Rebuilt snapshot not at version 4, %d instead", snap.Version)
+		}
+	})
+}
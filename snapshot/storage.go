@@ -0,0 +1,122 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/altairsix/eventsource"
+)
+
+// memoryStorage provides an in-memory implementation of Storage
+type memoryStorage struct {
+	mux       sync.Mutex
+	snapshots map[string]eventsource.Record
+}
+
+// NewMemoryStorage returns a Storage keeping snapshots in memory, suitable for testing only
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		snapshots: map[string]eventsource.Record{},
+	}
+}
+
+func (m *memoryStorage) Save(ctx context.Context, aggregateID string, record eventsource.Record) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if existing, ok := m.snapshots[aggregateID]; ok && existing.Version > record.Version {
+		return nil
+	}
+	m.snapshots[aggregateID] = record
+	return nil
+}
+
+func (m *memoryStorage) Load(ctx context.Context, aggregateID string) (eventsource.Record, bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	record, ok := m.snapshots[aggregateID]
+	return record, ok, nil
+}
+
+// DirStorage provides a Storage keeping one file per aggregate in a directory
+type DirStorage struct {
+	mux sync.Mutex
+	dir string
+}
+
+// NewDirStorage returns a DirStorage keeping snapshots in dir, creating it if needed
+func NewDirStorage(dir string) (*DirStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirStorage{dir: dir}, nil
+}
+
+func (d *DirStorage) path(aggregateID string) string {
+	return filepath.Join(d.dir, url.PathEscape(aggregateID)+".json")
+}
+
+// Save atomically replaces the snapshot file of the aggregate
+func (d *DirStorage) Save(ctx context.Context, aggregateID string, record eventsource.Record) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if existing, ok, err := d.load(aggregateID); err == nil && ok && existing.Version > record.Version {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(d.dir, ".snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), d.path(aggregateID))
+}
+
+// Load reads the snapshot file of the aggregate
+func (d *DirStorage) Load(ctx context.Context, aggregateID string) (eventsource.Record, bool, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return d.load(aggregateID)
+}
+
+func (d *DirStorage) load(aggregateID string) (eventsource.Record, bool, error) {
+	data, err := ioutil.ReadFile(d.path(aggregateID))
+	if os.IsNotExist(err) {
+		return eventsource.Record{}, false, nil
+	}
+	if err != nil {
+		return eventsource.Record{}, false, err
+	}
+
+	record := eventsource.Record{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return eventsource.Record{}, false, err
+	}
+	return record, true, nil
+}
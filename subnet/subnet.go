@@ -0,0 +1,452 @@
+package warewulf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+// Subnet represents a network that nodes' Netdevs are addressed in, along with the ranges
+// addresses are allocated from and the addresses reserved for other uses
+type Subnet struct {
+	ID           string
+	Version      int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	State        string
+	CIDR         string // Subnet in CIDR notation, as keyed in node.Node.Netdevs
+	Gateway      string
+	Domain       string
+	Ranges       []Range                // Ranges addresses are allocated from, the whole subnet when empty
+	Reservations map[string]Reservation // Keyed by IP
+}
+
+// Range is an inclusive range of addresses
+type Range struct {
+	Start string
+	End   string
+}
+
+// Reservation holds an address back from allocation. When HWAddr is set, the address may be
+// assigned to a Netdev with that hardware address.
+type Reservation struct {
+	IP          string
+	HWAddr      string
+	Description string
+}
+
+// ID returns the aggregate ID of the Subnet of cidr. Subnets share the event store with nodes, so
+// their IDs are prefixed to stay apart from node IDs.
+func ID(cidr string) string {
+	return "subnet:" + cidr
+}
+
+// Contains returns true if ip is in one of the Ranges of s, or in s when it has none
+func (s *Subnet) Contains(ip net.IP) bool {
+	_, network, err := net.ParseCIDR(s.CIDR)
+	if err != nil || !network.Contains(ip) {
+		return false
+	}
+	if len(s.Ranges) == 0 {
+		return true
+	}
+	for _, r := range s.Ranges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Range) contains(ip net.IP) bool {
+	start, end := normalizeIP(net.ParseIP(r.Start)), normalizeIP(net.ParseIP(r.End))
+	ip = normalizeIP(ip)
+	return len(start) == len(ip) && bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0
+}
+
+// normalizeIP returns the 4-byte form of IPv4 addresses so that addresses compare bytewise
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Create saves a new Subnet by building a CreateSubnet command and applying it against the
+// repository. s.ID is set from s.CIDR.
+func (s *Subnet) Create(ctx context.Context, repo *eventsource.Repository) error {
+	if s.CIDR == "" {
+		return fmt.Errorf("CIDR of Subnet must be specified")
+	}
+	s.ID = ID(s.CIDR)
+
+	createSubnet := &CreateSubnet{
+		CommandModel: eventsource.CommandModel{ID: s.ID},
+		CIDR:         s.CIDR,
+		Gateway:      s.Gateway,
+		Domain:       s.Domain,
+		Ranges:       s.Ranges,
+	}
+	version, err := repo.Apply(ctx, createSubnet)
+	if err != nil {
+		return err
+	}
+	s.Version = version
+
+	for _, r := range s.Reservations {
+		if err := s.Reserve(ctx, repo, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read attempts to fetch the Subnet aggregate from the event repository. s.ID or s.CIDR must be
+// specified.
+func (s *Subnet) Read(ctx context.Context, repo *eventsource.Repository) error {
+	if s.ID == "" && s.CIDR != "" {
+		s.ID = ID(s.CIDR)
+	}
+	if s.ID == "" {
+		return fmt.Errorf("ID of Subnet must be specified")
+	}
+
+	aggregate, err := repo.Load(ctx, s.ID)
+	if err != nil {
+		return err
+	}
+
+	subnet, ok := aggregate.(*Subnet)
+	if !ok {
+		return fmt.Errorf("ID returned an aggregate that is not a Subnet")
+	}
+
+	// Copy values of casted aggregate to *s
+	*s = *subnet
+
+	return nil
+}
+
+// Update replaces the Gateway, Domain and Ranges of the Subnet by applying an UpdateSubnet command
+// against the repository, with s.Version as the expected version. On success s.Version is set to
+// the new version.
+func (s *Subnet) Update(ctx context.Context, repo *eventsource.Repository) error {
+	if s.ID == "" {
+		return fmt.Errorf("ID of Subnet must be specified")
+	}
+	updateSubnet := &UpdateSubnet{
+		CommandModel:    eventsource.CommandModel{ID: s.ID},
+		ExpectedVersion: s.Version,
+		Gateway:         s.Gateway,
+		Domain:          s.Domain,
+		Ranges:          s.Ranges,
+	}
+	version, err := repo.Apply(ctx, updateSubnet)
+	if err != nil {
+		return err
+	}
+	s.Version = version
+	return nil
+}
+
+// Reserve reserves r.IP by applying a ReserveAddress command against the repository
+func (s *Subnet) Reserve(ctx context.Context, repo *eventsource.Repository, r Reservation) error {
+	if s.ID == "" {
+		return fmt.Errorf("ID of Subnet must be specified")
+	}
+	version, err := repo.Apply(ctx, &ReserveAddress{CommandModel: eventsource.CommandModel{ID: s.ID}, Reservation: r})
+	if err != nil {
+		return err
+	}
+	s.Version = version
+	return nil
+}
+
+// Release releases the reservation of ip by applying a ReleaseAddress command against the
+// repository
+func (s *Subnet) Release(ctx context.Context, repo *eventsource.Repository, ip string) error {
+	if s.ID == "" {
+		return fmt.Errorf("ID of Subnet must be specified")
+	}
+	version, err := repo.Apply(ctx, &ReleaseAddress{CommandModel: eventsource.CommandModel{ID: s.ID}, IP: ip})
+	if err != nil {
+		return err
+	}
+	s.Version = version
+	return nil
+}
+
+// Delete marks the Subnet as deleted by applying a DeleteSubnet command against the repository,
+// with s.Version as the expected version. On success s.Version is set to the new version.
+func (s *Subnet) Delete(ctx context.Context, repo *eventsource.Repository) error {
+	if s.ID == "" {
+		return fmt.Errorf("ID of Subnet must be specified")
+	}
+	deleteSubnet := &DeleteSubnet{
+		CommandModel:    eventsource.CommandModel{ID: s.ID},
+		ExpectedVersion: s.Version,
+	}
+	version, err := repo.Apply(ctx, deleteSubnet)
+	if err != nil {
+		return err
+	}
+	s.Version = version
+	return nil
+}
+
+// Events returns an instance of every event type of the Subnet aggregate, for binding to a
+// serializer
+func Events() []eventsource.Event {
+	return []eventsource.Event{
+		SubnetCreated{},
+		SubnetUpdated{},
+		SubnetAddressReserved{},
+		SubnetAddressReleased{},
+		SubnetDeleted{},
+	}
+}
+
+// SubnetCreated represents the event of a subnet being defined
+type SubnetCreated struct {
+	eventsource.Model
+	CIDR    string
+	Gateway string
+	Domain  string
+	Ranges  []Range
+}
+
+// SubnetUpdated represents the event of the gateway, domain and ranges of a subnet being replaced
+type SubnetUpdated struct {
+	eventsource.Model
+	Gateway string
+	Domain  string
+	Ranges  []Range
+}
+
+// SubnetAddressReserved represents the event of an address of the subnet being reserved
+type SubnetAddressReserved struct {
+	eventsource.Model
+	Reservation Reservation
+}
+
+// SubnetAddressReleased represents the event of a reservation being released
+type SubnetAddressReleased struct {
+	eventsource.Model
+	IP string
+}
+
+// SubnetDeleted represents the event of a subnet being deleted
+type SubnetDeleted struct {
+	eventsource.Model
+}
+
+// On applies the event's changes to the Subnet object
+func (s *Subnet) On(event eventsource.Event) error {
+	switch e := event.(type) {
+	case *SubnetCreated:
+		s.Version = e.Model.Version
+		s.ID = e.Model.ID
+		s.State = "Created"
+		s.CreatedAt = e.At
+		s.UpdatedAt = e.At
+		s.CIDR = e.CIDR
+		s.Gateway = e.Gateway
+		s.Domain = e.Domain
+		s.Ranges = e.Ranges
+		s.Reservations = map[string]Reservation{}
+
+	case *SubnetUpdated:
+		s.Version = e.Model.Version
+		s.UpdatedAt = e.At
+		s.Gateway = e.Gateway
+		s.Domain = e.Domain
+		s.Ranges = e.Ranges
+
+	case *SubnetAddressReserved:
+		s.Version = e.Model.Version
+		s.UpdatedAt = e.At
+		if s.Reservations == nil {
+			s.Reservations = map[string]Reservation{}
+		}
+		s.Reservations[e.Reservation.IP] = e.Reservation
+
+	case *SubnetAddressReleased:
+		s.Version = e.Model.Version
+		s.UpdatedAt = e.At
+		delete(s.Reservations, e.IP)
+
+	case *SubnetDeleted:
+		s.Version = e.Model.Version
+		s.UpdatedAt = e.At
+		s.State = "Deleted"
+
+	default:
+		return fmt.Errorf("unhandled event, %v, type: %s", e, reflect.TypeOf(e))
+	}
+
+	return nil
+}
+
+// CreateSubnet represents the command to define a subnet
+type CreateSubnet struct {
+	eventsource.CommandModel
+	CIDR    string
+	Gateway string
+	Domain  string
+	Ranges  []Range
+}
+
+// UpdateSubnet represents the command to replace the gateway, domain and ranges of a subnet
+type UpdateSubnet struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the subnet is at this version
+	Gateway         string
+	Domain          string
+	Ranges          []Range
+}
+
+// ReserveAddress represents the command to reserve an address of a subnet
+type ReserveAddress struct {
+	eventsource.CommandModel
+	Reservation Reservation
+}
+
+// ReleaseAddress represents the command to release a reserved address
+type ReleaseAddress struct {
+	eventsource.CommandModel
+	IP string
+}
+
+// DeleteSubnet represents the command to delete a subnet
+type DeleteSubnet struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected unless the subnet is at this version
+}
+
+// Apply implements the CommandHandler interface for Subnet
+func (s *Subnet) Apply(ctx context.Context, command eventsource.Command) ([]eventsource.Event, error) {
+	switch command.(type) {
+	case *CreateSubnet:
+		if s.State != "" {
+			return nil, fmt.Errorf("subnet, %v, already exists", command.AggregateID())
+		}
+	default:
+		if s.State == "" {
+			return nil, fmt.Errorf("subnet, %v, does not exist", command.AggregateID())
+		}
+		if s.State == "Deleted" {
+			return nil, fmt.Errorf("subnet, %v, is deleted", command.AggregateID())
+		}
+	}
+	model := eventsource.Model{ID: command.AggregateID(), Version: s.Version + 1, At: time.Now()}
+
+	switch c := command.(type) {
+	case *CreateSubnet:
+		_, network, err := net.ParseCIDR(c.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("subnet, %v, is invalid: %v", c.CIDR, err)
+		}
+		if network.String() != c.CIDR {
+			return nil, fmt.Errorf("subnet, %v, has host bits set, use %v", c.CIDR, network)
+		}
+		if command.AggregateID() != ID(c.CIDR) {
+			return nil, fmt.Errorf("subnet, %v, must have ID %v", c.CIDR, ID(c.CIDR))
+		}
+		if err := validate(network, c.Gateway, c.Ranges); err != nil {
+			return nil, err
+		}
+		return []eventsource.Event{&SubnetCreated{Model: model, CIDR: c.CIDR, Gateway: c.Gateway, Domain: c.Domain, Ranges: c.Ranges}}, nil
+
+	case *UpdateSubnet:
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, s.Version); err != nil {
+			return nil, err
+		}
+		_, network, _ := net.ParseCIDR(s.CIDR)
+		if err := validate(network, c.Gateway, c.Ranges); err != nil {
+			return nil, err
+		}
+		if c.Gateway == s.Gateway && c.Domain == s.Domain && reflect.DeepEqual(c.Ranges, s.Ranges) {
+			return nil, nil
+		}
+		return []eventsource.Event{&SubnetUpdated{Model: model, Gateway: c.Gateway, Domain: c.Domain, Ranges: c.Ranges}}, nil
+
+	case *ReserveAddress:
+		ip := net.ParseIP(c.Reservation.IP)
+		_, network, _ := net.ParseCIDR(s.CIDR)
+		if ip == nil || !network.Contains(ip) {
+			return nil, fmt.Errorf("reserved address, %v, is not in subnet %v", c.Reservation.IP, s.CIDR)
+		}
+		if c.Reservation.HWAddr != "" {
+			hwaddr, err := net.ParseMAC(c.Reservation.HWAddr)
+			if err != nil {
+				return nil, fmt.Errorf("reservation of %v has invalid hardware address, %v", c.Reservation.IP, c.Reservation.HWAddr)
+			}
+			c.Reservation.HWAddr = hwaddr.String()
+		}
+		c.Reservation.IP = ip.String()
+		if existing, ok := s.Reservations[c.Reservation.IP]; ok {
+			if existing == c.Reservation {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("address, %v, is already reserved", c.Reservation.IP)
+		}
+		return []eventsource.Event{&SubnetAddressReserved{Model: model, Reservation: c.Reservation}}, nil
+
+	case *ReleaseAddress:
+		ip := net.ParseIP(c.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address, %v", c.IP)
+		}
+		if _, ok := s.Reservations[ip.String()]; !ok {
+			return nil, fmt.Errorf("address, %v, is not reserved", c.IP)
+		}
+		return []eventsource.Event{&SubnetAddressReleased{Model: model, IP: ip.String()}}, nil
+
+	case *DeleteSubnet:
+		if err := concurrency.CheckVersion(command.AggregateID(), c.ExpectedVersion, s.Version); err != nil {
+			return nil, err
+		}
+		return []eventsource.Event{&SubnetDeleted{Model: model}}, nil
+
+	default:
+		return nil, fmt.Errorf("unhandled command, %v", c)
+	}
+}
+
+// validate returns an error if gateway or a range is outside network, or if ranges overlap
+func validate(network *net.IPNet, gateway string, ranges []Range) error {
+	if gateway != "" {
+		ip := net.ParseIP(gateway)
+		if ip == nil || !network.Contains(ip) {
+			return fmt.Errorf("gateway, %v, is not in subnet %v", gateway, network)
+		}
+	}
+
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	for _, r := range sorted {
+		start, end := net.ParseIP(r.Start), net.ParseIP(r.End)
+		if start == nil || end == nil || !network.Contains(start) || !network.Contains(end) {
+			return fmt.Errorf("range %v-%v is not in subnet %v", r.Start, r.End, network)
+		}
+		if bytes.Compare(normalizeIP(start), normalizeIP(end)) > 0 {
+			return fmt.Errorf("range %v-%v ends before it starts", r.Start, r.End)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(normalizeIP(net.ParseIP(sorted[i].Start)), normalizeIP(net.ParseIP(sorted[j].Start))) < 0
+	})
+	for i := 1; i < len(sorted); i++ {
+		if bytes.Compare(normalizeIP(net.ParseIP(sorted[i].Start)), normalizeIP(net.ParseIP(sorted[i-1].End))) <= 0 {
+			return fmt.Errorf("range %v-%v overlaps range %v-%v", sorted[i].Start, sorted[i].End, sorted[i-1].Start, sorted[i-1].End)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package warewulf
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+func TestSubnet(t *testing.T) {
+	repo := eventsource.New(&Subnet{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(Events()...)),
+	)
+	ctx := context.Background()
+
+	t.Run("CreateInvalid", func(t *testing.T) {
+		for _, s := range []Subnet{
+			{CIDR: "10.0.0.1/24"},
+			{CIDR: "10.0.0.0/24", Gateway: "10.0.1.1"},
+			{CIDR: "10.0.0.0/24", Ranges: []Range{{Start: "10.0.0.100", End: "10.0.1.10"}}},
+			{CIDR: "10.0.0.0/24", Ranges: []Range{{Start: "10.0.0.100", End: "10.0.0.10"}}},
+			{CIDR: "10.0.0.0/24", Ranges: []Range{{Start: "10.0.0.10", End: "10.0.0.100"}, {Start: "10.0.0.50", End: "10.0.0.150"}}},
+		} {
+			if err := s.Create(ctx, repo); err == nil {
+				t.Fatalf("Should have failed to create %+v", s)
+			}
+		}
+	})
+
+	s := Subnet{
+		CIDR:         "10.0.0.0/24",
+		Gateway:      "10.0.0.1",
+		Ranges:       []Range{{Start: "10.0.0.100", End: "10.0.0.199"}},
+		Reservations: map[string]Reservation{"10.0.0.150": {IP: "10.0.0.150", HWAddr: "00:11:22:33:44:AA"}},
+	}
+	t.Run("Create", func(t *testing.T) {
+		if err := s.Create(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if s.ID != "subnet:10.0.0.0/24" || s.Version != 2 {
+			t.Fatalf("Mismatch: %+v", s)
+		}
+		if err := s.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if r := s.Reservations["10.0.0.150"]; r.HWAddr != "00:11:22:33:44:aa" {
+			t.Fatalf("Mismatch: %+v", s.Reservations)
+		}
+		if !s.Contains(net.ParseIP("10.0.0.150")) || s.Contains(net.ParseIP("10.0.0.50")) {
+			t.Fatalf("Mismatch: %+v", s.Ranges)
+		}
+	})
+
+	t.Run("Reserve", func(t *testing.T) {
+		if err := s.Reserve(ctx, repo, Reservation{IP: "10.0.1.1"}); err == nil {
+			t.Fatal("Should have failed to reserve an address outside the subnet")
+		}
+		if err := s.Reserve(ctx, repo, Reservation{IP: "10.0.0.150", HWAddr: "00:11:22:33:44:bb"}); err == nil {
+			t.Fatal("Should have failed to reserve a reserved address")
+		}
+		if err := s.Release(ctx, repo, "10.0.0.150"); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := s.Release(ctx, repo, "10.0.0.150"); err == nil {
+			t.Fatal("Should have failed to release an address that is not reserved")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		if err := s.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		stale := s
+		s.Ranges = nil
+		if err := s.Update(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		stale.Domain = "cluster"
+		if err := stale.Update(ctx, repo); !concurrency.IsVersionConflict(err) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+		if err := s.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !s.Contains(net.ParseIP("10.0.0.50")) || len(s.Reservations) != 0 {
+			t.Fatalf("Mismatch: %+v", s)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := s.Delete(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := s.Reserve(ctx, repo, Reservation{IP: "10.0.0.2"}); err == nil {
+			t.Fatal("Should have failed to reserve an address of a deleted subnet")
+		}
+	})
+}
@@ -0,0 +1,486 @@
+// Package tftp is a read-only TFTP server (RFC 1350, with the option extension of RFC 2347 and the
+// blksize, timeout and tsize options of RFC 2348 and RFC 2349) serving the bootloaders that PXE and
+// UEFI firmware load before HTTP is available.
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/projection"
+)
+
+// ClientArch is a client system architecture type of RFC 4578, as sent by PXE clients in DHCP
+// option 93
+type ClientArch uint16
+
+// Client architectures of RFC 4578 and the IANA registry
+const (
+	BIOS     ClientArch = 0
+	EFIIA32  ClientArch = 6
+	EFIBC    ClientArch = 7
+	EFIX8664 ClientArch = 9
+	EFIARM32 ClientArch = 10
+	EFIARM64 ClientArch = 11
+)
+
+func (a ClientArch) String() string {
+	switch a {
+	case BIOS:
+		return "bios"
+	case EFIIA32:
+		return "efi-ia32"
+	case EFIBC:
+		return "efi-bc"
+	case EFIX8664:
+		return "efi-x86_64"
+	case EFIARM32:
+		return "efi-arm32"
+	case EFIARM64:
+		return "efi-arm64"
+	}
+	return "arch-" + strconv.Itoa(int(a))
+}
+
+// NodeClientArch returns the client architecture assumed for a node of the given Node.Arch when
+// the firmware's is not known. x86 nodes are assumed to boot from BIOS.
+func NodeClientArch(arch string) ClientArch {
+	switch arch {
+	case "aarch64", "arm64":
+		return EFIARM64
+	case "armv7l", "arm":
+		return EFIARM32
+	}
+	return BIOS
+}
+
+// Bootloaders maps client architectures to the file served to them, relative to the Root of the
+// Server. Only the files of the set are served.
+type Bootloaders map[ClientArch]string
+
+// DefaultBootloaders returns the iPXE builds of each architecture under their usual names
+func DefaultBootloaders() Bootloaders {
+	return Bootloaders{
+		BIOS:     "undionly.kpxe",
+		EFIIA32:  "ipxe-i386.efi",
+		EFIBC:    "ipxe.efi",
+		EFIX8664: "ipxe.efi",
+		EFIARM64: "ipxe-arm64.efi",
+	}
+}
+
+// BootFile is the file name that is served the bootloader of the requesting client's architecture
+const BootFile = "warewulf.boot"
+
+// TFTP opcodes
+const (
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+)
+
+// TFTP error codes
+const (
+	errUndefined  = 0
+	errNotFound   = 1
+	errAccess     = 2
+	errIllegal    = 4
+	errUnknownTID = 5
+	errOption     = 8
+)
+
+// Limits of the negotiated options
+const (
+	defaultBlksize = 512
+	minBlksize     = 8
+	maxBlksize     = 65464
+	maxTimeout     = 255
+)
+
+// Server serves the files of Bootloaders from Root
+type Server struct {
+	Root        string
+	Bootloaders Bootloaders
+
+	// Nodes, when set, is used to name the node requesting a file in the log and to choose its
+	// bootloader by Node.Arch
+	Nodes *projection.Projection
+
+	// ClientArch, when set, returns the architecture a client at ip announced, e.g. in DHCP
+	// option 93; it takes precedence over Node.Arch
+	ClientArch func(ip net.IP) (ClientArch, bool)
+
+	Timeout time.Duration // Default time to wait for an acknowledgement, 2s when zero
+	Retries int           // Number of retransmissions before giving up, 5 when zero
+}
+
+// ListenAndServe serves TFTP requests on the UDP address addr, such as ":69", until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve serves TFTP requests received on conn until ctx is done, then closes conn. Each transfer
+// is run from its own socket, as the TID of the server.
+func (s *Server) Serve(ctx context.Context, conn *net.UDPConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		req := make([]byte, n)
+		copy(req, buf[:n])
+		go s.transfer(local, peer, req)
+	}
+}
+
+// request is a parsed read or write request
+type request struct {
+	op       uint16
+	filename string
+	mode     string
+	options  map[string]string
+	order    []string // Option names in the order of the request
+}
+
+func parseRequest(pkt []byte) (*request, error) {
+	if len(pkt) < 2 {
+		return nil, fmt.Errorf("short packet")
+	}
+	r := &request{op: binary.BigEndian.Uint16(pkt), options: map[string]string{}}
+	if r.op != opRRQ && r.op != opWRQ {
+		return nil, fmt.Errorf("unexpected opcode %d", r.op)
+	}
+	fields := bytes.Split(pkt[2:], []byte{0})
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, fmt.Errorf("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+	r.filename, r.mode = string(fields[0]), strings.ToLower(string(fields[1]))
+	for i := 2; i+1 < len(fields); i += 2 {
+		name := strings.ToLower(string(fields[i]))
+		if _, ok := r.options[name]; !ok {
+			r.order = append(r.order, name)
+		}
+		r.options[name] = string(fields[i+1])
+	}
+	return r, nil
+}
+
+// transfer answers the request req received from peer
+func (s *Server) transfer(local, peer *net.UDPAddr, req []byte) {
+	laddr := &net.UDPAddr{}
+	if local != nil {
+		laddr.IP = local.IP
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Printf("tftp: %v: %v", peer, err)
+		return
+	}
+	defer conn.Close()
+
+	t := &transfer{conn: conn, peer: peer, timeout: s.Timeout, retries: s.Retries, blksize: defaultBlksize}
+	if t.timeout == 0 {
+		t.timeout = 2 * time.Second
+	}
+	if t.retries == 0 {
+		t.retries = 5
+	}
+
+	r, err := parseRequest(req)
+	if err != nil {
+		t.error(errIllegal, err.Error())
+		log.Printf("tftp: %v: %v", peer, err)
+		return
+	}
+	who := s.describe(peer.IP)
+	if r.op == opWRQ {
+		t.error(errAccess, "server is read-only")
+		log.Printf("tftp: %v%v: refused write of %v", peer, who, r.filename)
+		return
+	}
+	if r.mode != "octet" && r.mode != "netascii" {
+		t.error(errIllegal, "unsupported mode "+r.mode)
+		return
+	}
+
+	name, file, err := s.resolve(r.filename, peer.IP)
+	if err != nil {
+		t.error(errNotFound, err.Error())
+		log.Printf("tftp: %v%v: %v", peer, who, err)
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		t.error(errNotFound, "file not found")
+		log.Printf("tftp: %v%v: %v", peer, who, err)
+		return
+	}
+	if err != nil {
+		t.error(errUndefined, "cannot read file")
+		log.Printf("tftp: %v%v: %v", peer, who, err)
+		return
+	}
+	if r.mode == "netascii" {
+		data = toNetascii(data)
+	}
+
+	if err := t.send(r, data); err != nil {
+		log.Printf("tftp: %v%v: %v: %v", peer, who, name, err)
+		return
+	}
+	log.Printf("tftp: %v%v: sent %v, %d bytes", peer, who, name, len(data))
+}
+
+// resolve returns the name of the bootloader served for filename to the client at ip and its path
+func (s *Server) resolve(filename string, ip net.IP) (string, string, error) {
+	name := path.Clean(strings.TrimLeft(filename, "/"))
+	if name == BootFile {
+		arch := s.clientArch(ip)
+		bootloader, ok := s.Bootloaders[arch]
+		if !ok {
+			return "", "", fmt.Errorf("no bootloader for client architecture %v", arch)
+		}
+		name = path.Clean(bootloader)
+	}
+	for _, bootloader := range s.Bootloaders {
+		if path.Clean(bootloader) == name {
+			return name, filepath.Join(s.Root, filepath.FromSlash(name)), nil
+		}
+	}
+	return "", "", fmt.Errorf("%v is not a bootloader", filename)
+}
+
+// clientArch returns the architecture of the client at ip, as reported by ClientArch or else
+// assumed from the Arch of its node
+func (s *Server) clientArch(ip net.IP) ClientArch {
+	if s.ClientArch != nil {
+		if arch, ok := s.ClientArch(ip); ok {
+			return arch
+		}
+	}
+	if n, _, ok := s.node(ip); ok {
+		return NodeClientArch(n.Arch)
+	}
+	return BIOS
+}
+
+// node returns the node with a Netdev of address ip, along with the Netdev's hardware address
+func (s *Server) node(ip net.IP) (node.Node, string, bool) {
+	if s.Nodes == nil {
+		return node.Node{}, "", false
+	}
+	nodes := s.Nodes.NodesBy(projection.ByIP, ip.String())
+	if len(nodes) != 1 {
+		return node.Node{}, "", false
+	}
+	for _, netdev := range nodes[0].Netdevs {
+		if netdev != nil && net.ParseIP(netdev.IP).Equal(ip) {
+			return nodes[0], netdev.HWAddr, true
+		}
+	}
+	return nodes[0], "", true
+}
+
+// describe names the node at ip for the log
+func (s *Server) describe(ip net.IP) string {
+	if s.Nodes == nil {
+		return ""
+	}
+	n, hwaddr, ok := s.node(ip)
+	if !ok {
+		return " (unknown node)"
+	}
+	return fmt.Sprintf(" (node %v, %v)", n.ID, hwaddr)
+}
+
+// toNetascii converts line endings to CR LF and lone CRs to CR NUL
+func toNetascii(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch b {
+		case '\n':
+			out = append(out, '\r', '\n')
+		case '\r':
+			out = append(out, '\r', 0)
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// transfer is the state of a transfer to a client
+type transfer struct {
+	conn    *net.UDPConn
+	peer    *net.UDPAddr
+	timeout time.Duration
+	retries int
+	blksize int
+}
+
+// send negotiates the options of r and sends data in blocks
+func (t *transfer) send(r *request, data []byte) error {
+	oack := t.negotiate(r, len(data))
+	if len(oack) > 2 {
+		if err := t.exchange(oack, 0); err != nil {
+			return err
+		}
+	}
+
+	pkt := make([]byte, 4+t.blksize)
+	for i := 0; ; i++ {
+		start := i * t.blksize
+		end := start + t.blksize
+		if end > len(data) {
+			end = len(data)
+		}
+		block := uint16(i + 1) // Wraps around past 65535, as most clients expect
+		binary.BigEndian.PutUint16(pkt[0:], opDATA)
+		binary.BigEndian.PutUint16(pkt[2:], block)
+		n := copy(pkt[4:], data[start:end])
+		if err := t.exchange(pkt[:4+n], block); err != nil {
+			return err
+		}
+		if n < t.blksize {
+			return nil
+		}
+	}
+}
+
+// negotiate applies the options of r that the server supports and returns the OACK packet
+// acknowledging them, which carries no options if none were accepted
+func (t *transfer) negotiate(r *request, size int) []byte {
+	oack := []byte{0, opOACK}
+	for _, name := range r.order {
+		value := r.options[name]
+		switch name {
+		case "blksize":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < minBlksize {
+				continue
+			}
+			if n > maxBlksize {
+				n = maxBlksize
+			}
+			t.blksize = n
+			value = strconv.Itoa(n)
+		case "timeout":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxTimeout {
+				continue
+			}
+			t.timeout = time.Duration(n) * time.Second
+		case "tsize":
+			// The size of a netascii transfer is the size after conversion, which is what data is
+			value = strconv.Itoa(size)
+		default:
+			continue
+		}
+		oack = append(oack, name...)
+		oack = append(oack, 0)
+		oack = append(oack, value...)
+		oack = append(oack, 0)
+	}
+	return oack
+}
+
+// exchange sends pkt and waits for the acknowledgement of block, resending pkt on timeout.
+// Duplicate acknowledgements of earlier blocks are ignored rather than answered, which avoids the
+// Sorcerer's Apprentice bug.
+func (t *transfer) exchange(pkt []byte, block uint16) error {
+	buf := make([]byte, 4+maxBlksize)
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		if _, err := t.conn.WriteToUDP(pkt, t.peer); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(t.timeout)
+		for {
+			if err := t.conn.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+			n, addr, err := t.conn.ReadFromUDP(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !addr.IP.Equal(t.peer.IP) || addr.Port != t.peer.Port {
+				t.conn.WriteToUDP(errorPacket(errUnknownTID, "unknown transfer ID"), addr)
+				continue
+			}
+			if n < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(buf) {
+			case opACK:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+			case opERROR:
+				code := binary.BigEndian.Uint16(buf[2:])
+				msg := string(bytes.TrimRight(buf[4:n], "\x00"))
+				if code == errOption {
+					return fmt.Errorf("client refused options: %v", msg)
+				}
+				return fmt.Errorf("client error %d: %v", code, msg)
+			default:
+				t.error(errIllegal, "unexpected opcode")
+				return fmt.Errorf("unexpected opcode %d", binary.BigEndian.Uint16(buf))
+			}
+		}
+	}
+	return fmt.Errorf("timed out waiting for acknowledgement of block %d", block)
+}
+
+// error sends an ERROR packet to the peer, which ends the transfer
+func (t *transfer) error(code uint16, msg string) {
+	t.conn.WriteToUDP(errorPacket(code, msg), t.peer)
+}
+
+func errorPacket(code uint16, msg string) []byte {
+	pkt := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(pkt[0:], opERROR)
+	binary.BigEndian.PutUint16(pkt[2:], code)
+	pkt = append(pkt, msg...)
+	return append(pkt, 0)
+}
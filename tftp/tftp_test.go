@@ -0,0 +1,159 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// get reads filename from the server at addr, acknowledging each block, and returns the data and
+// the options acknowledged by the server
+func get(t *testing.T, addr *net.UDPAddr, filename, mode string, options ...string) ([]byte, map[string]string, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer conn.Close()
+
+	req := []byte{0, opRRQ}
+	for _, field := range append([]string{filename, mode}, options...) {
+		req = append(append(req, field...), 0)
+	}
+	if _, err := conn.WriteToUDP(req, addr); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	var data []byte
+	oack := map[string]string{}
+	blksize := defaultBlksize
+	buf := make([]byte, 4+maxBlksize)
+	next := uint16(1)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, peer, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		ack := func(block uint16) {
+			pkt := []byte{0, opACK, 0, 0}
+			binary.BigEndian.PutUint16(pkt[2:], block)
+			conn.WriteToUDP(pkt, peer)
+		}
+		switch binary.BigEndian.Uint16(buf) {
+		case opOACK:
+			fields := strings.Split(string(buf[2:n]), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				oack[fields[i]] = fields[i+1]
+			}
+			if oack["blksize"] != "" {
+				if blksize, err = strconv.Atoi(oack["blksize"]); err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+			}
+			ack(0)
+		case opDATA:
+			block := binary.BigEndian.Uint16(buf[2:])
+			if block == next {
+				data = append(data, buf[4:n]...)
+				next++
+			}
+			ack(block)
+			if n-4 < blksize {
+				return data, oack, nil
+			}
+		case opERROR:
+			return nil, nil, &net.AddrError{Err: string(buf[4 : n-1])}
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	bios := bytes.Repeat([]byte("undionly"), 300)
+	efi := []byte("ipxe efi\nbinary\r")
+	if err := ioutil.WriteFile(filepath.Join(dir, "undionly.kpxe"), bios, 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ipxe.efi"), efi, 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	arch := BIOS
+	s := &Server{
+		Root:        dir,
+		Bootloaders: DefaultBootloaders(),
+		ClientArch:  func(net.IP) (ClientArch, bool) { return arch, true },
+		Timeout:     time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, conn)
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	t.Run("Octet", func(t *testing.T) {
+		data, _, err := get(t, addr, "undionly.kpxe", "octet")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !bytes.Equal(data, bios) {
+			t.Fatalf("Mismatch: %d bytes", len(data))
+		}
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		data, oack, err := get(t, addr, "/undionly.kpxe", "octet", "blksize", "100", "tsize", "0", "timeout", "3", "unknown", "1")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !bytes.Equal(data, bios) {
+			t.Fatalf("Mismatch: %d bytes", len(data))
+		}
+		if oack["blksize"] != "100" || oack["tsize"] != "2400" || oack["timeout"] != "3" || len(oack) != 3 {
+			t.Fatalf("Mismatch: %v", oack)
+		}
+	})
+
+	t.Run("BootFile", func(t *testing.T) {
+		arch = EFIX8664
+		defer func() { arch = BIOS }()
+		data, _, err := get(t, addr, BootFile, "octet")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !bytes.Equal(data, efi) {
+			t.Fatalf("Mismatch: %q", data)
+		}
+	})
+
+	t.Run("Netascii", func(t *testing.T) {
+		data, _, err := get(t, addr, "ipxe.efi", "netascii")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if string(data) != "ipxe efi\r\nbinary\r\x00" {
+			t.Fatalf("Mismatch: %q", data)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		for _, filename := range []string{"secret", "../secret", "ipxe-arm64.efi"} {
+			if _, _, err := get(t, addr, filename, "octet"); err == nil {
+				t.Fatalf("Expected error reading %v", filename)
+			}
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package warewulf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/artifact"
+	"github.com/bensallen/warewulf4/compress"
+	"github.com/bensallen/warewulf4/cpio"
+)
+
+// Build archives the chroot directory into a newc cpio image compressed with v.CompressAlgo and
+// written to v.Path, then records it with a CreateVNFS command, or an UpdateVNFS command when the
+// VNFS already exists. When ctx carries an artifact.Store the image is added to the store instead
+// and v.Path is set to its blob. v.Size and v.Checksum are set from the written image. Ownership, modes,
+// symlinks, hard links, device nodes and extended attributes of the chroot are preserved.
+func (v *VNFS) Build(ctx context.Context, repo *eventsource.Repository, chroot string) error {
+	if v.ID == "" {
+		return fmt.Errorf("ID of VNFS must be specified")
+	}
+	if _, ok := artifact.StoreFrom(ctx); !ok && v.Path == "" {
+		return fmt.Errorf("Path of VNFS must be specified")
+	}
+	if info, err := os.Stat(chroot); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("chroot, %v, is not a directory", chroot)
+	}
+
+	existing := VNFS{ID: v.ID}
+	err := existing.Read(ctx, repo)
+	exists := !eventsource.IsNotFound(err)
+	if exists && err != nil {
+		return err
+	}
+	if existing.State == "Deleted" {
+		return fmt.Errorf("VNFS, %v, is deleted", v.ID)
+	}
+
+	path, size, sum, err := writeImage(ctx, chroot, v.Path, v.CompressAlgo)
+	if err != nil {
+		return err
+	}
+	v.Path = path
+	v.Size = size
+	v.Checksum = sum
+
+	if !exists {
+		return v.Create(ctx, repo)
+	}
+	return v.Update(ctx, repo)
+}
+
+// Recompress rewrites the image of the VNFS compressed with compressAlgo and records the result with
+// an UpdateVNFS command, so nodes following the latest version boot the new image while nodes
+// pinned to an earlier version keep the old one. The image is written to path, which must not be
+// the current image; when ctx carries an artifact.Store it is added to the store and path is
+// ignored. v is set to the updated VNFS.
+func (v *VNFS) Recompress(ctx context.Context, repo *eventsource.Repository, compressAlgo, path string) error {
+	if err := compress.ValidateNative(compressAlgo); err != nil {
+		return err
+	}
+	if err := v.Read(ctx, repo); err != nil {
+		return err
+	}
+	if v.State == "Deleted" {
+		return fmt.Errorf("VNFS, %v, is deleted", v.ID)
+	}
+	if v.Path == "" {
+		return fmt.Errorf("VNFS, %v, has no image to recompress", v.ID)
+	}
+	if _, ok := artifact.StoreFrom(ctx); !ok {
+		if path == "" {
+			return fmt.Errorf("Path of the recompressed image must be specified")
+		}
+		// Earlier versions keep referring to the current image
+		if filepath.Clean(path) == filepath.Clean(v.Path) {
+			return fmt.Errorf("Path of the recompressed image, %v, is the image of version %d of VNFS, %v", path, v.Version, v.ID)
+		}
+	}
+
+	src, err := os.Open(v.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	path, size, sum, err := artifact.Write(ctx, path, compressAlgo, func(w io.Writer) error {
+		return compress.Recompress(w, src, v.CompressAlgo, compress.None)
+	})
+	if err != nil {
+		return err
+	}
+
+	v.Path = path
+	v.Size = size
+	v.Checksum = sum
+	v.CompressAlgo = compressAlgo
+	return v.Update(ctx, repo)
+}
+
+// writeImage writes the compressed archive of chroot, see artifact.Write
+func writeImage(ctx context.Context, chroot, path, compressAlgo string) (string, int64, string, error) {
+	return artifact.Write(ctx, path, compressAlgo, func(w io.Writer) error {
+		archiver := cpio.NewArchiver(cpio.NewWriter(w))
+		if err := archiver.AddTree(chroot, ""); err != nil {
+			return err
+		}
+		return archiver.Close()
+	})
+}
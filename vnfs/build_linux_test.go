@@ -0,0 +1,181 @@
+package warewulf
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/artifact"
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/cpio"
+)
+
+func TestVNFSBuild(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	chroot := filepath.Join(dir, "chroot")
+
+	for _, d := range []string{"etc", "bin"} {
+		if err := os.MkdirAll(filepath.Join(chroot, d), 0755); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(chroot, "bin", "busybox"), []byte("busybox"), 0755); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := os.Link(filepath.Join(chroot, "bin", "busybox"), filepath.Join(chroot, "bin", "sh")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := os.Symlink("/proc/mounts", filepath.Join(chroot, "etc", "mtab")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	repo := eventsource.New(&VNFS{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(Events()...)),
+	)
+
+	v := VNFS{ID: "test", Arch: "x86_64", Path: filepath.Join(dir, "test.img.gz"), CompressAlgo: "gzip"}
+	if err := v.Build(ctx, repo, chroot); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(v.Path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sum := sha512.Sum512(data)
+	if v.Checksum != "sha512:"+hex.EncodeToString(sum[:]) || v.Size != int64(len(data)) {
+		t.Fatalf("Checksum or Size mismatch: %v", v)
+	}
+
+	loaded := VNFS{ID: "test"}
+	if err := loaded.Read(ctx, repo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if loaded.Version != 1 || loaded.Checksum != v.Checksum || loaded.Size != v.Size || loaded.CompressAlgo != "gzip" {
+		t.Fatalf("Mismatch: %v", loaded)
+	}
+
+	f, err := os.Open(v.Path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	headers := map[string]*cpio.Header{}
+	contents := map[string]string{}
+	r := cpio.NewReader(gz)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		headers[h.Name] = h
+		contents[h.Name] = string(data)
+	}
+
+	if h := headers["etc/mtab"]; h == nil || h.Type() != cpio.TypeSymlink || contents["etc/mtab"] != "/proc/mounts" {
+		t.Fatalf("Symlink not preserved: %+v", h)
+	}
+	busybox, sh := headers["bin/busybox"], headers["bin/sh"]
+	if busybox == nil || sh == nil || busybox.Ino != sh.Ino || busybox.Nlink != 2 {
+		t.Fatalf("Hard link not preserved: %+v %+v", busybox, sh)
+	}
+	if contents["bin/busybox"]+contents["bin/sh"] != "busybox" {
+		t.Fatalf("Hard linked data should be stored once: %q %q", contents["bin/busybox"], contents["bin/sh"])
+	}
+	if h := headers["bin"]; h == nil || h.Type() != cpio.TypeDir || h.Mode&0777 != 0755 {
+		t.Fatalf("Directory not preserved: %+v", h)
+	}
+
+	v.Path = filepath.Join(dir, "test.img")
+	v.CompressAlgo = "none"
+	if err := v.Build(ctx, repo, chroot); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if v.Version != 2 {
+		t.Fatalf("Rebuild should update the VNFS to version 2, %d instead", v.Version)
+	}
+
+	raw, err := ioutil.ReadFile(v.Path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, path := range []string{"", v.Path} {
+		if err := v.Recompress(ctx, repo, "gzip", path); err == nil {
+			t.Fatalf("Recompress should not overwrite the current image, %q", path)
+		}
+	}
+	if err := v.Recompress(ctx, repo, "gzip", filepath.Join(dir, "test-3.img.gz")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if v.Version != 3 || v.CompressAlgo != "gzip" || v.Path != filepath.Join(dir, "test-3.img.gz") {
+		t.Fatalf("Recompress should update the VNFS to version 3, %v instead", v)
+	}
+	f, err = os.Open(v.Path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer f.Close()
+	if gz, err = gzip.NewReader(f); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, err := ioutil.ReadAll(gz); err != nil || string(data) != string(raw) {
+		t.Fatalf("Recompressed image does not match the original: %v", err)
+	}
+	if err := v.Recompress(ctx, repo, "rar", ""); err == nil {
+		t.Fatal("Recompress with an unsupported algorithm should fail")
+	}
+
+	// Nodes pinned to version 2 keep booting its image
+	history, err := repo.Store().Load(ctx, "test", 0, 2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	pinned := VNFS{}
+	for _, record := range history {
+		if record.Version > 2 {
+			break
+		}
+		event, err := repo.Serializer().UnmarshalEvent(record)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := pinned.On(event); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if pinned.Version != 2 || pinned.CompressAlgo != "none" {
+		t.Fatalf("Mismatch: %v", pinned)
+	}
+	if _, err := checksum.VerifyFile(pinned.Path, pinned.Checksum); err != nil {
+		t.Fatalf("Image of version 2 changed by Recompress: %v", err)
+	}
+
+	store, err := artifact.New(filepath.Join(dir, "artifacts"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stored := VNFS{ID: "stored", CompressAlgo: "gzip"}
+	if err := stored.Build(artifact.WithStore(ctx, store), repo, chroot); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if path, _ := store.Path(stored.Checksum); stored.Path != path || !store.Has(stored.Checksum) {
+		t.Fatalf("Image not built into the artifact store: %v", stored.Path)
+	}
+}
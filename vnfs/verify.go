@@ -0,0 +1,68 @@
+package warewulf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/checksum"
+)
+
+// Verify streams the image at v.Path through the algorithm of v.Checksum and records the outcome
+// with a VerifyVNFS command, emitting VNFSVerified or VNFSCorrupted. v is set to the VNFS after
+// verification. If the VNFS was recorded as corrupted the *checksum.MismatchError, or the error
+// reading the image, is returned.
+func (v *VNFS) Verify(ctx context.Context, repo *eventsource.Repository) error {
+	if err := v.Read(ctx, repo); err != nil {
+		return err
+	}
+	if v.Checksum == "" {
+		return fmt.Errorf("VNFS, %v, has no checksum to verify", v.ID)
+	}
+
+	verifyVNFS := &VerifyVNFS{
+		CommandModel:    eventsource.CommandModel{ID: v.ID},
+		ExpectedVersion: v.Version,
+	}
+	actual, verr := checksum.VerifyFile(v.Path, v.Checksum)
+	verifyVNFS.Actual = actual
+	if verr != nil && !checksum.IsMismatch(verr) {
+		verifyVNFS.Reason = verr.Error()
+	}
+
+	if _, err := repo.Apply(ctx, verifyVNFS); err != nil {
+		return err
+	}
+	if err := v.Read(ctx, repo); err != nil {
+		return err
+	}
+	return verr
+}
+
+// VerifyAll verifies the images of the VNFS with the given IDs, e.g. those listed by a projection,
+// and returns the IDs of the ones found corrupted. Deleted VNFS and those without a checksum are
+// skipped. Errors other than corruption abort the run.
+func VerifyAll(ctx context.Context, repo *eventsource.Repository, ids []string) ([]string, error) {
+	var corrupted []string
+	for _, id := range ids {
+		v := VNFS{ID: id}
+		if err := v.Read(ctx, repo); err != nil {
+			return corrupted, err
+		}
+		if v.State == "Deleted" || v.Checksum == "" {
+			continue
+		}
+
+		// The version only advances when an outcome was recorded
+		version := v.Version
+		err := v.Verify(ctx, repo)
+		switch {
+		case err == nil:
+		case v.Version > version && v.Corrupted:
+			corrupted = append(corrupted, id)
+		default:
+			return corrupted, err
+		}
+	}
+	return corrupted, nil
+}
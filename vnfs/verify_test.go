@@ -0,0 +1,112 @@
+package warewulf
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/concurrency"
+)
+
+func TestVNFSVerify(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo := eventsource.New(&VNFS{},
+		eventsource.WithSerializer(eventsource.NewJSONSerializer(Events()...)),
+	)
+
+	images := map[string]string{}
+	for _, id := range []string{"centos7", "sles12", "missing"} {
+		path := filepath.Join(dir, id+".img")
+		if err := ioutil.WriteFile(path, []byte(id), 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		sum, err := checksum.Sum(strings.NewReader(id), checksum.BLAKE2b)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		v := VNFS{ID: id, Path: path, Checksum: sum}
+		if err := v.Create(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		images[id] = path
+	}
+
+	t.Run("Verified", func(t *testing.T) {
+		v := VNFS{ID: "centos7"}
+		if err := v.Verify(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if v.Version != 2 || v.VerifiedAt.IsZero() || v.Corrupted {
+			t.Fatalf("VNFSVerified not recorded: %v", v)
+		}
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		if err := ioutil.WriteFile(images["sles12"], []byte("sles15"), 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		v := VNFS{ID: "sles12"}
+		if err := v.Verify(ctx, repo); !checksum.IsMismatch(err) {
+			t.Fatalf("Should have failed with a mismatch, %v instead", err)
+		}
+		if v.Version != 2 || !v.Corrupted {
+			t.Fatalf("VNFSCorrupted not recorded: %v", v)
+		}
+	})
+
+	t.Run("VerifyAll", func(t *testing.T) {
+		if err := os.Remove(images["missing"]); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		corrupted, err := VerifyAll(ctx, repo, []string{"centos7", "missing", "sles12"})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(corrupted, []string{"missing", "sles12"}) {
+			t.Fatalf("Mismatch: %v", corrupted)
+		}
+	})
+
+	t.Run("UpdateAfterVerify", func(t *testing.T) {
+		v := VNFS{ID: "centos7"}
+		if err := v.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, err := VerifyAll(ctx, repo, []string{"centos7"}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		v.Arch = "x86_64"
+		if err := v.Update(ctx, repo); err != nil {
+			t.Fatalf("Verification should not make an Update stale, %v", err)
+		}
+		stale := VNFS{ID: "centos7", Version: v.Version - 1, Arch: "aarch64"}
+		if err := stale.Update(ctx, repo); !concurrency.IsVersionConflict(err) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+	})
+
+	t.Run("UpdateClearsCorrupted", func(t *testing.T) {
+		v := VNFS{ID: "sles12"}
+		if err := v.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		v.Checksum, _ = checksum.Sum(strings.NewReader("sles15"), checksum.SHA256)
+		if err := v.Update(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := v.Verify(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if v.Corrupted || v.VerifiedAt.IsZero() {
+			t.Fatalf("Mismatch: %v", v)
+		}
+	})
+}
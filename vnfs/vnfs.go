@@ -7,6 +7,10 @@ import (
 	"time"
 
 	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/artifact"
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/compress"
+	"github.com/bensallen/warewulf4/concurrency"
 )
 
 // VNFS represents a userland OS image compressed CPIO format
@@ -21,6 +25,13 @@ type VNFS struct {
 	Checksum     string
 	Size         int64
 	CompressAlgo string
+	VerifiedAt   time.Time // Time the image was last found to match Checksum
+	Corrupted    bool      // Set when the image was last found not to match Checksum
+
+	// ChangedVersion is the version of the last event other than a verification outcome. As
+	// verification does not change the VNFS, commands expecting any version from ChangedVersion
+	// to Version are not stale.
+	ChangedVersion int
 }
 
 // Create saves a new VNFS by building a CreateVNFS command and appling it against the repository.
@@ -29,7 +40,7 @@ func (v *VNFS) Create(ctx context.Context, repo *eventsource.Repository) error {
 		return fmt.Errorf("ID of VNFS must be specified")
 	}
 
-	createVNFS := CreateVNFS{
+	createVNFS := &CreateVNFS{
 		CommandModel: eventsource.CommandModel{ID: v.ID},
 		Arch:         v.Arch,
 		Path:         v.Path,
@@ -38,8 +49,12 @@ func (v *VNFS) Create(ctx context.Context, repo *eventsource.Repository) error {
 		CompressAlgo: v.CompressAlgo,
 	}
 
-	_, err := repo.Apply(ctx, createVNFS)
-	return err
+	version, err := repo.Apply(ctx, createVNFS)
+	if err != nil {
+		return err
+	}
+	v.Version = version
+	return nil
 }
 
 // Read attemps to fetch the VNFS aggregrate from the event repository. v.ID must be specified
@@ -50,8 +65,8 @@ func (v *VNFS) Read(ctx context.Context, repo *eventsource.Repository) error {
 	}
 
 	aggregate, err := repo.Load(ctx, v.ID)
-	if aggregate == nil {
-		return fmt.Errorf("VNFS not found")
+	if err != nil {
+		return err
 	}
 
 	vnfs, ok := aggregate.(*VNFS)
@@ -63,36 +78,62 @@ func (v *VNFS) Read(ctx context.Context, repo *eventsource.Repository) error {
 	// Copy values of casted aggregigate to *v
 	*v = *vnfs
 
-	return err
+	return nil
 }
 
-func (v *VNFS) Update(repo *eventsource.Repository, ctx context.Context) error {
+// Update applies an UpdateVNFS command against the repository. v.Version is sent as the expected
+// version, so an Update of a VNFS obtained from Read fails with a concurrency.ErrVersionConflict
+// error if the VNFS has been changed since. On success v.Version is set to the new version.
+func (v *VNFS) Update(ctx context.Context, repo *eventsource.Repository) error {
 	if v.ID == "" {
 		return fmt.Errorf("ID of VNFS must be specified")
 	}
-	updateVNFS := UpdateVNFS{
-		CommandModel: eventsource.CommandModel{ID: v.ID},
-		Arch:         v.Arch,
-		Path:         v.Path,
-		Checksum:     v.Checksum,
-		Size:         v.Size,
-		CompressAlgo: v.CompressAlgo,
+	updateVNFS := &UpdateVNFS{
+		CommandModel:    eventsource.CommandModel{ID: v.ID},
+		ExpectedVersion: v.Version,
+		Arch:            v.Arch,
+		Path:            v.Path,
+		Checksum:        v.Checksum,
+		Size:            v.Size,
+		CompressAlgo:    v.CompressAlgo,
 	}
 
-	_, err := repo.Apply(ctx, updateVNFS)
-	return err
-
+	version, err := repo.Apply(ctx, updateVNFS)
+	if err != nil {
+		return err
+	}
+	v.Version = version
+	return nil
 }
 
-func (v *VNFS) Delete(repo *eventsource.Repository, ctx context.Context) error {
+// Delete applies a DeleteVNFS command against the repository, with v.Version as the expected
+// version. On success v.Version is set to the new version.
+func (v *VNFS) Delete(ctx context.Context, repo *eventsource.Repository) error {
 	if v.ID == "" {
 		return fmt.Errorf("ID of VNFS must be specified")
 	}
-	deleteVNFS := DeleteVNFS{
-		CommandModel: eventsource.CommandModel{ID: v.ID},
+	deleteVNFS := &DeleteVNFS{
+		CommandModel:    eventsource.CommandModel{ID: v.ID},
+		ExpectedVersion: v.Version,
+	}
+	version, err := repo.Apply(ctx, deleteVNFS)
+	if err != nil {
+		return err
+	}
+	v.Version = version
+	return nil
+}
+
+// Events returns an instance of every event type of the VNFS aggregate, for binding to a serializer
+func Events() []eventsource.Event {
+	return []eventsource.Event{
+		VNFSCreated{},
+		VNFSUpdated{},
+		VNFSDeleted{},
+		VNFSSnapshotted{},
+		VNFSVerified{},
+		VNFSCorrupted{},
 	}
-	_, err := repo.Apply(ctx, deleteVNFS)
-	return err
 }
 
 //VNFSCreated represents the event of the bootstrap being created
@@ -122,11 +163,42 @@ type VNFSDeleted struct {
 	State string
 }
 
+// VNFSVerified represents the event of the VNFS image being found to match its checksum
+type VNFSVerified struct {
+	eventsource.Model
+	Checksum string
+}
+
+// VNFSCorrupted represents the event of the VNFS image being found not to match its checksum, or
+// being unreadable
+type VNFSCorrupted struct {
+	eventsource.Model
+	Expected string
+	Actual   string // Empty when the image could not be read
+	Reason   string
+}
+
+// VNFSSnapshotted carries the full state of a VNFS at a version. It is produced by Snapshot for
+// snapshot stores and is not saved to the event log.
+type VNFSSnapshotted struct {
+	eventsource.Model
+	VNFS VNFS
+}
+
+// Snapshot captures the current state of the VNFS as a VNFSSnapshotted event
+func (v *VNFS) Snapshot() eventsource.Event {
+	return &VNFSSnapshotted{
+		Model: eventsource.Model{ID: v.ID, Version: v.Version, At: time.Now()},
+		VNFS:  *v,
+	}
+}
+
 //On parses event types and applies the event's changes to the VNFS object
 func (v *VNFS) On(event eventsource.Event) error {
 	switch e := event.(type) {
 	case *VNFSCreated:
 		v.Version = e.Model.Version
+		v.ChangedVersion = e.Model.Version
 		v.ID = e.Model.ID
 		v.State = "Created"
 		v.CreatedAt = e.At
@@ -154,8 +226,15 @@ func (v *VNFS) On(event eventsource.Event) error {
 
 	case *VNFSUpdated:
 		v.Version = e.Model.Version
+		v.ChangedVersion = e.Model.Version
 		v.UpdatedAt = e.At
 
+		// A new image has not been verified yet
+		if e.Path != "" || e.Checksum != "" {
+			v.VerifiedAt = time.Time{}
+			v.Corrupted = false
+		}
+
 		if e.Arch != "" {
 			v.Arch = e.Arch
 		}
@@ -178,9 +257,27 @@ func (v *VNFS) On(event eventsource.Event) error {
 
 	case *VNFSDeleted:
 		v.Version = e.Model.Version
+		v.ChangedVersion = e.Model.Version
 		v.UpdatedAt = e.At
 		v.State = "Deleted"
 
+	case *VNFSVerified:
+		v.Version = e.Model.Version
+		v.VerifiedAt = e.At
+		v.Corrupted = false
+
+	case *VNFSCorrupted:
+		v.Version = e.Model.Version
+		v.Corrupted = true
+
+	case *VNFSSnapshotted:
+		*v = e.VNFS
+		v.Version = e.Model.Version
+		if v.ChangedVersion == 0 {
+			// Snapshotted before verification outcomes were told apart
+			v.ChangedVersion = v.Version
+		}
+
 	default:
 		return fmt.Errorf("unhandled event, %v, type: %s", e, reflect.TypeOf(e))
 	}
@@ -201,16 +298,28 @@ type CreateVNFS struct {
 //UpdateVNFS represents the command to create a VNFS
 type UpdateVNFS struct {
 	eventsource.CommandModel
-	Arch         string
-	Path         string
-	Checksum     string
-	Size         int64
-	CompressAlgo string
+	ExpectedVersion int // When non-zero, the command is rejected if the VNFS changed since this version
+	Arch            string
+	Path            string
+	Checksum        string
+	Size            int64
+	CompressAlgo    string
+}
+
+// VerifyVNFS represents the command to record the result of verifying the VNFS image against its
+// checksum. Actual is the checksum computed from the image, or empty with Reason set when the image
+// could not be read.
+type VerifyVNFS struct {
+	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected if the VNFS changed since this version
+	Actual          string
+	Reason          string
 }
 
 //DeleteVNFS represents the command to delete VNFS files
 type DeleteVNFS struct {
 	eventsource.CommandModel
+	ExpectedVersion int // When non-zero, the command is rejected if the VNFS changed since this version
 }
 
 //Apply implements the CommandHandler interface for VNFS
@@ -220,6 +329,17 @@ func (v *VNFS) Apply(ctx context.Context, command eventsource.Command) ([]events
 		if v.State != "" {
 			return nil, fmt.Errorf("VNFS, %v, already exists, use an UpdateVNFS type instead", command.AggregateID())
 		}
+		if err := compress.ValidateNative(c.CompressAlgo); err != nil {
+			return nil, err
+		}
+		if err := checksum.Validate(c.Checksum); err != nil {
+			return nil, err
+		}
+		if c.Path != "" {
+			if err := artifact.CheckPath(ctx, c.Path, c.Checksum); err != nil {
+				return nil, err
+			}
+		}
 		vnfsCreated := &VNFSCreated{
 			Model:        eventsource.Model{ID: command.AggregateID(), Version: v.Version + 1, At: time.Now()},
 			Arch:         c.Arch,
@@ -231,6 +351,35 @@ func (v *VNFS) Apply(ctx context.Context, command eventsource.Command) ([]events
 		return []eventsource.Event{vnfsCreated}, nil
 
 	case *UpdateVNFS:
+		if v.State == "" {
+			return nil, fmt.Errorf("VNFS, %v, does not exist, use a CreateVNFS type instead", command.AggregateID())
+		}
+		if v.State == "Deleted" {
+			return nil, fmt.Errorf("VNFS, %v, is deleted", command.AggregateID())
+		}
+		if err := v.checkVersion(c.ExpectedVersion); err != nil {
+			return nil, err
+		}
+		if err := compress.ValidateNative(c.CompressAlgo); err != nil {
+			return nil, err
+		}
+		if err := checksum.Validate(c.Checksum); err != nil {
+			return nil, err
+		}
+		if c.Path != "" || c.Checksum != "" {
+			path, sum := v.Path, v.Checksum
+			if c.Path != "" {
+				path = c.Path
+			}
+			if c.Checksum != "" {
+				sum = c.Checksum
+			}
+			if path != "" {
+				if err := artifact.CheckPath(ctx, path, sum); err != nil {
+					return nil, err
+				}
+			}
+		}
 		vnfsUpdated := &VNFSUpdated{
 			Model:        eventsource.Model{ID: command.AggregateID(), Version: v.Version + 1, At: time.Now()},
 			Arch:         c.Arch,
@@ -241,9 +390,40 @@ func (v *VNFS) Apply(ctx context.Context, command eventsource.Command) ([]events
 		}
 		return []eventsource.Event{vnfsUpdated}, nil
 
+	case *VerifyVNFS:
+		if v.State == "" {
+			return nil, fmt.Errorf("VNFS, %v, does not exist", command.AggregateID())
+		}
+		if v.State == "Deleted" {
+			return nil, fmt.Errorf("VNFS, %v, is deleted", command.AggregateID())
+		}
+		if err := v.checkVersion(c.ExpectedVersion); err != nil {
+			return nil, err
+		}
+		if v.Checksum == "" {
+			return nil, fmt.Errorf("VNFS, %v, has no checksum to verify", command.AggregateID())
+		}
+		model := eventsource.Model{ID: command.AggregateID(), Version: v.Version + 1, At: time.Now()}
+		if c.Reason == "" && checksum.Equal(c.Actual, v.Checksum) {
+			return []eventsource.Event{&VNFSVerified{Model: model, Checksum: c.Actual}}, nil
+		}
+		vnfsCorrupted := &VNFSCorrupted{
+			Model:    model,
+			Expected: v.Checksum,
+			Actual:   c.Actual,
+			Reason:   c.Reason,
+		}
+		return []eventsource.Event{vnfsCorrupted}, nil
+
 	case *DeleteVNFS:
+		if v.State == "" {
+			return nil, fmt.Errorf("VNFS, %v, does not exist", command.AggregateID())
+		}
 		if v.State == "Deleted" {
-			return nil, fmt.Errorf("VNFS, %v, is already deleted", command.AggregateID())
+			return nil, fmt.Errorf("VNFS, %v, is deleted", command.AggregateID())
+		}
+		if err := v.checkVersion(c.ExpectedVersion); err != nil {
+			return nil, err
 		}
 		vnfsDeleted := &VNFSDeleted{
 			Model: eventsource.Model{ID: command.AggregateID(), Version: v.Version + 1, At: time.Now()},
@@ -254,3 +434,12 @@ func (v *VNFS) Apply(ctx context.Context, command eventsource.Command) ([]events
 		return nil, fmt.Errorf("unhandled command, %v", c)
 	}
 }
+
+// checkVersion returns a concurrency.ErrVersionConflict error if the VNFS changed since version
+// expected, verification outcomes recorded since not counting as changes
+func (v *VNFS) checkVersion(expected int) error {
+	if expected >= v.ChangedVersion && expected <= v.Version {
+		return nil
+	}
+	return concurrency.CheckVersion(v.ID, expected, v.Version)
+}
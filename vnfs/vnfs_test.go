@@ -8,6 +8,7 @@ import (
 	"reflect"
 
 	"github.com/altairsix/eventsource"
+	"github.com/bensallen/warewulf4/concurrency"
 )
 
 func TestVNFSOn(t *testing.T) {
@@ -16,11 +17,12 @@ func TestVNFSOn(t *testing.T) {
 		v1 := VNFS{}
 		timeNow := time.Now()
 		v2 := VNFS{
-			ID:        "test",
-			Version:   1,
-			CreatedAt: timeNow,
-			UpdatedAt: timeNow,
-			State:     "Created",
+			ID:             "test",
+			Version:        1,
+			CreatedAt:      timeNow,
+			UpdatedAt:      timeNow,
+			State:          "Created",
+			ChangedVersion: 1,
 		}
 		vnfsCreated := VNFSCreated{
 			Model: eventsource.Model{ID: v2.ID, Version: v2.Version, At: v2.CreatedAt},
@@ -47,15 +49,16 @@ func TestVNFSOn(t *testing.T) {
 			State:     "Created",
 		}
 		v2 := VNFS{
-			ID:        "test",
-			Version:   2,
-			CreatedAt: v1.CreatedAt,
-			UpdatedAt: time.Now(),
-			State:     "Created",
-			Arch:      "x86_64",
-			Checksum:  "0f82992b7693500212e8dd9d7542a5e960c8f787a25f7ce2497a51202c16e558cf4b61a48eade93135bf96c79aafb12dc6dbabdb10907f84571c886157714a74",
-			Size:      123456,
-			Path:      "/test/path/to/nothing",
+			ID:             "test",
+			Version:        2,
+			CreatedAt:      v1.CreatedAt,
+			UpdatedAt:      time.Now(),
+			State:          "Created",
+			Arch:           "x86_64",
+			Checksum:       "0f82992b7693500212e8dd9d7542a5e960c8f787a25f7ce2497a51202c16e558cf4b61a48eade93135bf96c79aafb12dc6dbabdb10907f84571c886157714a74",
+			Size:           123456,
+			Path:           "/test/path/to/nothing",
+			ChangedVersion: 2,
 		}
 
 		vnfsUpdated := VNFSUpdated{
@@ -80,10 +83,11 @@ func TestVNFSOn(t *testing.T) {
 			ID: "test",
 		}
 		v2 := VNFS{
-			ID:        "test",
-			Version:   10,
-			UpdatedAt: time.Now(),
-			State:     "Deleted",
+			ID:             "test",
+			Version:        10,
+			UpdatedAt:      time.Now(),
+			State:          "Deleted",
+			ChangedVersion: 10,
 		}
 		vnfsDeleted := VNFSDeleted{
 			Model: eventsource.Model{ID: v2.ID, Version: v2.Version, At: v2.UpdatedAt},
@@ -209,6 +213,49 @@ func TestVNFSApply(t *testing.T) {
 			t.Fatalf("Path mismatch, set to %s instead", vnfs.Path)
 		}
 	})
+	t.Run("UpdateVNFSConflict", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &UpdateVNFS{
+			CommandModel:    eventsource.CommandModel{ID: vnfsID},
+			ExpectedVersion: 1,
+			Size:            1,
+		})
+		if !concurrency.IsVersionConflict(err) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+
+		v1 := VNFS{ID: vnfsID}
+		if err := v1.Read(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		v2 := v1
+
+		v1.Size = 1
+		if err := v1.Update(ctx, repo); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if v1.Version != 3 {
+			t.Fatalf("Version not 3, %d instead", v1.Version)
+		}
+
+		v2.Size = 2
+		err = v2.Update(ctx, repo)
+		if !concurrency.IsVersionConflict(err) {
+			t.Fatalf("Should have failed with version conflict, %v instead", err)
+		}
+	})
+
+	t.Run("UpdateVNFSCompressAlgo", func(t *testing.T) {
+		for _, algo := range []string{"rar", "lz4"} {
+			_, err := repo.Apply(ctx, &UpdateVNFS{
+				CommandModel: eventsource.CommandModel{ID: vnfsID},
+				CompressAlgo: algo,
+			})
+			if err == nil {
+				t.Fatalf("Should have failed with compression algorithm %v unusable by wwinit", algo)
+			}
+		}
+	})
+
 	t.Run("DeleteVNFS", func(t *testing.T) {
 
 		vers, err := repo.Apply(ctx, &DeleteVNFS{
@@ -217,7 +264,7 @@ func TestVNFSApply(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Error: %v", err)
 		}
-		if vers != 3 {
+		if vers != 4 {
 			t.Fatalf("Version, %d, not incremented on apply", vers)
 		}
 
@@ -234,7 +281,37 @@ func TestVNFSApply(t *testing.T) {
 			CommandModel: eventsource.CommandModel{ID: vnfsID},
 		})
 		if err == nil {
-			t.Fatal("Should have failed with already deleted error")
+			t.Fatal("Should have failed with deleted error")
+		}
+
+		_, err = repo.Apply(ctx, &UpdateVNFS{
+			CommandModel: eventsource.CommandModel{ID: vnfsID},
+			Size:         1,
+		})
+		if err == nil {
+			t.Fatal("Should have failed with deleted error")
+		}
+		if err := vnfs.Read(ctx, repo); err != nil || vnfs.State != "Deleted" {
+			t.Fatalf("Should not have resurrected a deleted VNFS, %v %v", vnfs.State, err)
+		}
+	})
+
+	t.Run("VNFSMissing", func(t *testing.T) {
+		_, err := repo.Apply(ctx, &UpdateVNFS{
+			CommandModel: eventsource.CommandModel{ID: "missing"},
+			Arch:         "x86_64",
+		})
+		if err == nil {
+			t.Fatal("Should have failed with does not exist error")
+		}
+		_, err = repo.Apply(ctx, &DeleteVNFS{
+			CommandModel: eventsource.CommandModel{ID: "missing"},
+		})
+		if err == nil {
+			t.Fatal("Should have failed with does not exist error")
+		}
+		if _, err := repo.Load(ctx, "missing"); !eventsource.IsNotFound(err) {
+			t.Fatalf("Should not have created a VNFS, %v", err)
 		}
 	})
 }
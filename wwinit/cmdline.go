@@ -0,0 +1,99 @@
+// Package wwinit is the provisioning init run from a Bootstrap's initramfs. It identifies the
+// node from the kernel command line, fetches the node's configuration and VNFS from the
+// controller, verifies and unpacks the VNFS into a tmpfs, configures the node's network devices
+// and hands over to the init of the VNFS.
+package wwinit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bensallen/warewulf4/provision"
+)
+
+// Params are the provisioning parameters read from the kernel command line
+type Params struct {
+	ID      string // wwid=, ID of the node
+	HWAddr  string // wwhwaddr=, or BOOTIF= as set by PXELINUX and iPXE; identifies the node when ID is unset
+	Server  string // wwserver=, base URL of the controller, e.g. http://10.0.0.1:9873
+	VNFS    string // wwvnfs=, URL of the VNFS image, by default its provisioning path on Server
+	IP      string // wwip=, address of the boot interface in CIDR notation, used to reach the controller
+	Gateway string // wwgw=, gateway of the boot interface
+	Init    string // wwinit=, init of the VNFS to hand over to
+}
+
+// DefaultInit is the init of the VNFS run when no wwinit parameter is given
+const DefaultInit = "/sbin/init"
+
+// ParseCmdline reads Params from a kernel command line
+func ParseCmdline(cmdline string) (Params, error) {
+	p := Params{Init: DefaultInit}
+	for _, field := range strings.Fields(cmdline) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "wwid":
+			p.ID = value
+		case "wwhwaddr":
+			p.HWAddr = value
+		case "BOOTIF":
+			// BOOTIF is the ARP hardware type followed by the address, separated by dashes
+			if p.HWAddr == "" && len(value) > 3 {
+				p.HWAddr = strings.Replace(value[3:], "-", ":", -1)
+			}
+		case "wwserver":
+			p.Server = strings.TrimRight(value, "/")
+		case "wwvnfs":
+			p.VNFS = value
+		case "wwip":
+			p.IP = value
+		case "wwgw":
+			p.Gateway = value
+		case "wwinit":
+			p.Init = value
+		}
+	}
+
+	if p.Server == "" {
+		return p, fmt.Errorf("wwserver must be set on the kernel command line")
+	}
+	if p.HWAddr != "" {
+		hwaddr, err := net.ParseMAC(p.HWAddr)
+		if err != nil {
+			return p, fmt.Errorf("invalid hardware address, %v: %v", p.HWAddr, err)
+		}
+		p.HWAddr = hwaddr.String()
+	}
+	if p.ID == "" && p.HWAddr == "" {
+		return p, fmt.Errorf("wwid or BOOTIF must be set on the kernel command line")
+	}
+	if p.IP != "" {
+		if _, _, err := net.ParseCIDR(p.IP); err != nil {
+			return p, fmt.Errorf("invalid wwip, %v: %v", p.IP, err)
+		}
+	}
+	if p.Gateway != "" && net.ParseIP(p.Gateway) == nil {
+		return p, fmt.Errorf("invalid wwgw, %v", p.Gateway)
+	}
+	return p, nil
+}
+
+// URL returns the URL of file of the node on the controller
+func (p Params) URL(file string) string {
+	if p.ID != "" {
+		return p.Server + provision.NodePath(p.ID, file)
+	}
+	return p.Server + provision.HWAddrPath(p.HWAddr, file)
+}
+
+// VNFSURL returns the URL of the node's VNFS image
+func (p Params) VNFSURL() string {
+	if p.VNFS != "" {
+		return p.VNFS
+	}
+	return p.URL(provision.FileVNFS)
+}
@@ -0,0 +1,44 @@
+package wwinit
+
+import (
+	"testing"
+)
+
+func TestParseCmdline(t *testing.T) {
+	p, err := ParseCmdline("console=ttyS0 BOOTIF=01-00-11-22-AA-BB-CC wwserver=http://10.0.0.1:9873/ wwip=10.0.0.5/24 wwgw=10.0.0.254 quiet\n")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if p.HWAddr != "00:11:22:aa:bb:cc" || p.Server != "http://10.0.0.1:9873" || p.Init != DefaultInit {
+		t.Fatalf("Mismatch: %+v", p)
+	}
+	if got := p.URL("vnfs"); got != "http://10.0.0.1:9873/provision/hwaddr/00:11:22:aa:bb:cc/vnfs" {
+		t.Fatalf("Mismatch: %v", got)
+	}
+
+	if got := p.VNFSURL(); got != "http://10.0.0.1:9873/provision/hwaddr/00:11:22:aa:bb:cc/vnfs" {
+		t.Fatalf("Mismatch: %v", got)
+	}
+
+	p, err = ParseCmdline("wwid=n0001 wwserver=http://controller wwvnfs=http://mirror/centos7.img wwinit=/usr/lib/systemd/systemd")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got := p.URL("config"); got != "http://controller/provision/node/n0001/config" || p.Init != "/usr/lib/systemd/systemd" {
+		t.Fatalf("Mismatch: %v %+v", got, p)
+	}
+	if got := p.VNFSURL(); got != "http://mirror/centos7.img" {
+		t.Fatalf("Mismatch: %v", got)
+	}
+
+	for _, bad := range []string{
+		"wwid=n0001",
+		"wwserver=http://controller",
+		"wwid=n0001 wwserver=http://controller wwip=10.0.0.5",
+		"wwserver=http://controller wwhwaddr=zz:zz",
+	} {
+		if _, err := ParseCmdline(bad); err == nil {
+			t.Fatalf("ParseCmdline(%q) should have failed", bad)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package wwinit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/compress"
+	"github.com/bensallen/warewulf4/cpio"
+	"github.com/bensallen/warewulf4/provision"
+)
+
+// FetchConfig gets the configuration of the node identified by p from the controller
+func FetchConfig(ctx context.Context, client *http.Client, p Params) (*provision.Config, error) {
+	resp, err := get(ctx, client, p.URL(provision.FileConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	config := &provision.Config{}
+	if err := json.NewDecoder(resp.Body).Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid node configuration: %v", err)
+	}
+	return config, nil
+}
+
+// FetchVNFS gets the VNFS image described by a from url, decompresses it with a.CompressAlgo and
+// extracts it below dir. The compressed image is first spooled to an unlinked file in dir, which
+// is expected to be a tmpfs, and verified against a.Size and a.Checksum; if it does not match, a
+// *SizeError or *checksum.MismatchError is returned and nothing is extracted.
+func FetchVNFS(ctx context.Context, client *http.Client, url string, a provision.Artifact, dir string) error {
+	algo, _, err := checksum.Parse(a.Checksum)
+	if err != nil {
+		return fmt.Errorf("VNFS, %v, cannot be verified: %v", a.ID, err)
+	}
+	hash, err := checksum.New(algo)
+	if err != nil {
+		return err
+	}
+	decompressor, err := compress.Lookup(a.CompressAlgo)
+	if err != nil {
+		return err
+	}
+
+	spool, err := ioutil.TempFile(dir, ".vnfs-")
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	// Unlinked, the spool neither shows in the extracted tree nor outlives a failed attempt
+	if err := os.Remove(spool.Name()); err != nil {
+		return err
+	}
+
+	resp, err := get(ctx, client, url)
+	if err != nil {
+		return err
+	}
+	body := io.Reader(resp.Body)
+	if a.Size != 0 {
+		// Read a byte past the expected size, to tell a longer image without spooling all of it
+		body = io.LimitReader(body, a.Size+1)
+	}
+	n, err := io.Copy(io.MultiWriter(spool, hash), body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if a.Size != 0 && n != a.Size {
+		return &SizeError{ID: a.ID, Size: a.Size}
+	}
+	if actual := checksum.Format(algo, hash.Sum(nil)); !checksum.Equal(actual, a.Checksum) {
+		return &checksum.MismatchError{Path: url, Expected: a.Checksum, Actual: actual}
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := decompressor.NewReader(spool)
+	if err != nil {
+		return err
+	}
+	if err := cpio.Extract(r, dir); err != nil {
+		r.Close()
+		return err
+	}
+	return r.Close()
+}
+
+// SizeError is returned by FetchVNFS when the image served is not of the expected size
+type SizeError struct {
+	ID   string
+	Size int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("VNFS, %v, is not the expected %d bytes", e.ID, e.Size)
+}
+
+// changed returns true if err, returned by FetchVNFS, shows that the image served is not the one
+// described
+func changed(err error) bool {
+	_, ok := err.(*SizeError)
+	return ok || checksum.IsMismatch(err)
+}
+
+func get(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %v: %v", url, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,162 @@
+package wwinit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bensallen/warewulf4/checksum"
+	"github.com/bensallen/warewulf4/cpio"
+	"github.com/bensallen/warewulf4/provision"
+)
+
+// testImage returns a gzip compressed VNFS image holding etc/hostname and its checksum
+func testImage(t *testing.T, hostname string) ([]byte, string) {
+	image := &bytes.Buffer{}
+	gz := gzip.NewWriter(image)
+	a := cpio.NewArchiver(cpio.NewWriter(gz))
+	if err := a.AddDir("etc", 0755); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := a.AddData("etc/hostname", 0644, []byte(hostname)); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sum, _ := checksum.Sum(bytes.NewReader(image.Bytes()), checksum.SHA256)
+	return image.Bytes(), sum
+}
+
+func TestFetch(t *testing.T) {
+	image, sum := testImage(t, "n0001\n")
+
+	config := provision.Config{
+		ID:   "n0001",
+		VNFS: provision.Artifact{ID: "centos7", Checksum: sum, Size: int64(len(image)), CompressAlgo: "gzip"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case provision.NodePath("n0001", provision.FileConfig):
+			json.NewEncoder(w).Encode(config)
+		case provision.NodePath("n0001", provision.FileVNFS):
+			w.Write(image)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	params, err := ParseCmdline("wwid=n0001 wwserver=" + server.URL)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	got, err := FetchConfig(ctx, server.Client(), params)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got.VNFS != config.VNFS {
+		t.Fatalf("Mismatch: %+v", got)
+	}
+
+	dir := t.TempDir()
+	if err := FetchVNFS(ctx, server.Client(), params.URL(provision.FileVNFS), got.VNFS, dir); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "etc", "hostname")); err != nil || string(data) != "n0001\n" {
+		t.Fatalf("VNFS not extracted: %q %v", data, err)
+	}
+
+	corrupt := got.VNFS
+	corrupt.Checksum = "sha256:" + strings.Repeat("0", 64)
+	empty := t.TempDir()
+	err = FetchVNFS(ctx, server.Client(), params.URL(provision.FileVNFS), corrupt, empty)
+	if !checksum.IsMismatch(err) {
+		t.Fatalf("Should have failed with a mismatch, %v instead", err)
+	}
+	if entries, _ := ioutil.ReadDir(empty); len(entries) != 0 {
+		t.Fatalf("Should not have extracted an unverified VNFS, found %v", entries[0].Name())
+	}
+
+	short := got.VNFS
+	short.Size--
+	if err := FetchVNFS(ctx, server.Client(), params.URL(provision.FileVNFS), short, t.TempDir()); err == nil {
+		t.Fatal("Should have failed with a size mismatch")
+	}
+
+	unknown, _ := ParseCmdline("wwid=n0002 wwserver=" + server.URL)
+	if _, err := FetchConfig(ctx, server.Client(), unknown); err == nil {
+		t.Fatal("Should have failed with not found")
+	}
+}
+
+func TestFetchRootUpdated(t *testing.T) {
+	defer func(wait time.Duration) { retryWait = wait }(retryWait)
+	retryWait = time.Millisecond
+
+	images := map[int][]byte{}
+	configs := map[int]provision.Config{}
+	for version, hostname := range map[int]string{1: "old\n", 2: "new\n"} {
+		image, sum := testImage(t, hostname)
+		images[version] = image
+		configs[version] = provision.Config{
+			ID:   "n0001",
+			VNFS: provision.Artifact{ID: "centos7", Version: version, Checksum: sum, Size: int64(len(image)), CompressAlgo: "gzip"},
+		}
+	}
+	var mux sync.Mutex
+	version, configRequests := 1, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		switch r.URL.Path {
+		case provision.NodePath("n0001", provision.FileConfig):
+			json.NewEncoder(w).Encode(configs[version])
+			configRequests++
+			// The VNFS is updated once its first configuration was served
+			version = 2
+		case provision.NodePath("n0001", provision.FileVNFS):
+			w.Write(images[version])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	params, err := ParseCmdline("wwid=n0001 wwserver=" + server.URL)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	dir := t.TempDir()
+	config, err := fetchRoot(context.Background(), server.Client(), params, dir, func() error {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if config.VNFS.Version != 2 || configRequests != 2 {
+		t.Fatalf("Should have fetched the configuration of version 2 again, %+v after %d requests", config.VNFS, configRequests)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "etc", "hostname")); err != nil || string(data) != "new\n" {
+		t.Fatalf("VNFS version 2 not extracted: %q %v", data, err)
+	}
+}
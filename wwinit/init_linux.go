@@ -0,0 +1,502 @@
+package wwinit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	node "github.com/bensallen/warewulf4/node"
+	"github.com/bensallen/warewulf4/provision"
+)
+
+// Paths used by Run
+const (
+	// NewRoot is where the VNFS is unpacked
+	NewRoot = "/newroot"
+
+	// ModulesList lists the modules to load, see bootstrap.InitramfsModules
+	ModulesList = "/etc/warewulf/modules"
+
+	// ConfigPath is where the node's provision.Config is written in the VNFS, for services of the
+	// booted system
+	ConfigPath = "/etc/warewulf/config.json"
+)
+
+// retryInterval is the longest wait between attempts to reach the controller
+const retryInterval = 30 * time.Second
+
+// Run provisions the node and execs the init of its VNFS; it only returns on failure. It must run
+// as PID 1 of an initramfs built by bootstrap.Build.
+func Run() error {
+	if err := mountEarly(); err != nil {
+		return err
+	}
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return err
+	}
+	params, err := ParseCmdline(string(cmdline))
+	if err != nil {
+		return err
+	}
+	if err := loadModules(ModulesList); err != nil {
+		return err
+	}
+
+	nl, err := openRtnetlink()
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	boot, err := configureBoot(nl, params)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client := &http.Client{Timeout: 10 * time.Minute}
+
+	config, err := fetchRoot(ctx, client, params, NewRoot, func() error {
+		// Start each attempt from an empty tmpfs
+		syscall.Unmount(NewRoot, syscall.MNT_DETACH)
+		if err := os.MkdirAll(NewRoot, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount("tmpfs", NewRoot, "tmpfs", 0, "mode=0755"); err != nil {
+			return os.NewSyscallError("mount tmpfs", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("wwinit: unpacked VNFS %v version %d", config.VNFS.ID, config.VNFS.Version)
+
+	// The netdevs may enslave the boot interface to a bond or bridge, which must not keep an
+	// address of its own, so the boot address is left to them
+	if err := nl.delAddr(boot.index, boot.addr); err != nil {
+		return err
+	}
+	if err := configureNetdevs(nl, config.Netdevs); err != nil {
+		return err
+	}
+	if err := writeConfig(filepath.Join(NewRoot, ConfigPath), config); err != nil {
+		return err
+	}
+
+	return switchRoot(NewRoot, params.Init)
+}
+
+// fetchRoot fetches the configuration of the node identified by p, then extracts its VNFS below
+// dir, calling prepare to empty dir before each attempt. When the image served does not match the
+// configuration, as when the VNFS was updated in between, the configuration is fetched again
+// before the next attempt. It returns the configuration describing the extracted VNFS.
+func fetchRoot(ctx context.Context, client *http.Client, p Params, dir string, prepare func() error) (*provision.Config, error) {
+	var config *provision.Config
+	retry("fetch node configuration", func() (err error) {
+		config, err = FetchConfig(ctx, client, p)
+		return err
+	})
+	if config.VNFS.ID == "" {
+		return nil, fmt.Errorf("node, %v, has no VNFS", config.ID)
+	}
+
+	retry("fetch VNFS", func() error {
+		if config == nil {
+			c, err := FetchConfig(ctx, client, p)
+			if err != nil {
+				return err
+			}
+			if c.VNFS.ID == "" {
+				return fmt.Errorf("node, %v, has no VNFS", c.ID)
+			}
+			config = c
+		}
+		if err := prepare(); err != nil {
+			return err
+		}
+		err := FetchVNFS(ctx, client, p.VNFSURL(), config.VNFS, dir)
+		if changed(err) {
+			config = nil
+			return fmt.Errorf("%v, fetching the node configuration again", err)
+		}
+		return err
+	})
+	return config, nil
+}
+
+// retryWait is the first wait between attempts of retry
+var retryWait = time.Second
+
+// retry calls fn until it succeeds, backing off up to retryInterval between attempts
+func retry(what string, fn func() error) {
+	wait := retryWait
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		log.Printf("wwinit: %v: %v, retrying in %v", what, err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > retryInterval {
+			wait = retryInterval
+		}
+	}
+}
+
+// mountEarly mounts the filesystems needed to read the command line, load modules and find devices
+func mountEarly() error {
+	mounts := []struct{ source, target, fstype string }{
+		{"proc", "/proc", "proc"},
+		{"sysfs", "/sys", "sysfs"},
+		{"devtmpfs", "/dev", "devtmpfs"},
+	}
+	for _, m := range mounts {
+		if err := os.MkdirAll(m.target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m.source, m.target, m.fstype, syscall.MS_NOSUID, ""); err != nil && err != syscall.EBUSY {
+			return os.NewSyscallError("mount "+m.target, err)
+		}
+	}
+	return nil
+}
+
+// moduleInitCompressedFile asks finit_module to decompress the module itself
+const moduleInitCompressedFile = 4
+
+// loadModules loads the modules listed in list, which are relative to the module directory of
+// the running kernel and in load order. A missing list loads nothing.
+func loadModules(list string) error {
+	f, err := os.Open(list)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return err
+	}
+	release := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	moduleDir := filepath.Join("/lib/modules", string(release))
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		module := strings.TrimSpace(scanner.Text())
+		if module == "" {
+			continue
+		}
+		if err := loadModule(filepath.Join(moduleDir, module)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func loadModule(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	flags := 0
+	if ext := filepath.Ext(path); ext != ".ko" {
+		flags = moduleInitCompressedFile
+	}
+	nr := sysFinitModule
+	if nr < 0 {
+		return fmt.Errorf("loading modules is not supported on this architecture")
+	}
+	params := []byte{0}
+	_, _, errno := syscall.Syscall(uintptr(nr), f.Fd(), uintptr(unsafe.Pointer(&params[0])), uintptr(flags))
+	if errno != 0 && errno != syscall.EEXIST {
+		return &os.PathError{Op: "finit_module", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// bootLink is the interface the node booted from and the address configureBoot assigned it
+type bootLink struct {
+	index int
+	addr  *net.IPNet
+}
+
+// configureBoot brings up the interface the node booted from and, when given, assigns the boot
+// address and gateway so the controller can be reached
+func configureBoot(nl *rtnetlink, p Params) (*bootLink, error) {
+	if p.HWAddr == "" || p.IP == "" {
+		return nil, fmt.Errorf("BOOTIF and wwip must be set on the kernel command line to reach the controller")
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	iface, err := findInterface(interfaces, p.HWAddr, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := nl.linkUp(iface.Index, ""); err != nil {
+		return nil, err
+	}
+	ip, network, err := net.ParseCIDR(p.IP)
+	if err != nil {
+		return nil, err
+	}
+	boot := &bootLink{index: iface.Index, addr: &net.IPNet{IP: ip, Mask: network.Mask}}
+	if err := nl.addAddr(boot.index, boot.addr); err != nil {
+		return nil, err
+	}
+	if p.Gateway != "" {
+		return boot, nl.addRoute(iface.Index, nil, net.ParseIP(p.Gateway))
+	}
+	return boot, nil
+}
+
+// configureNetdevs sets up the interfaces of netdevs and adds the default routes through the first
+// IPv4 and IPv6 gateways. Ethernet netdevs are matched by hardware address or by name and renamed;
+// bonds, bridges and vlans are created on the netdevs they are built on, which are configured
+// first. Members of a bond or bridge are brought up once enslaved.
+func configureNetdevs(nl *rtnetlink, netdevs map[string]*node.Netdev) error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	order, err := netdevOrder(netdevs)
+	if err != nil {
+		return err
+	}
+
+	indexes := map[string]int{}
+	defaultRoute, defaultRoute6 := false, false
+	for _, key := range order {
+		netdev := netdevs[key]
+		index, err := createLink(nl, interfaces, indexes, key, netdev)
+		if err != nil {
+			return err
+		}
+		if netdev.Name != "" {
+			indexes[netdev.Name] = index
+		}
+		if _, _, enslaved := node.Master(netdevs, netdev.Name); enslaved {
+			// Left down until its master enslaves it
+			continue
+		}
+		setIPv6Sysctls(index, netdev)
+		if err := nl.linkUp(index, ""); err != nil {
+			return err
+		}
+		addrs, err := netdevAddrs(key, netdev)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if err := nl.addAddr(index, addr); err != nil {
+				return err
+			}
+		}
+		v4, v6 := netdev.Gateways()
+		if v4.IsValid() && !defaultRoute {
+			if err := nl.addRoute(index, nil, net.IP(v4.AsSlice())); err != nil {
+				return err
+			}
+			defaultRoute = true
+		}
+		if v6.IsValid() && !defaultRoute6 {
+			if err := nl.addRoute(index, nil, net.IP(v6.AsSlice())); err != nil {
+				return err
+			}
+			defaultRoute6 = true
+		}
+	}
+	return nil
+}
+
+// setIPv6Sysctls applies the ipv6Sysctls of netdev to the interface with index. Failures are
+// logged, as they leave the node reachable over IPv4 or its static addresses.
+func setIPv6Sysctls(index int, netdev *node.Netdev) {
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		log.Printf("wwinit: %v", err)
+		return
+	}
+	for name, value := range ipv6Sysctls(netdev) {
+		path := filepath.Join("/proc/sys/net/ipv6/conf", iface.Name, name)
+		if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			log.Printf("wwinit: %v", err)
+		}
+	}
+}
+
+// createLink finds or creates the interface of netdev, with key key, and returns its index.
+// indexes holds the indexes of the netdevs configured so far, by name.
+func createLink(nl *rtnetlink, interfaces []net.Interface, indexes map[string]int, key string, netdev *node.Netdev) (int, error) {
+	var index int
+	switch netdev.Type {
+	case node.NetdevEthernet:
+		iface, err := findInterface(interfaces, netdev.HWAddr, netdev.Name)
+		if err != nil {
+			return 0, fmt.Errorf("netdev on %v: %v", key, err)
+		}
+		index = iface.Index
+		// Interfaces can only be renamed, set a new MTU reliably or be enslaved while down
+		if err := nl.linkDown(index); err != nil {
+			return 0, err
+		}
+		if netdev.Name != "" && netdev.Name != iface.Name {
+			if err := nl.newLink(index, 0, netdev.Name); err != nil {
+				return 0, fmt.Errorf("rename interface %d to %v: %v", index, netdev.Name, err)
+			}
+		}
+
+	case node.NetdevVLAN:
+		id := make([]byte, 2)
+		nativeEndian.PutUint16(id, uint16(netdev.VLAN))
+		if err := nl.addLink(netdev.Name, "vlan", indexes[netdev.Parent], appendAttr(nil, iflaVLANID, id)); err != nil {
+			return 0, err
+		}
+
+	case node.NetdevBond, node.NetdevBridge:
+		var data []byte
+		if netdev.Type == node.NetdevBond {
+			mode, err := bondMode(netdev.BondMode)
+			if err != nil {
+				return 0, fmt.Errorf("netdev on %v: %v", key, err)
+			}
+			// Without link monitoring a bond never notices a member going down
+			miimon := make([]byte, 4)
+			nativeEndian.PutUint32(miimon, 100)
+			data = appendAttr(appendAttr(nil, iflaBondMode, []byte{mode}), iflaBondMiimon, miimon)
+		}
+		if err := nl.addLink(netdev.Name, netdev.Type, 0, data); err != nil {
+			return 0, err
+		}
+
+	default:
+		return 0, fmt.Errorf("netdev on %v has invalid type, %v", key, netdev.Type)
+	}
+
+	if index == 0 {
+		iface, err := net.InterfaceByName(netdev.Name)
+		if err != nil {
+			return 0, fmt.Errorf("netdev on %v: %v", key, err)
+		}
+		index = iface.Index
+	}
+	for _, member := range netdev.Members {
+		if err := nl.linkDown(indexes[member]); err != nil {
+			return 0, err
+		}
+		if err := nl.setLink(indexes[member], syscall.IFLA_MASTER, uint32(index)); err != nil {
+			return 0, fmt.Errorf("enslave %v to %v: %v", member, netdev.Name, err)
+		}
+		if err := nl.linkUp(indexes[member], ""); err != nil {
+			return 0, err
+		}
+	}
+	// A bond sets the MTU of its members, so it is set once they are enslaved
+	if netdev.MTU != 0 {
+		if err := nl.setLink(index, syscall.IFLA_MTU, uint32(netdev.MTU)); err != nil {
+			return 0, fmt.Errorf("netdev on %v: set MTU %d: %v", key, netdev.MTU, err)
+		}
+	}
+	return index, nil
+}
+
+func writeConfig(path string, config *provision.Config) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// switchRoot moves the early mounts into newRoot, frees the initramfs, makes newRoot the root
+// and execs init
+func switchRoot(newRoot, init string) error {
+	for _, m := range []string{"/dev", "/proc", "/sys"} {
+		target := filepath.Join(newRoot, m)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m, target, "", syscall.MS_MOVE, ""); err != nil {
+			return os.NewSyscallError("move "+m, err)
+		}
+	}
+
+	if err := freeInitramfs(newRoot); err != nil {
+		log.Printf("wwinit: unable to free initramfs: %v", err)
+	}
+
+	if err := syscall.Chdir(newRoot); err != nil {
+		return err
+	}
+	if err := syscall.Mount(newRoot, "/", "", syscall.MS_MOVE, ""); err != nil {
+		return os.NewSyscallError("move "+newRoot, err)
+	}
+	if err := syscall.Chroot("."); err != nil {
+		return os.NewSyscallError("chroot", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	return syscall.Exec(init, []string{init}, os.Environ())
+}
+
+// freeInitramfs removes the files of the initramfs, which would otherwise stay in memory, leaving
+// other mounts such as newRoot alone
+func freeInitramfs(newRoot string) error {
+	var root syscall.Stat_t
+	if err := syscall.Lstat("/", &root); err != nil {
+		return err
+	}
+	return removeOnDevice("/", root.Dev, newRoot)
+}
+
+func removeOnDevice(dir string, dev uint64, skip string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if path == skip {
+			continue
+		}
+		st, ok := entry.Sys().(*syscall.Stat_t)
+		if !ok || uint64(st.Dev) != dev {
+			continue
+		}
+		if entry.IsDir() {
+			if err := removeOnDevice(path, dev, skip); err != nil {
+				return err
+			}
+		}
+		os.Remove(path)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package wwinit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// rtnetlink is a minimal client of the kernel's routing netlink interface, enough to bring
+// interfaces up, rename them and add addresses and routes without external tools
+type rtnetlink struct {
+	fd  int
+	seq uint32
+}
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+func openRtnetlink() (*rtnetlink, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return &rtnetlink{fd: fd}, nil
+}
+
+func (n *rtnetlink) Close() error {
+	return syscall.Close(n.fd)
+}
+
+// request sends a message of type typ and waits for the kernel's acknowledgement
+func (n *rtnetlink) request(typ, flags uint16, body []byte) error {
+	n.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	nativeEndian.PutUint32(msg[0:], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	nativeEndian.PutUint16(msg[4:], typ)
+	nativeEndian.PutUint16(msg[6:], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:], n.seq)
+	msg = append(msg, body...)
+
+	if err := syscall.Sendto(n.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		size, _, err := syscall.Recvfrom(n.fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:size])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != n.seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("netlink: truncated acknowledgement")
+			}
+			if errno := -int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+// linkUp brings the interface with the given index up, renaming it first when name is not empty
+func (n *rtnetlink) linkUp(index int, name string) error {
+	if name != "" {
+		// Interfaces can only be renamed while down
+		if err := n.newLink(index, 0, name); err != nil {
+			return fmt.Errorf("rename interface %d to %v: %v", index, name, err)
+		}
+	}
+	if err := n.newLink(index, syscall.IFF_UP, ""); err != nil {
+		return fmt.Errorf("bring interface %d up: %v", index, err)
+	}
+	return nil
+}
+
+func (n *rtnetlink) newLink(index int, flags uint32, name string) error {
+	body := make([]byte, syscall.SizeofIfInfomsg)
+	body[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(body[4:], uint32(index))
+	nativeEndian.PutUint32(body[8:], flags)
+	nativeEndian.PutUint32(body[12:], syscall.IFF_UP)
+	if name != "" {
+		body = appendAttr(body, syscall.IFLA_IFNAME, append([]byte(name), 0))
+	}
+	return n.request(syscall.RTM_NEWLINK, 0, body)
+}
+
+// Link attributes missing from package syscall
+const (
+	nlaFNested     = 0x8000
+	iflaInfoKind   = 1
+	iflaInfoData   = 2
+	iflaVLANID     = 1
+	iflaBondMode   = 1
+	iflaBondMiimon = 3
+)
+
+// linkDown brings the interface with the given index down
+func (n *rtnetlink) linkDown(index int) error {
+	if err := n.newLink(index, 0, ""); err != nil {
+		return fmt.Errorf("bring interface %d down: %v", index, err)
+	}
+	return nil
+}
+
+// setLink sets a 32 bit attribute, such as IFLA_MTU or IFLA_MASTER, of the interface with the
+// given index
+func (n *rtnetlink) setLink(index int, typ uint16, value uint32) error {
+	body := make([]byte, syscall.SizeofIfInfomsg)
+	body[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(body[4:], uint32(index))
+	v := make([]byte, 4)
+	nativeEndian.PutUint32(v, value)
+	body = appendAttr(body, typ, v)
+	return n.request(syscall.RTM_NEWLINK, 0, body)
+}
+
+// addLink creates the interface name of the given kind, e.g. bond, bridge or vlan, on the
+// interface with index parent when non-zero. data holds the attributes specific to kind.
+func (n *rtnetlink) addLink(name, kind string, parent int, data []byte) error {
+	body := make([]byte, syscall.SizeofIfInfomsg)
+	body[0] = syscall.AF_UNSPEC
+	body = appendAttr(body, syscall.IFLA_IFNAME, append([]byte(name), 0))
+	if parent != 0 {
+		link := make([]byte, 4)
+		nativeEndian.PutUint32(link, uint32(parent))
+		body = appendAttr(body, syscall.IFLA_LINK, link)
+	}
+	info := appendAttr(nil, iflaInfoKind, []byte(kind))
+	if len(data) > 0 {
+		info = appendAttr(info, iflaInfoData|nlaFNested, data)
+	}
+	body = appendAttr(body, syscall.IFLA_LINKINFO|nlaFNested, info)
+
+	err := n.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+	if err != nil {
+		return fmt.Errorf("create %v %v: %v", kind, name, err)
+	}
+	return nil
+}
+
+// addAddr adds an address to the interface with the given index
+func (n *rtnetlink) addAddr(index int, addr *net.IPNet) error {
+	family, ip := ipFamily(addr.IP)
+	prefix, _ := addr.Mask.Size()
+
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	body[0] = family
+	body[1] = byte(prefix)
+	nativeEndian.PutUint32(body[4:], uint32(index))
+	body = appendAttr(body, syscall.IFA_LOCAL, ip)
+	body = appendAttr(body, syscall.IFA_ADDRESS, ip)
+
+	err := n.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, body)
+	if err != nil {
+		return fmt.Errorf("add address %v to interface %d: %v", addr, index, err)
+	}
+	return nil
+}
+
+// delAddr removes an address from the interface with the given index
+func (n *rtnetlink) delAddr(index int, addr *net.IPNet) error {
+	family, ip := ipFamily(addr.IP)
+	prefix, _ := addr.Mask.Size()
+
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	body[0] = family
+	body[1] = byte(prefix)
+	nativeEndian.PutUint32(body[4:], uint32(index))
+	body = appendAttr(body, syscall.IFA_LOCAL, ip)
+
+	if err := n.request(syscall.RTM_DELADDR, 0, body); err != nil {
+		return fmt.Errorf("remove address %v from interface %d: %v", addr, index, err)
+	}
+	return nil
+}
+
+// addRoute adds a route to dst, the default route when nil, through gateway on the interface
+// with the given index. An existing route to dst is left in place.
+func (n *rtnetlink) addRoute(index int, dst *net.IPNet, gateway net.IP) error {
+	family, gw := ipFamily(gateway)
+	prefix := 0
+	if dst != nil {
+		prefix, _ = dst.Mask.Size()
+	}
+
+	body := make([]byte, syscall.SizeofRtMsg)
+	body[0] = family
+	body[1] = byte(prefix)
+	body[4] = syscall.RT_TABLE_MAIN
+	body[5] = syscall.RTPROT_BOOT
+	body[6] = syscall.RT_SCOPE_UNIVERSE
+	body[7] = syscall.RTN_UNICAST
+	if dst != nil {
+		_, ip := ipFamily(dst.IP)
+		body = appendAttr(body, syscall.RTA_DST, ip)
+	}
+	body = appendAttr(body, syscall.RTA_GATEWAY, gw)
+	oif := make([]byte, 4)
+	nativeEndian.PutUint32(oif, uint32(index))
+	body = appendAttr(body, syscall.RTA_OIF, oif)
+
+	err := n.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("add route via %v: %v", gateway, err)
+	}
+	return nil
+}
+
+func ipFamily(ip net.IP) (byte, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
+
+// appendAttr appends a route attribute to b, padded to the netlink alignment
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	attr := make([]byte, syscall.SizeofRtAttr, rtaAlign(syscall.SizeofRtAttr+len(data)))
+	nativeEndian.PutUint16(attr[0:], uint16(syscall.SizeofRtAttr+len(data)))
+	nativeEndian.PutUint16(attr[2:], typ)
+	attr = append(attr, data...)
+	attr = attr[:cap(attr)]
+	return append(b, attr...)
+}
+
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
@@ -0,0 +1,122 @@
+package wwinit
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	node "github.com/bensallen/warewulf4/node"
+)
+
+// netdevAddrs returns the addresses of netdev on subnet: IP, with the prefix length of
+// netdev.Netmask when set and of subnet otherwise, followed by netdev.Addresses
+func netdevAddrs(subnet string, netdev *node.Netdev) ([]*net.IPNet, error) {
+	prefixes, err := netdev.Prefixes(subnet)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]*net.IPNet, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		addrs = append(addrs, &net.IPNet{
+			IP:   net.IP(prefix.Addr().Unmap().AsSlice()),
+			Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().Unmap().BitLen()),
+		})
+	}
+	return addrs, nil
+}
+
+// ipv6Sysctls returns the IPv6 settings of the interface of netdev, by name below
+// /proc/sys/net/ipv6/conf/<interface>. Router advertisements are accepted, and addresses
+// autoconfigured from their prefixes, unless netdev is in node.IPv6Static mode; the addresses of
+// netdev are configured statically in every mode, as the node has them anyway.
+func ipv6Sysctls(netdev *node.Netdev) map[string]string {
+	if netdev.IPv6Mode == node.IPv6Static {
+		return map[string]string{"accept_ra": "0", "autoconf": "0"}
+	}
+	return map[string]string{"accept_ra": "1", "autoconf": "1"}
+}
+
+// findInterface returns the interface with hardware address hwaddr, or named name when hwaddr is
+// empty
+func findInterface(interfaces []net.Interface, hwaddr, name string) (*net.Interface, error) {
+	for i := range interfaces {
+		if hwaddr != "" && strings.EqualFold(interfaces[i].HardwareAddr.String(), hwaddr) {
+			return &interfaces[i], nil
+		}
+		if hwaddr == "" && name != "" && interfaces[i].Name == name {
+			return &interfaces[i], nil
+		}
+	}
+	if hwaddr != "" {
+		return nil, fmt.Errorf("no interface with hardware address %v", hwaddr)
+	}
+	return nil, fmt.Errorf("no interface named %v", name)
+}
+
+// netdevOrder returns the keys of netdevs ordered so that each netdev comes after those it is built
+// on: a vlan after its parent and a bond or bridge after its members. Netdevs are otherwise ordered
+// by key.
+func netdevOrder(netdevs map[string]*node.Netdev) ([]string, error) {
+	keys := make([]string, 0, len(netdevs))
+	byName := map[string]string{}
+	for key, netdev := range netdevs {
+		if netdev == nil {
+			continue
+		}
+		keys = append(keys, key)
+		if netdev.Name != "" {
+			byName[netdev.Name] = key
+		}
+	}
+	sort.Strings(keys)
+
+	order := make([]string, 0, len(keys))
+	state := map[string]int{}
+	var visit func(key string) error
+	visit = func(key string) error {
+		switch state[key] {
+		case 1:
+			return fmt.Errorf("netdev on %v is built on itself", key)
+		case 2:
+			return nil
+		}
+		state[key] = 1
+		netdev := netdevs[key]
+		lower := netdev.Members
+		if netdev.Type == node.NetdevVLAN {
+			lower = []string{netdev.Parent}
+		}
+		for _, name := range lower {
+			k, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("netdev on %v is built on %v, which is not a netdev", key, name)
+			}
+			if err := visit(k); err != nil {
+				return err
+			}
+		}
+		state[key] = 2
+		order = append(order, key)
+		return nil
+	}
+	for _, key := range keys {
+		if err := visit(key); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// bondMode returns the number the bonding driver gives mode, balance-rr when empty
+func bondMode(mode string) (byte, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	for i, m := range node.BondModes {
+		if m == mode {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown bond mode, %v", mode)
+}
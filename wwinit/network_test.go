@@ -0,0 +1,99 @@
+package wwinit
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	node "github.com/bensallen/warewulf4/node"
+)
+
+func TestNetdevAddrs(t *testing.T) {
+	tests := []struct {
+		subnet string
+		netdev *node.Netdev
+		addrs  string
+	}{
+		{"10.0.0.0/16", &node.Netdev{IP: "10.0.1.5"}, "10.0.1.5/16"},
+		{"10.0.0.0/16", &node.Netdev{IP: "10.0.1.5", Netmask: "255.255.255.0"}, "10.0.1.5/24"},
+		{"fd00:1::/64", &node.Netdev{IP: "fd00:1::5"}, "fd00:1::5/64"},
+		{"10.0.0.0/16", &node.Netdev{IP: "10.0.1.5", Addresses: []string{"fd00:1::5/64", "10.1.0.5/24"}}, "10.0.1.5/16 fd00:1::5/64 10.1.0.5/24"},
+		{"eth0", &node.Netdev{Name: "eth0"}, ""},
+	}
+	for _, test := range tests {
+		addrs, err := netdevAddrs(test.subnet, test.netdev)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		var s []string
+		for _, addr := range addrs {
+			s = append(s, addr.String())
+		}
+		if strings.Join(s, " ") != test.addrs {
+			t.Fatalf("Mismatch: %v, want %v", s, test.addrs)
+		}
+	}
+	if addrs, err := netdevAddrs("10.0.0.0/16", &node.Netdev{IP: "10.0.1.5"}); err != nil || addrs[0].IP.To4() == nil {
+		t.Fatalf("Mismatch: %v %v", addrs, err)
+	}
+	if _, err := netdevAddrs("10.0.0.0/16", &node.Netdev{IP: "n0001"}); err == nil {
+		t.Fatal("Should have failed with invalid IP")
+	}
+}
+
+func TestIPv6Sysctls(t *testing.T) {
+	if s := ipv6Sysctls(&node.Netdev{}); s["accept_ra"] != "0" || s["autoconf"] != "0" {
+		t.Fatalf("Mismatch: %v", s)
+	}
+	if s := ipv6Sysctls(&node.Netdev{IPv6Mode: node.IPv6SLAAC}); s["accept_ra"] != "1" || s["autoconf"] != "1" {
+		t.Fatalf("Mismatch: %v", s)
+	}
+}
+
+func TestFindInterface(t *testing.T) {
+	hwaddr, _ := net.ParseMAC("00:11:22:aa:bb:cc")
+	interfaces := []net.Interface{{Index: 1, Name: "lo"}, {Index: 2, Name: "eth0", HardwareAddr: hwaddr}}
+
+	if iface, err := findInterface(interfaces, "00:11:22:AA:BB:CC", "ib0"); err != nil || iface.Index != 2 {
+		t.Fatalf("Mismatch: %v %v", iface, err)
+	}
+	if iface, err := findInterface(interfaces, "", "lo"); err != nil || iface.Index != 1 {
+		t.Fatalf("Mismatch: %v %v", iface, err)
+	}
+	if _, err := findInterface(interfaces, "00:11:22:aa:bb:cd", ""); err == nil {
+		t.Fatal("Should have failed with no interface")
+	}
+}
+
+func TestNetdevOrder(t *testing.T) {
+	netdevs := map[string]*node.Netdev{
+		"10.0.0.0/24": {Name: "bond0.100", Type: node.NetdevVLAN, Parent: "bond0", VLAN: 100, IP: "10.0.0.10"},
+		"bond0":       {Name: "bond0", Type: node.NetdevBond, Members: []string{"eth1", "eth0"}},
+		"eth0":        {Name: "eth0", HWAddr: "00:11:22:33:44:01"},
+		"eth1":        {Name: "eth1", HWAddr: "00:11:22:33:44:02"},
+		"ib0":         {Name: "ib0"},
+	}
+	order, err := netdevOrder(netdevs)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got := strings.Join(order, ","); got != "eth1,eth0,bond0,10.0.0.0/24,ib0" {
+		t.Fatalf("Mismatch: %v", got)
+	}
+
+	netdevs["eth0"] = &node.Netdev{Name: "eth0", Type: node.NetdevVLAN, Parent: "bond0", VLAN: 1}
+	if _, err := netdevOrder(netdevs); err == nil {
+		t.Fatal("Should have failed with a cycle")
+	}
+}
+
+func TestBondMode(t *testing.T) {
+	for mode, want := range map[string]byte{"": 0, "active-backup": 1, "802.3ad": 4, "balance-alb": 6} {
+		if got, err := bondMode(mode); err != nil || got != want {
+			t.Fatalf("Mismatch for %q: %v %v", mode, got, err)
+		}
+	}
+	if _, err := bondMode("lacp"); err == nil {
+		t.Fatal("Should have failed with unknown mode")
+	}
+}
@@ -0,0 +1,4 @@
+package wwinit
+
+// sysFinitModule is the number of the finit_module system call, which the syscall package lacks
+const sysFinitModule = 313
@@ -0,0 +1,7 @@
+//go:build linux && !amd64 && !arm64 && !ppc64le
+// +build linux,!amd64,!arm64,!ppc64le
+
+package wwinit
+
+// sysFinitModule is unknown on this architecture; modules cannot be loaded
+const sysFinitModule = -1